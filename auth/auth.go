@@ -28,10 +28,22 @@ func New(jwtKey string) (*Auth, error) {
 	return auth, nil
 }
 
+// tokenClaims represents the claims saved in an authentication token.
+type tokenClaims struct {
+	jwt.StandardClaims
+	ActorUID         uint64 `json:"act,omitempty"`
+	ReadOnly         bool   `json:"ro,omitempty"`
+	SessionID        string `json:"sid,omitempty"`
+	SessionExpiresAt int64  `json:"sxp,omitempty"`
+	AuthTime         int64  `json:"auth_time,omitempty"`
+	PINTime          int64  `json:"pin_time,omitempty"`
+	Guest            bool   `json:"gst,omitempty"`
+}
+
 // authCookieClaims is a helper function for the ExpiresAt and UID function
-func (auth *Auth) authCookieClaims(c *http.Cookie) (*jwt.StandardClaims, error) {
+func (auth *Auth) authCookieClaims(c *http.Cookie) (*tokenClaims, error) {
 	tokenStr := c.Value
-	cl := &jwt.StandardClaims{}
+	cl := &tokenClaims{}
 
 	token, err := jwt.ParseWithClaims(tokenStr, cl, func(token *jwt.Token) (interface{}, error) {
 		return auth.jwtKey, nil
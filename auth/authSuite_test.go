@@ -207,9 +207,67 @@ func AuthenticatorSuite(t *testing.T, impl config.Authenticator) {
 				}
 			}
 		})
+
+		t.Run("test issue time collection", func(t *testing.T) {
+			for i, c := range cs {
+				issuedAt, err := impl.IssuedAt(c)
+				if err != nil {
+					t.Errorf("Unexpected error: %v when uid=%d and expire=%v", err, cVals[i].uid, cVals[i].expire)
+				}
+
+				if time.Since(issuedAt) > time.Minute || time.Until(issuedAt) > time.Second {
+					t.Errorf("The issue time in the cookie (%v) isn't the time the cookie was created at", issuedAt)
+				}
+			}
+		})
 	})
 }
 
+func ClaimsSuite(t *testing.T, impl config.Authenticator) {
+	inTwoMin := time.Now().Add(time.Minute * 2)
+
+	cases := []config.Claims{
+		{UID: 1, ExpiresAt: inTwoMin},
+		{UID: 2, ActorUID: 1, ReadOnly: true, ExpiresAt: inTwoMin},
+		{UID: 3, ActorUID: 1, ExpiresAt: inTwoMin},
+		{UID: 4, SessionID: "session-id", SessionExpiresAt: time.Now().Add(time.Hour), ExpiresAt: inTwoMin},
+		{UID: 5, AuthTime: time.Now().Add(-time.Hour), PINTime: time.Now(), ExpiresAt: inTwoMin},
+		{UID: 6, Guest: true, SessionExpiresAt: time.Now().Add(time.Hour), ExpiresAt: inTwoMin},
+	}
+
+	for _, i := range cases {
+		c, err := impl.CreateClaimsCookie(i)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v when claims=%+v", err, i)
+		}
+
+		cl, err := impl.Claims(c)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v when claims=%+v", err, i)
+		}
+
+		if cl.UID != i.UID || cl.ActorUID != i.ActorUID || cl.ReadOnly != i.ReadOnly || cl.SessionID != i.SessionID || cl.Guest != i.Guest {
+			t.Errorf("The claims in the cookie (%+v) didn't match the specified claims (%+v)", cl, i)
+		}
+
+		if cl.SessionExpiresAt.Unix() != i.SessionExpiresAt.Unix() {
+			t.Errorf("The session's expiration time in the cookie (%v) didn't match the specified one (%v)", cl.SessionExpiresAt, i.SessionExpiresAt)
+		}
+
+		if cl.AuthTime.Unix() != i.AuthTime.Unix() || cl.PINTime.Unix() != i.PINTime.Unix() {
+			t.Errorf("The authentication times in the cookie (%v, %v) didn't match the specified ones (%v, %v)", cl.AuthTime, cl.PINTime, i.AuthTime, i.PINTime)
+		}
+
+		if cl.ExpiresAt.Unix() != i.ExpiresAt.Unix() {
+			t.Errorf("The expiration time in the cookie (%v) didn't match the specified one (%v)", cl.ExpiresAt, i.ExpiresAt)
+		}
+	}
+
+	if _, err := impl.CreateClaimsCookie(config.Claims{UID: 1, ExpiresAt: time.Now().Add(time.Hour)}); err == nil {
+		t.Error("Expected an error when the expiration time is more than 5 minutes away")
+	}
+}
+
 func TestDefaultImpl(t *testing.T) {
 	auth, err := auth.New(mockJwtKey)
 	if err != nil {
@@ -217,4 +275,5 @@ func TestDefaultImpl(t *testing.T) {
 	}
 
 	AuthenticatorSuite(t, auth)
+	ClaimsSuite(t, auth)
 }
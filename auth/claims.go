@@ -0,0 +1,45 @@
+package auth
+
+import (
+	"auth-proxy/config"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Claims returns all claims saved in an authentication token.
+func (auth *Auth) Claims(c *http.Cookie) (config.Claims, error) {
+	cl, err := auth.authCookieClaims(c)
+	if err != nil {
+		return config.Claims{}, err
+	}
+
+	uid, err := strconv.ParseUint(cl.Id, 10, 64)
+	if err != nil {
+		return config.Claims{}, err
+	}
+
+	claims := config.Claims{
+		UID:       uid,
+		ActorUID:  cl.ActorUID,
+		ReadOnly:  cl.ReadOnly,
+		SessionID: cl.SessionID,
+		Guest:     cl.Guest,
+		IssuedAt:  time.Unix(cl.IssuedAt, 0),
+		ExpiresAt: time.Unix(cl.ExpiresAt, 0),
+	}
+
+	if cl.SessionExpiresAt != 0 {
+		claims.SessionExpiresAt = time.Unix(cl.SessionExpiresAt, 0)
+	}
+
+	if cl.AuthTime != 0 {
+		claims.AuthTime = time.Unix(cl.AuthTime, 0)
+	}
+
+	if cl.PINTime != 0 {
+		claims.PINTime = time.Unix(cl.PINTime, 0)
+	}
+
+	return claims, nil
+}
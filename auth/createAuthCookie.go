@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"auth-proxy/config"
 	"errors"
 	"net/http"
 	"strconv"
@@ -14,6 +15,14 @@ import (
 // It returns an error when the uid < 1 or the specified expiration time already passed or the 
 // expiration time is more than 5 minutes away.
 func (auth *Auth) CreateAuthCookie(uid uint64, expire time.Time) (*http.Cookie, error) {
+	return auth.CreateClaimsCookie(config.Claims{UID: uid, ExpiresAt: expire})
+}
+
+// CreateClaimsCookie returns a new JWT authentication token containing the specified claims. The issue time
+// is always set to the current time. It has the same restrictions as CreateAuthCookie.
+func (auth *Auth) CreateClaimsCookie(claims config.Claims) (*http.Cookie, error) {
+	uid, expire := claims.UID, claims.ExpiresAt
+
 	if uid < 1 {
 		return nil, errors.New("The uid cannot be smaller than 1")
 	}
@@ -26,9 +35,28 @@ func (auth *Auth) CreateAuthCookie(uid uint64, expire time.Time) (*http.Cookie,
 		return nil, errors.New("The expiration time cannot be more than 5 minutes in the future")
 	}
 
-	cl := &jwt.StandardClaims{
-		ExpiresAt: expire.Unix(),
-		Id:        strconv.FormatUint(uid, 10),
+	cl := &tokenClaims{
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: expire.Unix(),
+			IssuedAt:  time.Now().Unix(),
+			Id:        strconv.FormatUint(uid, 10),
+		},
+		ActorUID:  claims.ActorUID,
+		ReadOnly:  claims.ReadOnly,
+		SessionID: claims.SessionID,
+		Guest:     claims.Guest,
+	}
+
+	if !claims.SessionExpiresAt.IsZero() {
+		cl.SessionExpiresAt = claims.SessionExpiresAt.Unix()
+	}
+
+	if !claims.AuthTime.IsZero() {
+		cl.AuthTime = claims.AuthTime.Unix()
+	}
+
+	if !claims.PINTime.IsZero() {
+		cl.PINTime = claims.PINTime.Unix()
 	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, cl)
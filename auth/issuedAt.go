@@ -0,0 +1,16 @@
+package auth
+
+import (
+	"net/http"
+	"time"
+)
+
+// IssuedAt returns the time an authentication token was issued at.
+func (auth *Auth) IssuedAt(c *http.Cookie) (time.Time, error) {
+	cl, err := auth.authCookieClaims(c)
+	if err != nil {
+		return time.Unix(0, 0), err
+	}
+
+	return time.Unix(cl.IssuedAt, 0), nil
+}
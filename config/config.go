@@ -3,6 +3,8 @@ package config
 
 import (
 	"context"
+	"errors"
+	"net"
 	"net/http"
 	"time"
 )
@@ -11,16 +13,72 @@ var (
 	// ErrBadRequest defines an error which triggers a StatusBadRequest (http 400) to be sent
 	ErrBadRequest error
 
+	// ErrNotFound is returned by a Datastore when the requested entry doesn't exist.
+	ErrNotFound = errors.New("The requested entry doesn't exist")
+
+	// ErrConflict is returned by a Datastore when an entry can't be saved because it collides with an existing one.
+	ErrConflict = errors.New("The entry collides with an existing one")
+
 	// SupportedLangs defines the languages supported by the proxied services.
 	// It should be set once the program starts.
 	SupportedLangs []string
 )
 
+// Possible values of an account's status.
+const (
+	StatusActive    = "active"
+	StatusDisabled  = "disabled"
+	StatusSuspended = "suspended"
+	StatusPending   = "pending"
+)
+
+// Possible scopes of a grant.
+const (
+	// ScopeRead only lets the grantee read the grantor's data.
+	ScopeRead = "read"
+	// ScopeTrade additionally lets the grantee trade on behalf of the grantor.
+	ScopeTrade = "trade"
+)
+
+// Possible values of an account's role.
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
 type (
 	// Env represents a collection of interfaces required for the handlers.
 	Env struct {
 		Auth Authenticator
 		DB   Datastore
+		// Accounts caches the accounts looked up on every request. If it's nil the DB is used directly.
+		Accounts AccountCache
+		Mailer   Mailer
+		Locator  Locator
+
+		// Notifier gets informed about logins from unknown devices or networks. If it's nil
+		// no login history is kept and no notifications are sent.
+		Notifier Notifier
+
+		Sessions SessionPolicy
+
+		// MagicLinkURL is the url of the page which redeems magic login links. The token gets appended as the
+		// token query parameter. If it's empty, magic links are disabled.
+		MagicLinkURL string
+
+		// StepUpOnImpossibleTravel requires logins which couldn't physically have happened since
+		// the last login to be confirmed with a code sent to the user's email.
+		StepUpOnImpossibleTravel bool
+
+		// GuestLifetime defines how long guest accounts exist unless they're converted into regular accounts.
+		// Guest accounts are disabled if it's 0.
+		GuestLifetime time.Duration
+
+		// GuestLimiter limits how many guest accounts a client can create by its ip. If it's nil there's no limit.
+		GuestLimiter Limiter
+
+		// ShareLinkKey is used to sign the tokens of share links.
+		ShareLinkKey []byte
 	}
 
 	// RegistrationReqBody represents the expected request body from the /register route
@@ -31,10 +89,206 @@ type (
 		LastName  string `json:"lastName"`
 	}
 
-	// LoginReqBody represents the expected request body from the /login route
+	// LoginReqBody represents the expected request body from the /login route.
+	// NewPass only has to be set when the user is required to reset the password.
 	LoginReqBody struct {
+		Email      string `json:"email"`
+		Pass       string `json:"pass"`
+		NewPass    string `json:"newPass,omitempty"`
+		RememberMe bool   `json:"rememberMe,omitempty"`
+	}
+
+	// ImpersonationReqBody represents the expected request body from the /admin/users/{uid}/impersonate route.
+	// Impersonation sessions are read-only unless AllowWrites is set.
+	ImpersonationReqBody struct {
+		AllowWrites bool `json:"allowWrites"`
+	}
+
+	// Claims represents the information saved in an authentication token.
+	Claims struct {
+		UID uint64
+		// ActorUID is the uid of the admin impersonating the user. It's 0 if the user isn't impersonated.
+		ActorUID uint64
+		// ReadOnly prevents all requests which could change data.
+		ReadOnly bool
+		// SessionID is the id of the server-side session of a remembered login. It's empty for other logins.
+		SessionID string
+		// SessionExpiresAt is the time after which the token can't be refreshed anymore and the user
+		// has to log in again, regardless of how active the user is.
+		SessionExpiresAt time.Time
+		// AuthTime is the time the user last authenticated with a password or second factor.
+		AuthTime time.Time
+		// PINTime is the time the user last entered the trading PIN.
+		PINTime time.Time
+		// Guest marks tokens of sandbox accounts, which can only use a subset of the routes.
+		Guest     bool
+		IssuedAt  time.Time
+		ExpiresAt time.Time
+	}
+
+	// StepUpReqBody represents the expected request body from the /step-up route. Either the password
+	// or the trading PIN has to be specified.
+	StepUpReqBody struct {
+		Pass string `json:"pass,omitempty"`
+		PIN  string `json:"pin,omitempty"`
+	}
+
+	// TradingPINReqBody represents the expected request body from the /trading-pin route
+	TradingPINReqBody struct {
+		Pass string `json:"pass"`
+		PIN  string `json:"pin"`
+	}
+
+	// Session represents a remembered login.
+	Session struct {
+		// ID is the hash of the token saved in the session cookie.
+		ID        string
+		UID       uint64
+		CreatedAt time.Time
+		ExpiresAt time.Time
+	}
+
+	// SessionPolicy defines how long sessions last.
+	SessionPolicy struct {
+		// RememberFor defines how long a remembered login lasts.
+		RememberFor time.Duration
+		// MaxLifetime defines the absolute lifetime of every session after which the user has to log in again.
+		MaxLifetime time.Duration
+	}
+
+	// MagicLinkReqBody represents the expected request body from the /login/magic-link route
+	MagicLinkReqBody struct {
 		Email string `json:"email"`
-		Pass  string `json:"pass"`
+	}
+
+	// MagicLinkRedeemReqBody represents the expected request body from the /login/magic-link/redeem route
+	MagicLinkRedeemReqBody struct {
+		Token   string `json:"token"`
+		NewPass string `json:"newPass,omitempty"`
+	}
+
+	// MagicLink represents a single-use login link. Only hashes of the token and the browser nonce are saved.
+	MagicLink struct {
+		TokenHash string
+		NonceHash string
+		UID       uint64
+		ExpiresAt time.Time
+	}
+
+	// AccountStatusReqBody represents the expected request body from the /admin/users/{uid}/status route
+	AccountStatusReqBody struct {
+		Status string `json:"status"`
+	}
+
+	// Account represents a user's account as seen by the support staff.
+	Account struct {
+		UID                   uint64     `json:"uid"`
+		Email                 string     `json:"email"`
+		Lang                  string     `json:"lang"`
+		Role                  string     `json:"role"`
+		Status                string     `json:"status"`
+		FailedLogins          int        `json:"failedLogins"`
+		LockedUntil           *time.Time `json:"lockedUntil,omitempty"`
+		PasswordResetRequired bool       `json:"passwordResetRequired"`
+		SessionsRevokedAt     *time.Time `json:"sessionsRevokedAt,omitempty"`
+		// GuestExpiresAt is the time the guest account gets deleted. It's nil for regular accounts.
+		GuestExpiresAt *time.Time `json:"guestExpiresAt,omitempty"`
+	}
+
+	// ShareLink gives everybody knowing its token read access to the paths of the user's account until it
+	// expires or is revoked.
+	ShareLink struct {
+		ID        string    `json:"id"`
+		UID       uint64    `json:"-"`
+		Paths     []string  `json:"paths"`
+		CreatedAt time.Time `json:"createdAt"`
+		ExpiresAt time.Time `json:"expiresAt"`
+	}
+
+	// ShareLinkReqBody represents the expected request body from the /share-links route.
+	ShareLinkReqBody struct {
+		Paths     []string  `json:"paths"`
+		ExpiresAt time.Time `json:"expiresAt"`
+	}
+
+	// Grant lets the grantee act on the grantor's account within the scope until it expires.
+	Grant struct {
+		ID         string    `json:"id"`
+		GrantorUID uint64    `json:"grantorUid"`
+		GranteeUID uint64    `json:"granteeUid"`
+		Scope      string    `json:"scope"`
+		CreatedAt  time.Time `json:"createdAt"`
+		ExpiresAt  time.Time `json:"expiresAt"`
+	}
+
+	// GrantReqBody represents the expected request body from the /grants route. Email is the grantee's email.
+	GrantReqBody struct {
+		Email     string    `json:"email"`
+		Scope     string    `json:"scope"`
+		ExpiresAt time.Time `json:"expiresAt"`
+	}
+
+	// AuditEntry represents an action performed by a member of the staff.
+	AuditEntry struct {
+		ActorUID  uint64    `json:"actorUid"`
+		Action    string    `json:"action"`
+		TargetUID uint64    `json:"targetUid,omitempty"`
+		Details   string    `json:"details,omitempty"`
+		At        time.Time `json:"at"`
+	}
+
+	// LoginVerificationReqBody represents the expected request body from the /login/verify route
+	LoginVerificationReqBody struct {
+		Challenge string `json:"challenge"`
+		Code      string `json:"code"`
+	}
+
+	// Location represents the geographical region an ip address belongs to.
+	Location struct {
+		Region string  `json:"region"`
+		Lat    float64 `json:"lat"`
+		Lon    float64 `json:"lon"`
+	}
+
+	// LoginRecord represents a single successful login.
+	LoginRecord struct {
+		UID       uint64    `json:"uid"`
+		DeviceID  string    `json:"deviceId"`
+		Network   string    `json:"network"`
+		IP        string    `json:"ip"`
+		UserAgent string    `json:"userAgent"`
+		Location  *Location `json:"location,omitempty"`
+		At        time.Time `json:"at"`
+	}
+
+	// LoginEvent represents a login which the user should be informed about.
+	LoginEvent struct {
+		Email            string       `json:"email"`
+		Login            LoginRecord  `json:"login"`
+		Previous         *LoginRecord `json:"previous,omitempty"`
+		NewDevice        bool         `json:"newDevice"`
+		NewNetwork       bool         `json:"newNetwork"`
+		ImpossibleTravel bool         `json:"impossibleTravel"`
+	}
+
+	// LoginChallenge represents a pending login which has to be confirmed with a code
+	// before an authentication token gets issued.
+	LoginChallenge struct {
+		ID         string
+		CodeHash   string
+		Lang       string
+		RememberMe bool
+		// Authenticated tells if the login used a password, unlike e.g. one with a magic link.
+		Authenticated bool
+		Login         LoginRecord
+		ExpiresAt     time.Time
+	}
+
+	// Mail represents a plain text email.
+	Mail struct {
+		To      string
+		Subject string
+		Body    string
 	}
 )
 
@@ -45,12 +299,112 @@ type (
 		ValidateAuthCookie(c *http.Cookie) error
 		UID(c *http.Cookie) (uint64, error)
 		ExpiresAt(c *http.Cookie) (time.Time, error)
+		IssuedAt(c *http.Cookie) (time.Time, error)
+		// CreateClaimsCookie creates an authentication token containing the claims. The IssuedAt field is ignored.
+		CreateClaimsCookie(cl Claims) (*http.Cookie, error)
+		Claims(c *http.Cookie) (Claims, error)
 	}
 
 	// Datastore defines functions a datastore has to implement.
 	Datastore interface {
 		Login(ctx context.Context, body LoginReqBody) (uid uint64, pass string, lang string, err error)
 		Register(ctx context.Context, body RegistrationReqBody) error
+
+		// KnownLogin reports if the user already logged in from the specified device or network.
+		KnownLogin(ctx context.Context, uid uint64, deviceID, network string) (knownDevice bool, knownNetwork bool, err error)
+		// LastLogin returns the user's most recent login or ErrNotFound if the user never logged in.
+		LastLogin(ctx context.Context, uid uint64) (LoginRecord, error)
+		RecordLogin(ctx context.Context, login LoginRecord) error
+		SaveLoginChallenge(ctx context.Context, ch LoginChallenge) error
+		// ConsumeLoginChallenge returns and removes a challenge. It returns ErrNotFound if no
+		// challenge with the specified id exists.
+		ConsumeLoginChallenge(ctx context.Context, id string) (LoginChallenge, error)
+
+		// Account returns the account of the user or ErrNotFound if no user with the uid exists.
+		Account(ctx context.Context, uid uint64) (Account, error)
+		// AccountByEmail returns the account of the user or ErrNotFound if no user with the email exists.
+		AccountByEmail(ctx context.Context, email string) (Account, error)
+		// SearchAccounts returns at most limit accounts whose email contains the specified string.
+		SearchAccounts(ctx context.Context, email string, limit int) ([]Account, error)
+		SetAccountStatus(ctx context.Context, uid uint64, status string) error
+		// RecordFailedLogin increases the amount of failed logins and locks the account for the duration
+		// of lockout once maxAttempts is reached.
+		RecordFailedLogin(ctx context.Context, uid uint64, maxAttempts int, lockout time.Duration) error
+		ClearLockout(ctx context.Context, uid uint64) error
+		ForcePasswordReset(ctx context.Context, uid uint64) error
+		// SetPassword saves the new password and clears a forced password reset.
+		SetPassword(ctx context.Context, uid uint64, pass string) error
+		// TradingPIN returns the hash of the user's trading PIN or ErrNotFound if the user didn't set one.
+		TradingPIN(ctx context.Context, uid uint64) (string, error)
+		SetTradingPIN(ctx context.Context, uid uint64, pin string) error
+		// RevokeSessions invalidates all authentication tokens issued to the user so far and deletes
+		// the user's remembered sessions.
+		RevokeSessions(ctx context.Context, uid uint64) error
+		RecordAudit(ctx context.Context, entry AuditEntry) error
+
+		SaveMagicLink(ctx context.Context, link MagicLink) error
+		CreateSession(ctx context.Context, s Session) error
+		// Session returns the session with the specified id or ErrNotFound if it doesn't exist.
+		Session(ctx context.Context, id string) (Session, error)
+		DeleteSession(ctx context.Context, id string) error
+
+		// ConsumeMagicLink returns and removes the magic link with the specified token hash. It returns
+		// ErrNotFound if no such link exists.
+		ConsumeMagicLink(ctx context.Context, tokenHash string) (MagicLink, error)
+
+		// CreateGuest creates a sandbox account, which is deleted after expiresAt, and returns its uid.
+		CreateGuest(ctx context.Context, expiresAt time.Time) (uint64, error)
+		// ConvertGuest turns the guest account into a regular account with the registration's credentials,
+		// keeping its portfolio. It returns ErrNotFound if the account isn't a guest account and ErrConflict
+		// if the email is already used.
+		ConvertGuest(ctx context.Context, uid uint64, body RegistrationReqBody) error
+		// DeleteExpiredGuests deletes all guest accounts which expired and returns how many were deleted.
+		DeleteExpiredGuests(ctx context.Context) (int64, error)
+
+		CreateGrant(ctx context.Context, g Grant) error
+		// Grants returns the unexpired grants the user gave and received, in that order.
+		Grants(ctx context.Context, uid uint64) ([]Grant, []Grant, error)
+		// ActiveGrant returns the unexpired grant of the grantor to the grantee or ErrNotFound if there's none.
+		ActiveGrant(ctx context.Context, grantorUID, granteeUID uint64) (Grant, error)
+		// DeleteGrant deletes the grant if the user is either its grantor or its grantee. Otherwise it returns
+		// ErrNotFound.
+		DeleteGrant(ctx context.Context, uid uint64, id string) error
+
+		CreateShareLink(ctx context.Context, l ShareLink) error
+		// ShareLinks returns the unexpired share links of the user.
+		ShareLinks(ctx context.Context, uid uint64) ([]ShareLink, error)
+		// ShareLink returns the share link with the id or ErrNotFound if it doesn't exist.
+		ShareLink(ctx context.Context, id string) (ShareLink, error)
+		// DeleteShareLink deletes the user's share link. If the user has no link with the id it returns ErrNotFound.
+		DeleteShareLink(ctx context.Context, uid uint64, id string) error
+	}
+
+	// AccountCache defines functions for a short-lived cache of accounts.
+	AccountCache interface {
+		Account(ctx context.Context, uid uint64) (Account, error)
+		// Invalidate removes the user's account from the cache, so that changes become visible immediately.
+		Invalidate(uid uint64)
+	}
+
+	// Mailer defines functions for sending emails.
+	Mailer interface {
+		Send(ctx context.Context, m Mail) error
+	}
+
+	// Notifier defines functions for informing users about security relevant events.
+	Notifier interface {
+		NotifyLogin(ctx context.Context, ev LoginEvent) error
+	}
+
+	// Limiter defines functions for limiting how often an action can be taken.
+	Limiter interface {
+		// Allow reports if the key may take the action and counts it if so.
+		Allow(key string) bool
+	}
+
+	// Locator defines functions for resolving an ip address to a geographical location.
+	Locator interface {
+		Locate(ip net.IP) (Location, bool)
 	}
 )
 
@@ -58,3 +412,11 @@ type (
 func DefaultExpTime() time.Time {
 	return time.Now().Add(time.Minute * 2)
 }
+
+// DefaultSessionPolicy returns the session policy used when none is configured.
+func DefaultSessionPolicy() SessionPolicy {
+	return SessionPolicy{
+		RememberFor: time.Hour * 24 * 14,
+		MaxLifetime: time.Hour * 24 * 30,
+	}
+}
@@ -3,7 +3,9 @@ package config
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
@@ -13,7 +15,17 @@ type (
 	mockAuth struct{}
 
 	mockDB struct {
-		store map[string]string
+		store      map[string]string
+		logins     []LoginRecord
+		challenges map[string]LoginChallenge
+		accounts   map[uint64]*Account
+		audit      []AuditEntry
+		magicLinks map[string]MagicLink
+		sessions   map[string]Session
+		pins       map[uint64]string
+		grants     []Grant
+		shareLinks []ShareLink
+		lastUID    uint64
 	}
 )
 
@@ -43,13 +55,38 @@ func (auth *mockAuth) ExpiresAt(c *http.Cookie) (time.Time, error) {
 	return time.Unix(0, 0), nil
 }
 
+func (auth *mockAuth) IssuedAt(c *http.Cookie) (time.Time, error) {
+	return time.Unix(0, 0), nil
+}
+
+func (auth *mockAuth) CreateClaimsCookie(cl Claims) (*http.Cookie, error) {
+	return auth.CreateAuthCookie(cl.UID, cl.ExpiresAt)
+}
+
+func (auth *mockAuth) Claims(c *http.Cookie) (Claims, error) {
+	return Claims{IssuedAt: time.Unix(0, 0), ExpiresAt: time.Unix(0, 0)}, nil
+}
+
+// accountByEmail returns the account with the specified email or nil if none exists.
+func (db *mockDB) accountByEmail(email string) *Account {
+	for _, acc := range db.accounts {
+		if acc.Email == email {
+			return acc
+		}
+	}
+
+	return nil
+}
+
 func (db *mockDB) Login(ctx context.Context, body LoginReqBody) (uid uint64, pass string, lang string, err error) {
 	pwd := db.store[body.Email]
 	if pwd == "" {
 		return 0, "", "", errors.New("No user with this email exists")
 	}
 
-	return 1, pwd, "en", nil
+	acc := db.accountByEmail(body.Email)
+
+	return acc.UID, pwd, acc.Lang, nil
 }
 
 func (db *mockDB) Register(ctx context.Context, body RegistrationReqBody) error {
@@ -60,20 +97,424 @@ func (db *mockDB) Register(ctx context.Context, body RegistrationReqBody) error
 
 	db.store[body.Email] = string(pwd)
 
+	if db.accountByEmail(body.Email) == nil {
+		db.lastUID++
+		db.accounts[db.lastUID] = &Account{UID: db.lastUID, Email: body.Email, Lang: "en", Role: RoleUser, Status: StatusActive}
+	}
+
 	return nil
 }
 
+func (db *mockDB) KnownLogin(ctx context.Context, uid uint64, deviceID, network string) (bool, bool, error) {
+	var knownDevice, knownNetwork bool
+
+	for _, l := range db.logins {
+		if l.UID != uid {
+			continue
+		}
+
+		if l.DeviceID == deviceID {
+			knownDevice = true
+		}
+
+		if l.Network == network {
+			knownNetwork = true
+		}
+	}
+
+	return knownDevice, knownNetwork, nil
+}
+
+func (db *mockDB) LastLogin(ctx context.Context, uid uint64) (LoginRecord, error) {
+	for i := len(db.logins) - 1; i >= 0; i-- {
+		if db.logins[i].UID == uid {
+			return db.logins[i], nil
+		}
+	}
+
+	return LoginRecord{}, ErrNotFound
+}
+
+func (db *mockDB) RecordLogin(ctx context.Context, login LoginRecord) error {
+	db.logins = append(db.logins, login)
+
+	return nil
+}
+
+func (db *mockDB) SaveLoginChallenge(ctx context.Context, ch LoginChallenge) error {
+	db.challenges[ch.ID] = ch
+
+	return nil
+}
+
+func (db *mockDB) ConsumeLoginChallenge(ctx context.Context, id string) (LoginChallenge, error) {
+	ch, ok := db.challenges[id]
+	if !ok {
+		return LoginChallenge{}, ErrNotFound
+	}
+
+	delete(db.challenges, id)
+
+	return ch, nil
+}
+
+func (db *mockDB) Account(ctx context.Context, uid uint64) (Account, error) {
+	acc, ok := db.accounts[uid]
+	if !ok {
+		return Account{}, ErrNotFound
+	}
+
+	return *acc, nil
+}
+
+func (db *mockDB) AccountByEmail(ctx context.Context, email string) (Account, error) {
+	acc := db.accountByEmail(email)
+	if acc == nil {
+		return Account{}, ErrNotFound
+	}
+
+	return *acc, nil
+}
+
+func (db *mockDB) SearchAccounts(ctx context.Context, email string, limit int) ([]Account, error) {
+	var accs []Account
+
+	for uid := uint64(1); uid <= db.lastUID && len(accs) < limit; uid++ {
+		if acc, ok := db.accounts[uid]; ok && strings.Contains(acc.Email, email) {
+			accs = append(accs, *acc)
+		}
+	}
+
+	return accs, nil
+}
+
+func (db *mockDB) SetAccountStatus(ctx context.Context, uid uint64, status string) error {
+	acc, ok := db.accounts[uid]
+	if !ok {
+		return ErrNotFound
+	}
+
+	acc.Status = status
+
+	return nil
+}
+
+func (db *mockDB) RecordFailedLogin(ctx context.Context, uid uint64, maxAttempts int, lockout time.Duration) error {
+	acc, ok := db.accounts[uid]
+	if !ok {
+		return ErrNotFound
+	}
+
+	acc.FailedLogins++
+
+	if acc.FailedLogins >= maxAttempts {
+		lockedUntil := time.Now().Add(lockout)
+		acc.LockedUntil = &lockedUntil
+	}
+
+	return nil
+}
+
+func (db *mockDB) ClearLockout(ctx context.Context, uid uint64) error {
+	acc, ok := db.accounts[uid]
+	if !ok {
+		return ErrNotFound
+	}
+
+	acc.FailedLogins = 0
+	acc.LockedUntil = nil
+
+	return nil
+}
+
+func (db *mockDB) ForcePasswordReset(ctx context.Context, uid uint64) error {
+	acc, ok := db.accounts[uid]
+	if !ok {
+		return ErrNotFound
+	}
+
+	acc.PasswordResetRequired = true
+
+	return nil
+}
+
+func (db *mockDB) SetPassword(ctx context.Context, uid uint64, pass string) error {
+	acc, ok := db.accounts[uid]
+	if !ok {
+		return ErrNotFound
+	}
+
+	pwd, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	db.store[acc.Email] = string(pwd)
+	acc.PasswordResetRequired = false
+
+	return nil
+}
+
+func (db *mockDB) TradingPIN(ctx context.Context, uid uint64) (string, error) {
+	pin, ok := db.pins[uid]
+	if !ok {
+		return "", ErrNotFound
+	}
+
+	return pin, nil
+}
+
+func (db *mockDB) SetTradingPIN(ctx context.Context, uid uint64, pin string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(pin), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	db.pins[uid] = string(hash)
+
+	return nil
+}
+
+func (db *mockDB) RevokeSessions(ctx context.Context, uid uint64) error {
+	acc, ok := db.accounts[uid]
+	if !ok {
+		return ErrNotFound
+	}
+
+	now := time.Now()
+	acc.SessionsRevokedAt = &now
+
+	for id, s := range db.sessions {
+		if s.UID == uid {
+			delete(db.sessions, id)
+		}
+	}
+
+	return nil
+}
+
+func (db *mockDB) RecordAudit(ctx context.Context, entry AuditEntry) error {
+	db.audit = append(db.audit, entry)
+
+	return nil
+}
+
+func (db *mockDB) SaveMagicLink(ctx context.Context, link MagicLink) error {
+	db.magicLinks[link.TokenHash] = link
+
+	return nil
+}
+
+func (db *mockDB) ConsumeMagicLink(ctx context.Context, tokenHash string) (MagicLink, error) {
+	link, ok := db.magicLinks[tokenHash]
+	if !ok {
+		return MagicLink{}, ErrNotFound
+	}
+
+	delete(db.magicLinks, tokenHash)
+
+	return link, nil
+}
+
+func (db *mockDB) CreateSession(ctx context.Context, s Session) error {
+	db.sessions[s.ID] = s
+
+	return nil
+}
+
+func (db *mockDB) Session(ctx context.Context, id string) (Session, error) {
+	s, ok := db.sessions[id]
+	if !ok {
+		return Session{}, ErrNotFound
+	}
+
+	return s, nil
+}
+
+func (db *mockDB) DeleteSession(ctx context.Context, id string) error {
+	delete(db.sessions, id)
+
+	return nil
+}
+
+func (db *mockDB) CreateGuest(ctx context.Context, expiresAt time.Time) (uint64, error) {
+	db.lastUID++
+	db.accounts[db.lastUID] = &Account{
+		UID:            db.lastUID,
+		Email:          fmt.Sprintf("guest-%d@guest.invalid", db.lastUID),
+		Lang:           "en",
+		Role:           RoleUser,
+		Status:         StatusActive,
+		GuestExpiresAt: &expiresAt,
+	}
+
+	return db.lastUID, nil
+}
+
+func (db *mockDB) ConvertGuest(ctx context.Context, uid uint64, body RegistrationReqBody) error {
+	acc, ok := db.accounts[uid]
+	if !ok || acc.GuestExpiresAt == nil || !time.Now().Before(*acc.GuestExpiresAt) {
+		return ErrNotFound
+	}
+
+	if db.accountByEmail(body.Email) != nil {
+		return ErrConflict
+	}
+
+	pwd, err := bcrypt.GenerateFromPassword([]byte(body.Pass), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	db.store[body.Email] = string(pwd)
+	acc.Email = body.Email
+	acc.GuestExpiresAt = nil
+
+	return nil
+}
+
+func (db *mockDB) DeleteExpiredGuests(ctx context.Context) (int64, error) {
+	var n int64
+
+	for uid, acc := range db.accounts {
+		if acc.GuestExpiresAt == nil || time.Now().Before(*acc.GuestExpiresAt) {
+			continue
+		}
+
+		delete(db.accounts, uid)
+
+		for id, s := range db.sessions {
+			if s.UID == uid {
+				delete(db.sessions, id)
+			}
+		}
+
+		n++
+	}
+
+	return n, nil
+}
+
+func (db *mockDB) CreateGrant(ctx context.Context, g Grant) error {
+	db.grants = append(db.grants, g)
+
+	return nil
+}
+
+func (db *mockDB) Grants(ctx context.Context, uid uint64) ([]Grant, []Grant, error) {
+	given := []Grant{}
+	received := []Grant{}
+
+	for _, g := range db.grants {
+		if !time.Now().Before(g.ExpiresAt) {
+			continue
+		}
+
+		if g.GrantorUID == uid {
+			given = append(given, g)
+		} else if g.GranteeUID == uid {
+			received = append(received, g)
+		}
+	}
+
+	return given, received, nil
+}
+
+func (db *mockDB) ActiveGrant(ctx context.Context, grantorUID, granteeUID uint64) (Grant, error) {
+	var active *Grant
+
+	for i, g := range db.grants {
+		if g.GrantorUID == grantorUID && g.GranteeUID == granteeUID && time.Now().Before(g.ExpiresAt) &&
+			(active == nil || g.ExpiresAt.After(active.ExpiresAt)) {
+			active = &db.grants[i]
+		}
+	}
+
+	if active == nil {
+		return Grant{}, ErrNotFound
+	}
+
+	return *active, nil
+}
+
+func (db *mockDB) DeleteGrant(ctx context.Context, uid uint64, id string) error {
+	for i, g := range db.grants {
+		if g.ID == id && (g.GrantorUID == uid || g.GranteeUID == uid) {
+			db.grants = append(db.grants[:i], db.grants[i+1:]...)
+			return nil
+		}
+	}
+
+	return ErrNotFound
+}
+
+func (db *mockDB) CreateShareLink(ctx context.Context, l ShareLink) error {
+	db.shareLinks = append(db.shareLinks, l)
+
+	return nil
+}
+
+func (db *mockDB) ShareLinks(ctx context.Context, uid uint64) ([]ShareLink, error) {
+	links := []ShareLink{}
+
+	for _, l := range db.shareLinks {
+		if l.UID == uid && time.Now().Before(l.ExpiresAt) {
+			links = append(links, l)
+		}
+	}
+
+	return links, nil
+}
+
+func (db *mockDB) ShareLink(ctx context.Context, id string) (ShareLink, error) {
+	for _, l := range db.shareLinks {
+		if l.ID == id {
+			return l, nil
+		}
+	}
+
+	return ShareLink{}, ErrNotFound
+}
+
+func (db *mockDB) DeleteShareLink(ctx context.Context, uid uint64, id string) error {
+	for i, l := range db.shareLinks {
+		if l.ID == id && l.UID == uid {
+			db.shareLinks = append(db.shareLinks[:i], db.shareLinks[i+1:]...)
+			return nil
+		}
+	}
+
+	return ErrNotFound
+}
+
+// MockAuditTrail returns all audit entries recorded by the datastore of an Env returned by NewMockEnv.
+func MockAuditTrail(env *Env) []AuditEntry {
+	return env.DB.(*mockDB).audit
+}
+
+// MockSetRole sets the role of the account with the uid in the datastore of an Env returned by NewMockEnv.
+func MockSetRole(env *Env, uid uint64, role string) {
+	env.DB.(*mockDB).accounts[uid].Role = role
+}
+
 // NewMockEnv returns a new Env with mock values instead of production values.
 func NewMockEnv() *Env {
 	env := new(Env)
 
 	db := new(mockDB)
 	db.store = make(map[string]string)
+	db.challenges = make(map[string]LoginChallenge)
+	db.accounts = make(map[uint64]*Account)
+	db.magicLinks = make(map[string]MagicLink)
+	db.sessions = make(map[string]Session)
+	db.pins = make(map[uint64]string)
 
 	auth := new(mockAuth)
 
 	env.DB = db
 	env.Auth = auth
+	env.Sessions = DefaultSessionPolicy()
+	env.ShareLinkKey = []byte("share-link-key")
 
 	return env
 }
@@ -0,0 +1,135 @@
+// Package geo resolves ip addresses to geographical regions using an offline database.
+package geo
+
+import (
+	"auth-proxy/config"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxTravelSpeed is the speed in km/h which is considered physically possible between two logins.
+// It's roughly the cruising speed of a commercial airplane.
+const MaxTravelSpeed = 1000.0
+
+// earthRadius is the mean earth radius in km.
+const earthRadius = 6371.0
+
+type entry struct {
+	network *net.IPNet
+	loc     config.Location
+}
+
+// DB represents an offline ip to region database.
+type DB struct {
+	config.Locator
+	entries []entry
+}
+
+// Open loads the CSV database at path. See Load for the expected format.
+func Open(path string) (*DB, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return Load(f)
+}
+
+// Load reads a CSV database where every line has the format "cidr,region,latitude,longitude", e.g.
+// "81.2.69.0/24,GB-London,51.5142,-0.0931". Lines starting with a # are ignored.
+func Load(r io.Reader) (*DB, error) {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.FieldsPerRecord = 4
+	cr.TrimLeadingSpace = true
+
+	db := new(DB)
+
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		_, network, err := net.ParseCIDR(strings.TrimSpace(rec[0]))
+		if err != nil {
+			return nil, err
+		}
+
+		lat, err := strconv.ParseFloat(rec[2], 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid latitude for %s: %v", rec[0], err)
+		}
+
+		lon, err := strconv.ParseFloat(rec[3], 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid longitude for %s: %v", rec[0], err)
+		}
+
+		loc := config.Location{Region: rec[1], Lat: lat, Lon: lon}
+		db.entries = append(db.entries, entry{network: network, loc: loc})
+	}
+
+	return db, nil
+}
+
+// Locate returns the location of the most specific network containing ip.
+func (db *DB) Locate(ip net.IP) (config.Location, bool) {
+	var (
+		best     config.Location
+		bestOnes = -1
+	)
+
+	for _, e := range db.entries {
+		if !e.network.Contains(ip) {
+			continue
+		}
+
+		if ones, _ := e.network.Mask.Size(); ones > bestOnes {
+			best = e.loc
+			bestOnes = ones
+		}
+	}
+
+	return best, bestOnes >= 0
+}
+
+// Distance returns the great-circle distance between a and b in km.
+func Distance(a, b config.Location) float64 {
+	toRad := func(deg float64) float64 { return deg * math.Pi / 180 }
+
+	dLat := toRad(b.Lat - a.Lat)
+	dLon := toRad(b.Lon - a.Lon)
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRad(a.Lat))*math.Cos(toRad(b.Lat))*math.Sin(dLon/2)*math.Sin(dLon/2)
+
+	return 2 * earthRadius * math.Asin(math.Sqrt(h))
+}
+
+// ImpossibleTravel reports if getting from one location to the other in the elapsed time
+// would require travelling faster than MaxTravelSpeed.
+func ImpossibleTravel(from, to config.Location, elapsed time.Duration) bool {
+	dist := Distance(from, to)
+	if dist == 0 {
+		return false
+	}
+
+	if elapsed <= 0 {
+		return true
+	}
+
+	return dist/elapsed.Hours() > MaxTravelSpeed
+}
@@ -0,0 +1,81 @@
+package geo_test
+
+import (
+	"auth-proxy/config"
+	"auth-proxy/geo"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+const mockDB = `# cidr,region,latitude,longitude
+81.2.69.0/24,GB-London,51.5142,-0.0931
+81.2.0.0/16,GB,52.3555,-1.1743
+2001:db8::/32,US-NewYork,40.7128,-74.0060
+`
+
+func TestLocate(t *testing.T) {
+	db, err := geo.Load(strings.NewReader(mockDB))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		ip     string
+		region string
+		found  bool
+	}{
+		{"81.2.69.160", "GB-London", true},
+		{"81.2.1.1", "GB", true},
+		{"2001:db8::1", "US-NewYork", true},
+		{"10.0.0.1", "", false},
+	}
+
+	for _, i := range cases {
+		loc, found := db.Locate(net.ParseIP(i.ip))
+		if found != i.found {
+			t.Errorf("Expected found to be %v but got %v when ip=%s", i.found, found, i.ip)
+		}
+
+		if loc.Region != i.region {
+			t.Errorf("Expected the region %q but got %q when ip=%s", i.region, loc.Region, i.ip)
+		}
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	cases := []string{
+		"not-a-cidr,GB,1,1\n",
+		"81.2.69.0/24,GB,north,1\n",
+		"81.2.69.0/24,GB,1\n",
+	}
+
+	for _, i := range cases {
+		if _, err := geo.Load(strings.NewReader(i)); err == nil {
+			t.Errorf("Expected an error but got nil when db=%q", i)
+		}
+	}
+}
+
+func TestImpossibleTravel(t *testing.T) {
+	london := config.Location{Region: "GB-London", Lat: 51.5142, Lon: -0.0931}
+	newYork := config.Location{Region: "US-NewYork", Lat: 40.7128, Lon: -74.0060}
+
+	cases := []struct {
+		from, to   config.Location
+		elapsed    time.Duration
+		impossible bool
+	}{
+		{london, newYork, time.Hour, true},
+		{london, newYork, time.Hour * 10, false},
+		{london, london, 0, false},
+		{newYork, london, time.Minute, true},
+	}
+
+	for _, i := range cases {
+		if geo.ImpossibleTravel(i.from, i.to, i.elapsed) != i.impossible {
+			t.Errorf("Expected impossible travel to be %v when from=%s, to=%s and elapsed=%v", i.impossible, i.from.Region, i.to.Region, i.elapsed)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package handler
+
+import (
+	"auth-proxy/config"
+	"auth-proxy/internal"
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// maxSearchResults defines how many accounts a user search returns at most.
+	maxSearchResults = 50
+
+	// impersonationLifetime defines how long an impersonation session lasts at most.
+	impersonationLifetime = time.Hour
+)
+
+// errNoActor is returned when an admin handler is called without an authenticated user in the request context.
+var errNoActor = errors.New("The request context doesn't contain the uid of the acting user")
+
+// audit records an action of the acting user saved in the request context.
+func audit(r *http.Request, env *config.Env, action string, target uint64, details string) error {
+	actor, ok := internal.UIDFromContext(r.Context())
+	if !ok {
+		return errNoActor
+	}
+
+	entry := config.AuditEntry{
+		ActorUID:  actor,
+		Action:    action,
+		TargetUID: target,
+		Details:   details,
+		At:        time.Now(),
+	}
+
+	return env.DB.RecordAudit(r.Context(), entry)
+}
+
+// targetUID returns the uid specified in the route's uid variable.
+func targetUID(r *http.Request) (uint64, error) {
+	return strconv.ParseUint(mux.Vars(r)["uid"], 10, 64)
+}
+
+// adminAction returns a handler which records the action in the audit trail and then performs it on the
+// user specified in the route's uid variable. The action is only performed if it could be recorded.
+func adminAction(env *config.Env, action string, details func(r *http.Request) (string, error), do func(ctx context.Context, uid uint64, details string) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		uid, err := targetUID(r)
+		if err != nil || uid < 1 {
+			http.Error(w, "Invalid user id", http.StatusBadRequest)
+			return
+		}
+
+		var d string
+		if details != nil {
+			d, err = details(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		_, err = env.DB.Account(r.Context(), uid)
+		if err != nil {
+			if err == config.ErrNotFound {
+				http.Error(w, "No user with the specified id exists", http.StatusNotFound)
+			} else {
+				http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
+				log.Println(err)
+			}
+
+			return
+		}
+
+		err = audit(r, env, action, uid, d)
+		if err != nil {
+			http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		err = do(r.Context(), uid, d)
+		if err != nil {
+			http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		if env.Accounts != nil {
+			env.Accounts.Invalidate(uid)
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// HandleAdminSearchUsers returns the accounts whose email contains the email query parameter.
+// If the parameter is missing it returns a http.StatusBadRequest (http 400).
+func HandleAdminSearchUsers(env *config.Env) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		email := r.URL.Query().Get("email")
+		if email == "" {
+			http.Error(w, "The email query parameter has to be specified", http.StatusBadRequest)
+			return
+		}
+
+		err := audit(r, env, "search_users", 0, email)
+		if err != nil {
+			http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		accs, err := env.DB.SearchAccounts(r.Context(), email, maxSearchResults)
+		if err != nil {
+			http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		if accs == nil {
+			accs = []config.Account{}
+		}
+
+		internal.WriteJSON(w, http.StatusOK, accs)
+	}
+}
+
+// HandleAdminGetUser returns the account of the user specified in the route's uid variable.
+func HandleAdminGetUser(env *config.Env) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		uid, err := targetUID(r)
+		if err != nil || uid < 1 {
+			http.Error(w, "Invalid user id", http.StatusBadRequest)
+			return
+		}
+
+		err = audit(r, env, "view_user", uid, "")
+		if err != nil {
+			http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		acc, err := env.DB.Account(r.Context(), uid)
+		if err != nil {
+			if err == config.ErrNotFound {
+				http.Error(w, "No user with the specified id exists", http.StatusNotFound)
+			} else {
+				http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
+				log.Println(err)
+			}
+
+			return
+		}
+
+		internal.WriteJSON(w, http.StatusOK, acc)
+	}
+}
+
+// HandleAdminSetAccountStatus disables, suspends or re-enables an account. If the status in the request body isn't a
+// valid status it returns a http.StatusBadRequest (http 400).
+func HandleAdminSetAccountStatus(env *config.Env) http.HandlerFunc {
+	details := func(r *http.Request) (string, error) {
+		var body config.AccountStatusReqBody
+
+		if err := internal.ParseJSONBody(r.Body, &body); err != nil {
+			return "", errors.New("Invalid request syntax")
+		}
+
+		switch body.Status {
+		case config.StatusActive, config.StatusDisabled, config.StatusSuspended, config.StatusPending:
+		default:
+			return "", errors.New("The status has to be one of \"active\", \"disabled\", \"suspended\" or \"pending\"")
+		}
+
+		return body.Status, nil
+	}
+
+	return adminAction(env, "set_status", details, env.DB.SetAccountStatus)
+}
+
+// HandleAdminClearLockout unlocks an account which got locked because of too many failed logins.
+func HandleAdminClearLockout(env *config.Env) http.HandlerFunc {
+	return adminAction(env, "clear_lockout", nil, func(ctx context.Context, uid uint64, _ string) error {
+		return env.DB.ClearLockout(ctx, uid)
+	})
+}
+
+// HandleAdminForcePasswordReset requires the user to choose a new password on the next login.
+func HandleAdminForcePasswordReset(env *config.Env) http.HandlerFunc {
+	return adminAction(env, "force_password_reset", nil, func(ctx context.Context, uid uint64, _ string) error {
+		return env.DB.ForcePasswordReset(ctx, uid)
+	})
+}
+
+// HandleAdminRevokeSessions logs the user out of all sessions.
+func HandleAdminRevokeSessions(env *config.Env) http.HandlerFunc {
+	return adminAction(env, "revoke_sessions", nil, func(ctx context.Context, uid uint64, _ string) error {
+		return env.DB.RevokeSessions(ctx, uid)
+	})
+}
+
+// HandleAdminImpersonate replaces the admin's authentication cookie with one of the user specified in the
+// route's uid variable. The token carries the uid of the admin as well and is read-only unless the request
+// body's allowWrites field is set. Other admins can't be impersonated.
+func HandleAdminImpersonate(env *config.Env) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body config.ImpersonationReqBody
+
+		actor, ok := internal.UIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "You're unauthorized to perform this action", http.StatusUnauthorized)
+			return
+		}
+
+		uid, err := targetUID(r)
+		if err != nil || uid < 1 {
+			http.Error(w, "Invalid user id", http.StatusBadRequest)
+			return
+		}
+
+		// an empty body defaults to a read-only session
+		if r.ContentLength != 0 {
+			if err = internal.ParseJSONBody(r.Body, &body); err != nil {
+				http.Error(w, "Invalid request syntax", http.StatusBadRequest)
+				return
+			}
+		}
+
+		acc, err := env.DB.Account(r.Context(), uid)
+		if err != nil {
+			if err == config.ErrNotFound {
+				http.Error(w, "No user with the specified id exists", http.StatusNotFound)
+			} else {
+				http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
+				log.Println(err)
+			}
+
+			return
+		}
+
+		if uid == actor || acc.Role == config.RoleAdmin {
+			http.Error(w, "Admins can't be impersonated", http.StatusForbidden)
+			return
+		}
+
+		details := "read-only"
+		if body.AllowWrites {
+			details = "read-write"
+		}
+
+		err = audit(r, env, "impersonate", uid, details)
+		if err != nil {
+			http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		cl := config.Claims{
+			UID:              uid,
+			ActorUID:         actor,
+			ReadOnly:         !body.AllowWrites,
+			SessionExpiresAt: time.Now().Add(impersonationLifetime),
+			ExpiresAt:        config.DefaultExpTime(),
+		}
+
+		c, err := env.Auth.CreateClaimsCookie(cl)
+		if err != nil {
+			http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		http.SetCookie(w, c)
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,313 @@
+package handler_test
+
+import (
+	"auth-proxy/auth"
+	"auth-proxy/config"
+	"auth-proxy/handler"
+	"auth-proxy/internal"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// adminRouter returns a router serving the admin routes as the user with the uid 1.
+func adminRouter(env *config.Env) http.Handler {
+	r := mux.NewRouter()
+	r.Use(func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h.ServeHTTP(w, r.WithContext(internal.WithUID(r.Context(), 1)))
+		})
+	})
+
+	r.Handle("/users", handler.HandleAdminSearchUsers(env)).Methods("GET")
+	r.Handle("/users/{uid:[0-9]+}", handler.HandleAdminGetUser(env)).Methods("GET")
+	r.Handle("/users/{uid:[0-9]+}/status", handler.HandleAdminSetAccountStatus(env)).Methods("POST")
+	r.Handle("/users/{uid:[0-9]+}/unlock", handler.HandleAdminClearLockout(env)).Methods("POST")
+	r.Handle("/users/{uid:[0-9]+}/password-reset", handler.HandleAdminForcePasswordReset(env)).Methods("POST")
+	r.Handle("/users/{uid:[0-9]+}/logout", handler.HandleAdminRevokeSessions(env)).Methods("POST")
+	r.Handle("/users/{uid:[0-9]+}/impersonate", handler.HandleAdminImpersonate(env)).Methods("POST")
+
+	return r
+}
+
+func serve(t *testing.T, h http.Handler, method, url string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var rd io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rd = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, url, rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	return rr
+}
+
+func TestHandleAdmin(t *testing.T) {
+	ctx := context.Background()
+	mockEnv := config.NewMockEnv()
+	r := adminRouter(mockEnv)
+
+	bodies := []config.RegistrationReqBody{
+		{Email: "admin@doe.com", Pass: "password", LastName: "doe"},
+		{Email: "john.doe@gmail.com", Pass: "password", LastName: "doe"},
+	}
+
+	for _, b := range bodies {
+		if err := mockEnv.DB.Register(ctx, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("test user search", func(t *testing.T) {
+		rr := serve(t, r, "GET", "/users?email=gmail", nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status code %d but got %d", http.StatusOK, rr.Code)
+		}
+
+		var accs []config.Account
+		if err := json.NewDecoder(rr.Body).Decode(&accs); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(accs) != 1 || accs[0].UID != 2 {
+			t.Errorf("Expected only the user with the uid 2 to be found but got %+v", accs)
+		}
+
+		if rr := serve(t, r, "GET", "/users", nil); rr.Code != http.StatusBadRequest {
+			t.Errorf("Expected status code %d but got %d when no email was specified", http.StatusBadRequest, rr.Code)
+		}
+	})
+
+	t.Run("test user status", func(t *testing.T) {
+		cases := []struct {
+			url          string
+			body         config.AccountStatusReqBody
+			expectedCode int
+		}{
+			{"/users/2/status", config.AccountStatusReqBody{Status: config.StatusDisabled}, http.StatusNoContent},
+			{"/users/2/status", config.AccountStatusReqBody{Status: "deleted"}, http.StatusBadRequest},
+			{"/users/3/status", config.AccountStatusReqBody{Status: config.StatusDisabled}, http.StatusNotFound},
+		}
+
+		for _, i := range cases {
+			if rr := serve(t, r, "POST", i.url, i.body); rr.Code != i.expectedCode {
+				t.Errorf("Expected status code %d but got %d when url=%s and body=%+v", i.expectedCode, rr.Code, i.url, i.body)
+			}
+		}
+
+		rr := serve(t, r, "GET", "/users/2", nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status code %d but got %d", http.StatusOK, rr.Code)
+		}
+
+		var acc config.Account
+		if err := json.NewDecoder(rr.Body).Decode(&acc); err != nil {
+			t.Fatal(err)
+		}
+
+		if acc.Status != config.StatusDisabled {
+			t.Errorf("Expected the account to be disabled but its status is %s", acc.Status)
+		}
+
+		login := handler.HandleLogin(mockEnv)
+		body := config.LoginReqBody{Email: "john.doe@gmail.com", Pass: "password"}
+
+		rr = serve(t, login, "POST", "/api/login", body)
+		if rr.Code != http.StatusForbidden {
+			t.Fatalf("Expected status code %d but got %d when the account's disabled", http.StatusForbidden, rr.Code)
+		}
+
+		var resp map[string]string
+		if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp["code"] != "account_disabled" {
+			t.Errorf("Expected the error code account_disabled but got %s", resp["code"])
+		}
+
+		if rr := serve(t, r, "POST", "/users/2/status", config.AccountStatusReqBody{Status: config.StatusActive}); rr.Code != http.StatusNoContent {
+			t.Fatalf("Expected status code %d but got %d when re-enabling the account", http.StatusNoContent, rr.Code)
+		}
+
+		if rr := serve(t, login, "POST", "/api/login", body); rr.Code != http.StatusOK {
+			t.Errorf("Expected status code %d but got %d after the account was re-enabled", http.StatusOK, rr.Code)
+		}
+	})
+
+	t.Run("test lockout", func(t *testing.T) {
+		login := handler.HandleLogin(mockEnv)
+		wrong := config.LoginReqBody{Email: "john.doe@gmail.com", Pass: "wrong-password"}
+		right := config.LoginReqBody{Email: "john.doe@gmail.com", Pass: "password"}
+
+		for i := 0; i < 5; i++ {
+			if rr := serve(t, login, "POST", "/api/login", wrong); rr.Code != http.StatusUnauthorized {
+				t.Fatalf("Expected status code %d but got %d on a wrong password", http.StatusUnauthorized, rr.Code)
+			}
+		}
+
+		if rr := serve(t, login, "POST", "/api/login", right); rr.Code != http.StatusForbidden {
+			t.Fatalf("Expected status code %d but got %d when the account's locked", http.StatusForbidden, rr.Code)
+		}
+
+		if rr := serve(t, r, "POST", "/users/2/unlock", nil); rr.Code != http.StatusNoContent {
+			t.Fatalf("Expected status code %d but got %d", http.StatusNoContent, rr.Code)
+		}
+
+		if rr := serve(t, login, "POST", "/api/login", right); rr.Code != http.StatusOK {
+			t.Fatalf("Expected status code %d but got %d after the account was unlocked", http.StatusOK, rr.Code)
+		}
+	})
+
+	t.Run("test forced password reset", func(t *testing.T) {
+		login := handler.HandleLogin(mockEnv)
+
+		if rr := serve(t, r, "POST", "/users/2/password-reset", nil); rr.Code != http.StatusNoContent {
+			t.Fatalf("Expected status code %d but got %d", http.StatusNoContent, rr.Code)
+		}
+
+		body := config.LoginReqBody{Email: "john.doe@gmail.com", Pass: "password"}
+		if rr := serve(t, login, "POST", "/api/login", body); rr.Code != http.StatusForbidden {
+			t.Fatalf("Expected status code %d but got %d when no new password was specified", http.StatusForbidden, rr.Code)
+		}
+
+		body.NewPass = "new-password"
+		if rr := serve(t, login, "POST", "/api/login", body); rr.Code != http.StatusOK {
+			t.Fatalf("Expected status code %d but got %d when a new password was specified", http.StatusOK, rr.Code)
+		}
+
+		body = config.LoginReqBody{Email: "john.doe@gmail.com", Pass: "new-password"}
+		if rr := serve(t, login, "POST", "/api/login", body); rr.Code != http.StatusOK {
+			t.Fatalf("Expected status code %d but got %d when logging in with the new password", http.StatusOK, rr.Code)
+		}
+	})
+
+	t.Run("test session revocation", func(t *testing.T) {
+		if rr := serve(t, r, "POST", "/users/2/logout", nil); rr.Code != http.StatusNoContent {
+			t.Fatalf("Expected status code %d but got %d", http.StatusNoContent, rr.Code)
+		}
+
+		acc, err := mockEnv.DB.Account(ctx, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if acc.SessionsRevokedAt == nil {
+			t.Error("Expected the sessions to be revoked")
+		}
+	})
+
+	t.Run("test audit trail", func(t *testing.T) {
+		trail := config.MockAuditTrail(mockEnv)
+
+		actions := map[string]bool{}
+		for _, e := range trail {
+			if e.ActorUID != 1 {
+				t.Errorf("Expected the actor to be the user with the uid 1 but got %d", e.ActorUID)
+			}
+
+			actions[e.Action] = true
+		}
+
+		for _, a := range []string{"search_users", "view_user", "set_status", "clear_lockout", "force_password_reset", "revoke_sessions"} {
+			if !actions[a] {
+				t.Errorf("Expected the action %s to be recorded in the audit trail", a)
+			}
+		}
+	})
+}
+
+func TestHandleAdminImpersonate(t *testing.T) {
+	ctx := context.Background()
+	mockEnv := config.NewMockEnv()
+	r := adminRouter(mockEnv)
+
+	a, err := auth.New("jwt-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mockEnv.Auth = a
+
+	bodies := []config.RegistrationReqBody{
+		{Email: "admin@doe.com", Pass: "password", LastName: "doe"},
+		{Email: "john.doe@gmail.com", Pass: "password", LastName: "doe"},
+	}
+
+	for _, b := range bodies {
+		if err := mockEnv.DB.Register(ctx, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		url          string
+		body         interface{}
+		expectedCode int
+		readOnly     bool
+	}{
+		{"/users/2/impersonate", nil, http.StatusNoContent, true},
+		{"/users/2/impersonate", config.ImpersonationReqBody{AllowWrites: true}, http.StatusNoContent, false},
+		{"/users/1/impersonate", nil, http.StatusForbidden, false},
+		{"/users/3/impersonate", nil, http.StatusNotFound, false},
+	}
+
+	for _, i := range cases {
+		rr := serve(t, r, "POST", i.url, i.body)
+		if rr.Code != i.expectedCode {
+			t.Errorf("Expected status code %d but got %d when url=%s and body=%+v", i.expectedCode, rr.Code, i.url, i.body)
+			continue
+		}
+
+		c := cookieByName(rr.Result().Cookies(), "auth_token")
+		if i.expectedCode != http.StatusNoContent {
+			if c != nil {
+				t.Errorf("An authentication cookie was set even though the impersonation failed when url=%s", i.url)
+			}
+
+			continue
+		}
+
+		if c == nil {
+			t.Fatalf("Expected an authentication cookie to be set when url=%s", i.url)
+		}
+
+		cl, err := a.Claims(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if cl.UID != 2 || cl.ActorUID != 1 || cl.ReadOnly != i.readOnly {
+			t.Errorf("Unexpected claims %+v when url=%s and body=%+v", cl, i.url, i.body)
+		}
+	}
+
+	n := 0
+	for _, e := range config.MockAuditTrail(mockEnv) {
+		if e.Action == "impersonate" {
+			n++
+		}
+	}
+
+	if n != 2 {
+		t.Errorf("Expected 2 impersonations to be recorded in the audit trail but got %d", n)
+	}
+}
@@ -0,0 +1,143 @@
+package handler
+
+import (
+	"auth-proxy/config"
+	"auth-proxy/internal"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxGrantLifetime defines how long a grant can be valid at most.
+const maxGrantLifetime = time.Hour * 24 * 365
+
+// grantStepUp requires grants to be created shortly after the user entered the password, since they give others
+// access to the account.
+var grantStepUp = internal.StepUpRule{MaxAge: time.Minute * 5}
+
+// HandleCreateGrant lets the user give another user access to the account. The grantee is identified by email.
+// To not reveal which emails are registered, it responds with a http.StatusAccepted (http 202) even if no active
+// user with the email exists, in which case no grant is created.
+func HandleCreateGrant(env *config.Env) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body config.GrantReqBody
+
+		err := internal.ParseJSONBody(r.Body, &body)
+		if err != nil {
+			http.Error(w, "Invalid request syntax", http.StatusBadRequest)
+			return
+		}
+
+		if body.Scope != config.ScopeRead && body.Scope != config.ScopeTrade {
+			http.Error(w, "The scope has to be either read or trade", http.StatusBadRequest)
+			return
+		}
+
+		if !body.ExpiresAt.After(time.Now()) || time.Until(body.ExpiresAt) > maxGrantLifetime {
+			http.Error(w, "The grant has to expire within the next 365 days", http.StatusBadRequest)
+			return
+		}
+
+		cl, acc, ok := authenticatedAccount(w, r, env)
+		if !ok {
+			return
+		}
+
+		if !grantStepUp.Satisfied(cl) {
+			internal.WriteStepUpRequired(w, grantStepUp)
+			return
+		}
+
+		email := strings.TrimSpace(body.Email)
+		if strings.EqualFold(email, acc.Email) {
+			http.Error(w, "You can't grant access to yourself", http.StatusBadRequest)
+			return
+		}
+
+		grantee, err := env.DB.AccountByEmail(r.Context(), email)
+		if err != nil && err != config.ErrNotFound {
+			http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		if err == config.ErrNotFound || grantee.Status != config.StatusActive || grantee.GuestExpiresAt != nil || grantee.UID == acc.UID {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+
+		id, err := internal.RandomToken(16)
+		if err != nil {
+			http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		g := config.Grant{
+			ID:         id,
+			GrantorUID: cl.UID,
+			GranteeUID: grantee.UID,
+			Scope:      body.Scope,
+			CreatedAt:  time.Now(),
+			ExpiresAt:  body.ExpiresAt,
+		}
+
+		err = env.DB.CreateGrant(r.Context(), g)
+		if err != nil {
+			http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// HandleListGrants returns the unexpired grants the user gave and received.
+func HandleListGrants(env *config.Env) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cl, _, ok := authenticatedAccount(w, r, env)
+		if !ok {
+			return
+		}
+
+		given, received, err := env.DB.Grants(r.Context(), cl.UID)
+		if err != nil {
+			http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		internal.WriteJSON(w, http.StatusOK, map[string][]config.Grant{
+			"given":    given,
+			"received": received,
+		})
+	}
+}
+
+// HandleRevokeGrant deletes a grant. Both the grantor and the grantee can revoke it.
+func HandleRevokeGrant(env *config.Env) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cl, _, ok := authenticatedAccount(w, r, env)
+		if !ok {
+			return
+		}
+
+		err := env.DB.DeleteGrant(r.Context(), cl.UID, mux.Vars(r)["id"])
+		if err != nil {
+			if err == config.ErrNotFound {
+				http.Error(w, "The grant doesn't exist", http.StatusNotFound)
+			} else {
+				http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
+				log.Println(err)
+			}
+
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
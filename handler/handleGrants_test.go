@@ -0,0 +1,113 @@
+package handler_test
+
+import (
+	"auth-proxy/config"
+	"auth-proxy/handler"
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// grantsRouter returns a router serving the grant routes as the user with the uid, who authenticated at authTime.
+func grantsRouter(env *config.Env, uid uint64, authTime time.Time) http.Handler {
+	cl := config.Claims{UID: uid, AuthTime: authTime, ExpiresAt: time.Now().Add(time.Minute)}
+
+	r := mux.NewRouter()
+	r.Handle("/grants", withClaims(handler.HandleCreateGrant(env), cl)).Methods("POST")
+	r.Handle("/grants", withClaims(handler.HandleListGrants(env), cl)).Methods("GET")
+	r.Handle("/grants/{id}", withClaims(handler.HandleRevokeGrant(env), cl)).Methods("DELETE")
+
+	return r
+}
+
+func TestHandleGrants(t *testing.T) {
+	ctx := context.Background()
+	mockEnv := config.NewMockEnv()
+
+	bodies := []config.RegistrationReqBody{
+		{Email: "john.doe@gmail.com", Pass: "password", LastName: "doe"},
+		{Email: "advisor@bank.com", Pass: "password", LastName: "smith"},
+		{Email: "jane.doe@gmail.com", Pass: "password", LastName: "doe"},
+	}
+
+	for _, b := range bodies {
+		if err := mockEnv.DB.Register(ctx, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	grantor := grantsRouter(mockEnv, 1, time.Now())
+	grantee := grantsRouter(mockEnv, 2, time.Now())
+	nextWeek := time.Now().Add(time.Hour * 24 * 7)
+
+	cases := []struct {
+		body         config.GrantReqBody
+		expectedCode int
+	}{
+		{config.GrantReqBody{Email: "advisor@bank.com", Scope: "admin", ExpiresAt: nextWeek}, http.StatusBadRequest},
+		{config.GrantReqBody{Email: "advisor@bank.com", Scope: config.ScopeRead, ExpiresAt: time.Now().Add(-time.Hour)}, http.StatusBadRequest},
+		{config.GrantReqBody{Email: "advisor@bank.com", Scope: config.ScopeRead, ExpiresAt: time.Now().Add(time.Hour * 24 * 400)}, http.StatusBadRequest},
+		{config.GrantReqBody{Email: "john.doe@gmail.com", Scope: config.ScopeRead, ExpiresAt: nextWeek}, http.StatusBadRequest},
+		{config.GrantReqBody{Email: "nobody@bank.com", Scope: config.ScopeRead, ExpiresAt: nextWeek}, http.StatusAccepted},
+		{config.GrantReqBody{Email: "advisor@bank.com", Scope: config.ScopeTrade, ExpiresAt: nextWeek}, http.StatusAccepted},
+	}
+
+	for _, i := range cases {
+		rr := serve(t, grantor, "POST", "/grants", i.body)
+		if rr.Code != i.expectedCode {
+			t.Errorf("Expected status code %d but got %d when body=%+v", i.expectedCode, rr.Code, i.body)
+		}
+	}
+
+	stale := grantsRouter(mockEnv, 1, time.Now().Add(-time.Hour))
+	if rr := serve(t, stale, "POST", "/grants", config.GrantReqBody{Email: "jane.doe@gmail.com", Scope: config.ScopeTrade, ExpiresAt: nextWeek}); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a step-up to be required but got %d", rr.Code)
+	}
+
+	if _, err := mockEnv.DB.ActiveGrant(ctx, 1, 3); err != config.ErrNotFound {
+		t.Errorf("Expected no grant to be created without a step-up but got %v", err)
+	}
+
+	g, err := mockEnv.DB.ActiveGrant(ctx, 1, 2)
+	if err != nil {
+		t.Fatalf("Expected the grant to be active but got %v", err)
+	}
+
+	if g.Scope != config.ScopeTrade {
+		t.Errorf("Expected the scope %s but got %s", config.ScopeTrade, g.Scope)
+	}
+
+	rr := serve(t, grantee, "GET", "/grants", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d but got %d", http.StatusOK, rr.Code)
+	}
+
+	var list struct {
+		Given    []config.Grant `json:"given"`
+		Received []config.Grant `json:"received"`
+	}
+
+	if err := json.NewDecoder(rr.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(list.Given) != 0 || len(list.Received) != 1 || list.Received[0].ID != g.ID {
+		t.Errorf("Expected the grantee to have received the grant but got %+v", list)
+	}
+
+	if rr := serve(t, grantsRouter(mockEnv, 3, time.Now()), "DELETE", "/grants/"+g.ID, nil); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected other users not to be able to revoke the grant but got %d", rr.Code)
+	}
+
+	if rr := serve(t, grantor, "DELETE", "/grants/"+g.ID, nil); rr.Code != http.StatusNoContent {
+		t.Errorf("Expected status code %d but got %d", http.StatusNoContent, rr.Code)
+	}
+
+	if _, err := mockEnv.DB.ActiveGrant(ctx, 1, 2); err != config.ErrNotFound {
+		t.Errorf("Expected the grant to be revoked but got %v", err)
+	}
+}
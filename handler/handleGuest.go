@@ -0,0 +1,125 @@
+package handler
+
+import (
+	"auth-proxy/config"
+	"auth-proxy/internal"
+	"auth-proxy/session"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/csrf"
+)
+
+// HandleGuest creates a sandbox account, which lives for env.GuestLifetime, and logs the client in as its guest.
+// The account can be kept by registering while being logged in as the guest. Clients exceeding env.GuestLimiter
+// get a http.StatusTooManyRequests (http 429).
+func HandleGuest(env *config.Env) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if env.GuestLimiter != nil && !env.GuestLimiter.Allow(internal.ClientIP(r).String()) {
+			internal.WriteError(w, http.StatusTooManyRequests, "guest_limit_reached", "Too many guest accounts have been created. Please try again later.")
+			return
+		}
+
+		expiresAt := time.Now().Add(env.GuestLifetime)
+
+		uid, err := env.DB.CreateGuest(r.Context(), expiresAt)
+		if err != nil {
+			http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		cl, sc, err := session.NewGuest(r.Context(), env, uid, expiresAt)
+		if err != nil {
+			http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		c, err := env.Auth.CreateClaimsCookie(cl)
+		if err != nil {
+			http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		http.SetCookie(w, c)
+		http.SetCookie(w, sc)
+		http.SetCookie(w, internal.CreateLangCookie("en"))
+
+		w.Header().Set("X-CSRF-Token", csrf.Token(r))
+
+		internal.WriteJSON(w, http.StatusCreated, map[string]interface{}{
+			"expiresAt": expiresAt.UTC().Format(time.RFC3339),
+		})
+	}
+}
+
+// guestAccount returns the uid of the guest account the request is logged in as. The session cookie is
+// used if the authentication token expired.
+func guestAccount(r *http.Request, env *config.Env) (uint64, bool) {
+	var uid uint64
+
+	if c, err := r.Cookie("auth_token"); err == nil && env.Auth.ValidateAuthCookie(c) == nil {
+		cl, err := env.Auth.Claims(c)
+		if err != nil {
+			return 0, false
+		}
+
+		uid = cl.UID
+	} else if sc, err := r.Cookie("session"); err == nil {
+		cl, err := session.Resume(r.Context(), env, sc.Value)
+		if err != nil {
+			return 0, false
+		}
+
+		uid = cl.UID
+	} else {
+		return 0, false
+	}
+
+	acc, err := env.DB.Account(r.Context(), uid)
+	if err != nil || acc.GuestExpiresAt == nil {
+		return 0, false
+	}
+
+	return uid, true
+}
+
+// convertGuest turns the guest account into a regular account and replaces the guest's cookies with the ones
+// of a regular login.
+func convertGuest(w http.ResponseWriter, r *http.Request, env *config.Env, uid uint64, body config.RegistrationReqBody) {
+	err := env.DB.ConvertGuest(r.Context(), uid, body)
+	if err != nil {
+		switch err {
+		case config.ErrConflict:
+			http.Error(w, "An account using that email already exists", http.StatusBadRequest)
+		case config.ErrNotFound:
+			internal.WriteError(w, http.StatusBadRequest, "guest_expired", "The guest account expired")
+		default:
+			http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
+			log.Println(err)
+		}
+
+		return
+	}
+
+	if env.Accounts != nil {
+		env.Accounts.Invalidate(uid)
+	}
+
+	if sc, err := r.Cookie("session"); err == nil {
+		if err = session.End(r.Context(), env, sc.Value); err != nil {
+			log.Println(err)
+		}
+
+		http.SetCookie(w, session.Cookie("", time.Time{}))
+	}
+
+	// setting a password doesn't verify one, so trades still require a step-up
+	if err = issueLoginCookies(w, r, env, uid, "en", false, false); err != nil {
+		http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
+		log.Println(err)
+	}
+}
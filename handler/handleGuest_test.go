@@ -0,0 +1,187 @@
+package handler_test
+
+import (
+	"auth-proxy/auth"
+	"auth-proxy/config"
+	"auth-proxy/handler"
+	"auth-proxy/internal"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func register(t *testing.T, env *config.Env, body config.RegistrationReqBody, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	t.Helper()
+
+	jsonBody, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("POST", "/api/register", bytes.NewReader(jsonBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+
+	rr := httptest.NewRecorder()
+	handler.HandleRegistration(env).ServeHTTP(rr, req)
+
+	return rr
+}
+
+func TestHandleGuest(t *testing.T) {
+	ctx := context.Background()
+	mockEnv := config.NewMockEnv()
+	mockEnv.GuestLifetime = time.Hour
+
+	a, err := auth.New("jwt-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mockEnv.Auth = a
+
+	newGuest := func() (*http.Cookie, *http.Cookie, config.Claims) {
+		t.Helper()
+
+		rr := serve(t, handler.HandleGuest(mockEnv), "POST", "/api/guest", nil)
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("Expected status code %d but got %d", http.StatusCreated, rr.Code)
+		}
+
+		c := cookieByName(rr.Result().Cookies(), "auth_token")
+		sc := cookieByName(rr.Result().Cookies(), "session")
+		if c == nil || sc == nil {
+			t.Fatal("Expected the authentication and the session cookie to be set")
+		}
+
+		cl, err := a.Claims(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return c, sc, cl
+	}
+
+	t.Run("test guest creation", func(t *testing.T) {
+		_, _, cl := newGuest()
+
+		if !cl.Guest {
+			t.Error("Expected the token to be flagged as a guest token")
+		}
+
+		acc, err := mockEnv.DB.Account(ctx, cl.UID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if acc.GuestExpiresAt == nil || time.Until(*acc.GuestExpiresAt) > time.Hour {
+			t.Errorf("Expected the guest account to expire within an hour but got %v", acc.GuestExpiresAt)
+		}
+	})
+
+	t.Run("test guest conversion", func(t *testing.T) {
+		c, sc, cl := newGuest()
+		body := config.RegistrationReqBody{Email: "john.doe@gmail.com", Pass: "password", LastName: "doe"}
+
+		for _, useSession := range []bool{false, true} {
+			cookie := c
+			if useSession {
+				cookie = sc
+			}
+
+			rr := register(t, mockEnv, body, cookie)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("Expected status code %d but got %d", http.StatusOK, rr.Code)
+			}
+
+			nc := cookieByName(rr.Result().Cookies(), "auth_token")
+			if nc == nil {
+				t.Fatal("Expected a new authentication cookie to be set")
+			}
+
+			ncl, err := a.Claims(nc)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if ncl.UID != cl.UID || ncl.Guest {
+				t.Errorf("Expected a regular token of the converted account but got %+v", ncl)
+			}
+
+			acc, err := mockEnv.DB.Account(ctx, cl.UID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if acc.Email != body.Email || acc.GuestExpiresAt != nil {
+				t.Errorf("Expected the guest account to be converted but got %+v", acc)
+			}
+
+			// the second guest logs in with the session cookie and has to use another email
+			c, sc, cl = newGuest()
+			body.Email = "jane.doe@gmail.com"
+		}
+
+		rr := register(t, mockEnv, config.RegistrationReqBody{Email: "john.doe@gmail.com", Pass: "password", LastName: "doe"}, c)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("Expected status code %d when the email is already used but got %d", http.StatusBadRequest, rr.Code)
+		}
+	})
+
+	t.Run("test expired guests are deleted", func(t *testing.T) {
+		mockEnv.GuestLifetime = time.Millisecond
+		_, _, expired := newGuest()
+		mockEnv.GuestLifetime = time.Hour
+		_, _, active := newGuest()
+
+		time.Sleep(time.Millisecond * 5)
+
+		if _, err := mockEnv.DB.DeleteExpiredGuests(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := mockEnv.DB.Account(ctx, expired.UID); err != config.ErrNotFound {
+			t.Errorf("Expected the expired guest account to be deleted but got %v", err)
+		}
+
+		if _, err := mockEnv.DB.Account(ctx, active.UID); err != nil {
+			t.Errorf("Expected the active guest account to be kept but got %v", err)
+		}
+	})
+
+	t.Run("test guests per client are limited", func(t *testing.T) {
+		mockEnv.GuestLimiter = internal.NewRateLimiter(2, time.Hour)
+		defer func() { mockEnv.GuestLimiter = nil }()
+
+		cases := []struct {
+			remoteAddr   string
+			expectedCode int
+		}{
+			{"81.2.69.160:51234", http.StatusCreated},
+			{"81.2.69.160:51235", http.StatusCreated},
+			{"81.2.69.160:51236", http.StatusTooManyRequests},
+			{"81.2.69.161:51234", http.StatusCreated},
+		}
+
+		for _, i := range cases {
+			req := httptest.NewRequest("POST", "/api/guest", nil)
+			req.RemoteAddr = i.remoteAddr
+
+			rr := httptest.NewRecorder()
+			handler.HandleGuest(mockEnv).ServeHTTP(rr, req)
+
+			if rr.Code != i.expectedCode {
+				t.Errorf("Expected status code %d but got %d when remoteAddr=%s", i.expectedCode, rr.Code, i.remoteAddr)
+			}
+		}
+	})
+}
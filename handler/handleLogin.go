@@ -6,13 +6,27 @@ import (
 	"auth-proxy/internal"
 	"log"
 	"net/http"
+	"time"
 
-	"github.com/gorilla/csrf"
 	"golang.org/x/crypto/bcrypt"
 )
 
+const (
+	// maxFailedLogins defines after how many failed logins in a row an account gets locked.
+	maxFailedLogins = 5
+
+	// lockoutDuration defines how long an account stays locked after too many failed logins.
+	lockoutDuration = time.Minute * 15
+)
+
 // HandleLogin handles logins. If either the email or password field are invalid it returns a http.StatusBadRequest (http 400).
-// If the login was successful the handler sets a language cookie and a X-CSRF header.
+// If the login was successful the handler sets a language cookie and a X-CSRF header. If the rememberMe field is set,
+// a persistent session cookie is set as well.
+// Accounts which aren't active are rejected with a http.StatusForbidden (http 403) and an error code.
+// After too many failed logins the account gets locked for a while. If the support staff forced a password reset, the
+// new password has to be specified in the request body's newPass field.
+// When a notifier is configured, logins from unknown devices or networks are reported to the user. Logins which
+// imply an impossible travel since the last login can additionally be required to be verified with a code sent by email.
 func HandleLogin(env *config.Env) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var body config.LoginReqBody
@@ -52,30 +66,113 @@ func HandleLogin(env *config.Env) http.HandlerFunc {
 			return
 		}
 
+		acc, err := env.DB.Account(r.Context(), savedUID)
+		if err != nil {
+			http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		if rejectLocked(w, acc) {
+			return
+		}
+
 		err = bcrypt.CompareHashAndPassword([]byte(savedPass), []byte(body.Pass))
 		if err != nil {
+			if err := env.DB.RecordFailedLogin(r.Context(), savedUID, maxFailedLogins, lockoutDuration); err != nil {
+				log.Println(err)
+			}
+
 			http.Error(w, "You're unauthorized to perform this action", http.StatusUnauthorized)
 			return
 		}
 
-		c, err := env.Auth.CreateAuthCookie(savedUID, config.DefaultExpTime())
+		completeLogin(w, r, env, acc, lang, body.NewPass, body.RememberMe, true)
+	}
+}
+
+// completeLogin logs in the user, who has been identified. It enforces the account's status and a password reset
+// forced by the support staff, with newPass being the new password. When a notifier is configured the login is
+// compared with the user's login history, reported and possibly has to be verified. Otherwise the login cookies
+// are set. Authenticated tells if the user logged in with a password, see session.New.
+func completeLogin(w http.ResponseWriter, r *http.Request, env *config.Env, acc config.Account, lang, newPass string, remember, authenticated bool) {
+	if code, msg := internal.AccountStatusError(acc.Status); code != "" {
+		internal.WriteError(w, http.StatusForbidden, code, msg)
+		return
+	}
+
+	if acc.FailedLogins > 0 {
+		if err := env.DB.ClearLockout(r.Context(), acc.UID); err != nil {
+			log.Println(err)
+		}
+	}
+
+	if acc.PasswordResetRequired {
+		if newPass == "" {
+			internal.WriteError(w, http.StatusForbidden, "password_reset_required", "A new password has to be specified in the newPass field")
+			return
+		}
+
+		err := env.DB.SetPassword(r.Context(), acc.UID, newPass)
 		if err != nil {
-			if err == config.ErrBadRequest {
-				http.Error(w, "No user with the specified credentials exists", http.StatusBadRequest)
-			} else {
+			http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+	}
+
+	if env.Notifier != nil {
+		ev, err := assessLogin(w, r, env, acc.UID, acc.Email)
+		if err != nil {
+			http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		notifyLogin(env, ev)
+
+		if ev.ImpossibleTravel && env.StepUpOnImpossibleTravel {
+			id, err := requireLoginVerification(r.Context(), env, ev, lang, remember, authenticated)
+			if err != nil {
 				http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
 				log.Println(err)
+				return
 			}
 
+			internal.WriteJSON(w, http.StatusUnauthorized, map[string]string{
+				"code":      "login_verification_required",
+				"challenge": id,
+			})
+
 			return
 		}
 
-		http.SetCookie(w, c)
-
-		c = internal.CreateLangCookie(lang)
+		err = env.DB.RecordLogin(r.Context(), ev.Login)
+		if err != nil {
+			http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+	}
 
-		http.SetCookie(w, c)
+	err := issueLoginCookies(w, r, env, acc.UID, lang, remember, authenticated)
+	if err != nil {
+		if err == config.ErrBadRequest {
+			http.Error(w, "No user with the specified credentials exists", http.StatusBadRequest)
+		} else {
+			http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
+			log.Println(err)
+		}
+	}
+}
 
-		w.Header().Set("X-CSRF-Token", csrf.Token(r))
+// rejectLocked rejects the login if the account is locked because of too many failed logins.
+func rejectLocked(w http.ResponseWriter, acc config.Account) bool {
+	if acc.LockedUntil == nil || !time.Now().Before(*acc.LockedUntil) {
+		return false
 	}
+
+	internal.WriteError(w, http.StatusForbidden, "account_locked", "The account is locked because of too many failed logins. Please try again later.")
+
+	return true
 }
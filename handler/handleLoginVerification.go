@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"auth-proxy/config"
+	"auth-proxy/internal"
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"time"
+)
+
+// HandleLoginVerification completes a login which required a verification code. If the challenge doesn't
+// exist, expired or the code's wrong it returns a http.StatusUnauthorized (http 401). Every challenge can only
+// be used once, so a wrong code requires the user to log in again. Accounts which have been locked or aren't
+// active anymore are rejected with a http.StatusForbidden (http 403) and an error code.
+func HandleLoginVerification(env *config.Env) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body config.LoginVerificationReqBody
+
+		err := internal.ParseJSONBody(r.Body, &body)
+		if err != nil {
+			http.Error(w, "Invalid request syntax", http.StatusBadRequest)
+			return
+		}
+
+		if body.Challenge == "" || body.Code == "" {
+			http.Error(w, "Either the challenge or code field haven't been specified", http.StatusBadRequest)
+			return
+		}
+
+		ch, err := env.DB.ConsumeLoginChallenge(r.Context(), body.Challenge)
+		if err != nil {
+			if err == config.ErrNotFound {
+				http.Error(w, "You're unauthorized to perform this action", http.StatusUnauthorized)
+			} else {
+				http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
+				log.Println(err)
+			}
+
+			return
+		}
+
+		if time.Now().After(ch.ExpiresAt) || subtle.ConstantTimeCompare([]byte(ch.CodeHash), []byte(internal.HashToken(body.Code))) != 1 {
+			http.Error(w, "You're unauthorized to perform this action", http.StatusUnauthorized)
+			return
+		}
+
+		// the account may have been disabled or locked since the password was checked
+		acc, err := env.DB.Account(r.Context(), ch.Login.UID)
+		if err != nil {
+			http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		if rejectLocked(w, acc) {
+			return
+		}
+
+		if code, msg := internal.AccountStatusError(acc.Status); code != "" {
+			internal.WriteError(w, http.StatusForbidden, code, msg)
+			return
+		}
+
+		err = env.DB.RecordLogin(r.Context(), ch.Login)
+		if err != nil {
+			http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		err = issueLoginCookies(w, r, env, ch.Login.UID, ch.Lang, ch.RememberMe, ch.Authenticated)
+		if err != nil {
+			http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package handler_test
+
+import (
+	"auth-proxy/config"
+	"auth-proxy/handler"
+	"auth-proxy/mail"
+	"auth-proxy/notify"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+)
+
+type mockLocator map[string]config.Location
+
+func (l mockLocator) Locate(ip net.IP) (config.Location, bool) {
+	loc, ok := l[ip.String()]
+	return loc, ok
+}
+
+var locator = mockLocator{
+	"81.2.69.160": {Region: "GB-London", Lat: 51.5142, Lon: -0.0931},
+	"81.2.69.161": {Region: "GB-London", Lat: 51.5142, Lon: -0.0931},
+	"2001:db8::1": {Region: "US-NewYork", Lat: 40.7128, Lon: -74.0060},
+}
+
+func login(t *testing.T, env *config.Env, remoteAddr string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	t.Helper()
+
+	jsonBody, err := json.Marshal(config.LoginReqBody{Email: "john.doe@gmail.com", Pass: "password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("POST", "/api/login", bytes.NewReader(jsonBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.RemoteAddr = remoteAddr
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+
+	rr := httptest.NewRecorder()
+	handler.HandleLogin(env).ServeHTTP(rr, req)
+
+	return rr
+}
+
+func verify(t *testing.T, env *config.Env, body config.LoginVerificationReqBody) *httptest.ResponseRecorder {
+	t.Helper()
+
+	jsonBody, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("POST", "/api/login/verify", bytes.NewReader(jsonBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler.HandleLoginVerification(env).ServeHTTP(rr, req)
+
+	return rr
+}
+
+func cookieByName(cs []*http.Cookie, name string) *http.Cookie {
+	for _, c := range cs {
+		if c.Name == name {
+			return c
+		}
+	}
+
+	return nil
+}
+
+func nextEvent(t *testing.T, stub *notify.Stub) config.LoginEvent {
+	t.Helper()
+
+	select {
+	case ev := <-stub.Events:
+		return ev
+	case <-time.After(time.Second * 5):
+		t.Fatal("Expected a login notification but got none")
+	}
+
+	return config.LoginEvent{}
+}
+
+func TestLoginNotifications(t *testing.T) {
+	mockEnv := config.NewMockEnv()
+	stub := notify.NewStub(10)
+	mockEnv.Notifier = stub
+	mockEnv.Locator = locator
+
+	err := mockEnv.DB.Register(context.Background(), config.RegistrationReqBody{Email: "john.doe@gmail.com", Pass: "password", LastName: "doe"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := login(t, mockEnv, "81.2.69.160:51234")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d but got %d on the first login", http.StatusOK, rr.Code)
+	}
+
+	device := cookieByName(rr.Result().Cookies(), "device_id")
+	if device == nil {
+		t.Fatal("Expected a device cookie to be set on the first login")
+	}
+
+	// same device and network
+	rr = login(t, mockEnv, "81.2.69.161:51234", device)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d but got %d on a login from a known device", http.StatusOK, rr.Code)
+	}
+
+	// new device in a known network
+	rr = login(t, mockEnv, "81.2.69.160:51234")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d but got %d on a login from a new device", http.StatusOK, rr.Code)
+	}
+
+	ev := nextEvent(t, stub)
+	if !ev.NewDevice || ev.NewNetwork || ev.ImpossibleTravel {
+		t.Errorf("Expected only a new device to be reported but got %+v", ev)
+	}
+
+	if ev.Email != "john.doe@gmail.com" {
+		t.Errorf("Expected the event to be sent to john.doe@gmail.com but got %s", ev.Email)
+	}
+
+	select {
+	case ev := <-stub.Events:
+		t.Errorf("Expected only one notification but got another one: %+v", ev)
+	default:
+	}
+}
+
+func TestLoginVerification(t *testing.T) {
+	mockEnv := config.NewMockEnv()
+	stub := notify.NewStub(10)
+	mailer := new(mail.Memory)
+	mockEnv.Notifier = stub
+	mockEnv.Mailer = mailer
+	mockEnv.Locator = locator
+	mockEnv.StepUpOnImpossibleTravel = true
+
+	err := mockEnv.DB.Register(context.Background(), config.RegistrationReqBody{Email: "john.doe@gmail.com", Pass: "password", LastName: "doe"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := login(t, mockEnv, "81.2.69.160:51234")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d but got %d on the first login", http.StatusOK, rr.Code)
+	}
+
+	device := cookieByName(rr.Result().Cookies(), "device_id")
+
+	challenge := func() string {
+		rr := login(t, mockEnv, "[2001:db8::1]:443", device)
+		if rr.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected status code %d but got %d on an impossible travel", http.StatusUnauthorized, rr.Code)
+		}
+
+		if c := cookieByName(rr.Result().Cookies(), "auth_token"); c != nil {
+			t.Fatal("An authentication cookie was set even though the login has to be verified")
+		}
+
+		var resp map[string]string
+		if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp["code"] != "login_verification_required" || resp["challenge"] == "" {
+			t.Fatalf("Unexpected response body %v", resp)
+		}
+
+		if ev := nextEvent(t, stub); !ev.ImpossibleTravel {
+			t.Errorf("Expected an impossible travel to be reported but got %+v", ev)
+		}
+
+		return resp["challenge"]
+	}
+
+	id := challenge()
+
+	rr = verify(t, mockEnv, config.LoginVerificationReqBody{Challenge: id, Code: "wrong"})
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status code %d but got %d when the code was wrong", http.StatusUnauthorized, rr.Code)
+	}
+
+	id = challenge()
+	// verified after the account was disabled
+	pending := challenge()
+
+	sent := mailer.Sent()
+	if len(sent) != 3 {
+		t.Fatalf("Expected 3 verification mails but got %d", len(sent))
+	}
+
+	code := regexp.MustCompile(`\d{6}`).FindString(sent[1].Body)
+
+	rr = verify(t, mockEnv, config.LoginVerificationReqBody{Challenge: id, Code: code})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d but got %d when the code was correct", http.StatusOK, rr.Code)
+	}
+
+	if n := len(rr.Result().Cookies()); n != 2 {
+		t.Errorf("Expected an authentication and language cookie to be set but got %v", rr.Result().Cookies())
+	}
+
+	rr = verify(t, mockEnv, config.LoginVerificationReqBody{Challenge: id, Code: code})
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status code %d but got %d when the challenge was reused", http.StatusUnauthorized, rr.Code)
+	}
+
+	// the account is disabled while the user is waiting for the code
+	code = regexp.MustCompile(`\d{6}`).FindString(sent[2].Body)
+
+	if err = mockEnv.DB.SetAccountStatus(context.Background(), 1, config.StatusDisabled); err != nil {
+		t.Fatal(err)
+	}
+
+	rr = verify(t, mockEnv, config.LoginVerificationReqBody{Challenge: pending, Code: code})
+	if rr.Code != http.StatusForbidden || cookieByName(rr.Result().Cookies(), "auth_token") != nil {
+		t.Errorf("Expected status code %d without a session but got %d when the account was disabled", http.StatusForbidden, rr.Code)
+	}
+}
@@ -75,3 +75,33 @@ func TestHandleLogin(t *testing.T) {
 		}
 	}
 }
+
+func TestHandleLoginRememberMe(t *testing.T) {
+	mockEnv := config.NewMockEnv()
+
+	err := mockEnv.DB.Register(context.Background(), config.RegistrationReqBody{Email: "john.doe@gmail.com", Pass: "password", LastName: "doe"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	login := handler.HandleLogin(mockEnv)
+
+	rr := serve(t, login, "POST", "/api/login", config.LoginReqBody{Email: "john.doe@gmail.com", Pass: "password", RememberMe: true})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d but got %d", http.StatusOK, rr.Code)
+	}
+
+	c := cookieByName(rr.Result().Cookies(), "session")
+	if c == nil {
+		t.Fatal("Expected a session cookie to be set when the login should be remembered")
+	}
+
+	if c.Expires.IsZero() || !c.HttpOnly || !c.Secure {
+		t.Errorf("Expected a persistent, HttpOnly and Secure session cookie but got %v", c)
+	}
+
+	rr = serve(t, login, "POST", "/api/login", config.LoginReqBody{Email: "john.doe@gmail.com", Pass: "password"})
+	if c := cookieByName(rr.Result().Cookies(), "session"); c != nil {
+		t.Error("Expected no session cookie to be set when the login shouldn't be remembered")
+	}
+}
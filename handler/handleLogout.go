@@ -0,0 +1,35 @@
+package handler
+
+import (
+	"auth-proxy/config"
+	"auth-proxy/session"
+	"log"
+	"net/http"
+	"time"
+)
+
+// HandleLogout ends the remembered session, if there's one, and deletes the authentication and session cookie.
+// It doesn't require a valid authentication token, so that expired logins can be ended as well.
+func HandleLogout(env *config.Env) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if c, err := r.Cookie("session"); err == nil {
+			if err = session.End(r.Context(), env, c.Value); err != nil {
+				http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
+				log.Println(err)
+				return
+			}
+		}
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     "auth_token",
+			Path:     "/api",
+			MaxAge:   -1,
+			HttpOnly: true,
+			Secure:   true,
+			SameSite: http.SameSiteStrictMode,
+		})
+		http.SetCookie(w, session.Cookie("", time.Time{}))
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,45 @@
+package handler_test
+
+import (
+	"auth-proxy/config"
+	"auth-proxy/handler"
+	"auth-proxy/session"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandleLogout(t *testing.T) {
+	ctx := context.Background()
+	mockEnv := config.NewMockEnv()
+
+	_, c, err := session.New(ctx, mockEnv, 1, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("POST", "/api/logout", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.AddCookie(c)
+
+	rr := httptest.NewRecorder()
+	handler.HandleLogout(mockEnv).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("Expected status code %d but got %d", http.StatusNoContent, rr.Code)
+	}
+
+	for _, name := range []string{"auth_token", "session"} {
+		if c := cookieByName(rr.Result().Cookies(), name); c == nil || c.MaxAge >= 0 {
+			t.Errorf("Expected the %s cookie to be deleted", name)
+		}
+	}
+
+	if _, err = session.Resume(ctx, mockEnv, c.Value); err != session.ErrRevoked {
+		t.Errorf("Expected the session to be ended but resuming it returned %v", err)
+	}
+}
@@ -0,0 +1,209 @@
+package handler
+
+import (
+	"auth-proxy/config"
+	"auth-proxy/internal"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// magicLinkLifetime defines how long a magic login link stays valid.
+const magicLinkLifetime = time.Minute * 15
+
+// magicLinkCookie returns the cookie binding a magic link to the browser which requested it.
+// A negative lifetime deletes the cookie.
+func magicLinkCookie(nonce string, lifetime time.Duration) *http.Cookie {
+	c := &http.Cookie{
+		Name:     "magic_link_nonce",
+		Path:     "/api/login/magic-link",
+		Value:    nonce,
+		Expires:  time.Now().Add(lifetime),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	}
+
+	if lifetime < 0 {
+		c.MaxAge = -1
+	}
+
+	return c
+}
+
+// HandleMagicLinkRequest sends a single-use login link to the specified email. The link only works in the
+// browser which requested it. To not reveal which emails are registered, it responds with a
+// http.StatusNoContent (http 204) and sets a nonce cookie even if no active account with the email exists.
+func HandleMagicLinkRequest(env *config.Env) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body config.MagicLinkReqBody
+
+		err := internal.ParseJSONBody(r.Body, &body)
+		if err != nil {
+			http.Error(w, "Invalid request syntax", http.StatusBadRequest)
+			return
+		}
+
+		valid, err := internal.ValidateEmail(body.Email)
+		if err != nil {
+			http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		if !valid {
+			http.Error(w, "Invalid request syntax", http.StatusBadRequest)
+			return
+		}
+
+		// every browser gets a nonce, so that the response doesn't reveal if the email is registered
+		nonce, err := internal.RandomToken(32)
+		if err != nil {
+			http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		acc, err := env.DB.AccountByEmail(r.Context(), body.Email)
+		if err != nil && err != config.ErrNotFound {
+			http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		if err == nil && acc.Status == config.StatusActive {
+			m, err := newMagicLink(r.Context(), env, acc, nonce)
+			if err != nil {
+				http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
+				log.Println(err)
+				return
+			}
+
+			sendMail(env, m)
+		}
+
+		http.SetCookie(w, magicLinkCookie(nonce, magicLinkLifetime))
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// newMagicLink saves a magic link of the account, which only works in the browser with the nonce, and returns the
+// mail containing it.
+func newMagicLink(ctx context.Context, env *config.Env, acc config.Account, nonce string) (config.Mail, error) {
+	token, err := internal.RandomToken(32)
+	if err != nil {
+		return config.Mail{}, err
+	}
+
+	link := config.MagicLink{
+		TokenHash: internal.HashToken(token),
+		NonceHash: internal.HashToken(nonce),
+		UID:       acc.UID,
+		ExpiresAt: time.Now().Add(magicLinkLifetime),
+	}
+
+	err = env.DB.SaveMagicLink(ctx, link)
+	if err != nil {
+		return config.Mail{}, err
+	}
+
+	u, err := url.Parse(env.MagicLinkURL)
+	if err != nil {
+		return config.Mail{}, err
+	}
+
+	q := u.Query()
+	q.Set("token", token)
+	u.RawQuery = q.Encode()
+
+	m := config.Mail{
+		To:      acc.Email,
+		Subject: "Your login link",
+		Body: fmt.Sprintf("Click the following link to log in:\n\n%s\n\n"+
+			"The link expires in %d minutes and only works in the browser you requested it from. "+
+			"If you didn't request it, you can ignore this email.\n",
+			u.String(), int(magicLinkLifetime.Minutes())),
+	}
+
+	return m, nil
+}
+
+// sendMail sends the mail in the background, so that the response time doesn't reveal if a mail has been sent.
+func sendMail(env *config.Env, m config.Mail) {
+	// the mailer is read before the handler returns, since the env may change afterwards
+	mailer := env.Mailer
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+		defer cancel()
+
+		if err := mailer.Send(ctx, m); err != nil {
+			log.Println(err)
+		}
+	}()
+}
+
+// HandleMagicLinkRedeem logs the user in with a token from a magic link. The request has to come from the
+// browser which requested the link. If the token is invalid, expired, already used or the browser doesn't
+// match it returns a http.StatusUnauthorized (http 401). Otherwise the login is handled like the ones of HandleLogin,
+// including their checks and notifications, and a forced password reset requires the newPass field.
+func HandleMagicLinkRedeem(env *config.Env) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body config.MagicLinkRedeemReqBody
+
+		err := internal.ParseJSONBody(r.Body, &body)
+		if err != nil {
+			http.Error(w, "Invalid request syntax", http.StatusBadRequest)
+			return
+		}
+
+		if body.Token == "" {
+			http.Error(w, "The token field hasn't been specified", http.StatusBadRequest)
+			return
+		}
+
+		nonce, err := r.Cookie("magic_link_nonce")
+		if err != nil {
+			http.Error(w, "The login link has to be opened in the browser it was requested from", http.StatusUnauthorized)
+			return
+		}
+
+		link, err := env.DB.ConsumeMagicLink(r.Context(), internal.HashToken(body.Token))
+		if err != nil {
+			if err == config.ErrNotFound {
+				http.Error(w, "You're unauthorized to perform this action", http.StatusUnauthorized)
+			} else {
+				http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
+				log.Println(err)
+			}
+
+			return
+		}
+
+		if time.Now().After(link.ExpiresAt) || subtle.ConstantTimeCompare([]byte(link.NonceHash), []byte(internal.HashToken(nonce.Value))) != 1 {
+			http.Error(w, "You're unauthorized to perform this action", http.StatusUnauthorized)
+			return
+		}
+
+		acc, err := env.DB.Account(r.Context(), link.UID)
+		if err != nil {
+			http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		http.SetCookie(w, magicLinkCookie("", -1))
+
+		if rejectLocked(w, acc) {
+			return
+		}
+
+		// the link only proves access to the email, so trades still require a step-up
+		completeLogin(w, r, env, acc, acc.Lang, body.NewPass, false, false)
+	}
+}
@@ -0,0 +1,189 @@
+package handler_test
+
+import (
+	"auth-proxy/config"
+	"auth-proxy/handler"
+	"auth-proxy/mail"
+	"auth-proxy/notify"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func redeem(t *testing.T, env *config.Env, body config.MagicLinkRedeemReqBody, nonce *http.Cookie) *httptest.ResponseRecorder {
+	t.Helper()
+
+	jsonBody, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("POST", "/api/login/magic-link/redeem", bytes.NewReader(jsonBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if nonce != nil {
+		req.AddCookie(nonce)
+	}
+
+	rr := httptest.NewRecorder()
+	handler.HandleMagicLinkRedeem(env).ServeHTTP(rr, req)
+
+	return rr
+}
+
+// waitForMails returns the mails sent by the mailer once there are n of them, since they're sent in the background.
+func waitForMails(t *testing.T, mailer *mail.Memory, n int) []config.Mail {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second * 5)
+	for len(mailer.Sent()) < n && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 5)
+	}
+
+	sent := mailer.Sent()
+	if len(sent) != n {
+		t.Fatalf("Expected %d mails to be sent but got %d", n, len(sent))
+	}
+
+	return sent
+}
+
+func TestHandleMagicLink(t *testing.T) {
+	mockEnv := config.NewMockEnv()
+	mailer := new(mail.Memory)
+	mockEnv.Mailer = mailer
+	mockEnv.MagicLinkURL = "https://example.com/magic-login"
+
+	err := mockEnv.DB.Register(context.Background(), config.RegistrationReqBody{Email: "john.doe@gmail.com", Pass: "password", LastName: "doe"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := handler.HandleMagicLinkRequest(mockEnv)
+
+	cases := []struct {
+		body         config.MagicLinkReqBody
+		expectedCode int
+	}{
+		{config.MagicLinkReqBody{Email: "john.doe@gmail.com"}, http.StatusNoContent},
+		{config.MagicLinkReqBody{Email: "jane.doe@gmail.com"}, http.StatusNoContent},
+		{config.MagicLinkReqBody{Email: "johndoe"}, http.StatusBadRequest},
+	}
+
+	for _, i := range cases {
+		rr := serve(t, request, "POST", "/api/login/magic-link", i.body)
+		if rr.Code != i.expectedCode {
+			t.Errorf("Expected status code %d but got %d when body=%+v", i.expectedCode, rr.Code, i.body)
+		}
+
+		// unknown emails get a nonce as well, so that they can't be told apart
+		if nonce := cookieByName(rr.Result().Cookies(), "magic_link_nonce"); (nonce != nil) != (rr.Code == http.StatusNoContent) {
+			t.Errorf("Expected a nonce cookie to be set only on success but got %v when body=%+v", nonce, i.body)
+		}
+	}
+
+	waitForMails(t, mailer, 1)
+
+	link := func(body string) string {
+		u, err := url.Parse(regexp.MustCompile(`https://\S+`).FindString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return u.Query().Get("token")
+	}
+
+	rr := serve(t, request, "POST", "/api/login/magic-link", config.MagicLinkReqBody{Email: "john.doe@gmail.com"})
+	nonce := cookieByName(rr.Result().Cookies(), "magic_link_nonce")
+	if nonce == nil {
+		t.Fatal("Expected a nonce cookie to be set")
+	}
+
+	token := link(waitForMails(t, mailer, 2)[1].Body)
+
+	if rr := redeem(t, mockEnv, config.MagicLinkRedeemReqBody{Token: token}, nil); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status code %d but got %d when redeemed in another browser", http.StatusUnauthorized, rr.Code)
+	}
+
+	if rr := redeem(t, mockEnv, config.MagicLinkRedeemReqBody{Token: "wrong-token"}, nonce); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status code %d but got %d when the token was wrong", http.StatusUnauthorized, rr.Code)
+	}
+
+	rr = redeem(t, mockEnv, config.MagicLinkRedeemReqBody{Token: token}, nonce)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d but got %d when redeeming the link", http.StatusOK, rr.Code)
+	}
+
+	cs := rr.Result().Cookies()
+	if cookieByName(cs, "auth_token") == nil || cookieByName(cs, "lang") == nil {
+		t.Errorf("Expected an authentication and language cookie to be set but got %v", cs)
+	}
+
+	if rr := redeem(t, mockEnv, config.MagicLinkRedeemReqBody{Token: token}, nonce); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status code %d but got %d when the link was reused", http.StatusUnauthorized, rr.Code)
+	}
+
+	t.Run("test redeeming goes through the login checks", func(t *testing.T) {
+		ctx := context.Background()
+		mockEnv.Notifier = notify.NewStub(10)
+		defer func() { mockEnv.Notifier = nil }()
+
+		newLink := func() (string, *http.Cookie) {
+			n := len(mailer.Sent())
+			rr := serve(t, request, "POST", "/api/login/magic-link", config.MagicLinkReqBody{Email: "john.doe@gmail.com"})
+
+			return link(waitForMails(t, mailer, n+1)[n].Body), cookieByName(rr.Result().Cookies(), "magic_link_nonce")
+		}
+
+		token, nonce := newLink()
+		rr := redeem(t, mockEnv, config.MagicLinkRedeemReqBody{Token: token}, nonce)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status code %d but got %d when redeeming the link", http.StatusOK, rr.Code)
+		}
+
+		if cookieByName(rr.Result().Cookies(), "device_id") == nil {
+			t.Error("Expected a device cookie to be set")
+		}
+
+		if _, err := mockEnv.DB.LastLogin(ctx, 1); err != nil {
+			t.Errorf("Expected the login to be recorded but got %v", err)
+		}
+
+		if err := mockEnv.DB.ForcePasswordReset(ctx, 1); err != nil {
+			t.Fatal(err)
+		}
+
+		token, nonce = newLink()
+		rr = redeem(t, mockEnv, config.MagicLinkRedeemReqBody{Token: token}, nonce)
+		if rr.Code != http.StatusForbidden || !strings.Contains(rr.Body.String(), "password_reset_required") {
+			t.Errorf("Expected a password reset to be required but got %d %s", rr.Code, rr.Body.String())
+		}
+
+		token, nonce = newLink()
+		rr = redeem(t, mockEnv, config.MagicLinkRedeemReqBody{Token: token, NewPass: "new-password"}, nonce)
+		if rr.Code != http.StatusOK {
+			t.Errorf("Expected status code %d but got %d when resetting the password", http.StatusOK, rr.Code)
+		}
+
+		for i := 0; i < 5; i++ {
+			if err := mockEnv.DB.RecordFailedLogin(ctx, 1, 5, time.Minute); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		token, nonce = newLink()
+		rr = redeem(t, mockEnv, config.MagicLinkRedeemReqBody{Token: token}, nonce)
+		if rr.Code != http.StatusForbidden || !strings.Contains(rr.Body.String(), "account_locked") {
+			t.Errorf("Expected the locked account to be rejected but got %d %s", rr.Code, rr.Body.String())
+		}
+	})
+}
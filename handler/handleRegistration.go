@@ -11,7 +11,8 @@ import (
 
 // HandleRegistration handles the registrations. If either the email, password or last name field is invalid
 // it returns a http.StatusBadRequest (http 400).
-// If successful it sets a X-CSRF header.
+// If successful it sets a X-CSRF header. Guests registering are converted into regular users, keeping their portfolio,
+// and logged in.
 func HandleRegistration(env *config.Env) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var body config.RegistrationReqBody
@@ -40,6 +41,11 @@ func HandleRegistration(env *config.Env) http.HandlerFunc {
 			return
 		}
 
+		if uid, ok := guestAccount(r, env); ok {
+			convertGuest(w, r, env, uid, body)
+			return
+		}
+
 		err = env.DB.Register(r.Context(), body)
 		if err != nil {
 			if err == config.ErrBadRequest {
@@ -0,0 +1,90 @@
+package handler
+
+import (
+	"auth-proxy/config"
+	"auth-proxy/internal"
+	"auth-proxy/share"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// HandleCreateShareLink creates a share link giving read access to the specified paths below /api/users and
+// /api/stocks. The token is only returned once.
+func HandleCreateShareLink(env *config.Env) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body config.ShareLinkReqBody
+
+		err := internal.ParseJSONBody(r.Body, &body)
+		if err != nil {
+			http.Error(w, "Invalid request syntax", http.StatusBadRequest)
+			return
+		}
+
+		cl, _, ok := authenticatedAccount(w, r, env)
+		if !ok {
+			return
+		}
+
+		l, token, err := share.New(r.Context(), env, cl.UID, body.Paths, body.ExpiresAt)
+		if err != nil {
+			if err == share.ErrInvalid {
+				http.Error(w, "The paths have to be below /api/users or /api/stocks and the link has to expire within the next 30 days", http.StatusBadRequest)
+			} else {
+				http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
+				log.Println(err)
+			}
+
+			return
+		}
+
+		internal.WriteJSON(w, http.StatusCreated, struct {
+			config.ShareLink
+			Token string `json:"token"`
+		}{l, token})
+	}
+}
+
+// HandleListShareLinks returns the user's unexpired share links.
+func HandleListShareLinks(env *config.Env) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cl, _, ok := authenticatedAccount(w, r, env)
+		if !ok {
+			return
+		}
+
+		links, err := env.DB.ShareLinks(r.Context(), cl.UID)
+		if err != nil {
+			http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		internal.WriteJSON(w, http.StatusOK, links)
+	}
+}
+
+// HandleRevokeShareLink deletes one of the user's share links.
+func HandleRevokeShareLink(env *config.Env) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cl, _, ok := authenticatedAccount(w, r, env)
+		if !ok {
+			return
+		}
+
+		err := env.DB.DeleteShareLink(r.Context(), cl.UID, mux.Vars(r)["id"])
+		if err != nil {
+			if err == config.ErrNotFound {
+				http.Error(w, "The share link doesn't exist", http.StatusNotFound)
+			} else {
+				http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
+				log.Println(err)
+			}
+
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
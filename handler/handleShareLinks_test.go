@@ -0,0 +1,84 @@
+package handler_test
+
+import (
+	"auth-proxy/config"
+	"auth-proxy/handler"
+	"auth-proxy/share"
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestHandleShareLinks(t *testing.T) {
+	ctx := context.Background()
+	mockEnv := config.NewMockEnv()
+
+	err := mockEnv.DB.Register(ctx, config.RegistrationReqBody{Email: "john.doe@gmail.com", Pass: "password", LastName: "doe"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cl := config.Claims{UID: 1, ExpiresAt: time.Now().Add(time.Minute)}
+
+	r := mux.NewRouter()
+	r.Handle("/share-links", withClaims(handler.HandleCreateShareLink(mockEnv), cl)).Methods("POST")
+	r.Handle("/share-links", withClaims(handler.HandleListShareLinks(mockEnv), cl)).Methods("GET")
+	r.Handle("/share-links/{id}", withClaims(handler.HandleRevokeShareLink(mockEnv), cl)).Methods("DELETE")
+
+	nextWeek := time.Now().Add(time.Hour * 24 * 7)
+
+	cases := []struct {
+		body         config.ShareLinkReqBody
+		expectedCode int
+	}{
+		{config.ShareLinkReqBody{Paths: []string{"/api/admin/users"}, ExpiresAt: nextWeek}, http.StatusBadRequest},
+		{config.ShareLinkReqBody{Paths: []string{"/api/users/portfolio"}}, http.StatusBadRequest},
+		{config.ShareLinkReqBody{Paths: []string{"/api/users/portfolio"}, ExpiresAt: nextWeek}, http.StatusCreated},
+	}
+
+	var created struct {
+		ID    string `json:"id"`
+		Token string `json:"token"`
+	}
+
+	for _, i := range cases {
+		rr := serve(t, r, "POST", "/share-links", i.body)
+		if rr.Code != i.expectedCode {
+			t.Errorf("Expected status code %d but got %d when body=%+v", i.expectedCode, rr.Code, i.body)
+			continue
+		}
+
+		if rr.Code == http.StatusCreated {
+			if err := json.NewDecoder(rr.Body).Decode(&created); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if l, err := share.Resolve(ctx, mockEnv, created.Token); err != nil || l.ID != created.ID {
+		t.Fatalf("Expected the returned token to resolve to the link %s but got %+v and %v", created.ID, l, err)
+	}
+
+	rr := serve(t, r, "GET", "/share-links", nil)
+
+	var links []config.ShareLink
+	if err := json.NewDecoder(rr.Body).Decode(&links); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(links) != 1 || links[0].ID != created.ID {
+		t.Errorf("Expected the created link to be listed but got %+v", links)
+	}
+
+	if rr := serve(t, r, "DELETE", "/share-links/"+created.ID, nil); rr.Code != http.StatusNoContent {
+		t.Errorf("Expected status code %d but got %d", http.StatusNoContent, rr.Code)
+	}
+
+	if _, err := share.Resolve(ctx, mockEnv, created.Token); err != share.ErrRevoked {
+		t.Errorf("Expected the link to be revoked but got %v", err)
+	}
+}
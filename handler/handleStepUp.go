@@ -0,0 +1,195 @@
+package handler
+
+import (
+	"auth-proxy/config"
+	"auth-proxy/internal"
+	"auth-proxy/session"
+	"context"
+	"log"
+	"net/http"
+	"regexp"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// pinPattern defines what a valid trading PIN looks like.
+var pinPattern = regexp.MustCompile(`^[0-9]{4,8}$`)
+
+// errLocked is returned by verifySecret when the account is locked.
+type errLocked struct{}
+
+func (errLocked) Error() string { return "The account is locked" }
+
+// verifySecret compares a secret with its saved bcrypt hash. Wrong secrets count as failed logins, so that
+// they can't be brute-forced. It returns an errLocked if the account's locked.
+func verifySecret(ctx context.Context, env *config.Env, acc config.Account, hash, secret string) (bool, error) {
+	if acc.LockedUntil != nil && time.Now().Before(*acc.LockedUntil) {
+		return false, errLocked{}
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(secret)) != nil {
+		if err := env.DB.RecordFailedLogin(ctx, acc.UID, maxFailedLogins, lockoutDuration); err != nil {
+			return false, err
+		}
+
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// verifyPassword checks the password of the account's user.
+func verifyPassword(ctx context.Context, env *config.Env, acc config.Account, pass string) (bool, error) {
+	_, hash, _, err := env.DB.Login(ctx, config.LoginReqBody{Email: acc.Email, Pass: pass})
+	if err != nil {
+		return false, err
+	}
+
+	return verifySecret(ctx, env, acc, hash, pass)
+}
+
+// writeVerificationError writes the response for a failed password or PIN verification.
+func writeVerificationError(w http.ResponseWriter, ok bool, err error) {
+	switch {
+	case err == errLocked{}:
+		internal.WriteError(w, http.StatusForbidden, "account_locked", "The account is locked because of too many failed logins. Please try again later.")
+	case err != nil:
+		http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
+		log.Println(err)
+	case !ok:
+		http.Error(w, "You're unauthorized to perform this action", http.StatusUnauthorized)
+	}
+}
+
+// authenticatedAccount returns the claims and account of the authenticated user. Impersonation sessions
+// are rejected. If it fails it writes the error response and returns false.
+func authenticatedAccount(w http.ResponseWriter, r *http.Request, env *config.Env) (config.Claims, config.Account, bool) {
+	cl, ok := internal.ClaimsFromContext(r.Context())
+	if !ok {
+		http.Error(w, "You're unauthorized to perform this action", http.StatusUnauthorized)
+		return config.Claims{}, config.Account{}, false
+	}
+
+	if cl.ActorUID != 0 {
+		internal.WriteError(w, http.StatusForbidden, "impersonation_forbidden", "This action isn't allowed while impersonating a user")
+		return config.Claims{}, config.Account{}, false
+	}
+
+	acc, err := env.DB.Account(r.Context(), cl.UID)
+	if err != nil {
+		http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
+		log.Println(err)
+		return config.Claims{}, config.Account{}, false
+	}
+
+	return cl, acc, true
+}
+
+// HandleStepUp re-authenticates an already logged in user with either the password or the trading PIN and
+// replaces the authentication cookie with one carrying the new authentication time. Wrong passwords and
+// PINs count as failed logins.
+func HandleStepUp(env *config.Env) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body config.StepUpReqBody
+
+		err := internal.ParseJSONBody(r.Body, &body)
+		if err != nil {
+			http.Error(w, "Invalid request syntax", http.StatusBadRequest)
+			return
+		}
+
+		if (body.Pass == "") == (body.PIN == "") {
+			http.Error(w, "Either the password or the PIN field has to be specified", http.StatusBadRequest)
+			return
+		}
+
+		cl, acc, ok := authenticatedAccount(w, r, env)
+		if !ok {
+			return
+		}
+
+		if body.Pass != "" {
+			ok, err = verifyPassword(r.Context(), env, acc, body.Pass)
+		} else {
+			var hash string
+
+			hash, err = env.DB.TradingPIN(r.Context(), acc.UID)
+			if err == config.ErrNotFound {
+				internal.WriteError(w, http.StatusBadRequest, "pin_not_set", "No trading PIN has been set")
+				return
+			}
+
+			if err == nil {
+				ok, err = verifySecret(r.Context(), env, acc, hash, body.PIN)
+			}
+		}
+
+		if err != nil || !ok {
+			writeVerificationError(w, ok, err)
+			return
+		}
+
+		if body.Pass != "" {
+			cl.AuthTime = time.Now()
+		} else {
+			cl.PINTime = time.Now()
+		}
+
+		cl, err = session.Refresh(r.Context(), env, cl)
+		if err != nil {
+			http.Error(w, "You're unauthorized to perform this action", http.StatusUnauthorized)
+			return
+		}
+
+		c, err := env.Auth.CreateClaimsCookie(cl)
+		if err != nil {
+			http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		http.SetCookie(w, c)
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// HandleSetTradingPIN sets the user's trading PIN, which has to consist of 4 to 8 digits. Changing it requires
+// the user's password.
+func HandleSetTradingPIN(env *config.Env) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body config.TradingPINReqBody
+
+		err := internal.ParseJSONBody(r.Body, &body)
+		if err != nil {
+			http.Error(w, "Invalid request syntax", http.StatusBadRequest)
+			return
+		}
+
+		if body.Pass == "" || !pinPattern.MatchString(body.PIN) {
+			http.Error(w, "The password has to be specified and the PIN has to consist of 4 to 8 digits", http.StatusBadRequest)
+			return
+		}
+
+		_, acc, ok := authenticatedAccount(w, r, env)
+		if !ok {
+			return
+		}
+
+		ok, err = verifyPassword(r.Context(), env, acc, body.Pass)
+		if err != nil || !ok {
+			writeVerificationError(w, ok, err)
+			return
+		}
+
+		err = env.DB.SetTradingPIN(r.Context(), acc.UID, body.PIN)
+		if err != nil {
+			http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,131 @@
+package handler_test
+
+import (
+	"auth-proxy/auth"
+	"auth-proxy/config"
+	"auth-proxy/handler"
+	"auth-proxy/internal"
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// withClaims returns a handler serving h as if the authMiddleware authenticated the request with the claims.
+func withClaims(h http.Handler, cl config.Claims) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := internal.WithClaims(internal.WithUID(r.Context(), cl.UID), cl)
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func TestHandleStepUp(t *testing.T) {
+	ctx := context.Background()
+	mockEnv := config.NewMockEnv()
+
+	a, err := auth.New("jwt-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mockEnv.Auth = a
+
+	err = mockEnv.DB.Register(ctx, config.RegistrationReqBody{Email: "john.doe@gmail.com", Pass: "password", LastName: "doe"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cl := config.Claims{UID: 1, ExpiresAt: time.Now().Add(time.Minute)}
+	stepUp := withClaims(handler.HandleStepUp(mockEnv), cl)
+	setPIN := withClaims(handler.HandleSetTradingPIN(mockEnv), cl)
+
+	t.Run("test setting the trading pin", func(t *testing.T) {
+		cases := []struct {
+			body         config.TradingPINReqBody
+			expectedCode int
+		}{
+			{config.TradingPINReqBody{Pass: "password", PIN: "12a4"}, http.StatusBadRequest},
+			{config.TradingPINReqBody{Pass: "password", PIN: "123"}, http.StatusBadRequest},
+			{config.TradingPINReqBody{PIN: "1234"}, http.StatusBadRequest},
+			{config.TradingPINReqBody{Pass: "wrong", PIN: "1234"}, http.StatusUnauthorized},
+			{config.TradingPINReqBody{Pass: "password", PIN: "1234"}, http.StatusNoContent},
+		}
+
+		for _, i := range cases {
+			rr := serve(t, setPIN, "POST", "/trading-pin", i.body)
+			if rr.Code != i.expectedCode {
+				t.Errorf("Expected status code %d but got %d when body=%+v", i.expectedCode, rr.Code, i.body)
+			}
+		}
+	})
+
+	t.Run("test step up", func(t *testing.T) {
+		cases := []struct {
+			body         config.StepUpReqBody
+			expectedCode int
+			pin          bool
+		}{
+			{config.StepUpReqBody{}, http.StatusBadRequest, false},
+			{config.StepUpReqBody{Pass: "password", PIN: "1234"}, http.StatusBadRequest, false},
+			{config.StepUpReqBody{Pass: "wrong"}, http.StatusUnauthorized, false},
+			{config.StepUpReqBody{PIN: "4321"}, http.StatusUnauthorized, false},
+			{config.StepUpReqBody{Pass: "password"}, http.StatusNoContent, false},
+			{config.StepUpReqBody{PIN: "1234"}, http.StatusNoContent, true},
+		}
+
+		for _, i := range cases {
+			rr := serve(t, stepUp, "POST", "/step-up", i.body)
+			if rr.Code != i.expectedCode {
+				t.Errorf("Expected status code %d but got %d when body=%+v", i.expectedCode, rr.Code, i.body)
+				continue
+			}
+
+			c := cookieByName(rr.Result().Cookies(), "auth_token")
+			if i.expectedCode != http.StatusNoContent {
+				if c != nil {
+					t.Errorf("An authentication cookie was set even though the step up failed when body=%+v", i.body)
+				}
+
+				continue
+			}
+
+			if c == nil {
+				t.Fatalf("Expected an authentication cookie to be set when body=%+v", i.body)
+			}
+
+			got, err := a.Claims(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if i.pin && (got.PINTime.IsZero() || !got.AuthTime.IsZero()) {
+				t.Errorf("Expected only the PIN time to be set but got %+v", got)
+			}
+
+			if !i.pin && (got.AuthTime.IsZero() || !got.PINTime.IsZero()) {
+				t.Errorf("Expected only the authentication time to be set but got %+v", got)
+			}
+		}
+	})
+
+	t.Run("test wrong secrets lock the account", func(t *testing.T) {
+		for i := 0; i < 5; i++ {
+			serve(t, stepUp, "POST", "/step-up", config.StepUpReqBody{PIN: "0000"})
+		}
+
+		rr := serve(t, stepUp, "POST", "/step-up", config.StepUpReqBody{PIN: "1234"})
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("Expected status code %d but got %d", http.StatusForbidden, rr.Code)
+		}
+	})
+
+	t.Run("test impersonation sessions can't step up", func(t *testing.T) {
+		impersonated := cl
+		impersonated.ActorUID = 2
+
+		rr := serve(t, withClaims(handler.HandleStepUp(mockEnv), impersonated), "POST", "/step-up", config.StepUpReqBody{Pass: "password"})
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("Expected status code %d but got %d", http.StatusForbidden, rr.Code)
+		}
+	})
+}
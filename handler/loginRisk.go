@@ -0,0 +1,199 @@
+package handler
+
+import (
+	"auth-proxy/config"
+	"auth-proxy/geo"
+	"auth-proxy/internal"
+	"auth-proxy/session"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/csrf"
+)
+
+const (
+	// loginChallengeLifetime defines how long a login verification code stays valid.
+	loginChallengeLifetime = time.Minute * 10
+
+	// notifyTimeout defines how long a notifier may take to deliver a notification.
+	notifyTimeout = time.Second * 30
+)
+
+// deviceCookie returns the cookie which identifies a browser across logins.
+func deviceCookie(deviceID string) *http.Cookie {
+	c := &http.Cookie{
+		Name:     "device_id",
+		Path:     "/api",
+		Value:    deviceID,
+		Expires:  time.Now().Add(time.Hour * 24 * 365),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	}
+
+	return c
+}
+
+// assessLogin compares a successful login with the user's login history. If the browser doesn't have
+// a device cookie yet, a new device id is generated and the cookie is set.
+func assessLogin(w http.ResponseWriter, r *http.Request, env *config.Env, uid uint64, email string) (config.LoginEvent, error) {
+	var deviceID string
+
+	c, err := r.Cookie("device_id")
+	if err == nil && c.Value != "" {
+		deviceID = c.Value
+	} else {
+		deviceID, err = internal.RandomToken(16)
+		if err != nil {
+			return config.LoginEvent{}, err
+		}
+
+		http.SetCookie(w, deviceCookie(deviceID))
+	}
+
+	ip := internal.ClientIP(r)
+
+	login := config.LoginRecord{
+		UID:       uid,
+		DeviceID:  deviceID,
+		Network:   internal.Network(ip),
+		UserAgent: r.UserAgent(),
+		At:        time.Now(),
+	}
+
+	if ip != nil {
+		login.IP = ip.String()
+	}
+
+	if env.Locator != nil && ip != nil {
+		if loc, ok := env.Locator.Locate(ip); ok {
+			login.Location = &loc
+		}
+	}
+
+	ev := config.LoginEvent{Email: email, Login: login}
+
+	knownDevice, knownNetwork, err := env.DB.KnownLogin(r.Context(), uid, login.DeviceID, login.Network)
+	if err != nil {
+		return config.LoginEvent{}, err
+	}
+
+	prev, err := env.DB.LastLogin(r.Context(), uid)
+	switch {
+	case err == config.ErrNotFound:
+		// The first login of a user can't be compared with anything so there's nothing to report.
+		return ev, nil
+
+	case err != nil:
+		return config.LoginEvent{}, err
+	}
+
+	ev.Previous = &prev
+	ev.NewDevice = !knownDevice
+	ev.NewNetwork = !knownNetwork
+
+	if prev.Location != nil && login.Location != nil {
+		ev.ImpossibleTravel = geo.ImpossibleTravel(*prev.Location, *login.Location, login.At.Sub(prev.At))
+	}
+
+	return ev, nil
+}
+
+// notifyLogin sends the notification in the background, so that slow notifiers don't delay the login.
+func notifyLogin(env *config.Env, ev config.LoginEvent) {
+	if !ev.NewDevice && !ev.NewNetwork && !ev.ImpossibleTravel {
+		return
+	}
+
+	// the notifier is read before the handler returns, since the env may change afterwards
+	n := env.Notifier
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+		defer cancel()
+
+		if err := n.NotifyLogin(ctx, ev); err != nil {
+			log.Println(err)
+		}
+	}()
+}
+
+// requireLoginVerification saves a login challenge and sends its code to the user's email.
+// It returns the id of the challenge. Since the code only proves access to the email, the verified login is
+// authenticated only if the login itself was.
+func requireLoginVerification(ctx context.Context, env *config.Env, ev config.LoginEvent, lang string, remember, authenticated bool) (string, error) {
+	id, err := internal.RandomToken(16)
+	if err != nil {
+		return "", err
+	}
+
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+
+	code := fmt.Sprintf("%06d", n.Int64())
+
+	ch := config.LoginChallenge{
+		ID:            id,
+		CodeHash:      internal.HashToken(code),
+		Lang:          lang,
+		RememberMe:    remember,
+		Authenticated: authenticated,
+		Login:         ev.Login,
+		ExpiresAt:     time.Now().Add(loginChallengeLifetime),
+	}
+
+	if err = env.DB.SaveLoginChallenge(ctx, ch); err != nil {
+		return "", err
+	}
+
+	m := config.Mail{
+		To:      ev.Email,
+		Subject: "Confirm your login",
+		Body: fmt.Sprintf("Someone tried to log into your account from an unusual location. "+
+			"If this was you, please enter the following code to continue: %s\n\n"+
+			"The code expires in %d minutes. If this wasn't you, please change your password immediately.\n",
+			code, int(loginChallengeLifetime.Minutes())),
+	}
+
+	if err = env.Mailer.Send(ctx, m); err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+// issueLoginCookies starts a new session and sets the authentication and language cookie as well as the X-CSRF header
+// for a user who successfully logged in. If the login should be remembered the session cookie is set as well.
+// Authenticated tells if the user logged in with a password or second factor, see session.New.
+func issueLoginCookies(w http.ResponseWriter, r *http.Request, env *config.Env, uid uint64, lang string, remember, authenticated bool) error {
+	cl, sc, err := session.New(r.Context(), env, uid, remember, authenticated)
+	if err != nil {
+		return err
+	}
+
+	c, err := env.Auth.CreateClaimsCookie(cl)
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, c)
+
+	if sc != nil {
+		http.SetCookie(w, sc)
+	}
+
+	c = internal.CreateLangCookie(lang)
+
+	http.SetCookie(w, c)
+
+	w.Header().Set("X-CSRF-Token", csrf.Token(r))
+
+	return nil
+}
@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"auth-proxy/config"
+	"context"
+	"sync"
+	"time"
+)
+
+type cachedAccount struct {
+	acc     config.Account
+	expires time.Time
+}
+
+// AccountCache caches accounts for a short time, so that checking an account on every request doesn't
+// hit the database every time.
+type AccountCache struct {
+	config.AccountCache
+	db  config.Datastore
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[uint64]cachedAccount
+}
+
+// NewAccountCache returns a new AccountCache which keeps accounts loaded from db for the duration of ttl.
+func NewAccountCache(db config.Datastore, ttl time.Duration) *AccountCache {
+	c := &AccountCache{
+		db:      db,
+		ttl:     ttl,
+		entries: make(map[uint64]cachedAccount),
+	}
+
+	return c
+}
+
+// Account returns the cached account or loads it from the database if it isn't cached or expired.
+// Errors aren't cached.
+func (c *AccountCache) Account(ctx context.Context, uid uint64) (config.Account, error) {
+	now := time.Now()
+
+	c.mu.Lock()
+	e, ok := c.entries[uid]
+	c.mu.Unlock()
+
+	if ok && now.Before(e.expires) {
+		return e.acc, nil
+	}
+
+	acc, err := c.db.Account(ctx, uid)
+	if err != nil {
+		return config.Account{}, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[uid] = cachedAccount{acc: acc, expires: now.Add(c.ttl)}
+
+	// drop expired entries once the cache grows, so that it doesn't keep every user who ever made a request
+	if len(c.entries) > 10000 {
+		for k, v := range c.entries {
+			if now.After(v.expires) {
+				delete(c.entries, k)
+			}
+		}
+	}
+
+	return acc, nil
+}
+
+// Invalidate removes the user's account from the cache.
+func (c *AccountCache) Invalidate(uid uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, uid)
+}
+
+// AccountStatusError returns an error code and message describing why an account with the specified status
+// can't be used. It returns empty strings if the account's active.
+func AccountStatusError(status string) (code string, msg string) {
+	switch status {
+	case config.StatusActive:
+		return "", ""
+	case config.StatusDisabled:
+		return "account_disabled", "The account has been disabled"
+	case config.StatusSuspended:
+		return "account_suspended", "The account has been suspended. Please contact the support."
+	case config.StatusPending:
+		return "account_pending", "The account hasn't been activated yet"
+	default:
+		return "account_inactive", "The account isn't active"
+	}
+}
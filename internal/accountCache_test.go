@@ -0,0 +1,67 @@
+package internal_test
+
+import (
+	"auth-proxy/config"
+	"auth-proxy/internal"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAccountCache(t *testing.T) {
+	ctx := context.Background()
+	env := config.NewMockEnv()
+
+	err := env.DB.Register(ctx, config.RegistrationReqBody{Email: "john@doe.com", Pass: "password", LastName: "doe"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache := internal.NewAccountCache(env.DB, time.Hour)
+
+	acc, err := cache.Account(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if acc.Status != config.StatusActive {
+		t.Fatalf("Expected the account to be active but its status is %s", acc.Status)
+	}
+
+	if err = env.DB.SetAccountStatus(ctx, 1, config.StatusSuspended); err != nil {
+		t.Fatal(err)
+	}
+
+	if acc, _ = cache.Account(ctx, 1); acc.Status != config.StatusActive {
+		t.Error("Expected the cached account to be returned before it expired")
+	}
+
+	cache.Invalidate(1)
+
+	if acc, _ = cache.Account(ctx, 1); acc.Status != config.StatusSuspended {
+		t.Error("Expected the account to be reloaded after it was invalidated")
+	}
+
+	if _, err = cache.Account(ctx, 2); err != config.ErrNotFound {
+		t.Errorf("Expected config.ErrNotFound for an unknown user but got %v", err)
+	}
+}
+
+func TestAccountStatusError(t *testing.T) {
+	cases := []struct {
+		status string
+		code   string
+	}{
+		{config.StatusActive, ""},
+		{config.StatusDisabled, "account_disabled"},
+		{config.StatusSuspended, "account_suspended"},
+		{config.StatusPending, "account_pending"},
+		{"unknown", "account_inactive"},
+	}
+
+	for _, i := range cases {
+		if code, _ := internal.AccountStatusError(i.status); code != i.code {
+			t.Errorf("Expected the code %q but got %q when status=%s", i.code, code, i.status)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxConfirmedBodySize limits the size of request bodies which are read to be confirmed.
+const maxConfirmedBodySize = 1 << 20
+
+// Confirmer issues and checks confirmation tokens. A token is bound to the user, the method, the url and
+// the hash of the request body, so it can only confirm the exact request it was issued for. Tokens can
+// only be used once.
+type Confirmer struct {
+	key []byte
+	ttl time.Duration
+
+	mu   sync.Mutex
+	used map[string]time.Time
+}
+
+// NewConfirmer returns a Confirmer signing tokens with key, which stay valid for ttl.
+func NewConfirmer(key []byte, ttl time.Duration) *Confirmer {
+	return &Confirmer{key: key, ttl: ttl, used: make(map[string]time.Time)}
+}
+
+func (c *Confirmer) sign(uid uint64, r *http.Request, bodyHash string, exp int64) string {
+	mac := hmac.New(sha256.New, c.key)
+	fmt.Fprintf(mac, "%d\n%s\n%s\n%s\n%d", uid, r.Method, r.URL.RequestURI(), bodyHash, exp)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Token returns a token confirming the request of the user with the body hash.
+func (c *Confirmer) Token(uid uint64, r *http.Request, bodyHash string) (string, time.Time) {
+	exp := time.Now().Add(c.ttl)
+
+	return strconv.FormatInt(exp.Unix(), 10) + "." + c.sign(uid, r, bodyHash, exp.Unix()), exp
+}
+
+// Verify reports if the token confirms the request of the user with the body hash and marks it as used.
+func (c *Confirmer) Verify(token string, uid uint64, r *http.Request, bodyHash string) bool {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return false
+	}
+
+	exp, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || time.Now().Unix() >= exp {
+		return false
+	}
+
+	if !hmac.Equal([]byte(parts[1]), []byte(c.sign(uid, r, bodyHash, exp))) {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for t, e := range c.used {
+		if now.After(e) {
+			delete(c.used, t)
+		}
+	}
+
+	if _, ok := c.used[parts[1]]; ok {
+		return false
+	}
+
+	c.used[parts[1]] = time.Unix(exp, 0)
+
+	return true
+}
+
+// RequireConfirmation only passes requests matching one of the rules to h, if they carry a valid token in
+// the X-Confirmation-Token header. Otherwise a http 428 with a new token and the hash of the request body is
+// sent. It has to be used after the authMiddleware.
+func RequireConfirmation(c *Confirmer, rules []RouteRule, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !MatchAny(rules, r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		uid, ok := UIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "You're unauthorized to perform this action", http.StatusUnauthorized)
+			return
+		}
+
+		var body []byte
+		if r.Body != nil {
+			var err error
+
+			body, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxConfirmedBodySize))
+			if err != nil {
+				http.Error(w, "The request body is too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+		}
+
+		sum := sha256.Sum256(body)
+		bodyHash := hex.EncodeToString(sum[:])
+
+		token := r.Header.Get("X-Confirmation-Token")
+		if token == "" || !c.Verify(token, uid, r, bodyHash) {
+			token, exp := c.Token(uid, r, bodyHash)
+
+			WriteJSON(w, http.StatusPreconditionRequired, map[string]interface{}{
+				"code":      "confirmation_required",
+				"message":   "The request has to be confirmed",
+				"bodyHash":  bodyHash,
+				"token":     token,
+				"expiresAt": exp.UTC().Format(time.RFC3339),
+			})
+
+			return
+		}
+
+		r.Header.Del("X-Confirmation-Token")
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+
+		h.ServeHTTP(w, r)
+	})
+}
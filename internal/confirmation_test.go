@@ -0,0 +1,101 @@
+package internal_test
+
+import (
+	"auth-proxy/internal"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequireConfirmation(t *testing.T) {
+	c := internal.NewConfirmer([]byte("key"), time.Minute)
+	rules := []internal.RouteRule{{Methods: []string{"POST"}, Prefix: "/api/stocks/buy"}}
+
+	var forwarded []string
+	h := internal.RequireConfirmation(c, rules, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		forwarded = append(forwarded, string(b))
+
+		if r.Header.Get("X-Confirmation-Token") != "" {
+			t.Error("The confirmation token was forwarded")
+		}
+	}))
+
+	send := func(uid uint64, method, path, body, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r = r.WithContext(internal.WithUID(r.Context(), uid))
+
+		if token != "" {
+			r.Header.Set("X-Confirmation-Token", token)
+		}
+
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, r)
+
+		return rr
+	}
+
+	challenge := func(rr *httptest.ResponseRecorder) string {
+		t.Helper()
+
+		if rr.Code != http.StatusPreconditionRequired {
+			t.Fatalf("Expected status code %d but got %d", http.StatusPreconditionRequired, rr.Code)
+		}
+
+		var body struct {
+			Code  string `json:"code"`
+			Token string `json:"token"`
+		}
+
+		if err := json.NewDecoder(rr.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+
+		if body.Code != "confirmation_required" || body.Token == "" {
+			t.Fatalf("Unexpected challenge %+v", body)
+		}
+
+		return body.Token
+	}
+
+	order := `{"symbol":"ACME","amount":10}`
+
+	if rr := send(1, "GET", "/api/stocks/buy", "", ""); rr.Code != http.StatusOK {
+		t.Errorf("Expected unconfirmed requests not matching a rule to pass but got %d", rr.Code)
+	}
+
+	token := challenge(send(1, "POST", "/api/stocks/buy", order, ""))
+
+	cases := []struct {
+		uid  uint64
+		path string
+		body string
+	}{
+		{1, "/api/stocks/buy", `{"symbol":"ACME","amount":1000}`},
+		{2, "/api/stocks/buy", order},
+		{1, "/api/stocks/buy?account=2", order},
+	}
+
+	for _, i := range cases {
+		challenge(send(i.uid, "POST", i.path, i.body, token))
+	}
+
+	if len(forwarded) != 1 {
+		t.Fatalf("Expected only the GET request to be forwarded but got %d requests", len(forwarded))
+	}
+
+	if rr := send(1, "POST", "/api/stocks/buy", order, token); rr.Code != http.StatusOK {
+		t.Fatalf("Expected the confirmed request to pass but got %d", rr.Code)
+	}
+
+	if forwarded[1] != order {
+		t.Errorf("Expected the body %s to be forwarded but got %s", order, forwarded[1])
+	}
+
+	challenge(send(1, "POST", "/api/stocks/buy", order, token))
+	challenge(send(1, "POST", "/api/stocks/buy", order, "1."+strings.Repeat("0", 64)))
+}
@@ -3,10 +3,19 @@ package internal
 
 import (
 	"auth-proxy/config"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"io"
+	"log"
+	"net"
 	"net/http"
 	"regexp"
+	"strings"
 	"time"
 )
 
@@ -65,3 +74,160 @@ func IsSupportedLang(lang string) bool {
 
 	return false
 }
+
+// WriteJSON encodes v as the response body and sets the specified status code.
+func WriteJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
+
+// WriteError sends an error response containing a machine-readable code and a human-readable message.
+func WriteError(w http.ResponseWriter, status int, code, msg string) {
+	WriteJSON(w, status, map[string]string{"code": code, "message": msg})
+}
+
+type uidKey struct{}
+
+// WithUID returns a copy of ctx which carries the uid of the authenticated user.
+func WithUID(ctx context.Context, uid uint64) context.Context {
+	return context.WithValue(ctx, uidKey{}, uid)
+}
+
+// UIDFromContext returns the uid of the authenticated user saved with WithUID.
+func UIDFromContext(ctx context.Context) (uint64, bool) {
+	uid, ok := ctx.Value(uidKey{}).(uint64)
+	return uid, ok
+}
+
+type roleKey struct{}
+
+// WithRole returns a copy of ctx which carries the role of the authenticated user.
+func WithRole(ctx context.Context, role string) context.Context {
+	return context.WithValue(ctx, roleKey{}, role)
+}
+
+// RoleFromContext returns the role of the authenticated user saved with WithRole.
+func RoleFromContext(ctx context.Context) (string, bool) {
+	role, ok := ctx.Value(roleKey{}).(string)
+	return role, ok
+}
+
+// TrustedProxies are the networks of the load balancers in front of the proxy. Only their X-Forwarded-For
+// headers are trusted. It's set with ParseTrustedProxies.
+var TrustedProxies []*net.IPNet
+
+// ParseTrustedProxies parses a comma separated list of ip addresses and networks like "10.0.0.0/8".
+func ParseTrustedProxies(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", v)
+			}
+
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", v)
+		}
+
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
+
+func trustedProxy(ip net.IP) bool {
+	for _, n := range TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ClientIP returns the ip address of the client which sent the request. If the request comes from one of the
+// TrustedProxies, the X-Forwarded-For header is read from right to left up to the first address which isn't a
+// trusted proxy, since clients can put anything in front of it.
+func ClientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !trustedProxy(ip) {
+		return ip
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+
+		ip = hop
+		if !trustedProxy(ip) {
+			break
+		}
+	}
+
+	return ip
+}
+
+// Network returns the network an ip address belongs to. For IPv4 addresses that's the /24 and
+// for IPv6 addresses the /48 network. It returns an empty string if ip is nil.
+func Network(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		n := net.IPNet{IP: ip4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}
+		return n.String()
+	}
+
+	n := net.IPNet{IP: ip.Mask(net.CIDRMask(48, 128)), Mask: net.CIDRMask(48, 128)}
+	return n.String()
+}
+
+// RandomToken returns a url safe random string containing n random bytes.
+func RandomToken(n int) (string, error) {
+	b := make([]byte, n)
+
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashToken returns the hex encoded SHA-256 hash of a token, so it can be saved without
+// exposing the token itself.
+func HashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+
+	return hex.EncodeToString(h[:])
+}
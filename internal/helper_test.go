@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"reflect"
 	"strings"
@@ -110,3 +111,81 @@ func TestCreateLangCookie(t *testing.T) {
 		}
 	}
 }
+
+func TestClientIPAndNetwork(t *testing.T) {
+	cases := []struct {
+		remoteAddr string
+		network    string
+	}{
+		{"81.2.69.160:51234", "81.2.69.0/24"},
+		{"[2001:db8:1234:5678::1]:443", "2001:db8:1234::/48"},
+		{"81.2.69.160", "81.2.69.0/24"},
+		{"invalid", ""},
+	}
+
+	for _, i := range cases {
+		r := &http.Request{RemoteAddr: i.remoteAddr}
+
+		if n := internal.Network(internal.ClientIP(r)); n != i.network {
+			t.Errorf("Expected the network %q but got %q when remoteAddr=%s", i.network, n, i.remoteAddr)
+		}
+	}
+}
+
+func TestClientIPBehindTrustedProxies(t *testing.T) {
+	nets, err := internal.ParseTrustedProxies("10.0.0.0/8, 192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	internal.TrustedProxies = nets
+	defer func() { internal.TrustedProxies = nil }()
+
+	cases := []struct {
+		remoteAddr string
+		forwarded  string
+		ip         string
+	}{
+		{"10.1.2.3:80", "81.2.69.160", "81.2.69.160"},
+		{"10.1.2.3:80", "1.1.1.1, 81.2.69.160, 192.0.2.1", "81.2.69.160"},
+		{"10.1.2.3:80", "", "10.1.2.3"},
+		{"10.1.2.3:80", "garbage, 81.2.69.160", "81.2.69.160"},
+		{"10.1.2.3:80", "81.2.69.160, garbage", "10.1.2.3"},
+		{"81.2.69.160:80", "1.1.1.1", "81.2.69.160"},
+	}
+
+	for _, i := range cases {
+		r := &http.Request{RemoteAddr: i.remoteAddr, Header: http.Header{}}
+		if i.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", i.forwarded)
+		}
+
+		if ip := internal.ClientIP(r).String(); ip != i.ip {
+			t.Errorf("Expected the ip %s but got %s when remoteAddr=%s, X-Forwarded-For=%s", i.ip, ip, i.remoteAddr, i.forwarded)
+		}
+	}
+
+	if _, err := internal.ParseTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Error("Expected an invalid network to be rejected")
+	}
+}
+
+func TestRandomToken(t *testing.T) {
+	a, err := internal.RandomToken(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := internal.RandomToken(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a == b {
+		t.Error("Two random tokens were equal")
+	}
+
+	if internal.HashToken(a) == a {
+		t.Error("The hashed token equals the token itself")
+	}
+}
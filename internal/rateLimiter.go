@@ -0,0 +1,64 @@
+package internal
+
+import (
+	"auth-proxy/config"
+	"sync"
+	"time"
+)
+
+type rateWindow struct {
+	start time.Time
+	n     int
+}
+
+// RateLimiter allows every key a maximum number of actions per fixed time window.
+type RateLimiter struct {
+	config.Limiter
+	max    int
+	window time.Duration
+
+	mu      sync.Mutex
+	windows map[string]*rateWindow
+}
+
+// NewRateLimiter returns a new RateLimiter which allows max actions per key within every window.
+func NewRateLimiter(max int, window time.Duration) *RateLimiter {
+	l := &RateLimiter{
+		max:     max,
+		window:  window,
+		windows: make(map[string]*rateWindow),
+	}
+
+	return l
+}
+
+// Allow reports if the key may take another action and counts it if so.
+func (l *RateLimiter) Allow(key string) bool {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	w, ok := l.windows[key]
+	if !ok || !now.Before(w.start.Add(l.window)) {
+		// drop ended windows once the limiter grows, so that it doesn't keep every key it ever saw
+		if len(l.windows) > 10000 {
+			for k, v := range l.windows {
+				if !now.Before(v.start.Add(l.window)) {
+					delete(l.windows, k)
+				}
+			}
+		}
+
+		w = &rateWindow{start: now}
+		l.windows[key] = w
+	}
+
+	if w.n >= l.max {
+		return false
+	}
+
+	w.n++
+
+	return true
+}
@@ -0,0 +1,27 @@
+package internal_test
+
+import (
+	"auth-proxy/internal"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := internal.NewRateLimiter(2, time.Millisecond*50)
+
+	for i, expected := range []bool{true, true, false} {
+		if allowed := l.Allow("81.2.69.160"); allowed != expected {
+			t.Errorf("Expected action %d to be allowed=%t but got %t", i+1, expected, allowed)
+		}
+	}
+
+	if !l.Allow("81.2.69.161") {
+		t.Error("Expected another key to have its own limit")
+	}
+
+	time.Sleep(time.Millisecond * 60)
+
+	if !l.Allow("81.2.69.160") {
+		t.Error("Expected the limit to be reset once the window ended")
+	}
+}
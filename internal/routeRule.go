@@ -0,0 +1,59 @@
+package internal
+
+import (
+	"net/http"
+	"strings"
+)
+
+// RouteRule matches requests by their method and path prefix.
+type RouteRule struct {
+	// Methods the rule applies to. If it's empty, the rule applies to all methods.
+	Methods []string
+	// Prefix the path has to start with. It only matches whole path segments, so "/api/stocks"
+	// matches "/api/stocks/buy" but not "/api/stocksearch".
+	Prefix string
+}
+
+// Matches reports if the request matches the rule.
+func (rule RouteRule) Matches(r *http.Request) bool {
+	if len(rule.Methods) > 0 {
+		found := false
+
+		for _, m := range rule.Methods {
+			if strings.EqualFold(m, r.Method) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	p := r.URL.Path
+	prefix := strings.TrimSuffix(rule.Prefix, "/")
+
+	return p == prefix || strings.HasPrefix(p, prefix+"/")
+}
+
+// MatchAny reports if the request matches at least one of the rules.
+func MatchAny(rules []RouteRule, r *http.Request) bool {
+	for _, rule := range rules {
+		if rule.Matches(r) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsSafeMethod reports if the method is one that doesn't change any data according to RFC 7231.
+func IsSafeMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	default:
+		return false
+	}
+}
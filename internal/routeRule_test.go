@@ -0,0 +1,32 @@
+package internal_test
+
+import (
+	"auth-proxy/internal"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRouteRule(t *testing.T) {
+	cases := []struct {
+		rule    internal.RouteRule
+		method  string
+		path    string
+		matches bool
+	}{
+		{internal.RouteRule{Prefix: "/api/stocks"}, "GET", "/api/stocks", true},
+		{internal.RouteRule{Prefix: "/api/stocks"}, "GET", "/api/stocks/buy", true},
+		{internal.RouteRule{Prefix: "/api/stocks/"}, "GET", "/api/stocks/buy", true},
+		{internal.RouteRule{Prefix: "/api/stocks"}, "GET", "/api/stocksearch", false},
+		{internal.RouteRule{Methods: []string{"POST"}, Prefix: "/api/stocks"}, "POST", "/api/stocks/buy", true},
+		{internal.RouteRule{Methods: []string{"post"}, Prefix: "/api/stocks"}, "POST", "/api/stocks/buy", true},
+		{internal.RouteRule{Methods: []string{"POST"}, Prefix: "/api/stocks"}, "GET", "/api/stocks/buy", false},
+	}
+
+	for _, i := range cases {
+		r := httptest.NewRequest(i.method, i.path, nil)
+
+		if i.rule.Matches(r) != i.matches {
+			t.Errorf("Expected matches to be %v when rule=%+v, method=%s and path=%s", i.matches, i.rule, i.method, i.path)
+		}
+	}
+}
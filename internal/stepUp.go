@@ -0,0 +1,65 @@
+package internal
+
+import (
+	"auth-proxy/config"
+	"context"
+	"net/http"
+	"time"
+)
+
+// StepUpRule requires requests matching the route rule to be made shortly after the user authenticated.
+type StepUpRule struct {
+	RouteRule
+	// MaxAge defines how long ago the last authentication may have happened.
+	MaxAge time.Duration
+	// AllowPIN lets the trading PIN satisfy the rule instead of the password.
+	AllowPIN bool
+}
+
+// Satisfied reports if the claims contain a recent enough authentication.
+func (rule StepUpRule) Satisfied(cl config.Claims) bool {
+	if !cl.AuthTime.IsZero() && time.Since(cl.AuthTime) <= rule.MaxAge {
+		return true
+	}
+
+	return rule.AllowPIN && !cl.PINTime.IsZero() && time.Since(cl.PINTime) <= rule.MaxAge
+}
+
+// UnsatisfiedStepUp returns the first rule matching the request which isn't satisfied by the claims.
+func UnsatisfiedStepUp(rules []StepUpRule, r *http.Request, cl config.Claims) (StepUpRule, bool) {
+	for _, rule := range rules {
+		if rule.Matches(r) && !rule.Satisfied(cl) {
+			return rule, true
+		}
+	}
+
+	return StepUpRule{}, false
+}
+
+// WriteStepUpRequired sends the machine-readable error telling the client which authentication satisfies the rule.
+func WriteStepUpRequired(w http.ResponseWriter, rule StepUpRule) {
+	methods := []string{"password"}
+	if rule.AllowPIN {
+		methods = append(methods, "pin")
+	}
+
+	WriteJSON(w, http.StatusUnauthorized, map[string]interface{}{
+		"code":    "step_up_required",
+		"message": "This action requires a recent authentication",
+		"maxAge":  int(rule.MaxAge.Seconds()),
+		"methods": methods,
+	})
+}
+
+type claimsKey struct{}
+
+// WithClaims returns a copy of ctx which carries the claims of the request's authentication token.
+func WithClaims(ctx context.Context, cl config.Claims) context.Context {
+	return context.WithValue(ctx, claimsKey{}, cl)
+}
+
+// ClaimsFromContext returns the claims saved with WithClaims.
+func ClaimsFromContext(ctx context.Context) (config.Claims, bool) {
+	cl, ok := ctx.Value(claimsKey{}).(config.Claims)
+	return cl, ok
+}
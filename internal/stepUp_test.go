@@ -0,0 +1,42 @@
+package internal_test
+
+import (
+	"auth-proxy/config"
+	"auth-proxy/internal"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStepUpRule(t *testing.T) {
+	rules := []internal.StepUpRule{
+		{RouteRule: internal.RouteRule{Methods: []string{"POST"}, Prefix: "/api/stocks"}, MaxAge: time.Minute * 5, AllowPIN: true},
+		{RouteRule: internal.RouteRule{Prefix: "/api/users/password"}, MaxAge: time.Minute * 5},
+	}
+
+	now := time.Now()
+	old := now.Add(-time.Hour)
+
+	cases := []struct {
+		method    string
+		path      string
+		cl        config.Claims
+		satisfied bool
+	}{
+		{"GET", "/api/stocks/quote", config.Claims{AuthTime: old}, true},
+		{"POST", "/api/stocks/buy", config.Claims{AuthTime: now}, true},
+		{"POST", "/api/stocks/buy", config.Claims{AuthTime: old}, false},
+		{"POST", "/api/stocks/buy", config.Claims{AuthTime: old, PINTime: now}, true},
+		{"POST", "/api/stocks/buy", config.Claims{}, false},
+		{"POST", "/api/users/password", config.Claims{AuthTime: old, PINTime: now}, false},
+		{"POST", "/api/users/password", config.Claims{AuthTime: now}, true},
+	}
+
+	for _, i := range cases {
+		r := httptest.NewRequest(i.method, i.path, nil)
+
+		if _, unsatisfied := internal.UnsatisfiedStepUp(rules, r, i.cl); unsatisfied == i.satisfied {
+			t.Errorf("Expected satisfied to be %v when method=%s, path=%s and claims=%+v", i.satisfied, i.method, i.path, i.cl)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+// Package mail provides implementations of the config.Mailer interface.
+package mail
+
+import (
+	"auth-proxy/config"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/smtp"
+	"sync"
+)
+
+// SMTP sends mails through an SMTP server.
+type SMTP struct {
+	config.Mailer
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+// NewSMTP returns a new SMTP mailer which sends mails from the specified address using the server at addr.
+// If user is empty no authentication is used.
+func NewSMTP(addr, from, user, pass, host string) (*SMTP, error) {
+	if addr == "" {
+		return nil, errors.New("The SMTP server address can't be an empty string")
+	}
+
+	if from == "" {
+		return nil, errors.New("The sender address can't be an empty string")
+	}
+
+	m := &SMTP{addr: addr, from: from}
+
+	if user != "" {
+		m.auth = smtp.PlainAuth("", user, pass, host)
+	}
+
+	return m, nil
+}
+
+// Send sends the mail. The context is only checked before the mail gets sent since net/smtp
+// doesn't support cancellation.
+func (m *SMTP) Send(ctx context.Context, msg config.Mail) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", m.from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=\"utf-8\"\r\n\r\n")
+	b.WriteString(msg.Body)
+
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{msg.To}, b.Bytes())
+}
+
+// Memory keeps all sent mails in memory. It's meant to be used in tests.
+type Memory struct {
+	config.Mailer
+	mu   sync.Mutex
+	sent []config.Mail
+}
+
+// Send saves the mail.
+func (m *Memory) Send(ctx context.Context, msg config.Mail) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sent = append(m.sent, msg)
+
+	return nil
+}
+
+// Sent returns all mails sent so far.
+func (m *Memory) Sent() []config.Mail {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sent := make([]config.Mail, len(m.sent))
+	copy(sent, m.sent)
+
+	return sent
+}
@@ -3,25 +3,66 @@ package main
 import (
 	"auth-proxy/auth"
 	"auth-proxy/config"
-	"auth-proxy/handler"
+	"auth-proxy/geo"
 	"auth-proxy/internal"
+	"auth-proxy/mail"
 	"auth-proxy/models"
+	"auth-proxy/notify"
+	"auth-proxy/proxy"
+	"context"
+	"crypto/sha256"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
-	"github.com/gorilla/csrf"
-	"github.com/gorilla/mux"
-
 	_ "github.com/lib/pq"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
+// accountCacheTTL defines how long the account checked on every request is cached. Changes made by another
+// instance of the proxy take at most this long to be enforced.
+const accountCacheTTL = time.Second * 5
+
+// guestCollectionInterval defines how often expired guest accounts are deleted.
+const guestCollectionInterval = time.Hour
+
+// defaultGuestsPerClient defines how many guest accounts a client can create per guestLimitWindow by default.
+const defaultGuestsPerClient = 5
+
+// guestLimitWindow defines the window in which the guest accounts created by a client are counted.
+const guestLimitWindow = time.Hour
+
+// confirmationTTL defines how long a client has to confirm an order.
+const confirmationTTL = time.Minute * 2
+
+// routesPollInterval defines how often the route configuration file is checked for changes.
+const routesPollInterval = time.Second * 2
+
+// versionUsageLogInterval defines how often the usage of the API versions is logged.
+const versionUsageLogInterval = time.Hour
+
+// Default timeouts of the server. The write timeout has to be longer than the timeouts of the routes.
+const (
+	defaultReadHeaderTimeout = time.Second * 5
+	defaultReadTimeout       = time.Second * 30
+	defaultWriteTimeout      = time.Second * 60
+	defaultIdleTimeout       = time.Second * 120
+)
+
+// defaultAPITimeout defines how long the endpoints handled by the proxy itself, including their database
+// queries, may take by default.
+const defaultAPITimeout = time.Second * 10
+
 var (
 	jwtKey   = os.Getenv("JWT_KEY")
 	csrfKey  = os.Getenv("CSRF_KEY")
@@ -32,10 +73,45 @@ var (
 	dbHost   = os.Getenv("DB_HOST")
 	sptLangs = os.Getenv("SUPPORTED_LANGUAGES")
 
-	env *config.Env
+	smtpAddr   = os.Getenv("SMTP_ADDR")
+	smtpFrom   = os.Getenv("SMTP_FROM")
+	smtpUser   = os.Getenv("SMTP_USER")
+	smtpPass   = os.Getenv("SMTP_PASSWORD")
+	webhookURL = os.Getenv("NOTIFY_WEBHOOK_URL")
+	geoIPDB    = os.Getenv("GEOIP_DB")
+	stepUp     = os.Getenv("STEP_UP_ON_IMPOSSIBLE_TRAVEL") == "true"
+
+	magicLinkURL = os.Getenv("MAGIC_LINK_URL")
+
+	confirmationKey = os.Getenv("CONFIRMATION_KEY")
+
+	routesFile = os.Getenv("ROUTES_FILE")
+
+	shareLinkKey = os.Getenv("SHARE_LINK_KEY")
+
+	guestLifetime   = os.Getenv("GUEST_LIFETIME")
+	guestRoutes     = os.Getenv("GUEST_ROUTES")
+	guestsPerClient = os.Getenv("GUESTS_PER_CLIENT")
+
+	rememberFor        = os.Getenv("REMEMBER_ME_DURATION")
+	sessionMaxLifetime = os.Getenv("SESSION_MAX_LIFETIME")
+
+	readHeaderTimeout = os.Getenv("SERVER_READ_HEADER_TIMEOUT")
+	readTimeout       = os.Getenv("SERVER_READ_TIMEOUT")
+	writeTimeout      = os.Getenv("SERVER_WRITE_TIMEOUT")
+	idleTimeout       = os.Getenv("SERVER_IDLE_TIMEOUT")
+	apiTimeoutVar     = os.Getenv("API_TIMEOUT")
+
+	trustedProxies = os.Getenv("TRUSTED_PROXIES")
+
+	apiTimeout time.Duration
+
+	env       *config.Env
+	confirmer *internal.Confirmer
 )
 
-func init() {
+// checkEnv checks the environment variables and applies the ones configuring other packages.
+func checkEnv() {
 	if jwtKey == "" {
 		log.Fatal("No environment variable named JWT_KEY present")
 	}
@@ -64,14 +140,39 @@ func init() {
 		dbHost = "localhost"
 	}
 
+	if routesFile == "" {
+		routesFile = "routes.yaml"
+	}
+
 	if sptLangs == "" {
 		config.SupportedLangs = []string{"en"}
 	}
 
 	config.SupportedLangs = strings.Split(sptLangs, ",")
+
+	nets, err := internal.ParseTrustedProxies(trustedProxies)
+	if err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
+
+	internal.TrustedProxies = nets
+
+	if stepUp && smtpAddr == "" {
+		log.Fatal("STEP_UP_ON_IMPOSSIBLE_TRAVEL requires the environment variable SMTP_ADDR to be present")
+	}
+
+	if magicLinkURL != "" && smtpAddr == "" {
+		log.Fatal("MAGIC_LINK_URL requires the environment variable SMTP_ADDR to be present")
+	}
+
+	if stepUp && geoIPDB == "" {
+		log.Fatal("STEP_UP_ON_IMPOSSIBLE_TRAVEL requires the environment variable GEOIP_DB to be present")
+	}
 }
 
 func main() {
+	checkEnv()
+
 	connStr := fmt.Sprintf("port=%s user=%s password=%s dbname=%s host=%s sslmode=disable", dbPort, dbUser, dbPass, dbName, dbHost)
 	db, err := models.New(connStr)
 	if err != nil {
@@ -85,163 +186,216 @@ func main() {
 		log.Fatal(err)
 	}
 
-	env = &config.Env{DB: db, Auth: auth}
-
-	usersProxy, err := routeReverseProxy("user_service:8081", "user_service")
-	if err != nil {
-		log.Panic(err)
+	env = &config.Env{
+		DB:                       db,
+		Auth:                     auth,
+		Accounts:                 internal.NewAccountCache(db, accountCacheTTL),
+		Sessions:                 sessionPolicy(),
+		MagicLinkURL:             magicLinkURL,
+		StepUpOnImpossibleTravel: stepUp,
 	}
 
-	newsProxy, err := routeReverseProxy("news_service:8083", "news_service")
+	err = setupNotifications(env)
 	if err != nil {
-		log.Panic(err)
+		log.Fatal(err)
 	}
 
-	stockProxy, err := routeReverseProxy("stock_service:8082", "stock_service")
+	setupGuests(env)
+
+	env.ShareLinkKey = signingKey(shareLinkKey, "share link")
+
+	confirmer = internal.NewConfirmer(signingKey(confirmationKey, "confirmation"), confirmationTTL)
+
+	apiTimeout = parseTimeout("API_TIMEOUT", apiTimeoutVar, defaultAPITimeout)
+
+	reloader, err := proxy.NewReloader(routesFile, buildRouter)
 	if err != nil {
-		log.Panic(err)
+		log.Fatal(err)
 	}
 
-	csrfMiddleware := csrf.Protect(
-		[]byte(csrfKey),
-	)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 
-	r := mux.NewRouter()
-	r.Use(csrfMiddleware)
+	go reloader.ReloadOn(hup)
+	go reloader.Watch(routesPollInterval, nil)
+	go logVersionUsage(versionUsageLogInterval)
+
+	fmt.Println("The auth proxy is ready")
+	log.Panic(newServer(":9000", reloader).ListenAndServe())
+}
 
-	api := r.PathPrefix("/api").Subrouter()
+// newServer returns the server listening on addr with the timeouts based on the environment variables. Streams
+// of routes which allow them aren't bound by the timeouts. Besides HTTP/1.1, it accepts HTTP/2 without TLS, so
+// that gRPC clients can connect.
+func newServer(addr string, h http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           h2c.NewHandler(h, &http2.Server{}),
+		ConnContext:       proxy.ConnContext,
+		ReadHeaderTimeout: parseTimeout("SERVER_READ_HEADER_TIMEOUT", readHeaderTimeout, defaultReadHeaderTimeout),
+		ReadTimeout:       parseTimeout("SERVER_READ_TIMEOUT", readTimeout, defaultReadTimeout),
+		WriteTimeout:      parseTimeout("SERVER_WRITE_TIMEOUT", writeTimeout, defaultWriteTimeout),
+		IdleTimeout:       parseTimeout("SERVER_IDLE_TIMEOUT", idleTimeout, defaultIdleTimeout),
+	}
+}
 
-	api.HandleFunc("/get-csrf-token", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("X-CSRF-Token", csrf.Token(r))
-	}).Methods("GET")
+// signingKey returns the key set in an environment variable. If it's empty, a key is derived from the JWT key with
+// the label, so that a token signed for one purpose can't be passed off as one signed for another.
+func signingKey(key, label string) []byte {
+	if key != "" {
+		return []byte(key)
+	}
 
-	api.Handle("/check-credentials", authMiddleware(func() http.HandlerFunc {
-		return func(w http.ResponseWriter, r *http.Request) {}
-	}())).Methods("GET")
+	derived := make([]byte, 32)
 
-	api.Handle("/login", handler.HandleLogin(env)).Methods("POST")
-	api.Handle("/register", handler.HandleRegistration(env)).Methods("POST")
+	_, err := io.ReadFull(hkdf.New(sha256.New, []byte(jwtKey), nil, []byte("auth-proxy "+label)), derived)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	apiUsers := api.PathPrefix("/users").Subrouter()
-	apiUsers.Use(authMiddleware)
-	apiUsers.NewRoute().Handler(usersProxy)
+	return derived
+}
 
-	apiNews := api.PathPrefix("/news").Subrouter()
-	apiNews.Use(authMiddleware)
-	apiNews.NewRoute().Handler(newsProxy)
+// parseTimeout parses the value of the environment variable name. An empty value returns the default and 0
+// disables the timeout.
+func parseTimeout(name, value string, def time.Duration) time.Duration {
+	if value == "" {
+		return def
+	}
 
-	apiStocks := api.PathPrefix("/stocks").Subrouter()
-	apiStocks.Use(authMiddleware)
-	apiStocks.NewRoute().Handler(stockProxy)
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		log.Fatalf("Invalid %s: %q", name, value)
+	}
 
-	fmt.Println("The auth proxy is ready")
-	log.Panic(http.ListenAndServe(":9000", r))
+	return d
 }
 
-func routeReverseProxy(host, servicePath string) (*httputil.ReverseProxy, error) {
-	serviceURL, err := url.Parse(servicePath)
-	if err != nil {
-		return nil, err
+// sessionPolicy returns the session policy based on the environment variables. Missing values default to
+// the ones of config.DefaultSessionPolicy.
+func sessionPolicy() config.SessionPolicy {
+	p := config.DefaultSessionPolicy()
+
+	if rememberFor != "" {
+		d, err := time.ParseDuration(rememberFor)
+		if err != nil {
+			log.Fatalf("Invalid REMEMBER_ME_DURATION: %v", err)
+		}
+
+		p.RememberFor = d
 	}
 
-	proxy := httputil.NewSingleHostReverseProxy(serviceURL)
+	if sessionMaxLifetime != "" {
+		d, err := time.ParseDuration(sessionMaxLifetime)
+		if err != nil {
+			log.Fatalf("Invalid SESSION_MAX_LIFETIME: %v", err)
+		}
 
-	origin, err := url.Parse("http_server")
-	if err != nil {
-		return nil, err
+		p.MaxLifetime = d
+	}
+
+	return p
+}
+
+// setupGuests enables guest accounts if GUEST_LIFETIME is set, limits how many a client can create and starts
+// deleting the expired ones.
+func setupGuests(env *config.Env) {
+	if guestLifetime == "" {
+		return
 	}
 
-	director := func(r *http.Request) {
-		r.Header.Add("X-Forwarded-Host", r.Host)
-		r.Header.Add("X-Origin-Host", origin.Host)
-		r.URL.Scheme = "http"
-		r.URL.Host = host
+	d, err := time.ParseDuration(guestLifetime)
+	if err != nil || d <= 0 {
+		log.Fatalf("Invalid GUEST_LIFETIME: %q", guestLifetime)
 	}
-	proxy.Director = director
 
-	modifyResp := func(resp *http.Response) error {
-		r := resp.Request
+	env.GuestLifetime = d
 
-		if r.Method == "POST" {
-			resp.Header.Set("X-CSRF-Token", csrf.Token(r))
+	max := defaultGuestsPerClient
+	if guestsPerClient != "" {
+		max, err = strconv.Atoi(guestsPerClient)
+		if err != nil || max <= 0 {
+			log.Fatalf("Invalid GUESTS_PER_CLIENT: %q", guestsPerClient)
 		}
-
-		return nil
 	}
-	proxy.ModifyResponse = modifyResp
 
-	return proxy, nil
+	env.GuestLimiter = internal.NewRateLimiter(max, guestLimitWindow)
+
+	go collectGuests(env.DB, guestCollectionInterval)
 }
 
-func authMiddleware(h http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		c, err := r.Cookie("auth_token")
+// collectGuests deletes the expired guest accounts every interval.
+func collectGuests(db config.Datastore, interval time.Duration) {
+	for range time.Tick(interval) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		n, err := db.DeleteExpiredGuests(ctx)
+		cancel()
+
 		if err != nil {
-			if err == http.ErrNoCookie {
-				http.Error(w, "The request didn't include an authentication token", http.StatusUnauthorized)
-			} else {
-				http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
-				log.Println(err)
-			}
-
-			return
+			log.Println(err)
+			continue
 		}
 
-		err = env.Auth.ValidateAuthCookie(c)
-		if err != nil {
-			http.Error(w, "The specified authentication token's invalid", http.StatusBadRequest)
-			return
+		if n > 0 {
+			log.Printf("guests: deleted %d expired guest accounts", n)
 		}
+	}
+}
+
+// logVersionUsage logs the usage of the API versions every interval.
+func logVersionUsage(interval time.Duration) {
+	for range time.Tick(interval) {
+		proxy.LogVersionUsage()
+	}
+}
 
-		uid, err := env.Auth.UID(c)
+// setupNotifications configures the mailer, notifiers and ip locator based on the environment variables.
+// Without any notifier no login history is kept.
+func setupNotifications(env *config.Env) error {
+	var notifiers notify.Multi
+
+	if smtpAddr != "" {
+		host, _, err := net.SplitHostPort(smtpAddr)
 		if err != nil {
-			http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
-			log.Println(err)
-			return
+			return err
 		}
 
-		expiresAt, err := env.Auth.ExpiresAt(c)
+		mailer, err := mail.NewSMTP(smtpAddr, smtpFrom, smtpUser, smtpPass, host)
 		if err != nil {
-			http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
-			log.Println(err)
-			return
+			return err
 		}
 
-		// refresh the token if it's about to expire
-		if time.Until(expiresAt) < time.Second*30 {
-			c, err = env.Auth.CreateAuthCookie(uid, config.DefaultExpTime())
-			if err != nil {
-				http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
-				log.Println(err)
-				return
-			}
+		env.Mailer = mailer
 
-			http.SetCookie(w, c)
+		n, err := notify.NewEmail(mailer)
+		if err != nil {
+			return err
 		}
 
-		c, err = r.Cookie("lang")
+		notifiers = append(notifiers, n)
+	}
+
+	if webhookURL != "" {
+		n, err := notify.NewWebhook(webhookURL)
 		if err != nil {
-			if err == http.ErrNoCookie {
-				c = internal.CreateLangCookie("en")
-
-				http.SetCookie(w, c)
-			} else {
-				http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
-				log.Println(err)
-				return
-			}
+			return err
 		}
 
-		lang := c.Value
+		notifiers = append(notifiers, n)
+	}
+
+	if len(notifiers) > 0 {
+		env.Notifier = notifiers
+	}
 
-		if !internal.IsSupportedLang(lang) {
-			http.Error(w, "The specified language isn't a supported language", http.StatusBadRequest)
-			return
+	if geoIPDB != "" {
+		locator, err := geo.Open(geoIPDB)
+		if err != nil {
+			return err
 		}
 
-		r.Header.Add("UID", strconv.FormatUint(uid, 10))
-		r.Header.Add("Lang", lang)
+		env.Locator = locator
+	}
 
-		h.ServeHTTP(w, r)
-	})
+	return nil
 }
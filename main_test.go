@@ -0,0 +1,27 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSigningKey(t *testing.T) {
+	jwtKey = "jwt-key"
+
+	confirmation := signingKey("", "confirmation")
+	if bytes.Equal(confirmation, []byte(jwtKey)) || len(confirmation) != 32 {
+		t.Errorf("Expected a derived key of 32 bytes but got %x", confirmation)
+	}
+
+	if again := signingKey("", "confirmation"); !bytes.Equal(confirmation, again) {
+		t.Error("Expected the same key to be derived for the same label")
+	}
+
+	if shareLink := signingKey("", "share link"); bytes.Equal(confirmation, shareLink) {
+		t.Error("Expected different keys to be derived for different labels")
+	}
+
+	if key := signingKey("confirmation-key", "confirmation"); string(key) != "confirmation-key" {
+		t.Errorf("Expected the configured key to be used but got %q", key)
+	}
+}
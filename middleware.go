@@ -0,0 +1,434 @@
+package main
+
+import (
+	"auth-proxy/config"
+	"auth-proxy/internal"
+	"auth-proxy/proxy"
+	"auth-proxy/session"
+	"auth-proxy/share"
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/csrf"
+)
+
+// account returns the user's account from the account cache, or from the DB if there's no cache.
+func account(ctx context.Context, uid uint64) (config.Account, error) {
+	if env.Accounts == nil {
+		return env.DB.Account(ctx, uid)
+	}
+
+	return env.Accounts.Account(ctx, uid)
+}
+
+// sessionRevoked reports if a token issued at issuedAt has been revoked. Since tokens only store the issue time
+// in seconds, tokens issued within the same second as the revocation are treated as revoked as well.
+func sessionRevoked(acc config.Account, issuedAt time.Time) bool {
+	if acc.SessionsRevokedAt == nil {
+		return false
+	}
+
+	return !issuedAt.After(acc.SessionsRevokedAt.Truncate(time.Second))
+}
+
+// impersonationBlocked defines requests which can't be made while impersonating a user, even if the
+// impersonation session allows writes.
+var impersonationBlocked = []internal.RouteRule{
+	{Methods: []string{"POST", "PUT", "PATCH", "DELETE"}, Prefix: "/api/stocks"},
+	{Methods: []string{"POST", "PUT", "PATCH", "DELETE"}, Prefix: "/api/users/password"},
+	{Methods: []string{"POST", "PUT", "PATCH", "DELETE"}, Prefix: "/api/users/email"},
+	{Prefix: "/api/admin"},
+	{Prefix: "/api/step-up"},
+	{Prefix: "/api/trading-pin"},
+	{Prefix: "/api/grants"},
+	{Prefix: "/api/share-links"},
+}
+
+// delegationBlocked defines requests which can't be made on behalf of another user, regardless of the grant's scope.
+var delegationBlocked = []internal.RouteRule{
+	{Methods: []string{"POST", "PUT", "PATCH", "DELETE"}, Prefix: "/api/users/password"},
+	{Methods: []string{"POST", "PUT", "PATCH", "DELETE"}, Prefix: "/api/users/email"},
+	{Prefix: "/api/admin"},
+	{Prefix: "/api/grants"},
+	{Prefix: "/api/share-links"},
+	{Prefix: "/api/step-up"},
+	{Prefix: "/api/trading-pin"},
+}
+
+// delegationTrades defines the requests besides safe ones which grants with the trade scope allow.
+var delegationTrades = []internal.RouteRule{
+	{Methods: []string{"POST", "PUT", "PATCH", "DELETE"}, Prefix: "/api/stocks"},
+}
+
+// allowDelegation checks if the user may make the request on behalf of the user with the uid specified in the
+// X-Act-As header and returns that uid. If the request isn't allowed it writes the error response and returns false.
+func allowDelegation(w http.ResponseWriter, r *http.Request, cl config.Claims) (uint64, bool) {
+	principal, err := strconv.ParseUint(r.Header.Get("X-Act-As"), 10, 64)
+	if err != nil {
+		http.Error(w, "The X-Act-As header has to contain a uid", http.StatusBadRequest)
+		return 0, false
+	}
+
+	if cl.ActorUID != 0 || cl.Guest {
+		internal.WriteError(w, http.StatusForbidden, "delegation_forbidden", "You can't act on behalf of other users")
+		return 0, false
+	}
+
+	g, err := env.DB.ActiveGrant(r.Context(), principal, cl.UID)
+	if err != nil {
+		if err == config.ErrNotFound {
+			internal.WriteError(w, http.StatusForbidden, "delegation_forbidden", "You haven't been granted access to this account")
+		} else {
+			http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
+			log.Println(err)
+		}
+
+		return 0, false
+	}
+
+	acc, err := account(r.Context(), principal)
+	if err != nil {
+		http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
+		log.Println(err)
+		return 0, false
+	}
+
+	if code, msg := internal.AccountStatusError(acc.Status); code != "" {
+		internal.WriteError(w, http.StatusForbidden, code, msg)
+		return 0, false
+	}
+
+	allowed := internal.IsSafeMethod(r.Method) || (g.Scope == config.ScopeTrade && internal.MatchAny(delegationTrades, r))
+	if !allowed || internal.MatchAny(delegationBlocked, r) {
+		log.Printf("delegation: user %d as user %d was denied %s %s", cl.UID, principal, r.Method, r.URL.Path)
+		internal.WriteError(w, http.StatusForbidden, "delegation_forbidden", "The grant doesn't allow this action")
+		return 0, false
+	}
+
+	log.Printf("delegation: user %d as user %d %s %s", cl.UID, principal, r.Method, r.URL.Path)
+
+	return principal, true
+}
+
+// allowImpersonation checks if the request of an impersonation session may pass and logs it. The acting admin
+// has to still be an active admin. If the request isn't allowed it writes the error response and returns false.
+func allowImpersonation(w http.ResponseWriter, r *http.Request, cl config.Claims) bool {
+	actor, err := account(r.Context(), cl.ActorUID)
+	if err != nil && err != config.ErrNotFound {
+		http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
+		log.Println(err)
+		return false
+	}
+
+	if err == config.ErrNotFound || actor.Role != config.RoleAdmin || actor.Status != config.StatusActive || sessionRevoked(actor, cl.IssuedAt) {
+		internal.WriteError(w, http.StatusUnauthorized, "session_revoked", "The impersonation session is no longer valid")
+		return false
+	}
+
+	if (cl.ReadOnly && !internal.IsSafeMethod(r.Method)) || internal.MatchAny(impersonationBlocked, r) {
+		log.Printf("impersonation: admin %d as user %d was denied %s %s", cl.ActorUID, cl.UID, r.Method, r.URL.Path)
+		internal.WriteError(w, http.StatusForbidden, "impersonation_forbidden", "This action isn't allowed while impersonating a user")
+		return false
+	}
+
+	log.Printf("impersonation: admin %d as user %d %s %s", cl.ActorUID, cl.UID, r.Method, r.URL.Path)
+
+	return true
+}
+
+// writeSessionError writes the response for an error returned by the session package.
+func writeSessionError(w http.ResponseWriter, err error) {
+	switch err {
+	case session.ErrExpired:
+		internal.WriteError(w, http.StatusUnauthorized, "session_expired", "The session expired. Please log in again.")
+	case session.ErrRevoked:
+		internal.WriteError(w, http.StatusUnauthorized, "session_revoked", "The session has been revoked. Please log in again.")
+	default:
+		http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
+		log.Println(err)
+	}
+}
+
+// authenticate returns the claims of the request's authentication token. If the token is missing or invalid
+// but the request carries the cookie of a remembered session, the session is resumed and resumed is set.
+// If the request can't be authenticated it writes the error response and returns false.
+func authenticate(w http.ResponseWriter, r *http.Request) (cl config.Claims, resumed bool, ok bool) {
+	c, err := r.Cookie("auth_token")
+	if err == nil && env.Auth.ValidateAuthCookie(c) == nil {
+		cl, err = env.Auth.Claims(c)
+		if err != nil {
+			http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
+			log.Println(err)
+			return config.Claims{}, false, false
+		}
+
+		return cl, false, true
+	}
+
+	if sc, serr := r.Cookie("session"); serr == nil {
+		cl, serr = session.Resume(r.Context(), env, sc.Value)
+		if serr != nil {
+			writeSessionError(w, serr)
+			return config.Claims{}, false, false
+		}
+
+		return cl, true, true
+	}
+
+	switch {
+	case err == http.ErrNoCookie:
+		http.Error(w, "The request didn't include an authentication token", http.StatusUnauthorized)
+	case err != nil:
+		http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
+		log.Println(err)
+	default:
+		http.Error(w, "The specified authentication token's invalid", http.StatusBadRequest)
+	}
+
+	return config.Claims{}, false, false
+}
+
+// serveShared serves a read-only request authenticated with the token of a share link. The proxied services
+// receive the uid of the link's owner and the link's id in the Share-Link-ID header.
+func serveShared(w http.ResponseWriter, r *http.Request, h http.Handler, token string) {
+	l, err := share.Resolve(r.Context(), env, token)
+	if err != nil {
+		switch err {
+		case share.ErrInvalid:
+			internal.WriteError(w, http.StatusUnauthorized, "share_link_invalid", "The share link is invalid")
+		case share.ErrExpired:
+			internal.WriteError(w, http.StatusUnauthorized, "share_link_expired", "The share link expired")
+		case share.ErrRevoked:
+			internal.WriteError(w, http.StatusUnauthorized, "share_link_revoked", "The share link has been revoked")
+		default:
+			http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
+			log.Println(err)
+		}
+
+		return
+	}
+
+	acc, err := account(r.Context(), l.UID)
+	if err != nil {
+		http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if code, msg := internal.AccountStatusError(acc.Status); code != "" {
+		internal.WriteError(w, http.StatusForbidden, code, msg)
+		return
+	}
+
+	if !share.Allows(l, r) {
+		internal.WriteError(w, http.StatusForbidden, "share_link_forbidden", "The share link doesn't give access to this resource")
+		return
+	}
+
+	q := r.URL.Query()
+	q.Del("share")
+	r.URL.RawQuery = q.Encode()
+
+	// the visitor's own credentials must not reach the proxied services
+	r.Header.Del("X-Share-Token")
+	r.Header.Del("Cookie")
+	r.Header.Del("Impersonator-UID")
+	r.Header.Del("Guest")
+	r.Header.Del("Actor-UID")
+
+	r.Header.Set("UID", strconv.FormatUint(l.UID, 10))
+	r.Header.Set("Lang", acc.Lang)
+	r.Header.Set("Share-Link-ID", l.ID)
+
+	ctx := withStreamCheck(internal.WithUID(r.Context(), l.UID), shareCheck(token))
+
+	h.ServeHTTP(w, r.WithContext(ctx))
+}
+
+func (p *policy) authMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token := share.Token(r); token != "" {
+			serveShared(w, r, h, token)
+			return
+		}
+
+		cl, resumed, ok := authenticate(w, r)
+		if !ok {
+			return
+		}
+
+		uid := cl.UID
+		issuedAt := cl.IssuedAt
+
+		acc, err := account(r.Context(), uid)
+		if err != nil {
+			if err == config.ErrNotFound {
+				http.Error(w, "The specified authentication token's invalid", http.StatusBadRequest)
+			} else {
+				http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
+				log.Println(err)
+			}
+
+			return
+		}
+
+		if sessionRevoked(acc, cl.IssuedAt) {
+			internal.WriteError(w, http.StatusUnauthorized, "session_revoked", "The session has been revoked. Please log in again.")
+			return
+		}
+
+		if code, msg := internal.AccountStatusError(acc.Status); code != "" {
+			internal.WriteError(w, http.StatusForbidden, code, msg)
+			return
+		}
+
+		if cl.ActorUID != 0 && !allowImpersonation(w, r, cl) {
+			return
+		}
+
+		// the account decides, so that converted guests lose the restrictions immediately
+		cl.Guest = acc.GuestExpiresAt != nil
+
+		if cl.Guest && !internal.MatchAny(p.guests, r) {
+			internal.WriteError(w, http.StatusForbidden, "guest_forbidden", "This action requires a registered account")
+			return
+		}
+
+		if r.Header.Get("X-Act-As") != "" {
+			uid, ok = allowDelegation(w, r, cl)
+			if !ok {
+				return
+			}
+		}
+
+		// guests trade in a sandbox and have no credentials to step up with
+		if rule, ok := internal.UnsatisfiedStepUp(p.stepUp, r, cl); ok && !cl.Guest {
+			internal.WriteStepUpRequired(w, rule)
+			return
+		}
+
+		// refresh the token if it's about to expire
+		if resumed || time.Until(cl.ExpiresAt) < time.Second*30 {
+			cl, err = session.Refresh(r.Context(), env, cl)
+			if err != nil {
+				writeSessionError(w, err)
+				return
+			}
+
+			c, err := env.Auth.CreateClaimsCookie(cl)
+			if err != nil {
+				http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
+				log.Println(err)
+				return
+			}
+
+			http.SetCookie(w, c)
+		}
+
+		c, err := r.Cookie("lang")
+		if err != nil {
+			if err == http.ErrNoCookie {
+				c = internal.CreateLangCookie("en")
+
+				http.SetCookie(w, c)
+			} else {
+				http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
+				log.Println(err)
+				return
+			}
+		}
+
+		lang := c.Value
+
+		if !internal.IsSupportedLang(lang) {
+			http.Error(w, "The specified language isn't a supported language", http.StatusBadRequest)
+			return
+		}
+
+		// Set instead of Add, so that clients can't smuggle in their own identity. gRPC services receive the
+		// headers as the metadata uid, lang, etc., since HTTP/2 sends header names in lowercase.
+		r.Header.Set("UID", strconv.FormatUint(uid, 10))
+		r.Header.Set("Lang", lang)
+		r.Header.Del("Impersonator-UID")
+		r.Header.Del("Guest")
+		r.Header.Del("Actor-UID")
+		r.Header.Del("X-Act-As")
+		r.Header.Del("Share-Link-ID")
+
+		if cl.ActorUID != 0 {
+			r.Header.Set("Impersonator-UID", strconv.FormatUint(cl.ActorUID, 10))
+		}
+
+		if cl.Guest {
+			r.Header.Set("Guest", "true")
+		}
+
+		if uid != cl.UID {
+			r.Header.Set("Actor-UID", strconv.FormatUint(cl.UID, 10))
+		}
+
+		ctx := internal.WithClaims(internal.WithUID(r.Context(), uid), cl)
+		ctx = internal.WithRole(ctx, acc.Role)
+		ctx = withStreamCheck(ctx, sessionCheck(cl, issuedAt, uid))
+
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// grpcMiddleware exempts gRPC calls from the csrf check. Browsers can't send them across sites without a CORS
+// preflight, since application/grpc isn't a content type forms can have. It has to be used before the csrf
+// middleware.
+func grpcMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if proxy.IsGRPC(r) {
+			r = csrf.UnsafeSkipCheck(r)
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// adminMiddleware only lets users with the admin role pass. It has to be used after the authMiddleware.
+func adminMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uid, ok := internal.UIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "You're unauthorized to perform this action", http.StatusUnauthorized)
+			return
+		}
+
+		acc, err := account(r.Context(), uid)
+		if err != nil {
+			http.Error(w, "An unexpected error occured. Please try again later.", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		if acc.Role != config.RoleAdmin {
+			http.Error(w, "You're unauthorized to perform this action", http.StatusForbidden)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// timeoutMiddleware cancels the request's context after d, so that the database queries and upstream requests made
+// while handling it give up. A zero d disables the timeout.
+func timeoutMiddleware(d time.Duration) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		if d <= 0 {
+			return h
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), d)
+			defer cancel()
+
+			h.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
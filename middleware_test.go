@@ -0,0 +1,376 @@
+package main
+
+import (
+	"auth-proxy/auth"
+	"auth-proxy/config"
+	"auth-proxy/handler"
+	"auth-proxy/internal"
+	"auth-proxy/proxy"
+	"auth-proxy/session"
+	"auth-proxy/share"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+)
+
+// upstreamHeaders are the identity headers the proxied services receive.
+var upstreamHeaders = []string{"UID", "Lang", "Impersonator-UID", "Guest", "Actor-UID", "X-Act-As", "Share-Link-ID"}
+
+// setupEnv sets the env used by the middleware to a mock env with the users:
+// 1 user, 2 admin, 3 disabled, 4 user, 5 guest, 6 read grant of 1, 7 trade grant of 1
+func setupEnv(t *testing.T) {
+	ctx := context.Background()
+	env = config.NewMockEnv()
+	config.SupportedLangs = []string{"en"}
+
+	a, err := auth.New("jwt-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env.Auth = a
+
+	for _, email := range []string{"john.doe@gmail.com", "admin@gmail.com", "disabled@gmail.com", "revoked@gmail.com"} {
+		err = env.DB.Register(ctx, config.RegistrationReqBody{Email: email, Pass: "password", LastName: "doe"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	config.MockSetRole(env, 2, config.RoleAdmin)
+
+	if err = env.DB.SetAccountStatus(ctx, 3, config.StatusDisabled); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = env.DB.CreateGuest(ctx, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, g := range []config.Grant{{ID: "read", GranteeUID: 6, Scope: config.ScopeRead}, {ID: "trade", GranteeUID: 7, Scope: config.ScopeTrade}} {
+		err = env.DB.Register(ctx, config.RegistrationReqBody{Email: g.ID + "@gmail.com", Pass: "password", LastName: "doe"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		g.GrantorUID = 1
+		g.ExpiresAt = time.Now().Add(time.Hour)
+
+		if err = env.DB.CreateGrant(ctx, g); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// claims returns the claims of a user who just logged in.
+func claims(uid uint64) *config.Claims {
+	return &config.Claims{UID: uid, AuthTime: time.Now(), ExpiresAt: time.Now().Add(time.Minute * 4)}
+}
+
+// echo returns a handler responding with the identity headers it received.
+func echo() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, name := range upstreamHeaders {
+			if v := r.Header.Get(name); v != "" {
+				w.Header().Set(name, v)
+			}
+		}
+	})
+}
+
+func serveAs(t *testing.T, h http.Handler, method, url string, cl *config.Claims, headers map[string]string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(method, url, nil)
+
+	if cl != nil {
+		c, err := env.Auth.CreateClaimsCookie(*cl)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.AddCookie(c)
+	}
+
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	return rr
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	setupEnv(t)
+
+	ctx := context.Background()
+	h := newPolicy(&proxy.Config{}).authMiddleware(echo())
+
+	impersonated := claims(1)
+	impersonated.ActorUID = 2
+
+	readOnly := claims(1)
+	readOnly.ActorUID = 2
+	readOnly.ReadOnly = true
+
+	byUser := claims(1)
+	byUser.ActorUID = 6
+
+	stale := claims(1)
+	stale.AuthTime = time.Now().Add(-time.Hour)
+
+	revoked, err := env.Auth.CreateClaimsCookie(*claims(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = env.DB.RevokeSessions(ctx, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	_, rememberMe, err := session.New(ctx, env, 1, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	link, token, err := share.New(ctx, env, 1, []string{"/api/stocks"}, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, disabledToken, err := share.New(ctx, env, 3, []string{"/api/stocks"}, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spoofed := map[string]string{"UID": "2", "Impersonator-UID": "2", "Guest": "true", "Actor-UID": "2", "Share-Link-ID": "link"}
+
+	cases := []struct {
+		name         string
+		method       string
+		url          string
+		cl           *config.Claims
+		headers      map[string]string
+		cookies      []*http.Cookie
+		expectedCode int
+		// expectedHeaders are the identity headers the upstream receives, missing ones mustn't be received at all
+		expectedHeaders map[string]string
+	}{
+		{"no token", "GET", "/api/news", nil, nil, nil, http.StatusUnauthorized, nil},
+		{"invalid token", "GET", "/api/news", nil, nil, []*http.Cookie{{Name: "auth_token", Value: "invalid"}}, http.StatusBadRequest, nil},
+		{"unknown user", "GET", "/api/news", claims(42), nil, nil, http.StatusBadRequest, nil},
+		{"user", "GET", "/api/news", claims(1), nil, nil, http.StatusOK, map[string]string{"UID": "1", "Lang": "en"}},
+		{"spoofed identity", "GET", "/api/news", claims(1), spoofed, nil, http.StatusOK, map[string]string{"UID": "1", "Lang": "en"}},
+		{"unsupported lang", "GET", "/api/news", claims(1), nil, []*http.Cookie{{Name: "lang", Value: "xx"}}, http.StatusBadRequest, nil},
+		{"disabled account", "GET", "/api/news", claims(3), nil, nil, http.StatusForbidden, nil},
+		{"revoked session", "GET", "/api/news", nil, nil, []*http.Cookie{revoked}, http.StatusUnauthorized, nil},
+		{"resumed session", "GET", "/api/news", nil, nil, []*http.Cookie{rememberMe}, http.StatusOK, map[string]string{"UID": "1", "Lang": "en"}},
+		{"revoked remembered session", "GET", "/api/news", nil, nil, []*http.Cookie{session.Cookie("revoked", time.Now().Add(time.Hour))}, http.StatusUnauthorized, nil},
+		{"impersonation", "GET", "/api/news", impersonated, spoofed, nil, http.StatusOK, map[string]string{"UID": "1", "Lang": "en", "Impersonator-UID": "2"}},
+		{"impersonation by a user", "GET", "/api/news", byUser, nil, nil, http.StatusUnauthorized, nil},
+		{"read-only impersonation writing", "POST", "/api/news", readOnly, nil, nil, http.StatusForbidden, nil},
+		{"impersonation of a blocked route", "GET", "/api/admin/users", impersonated, nil, nil, http.StatusForbidden, nil},
+		{"guest", "GET", "/api/news", claims(5), nil, nil, http.StatusOK, map[string]string{"UID": "5", "Lang": "en", "Guest": "true"}},
+		{"guest on a registered route", "GET", "/api/users", claims(5), nil, nil, http.StatusForbidden, nil},
+		{"guest without step-up", "POST", "/api/stocks/buy", claims(5), nil, nil, http.StatusOK, map[string]string{"UID": "5", "Lang": "en", "Guest": "true"}},
+		{"guest delegation", "GET", "/api/news", claims(5), map[string]string{"X-Act-As": "1"}, nil, http.StatusForbidden, nil},
+		{"step-up satisfied", "POST", "/api/stocks/buy", claims(1), nil, nil, http.StatusOK, map[string]string{"UID": "1", "Lang": "en"}},
+		{"step-up required", "POST", "/api/stocks/buy", stale, nil, nil, http.StatusUnauthorized, nil},
+		{"delegation", "GET", "/api/stocks", claims(6), map[string]string{"X-Act-As": "1"}, nil, http.StatusOK, map[string]string{"UID": "1", "Lang": "en", "Actor-UID": "6"}},
+		{"delegation without a uid", "GET", "/api/stocks", claims(6), map[string]string{"X-Act-As": "john"}, nil, http.StatusBadRequest, nil},
+		{"delegation without a grant", "GET", "/api/stocks", claims(7), map[string]string{"X-Act-As": "2"}, nil, http.StatusForbidden, nil},
+		{"delegated trade with the read scope", "POST", "/api/stocks/buy", claims(6), map[string]string{"X-Act-As": "1"}, nil, http.StatusForbidden, nil},
+		{"delegated trade", "POST", "/api/stocks/buy", claims(7), map[string]string{"X-Act-As": "1"}, nil, http.StatusOK, map[string]string{"UID": "1", "Lang": "en", "Actor-UID": "7"}},
+		{"delegation of a blocked route", "GET", "/api/grants", claims(7), map[string]string{"X-Act-As": "1"}, nil, http.StatusForbidden, nil},
+		{"share link", "GET", "/api/stocks?share=" + token, nil, spoofed, nil, http.StatusOK, map[string]string{"UID": "1", "Lang": "en", "Share-Link-ID": link.ID}},
+		{"share link header", "GET", "/api/stocks/AAPL", claims(2), map[string]string{"X-Share-Token": token}, nil, http.StatusOK, map[string]string{"UID": "1", "Lang": "en", "Share-Link-ID": link.ID}},
+		{"share link of another path", "GET", "/api/users?share=" + token, nil, nil, nil, http.StatusForbidden, nil},
+		{"share link writing", "POST", "/api/stocks?share=" + token, nil, nil, nil, http.StatusForbidden, nil},
+		{"share link of a disabled account", "GET", "/api/stocks?share=" + disabledToken, nil, nil, nil, http.StatusForbidden, nil},
+		{"invalid share link", "GET", "/api/stocks?share=" + token + "x", nil, nil, nil, http.StatusUnauthorized, nil},
+	}
+
+	for _, i := range cases {
+		rr := serveAs(t, h, i.method, i.url, i.cl, i.headers, i.cookies...)
+		if rr.Code != i.expectedCode {
+			t.Errorf("%s: Expected status code %d but got %d: %s", i.name, i.expectedCode, rr.Code, rr.Body.String())
+			continue
+		}
+
+		if rr.Code != http.StatusOK {
+			continue
+		}
+
+		for _, name := range upstreamHeaders {
+			if v := rr.Header().Get(name); v != i.expectedHeaders[name] {
+				t.Errorf("%s: Expected the upstream to receive %s=%q but got %q", i.name, name, i.expectedHeaders[name], v)
+			}
+		}
+	}
+
+	t.Run("test refreshing the token of a resumed session", func(t *testing.T) {
+		rr := serveAs(t, h, "GET", "/api/news", nil, nil, rememberMe)
+
+		var refreshed bool
+		for _, c := range rr.Result().Cookies() {
+			refreshed = refreshed || (c.Name == "auth_token" && env.Auth.ValidateAuthCookie(c) == nil)
+		}
+
+		if !refreshed {
+			t.Error("Expected a new authentication token when resuming a session")
+		}
+	})
+}
+
+func TestMagicLinkStepUp(t *testing.T) {
+	setupEnv(t)
+
+	link := config.MagicLink{
+		TokenHash: internal.HashToken("token"),
+		NonceHash: internal.HashToken("nonce"),
+		UID:       1,
+		ExpiresAt: time.Now().Add(time.Minute),
+	}
+
+	if err := env.DB.SaveMagicLink(context.Background(), link); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("POST", "/api/login/magic-link/redeem", strings.NewReader(`{"token": "token"}`))
+	req.AddCookie(&http.Cookie{Name: "magic_link_nonce", Value: "nonce"})
+
+	rr := httptest.NewRecorder()
+	handler.HandleMagicLinkRedeem(env).ServeHTTP(rr, req)
+
+	var token *http.Cookie
+	for _, c := range rr.Result().Cookies() {
+		if c.Name == "auth_token" {
+			token = c
+		}
+	}
+
+	if rr.Code != http.StatusOK || token == nil {
+		t.Fatalf("Expected the magic link to log the user in but got %d", rr.Code)
+	}
+
+	h := newPolicy(&proxy.Config{}).authMiddleware(echo())
+
+	if rr := serveAs(t, h, "GET", "/api/news", nil, nil, token); rr.Code != http.StatusOK {
+		t.Errorf("Expected status code %d but got %d", http.StatusOK, rr.Code)
+	}
+
+	// the link only proves access to the email, so trades require a step-up
+	rr = serveAs(t, h, "POST", "/api/stocks/buy", nil, nil, token)
+	if rr.Code != http.StatusUnauthorized || !strings.Contains(rr.Body.String(), `"step_up_required"`) {
+		t.Errorf("Expected a step-up to be required but got %d %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestAdminMiddleware(t *testing.T) {
+	setupEnv(t)
+
+	p := newPolicy(&proxy.Config{})
+	h := p.authMiddleware(adminMiddleware(echo()))
+
+	cases := []struct {
+		cl           *config.Claims
+		expectedCode int
+	}{
+		{claims(1), http.StatusForbidden},
+		{claims(2), http.StatusOK},
+		{claims(5), http.StatusForbidden},
+	}
+
+	for _, i := range cases {
+		rr := serveAs(t, h, "GET", "/api/admin/users", i.cl, nil)
+		if rr.Code != i.expectedCode {
+			t.Errorf("Expected status code %d but got %d when uid=%d", i.expectedCode, rr.Code, i.cl.UID)
+		}
+	}
+
+	rr := serveAs(t, adminMiddleware(echo()), "GET", "/api/admin/users", nil, nil)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status code %d without the authMiddleware but got %d", http.StatusUnauthorized, rr.Code)
+	}
+}
+
+// uidService returns the uid metadata of every call in the trailer received-uid.
+type uidService struct {
+	grpc_health_v1.UnimplementedHealthServer
+}
+
+func (uidService) Check(ctx context.Context, req *grpc_health_v1.HealthCheckRequest) (*grpc_health_v1.HealthCheckResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	grpc.SetTrailer(ctx, metadata.Pairs("received-uid", strings.Join(md.Get("uid"), ",")))
+
+	return &grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_SERVING}, nil
+}
+
+func TestAuthMiddlewareGRPC(t *testing.T) {
+	setupEnv(t)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upstream := grpc.NewServer()
+	grpc_health_v1.RegisterHealthServer(upstream, uidService{})
+
+	go upstream.Serve(lis)
+	defer upstream.Stop()
+
+	ph, err := proxy.New(proxy.Route{
+		Name:      "health",
+		Protocol:  proxy.H2C,
+		Upstreams: []string{"http://" + lis.Addr().String()},
+		Prefix:    "/grpc.health.v1.Health",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := httptest.NewServer(h2c.NewHandler(newPolicy(&proxy.Config{}).authMiddleware(ph), &http2.Server{}))
+	defer s.Close()
+
+	conn, err := grpc.Dial(s.Listener.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	c, err := env.Auth.CreateClaimsCookie(*claims(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the client claims to be another user
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "cookie", c.Name+"="+c.Value, "uid", "1")
+
+	var trailer metadata.MD
+
+	_, err = grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{}, grpc.Trailer(&trailer))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if uid := trailer.Get("received-uid"); len(uid) != 1 || uid[0] != "4" {
+		t.Errorf("Expected the service to receive the uid 4 of the authenticated user but got %v", uid)
+	}
+}
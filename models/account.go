@@ -0,0 +1,227 @@
+package models
+
+import (
+	"auth-proxy/config"
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// accountColumns are the columns scanned by scanAccount.
+const accountColumns = "id,email,lang,role,status,failed_logins,locked_until,password_reset_required,sessions_revoked_at,guest_expires_at"
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanAccount(row scanner) (config.Account, error) {
+	var (
+		acc               config.Account
+		lockedUntil       sql.NullTime
+		sessionsRevokedAt sql.NullTime
+		guestExpiresAt    sql.NullTime
+	)
+
+	err := row.Scan(&acc.UID, &acc.Email, &acc.Lang, &acc.Role, &acc.Status, &acc.FailedLogins, &lockedUntil, &acc.PasswordResetRequired, &sessionsRevokedAt, &guestExpiresAt)
+	if err != nil {
+		return config.Account{}, err
+	}
+
+	if lockedUntil.Valid {
+		acc.LockedUntil = &lockedUntil.Time
+	}
+
+	if sessionsRevokedAt.Valid {
+		acc.SessionsRevokedAt = &sessionsRevokedAt.Time
+	}
+
+	if guestExpiresAt.Valid {
+		acc.GuestExpiresAt = &guestExpiresAt.Time
+	}
+
+	return acc, nil
+}
+
+// updateAccount executes an update statement whose first parameter is the uid. If no user with the uid
+// exists it returns a config.ErrNotFound.
+func (db *DB) updateAccount(ctx context.Context, stmt string, args ...interface{}) error {
+	res, err := db.ExecContext(ctx, stmt, args...)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return config.ErrNotFound
+	}
+
+	return nil
+}
+
+// Account returns the account of the user. If no user with the uid exists it returns a config.ErrNotFound.
+func (db *DB) Account(ctx context.Context, uid uint64) (config.Account, error) {
+	query := "SELECT " + accountColumns + " FROM users WHERE id=$1;"
+
+	acc, err := scanAccount(db.QueryRowContext(ctx, query, uid))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return config.Account{}, config.ErrNotFound
+		}
+
+		return config.Account{}, err
+	}
+
+	return acc, nil
+}
+
+// AccountByEmail returns the account of the user. If no user with the email exists it returns a config.ErrNotFound.
+func (db *DB) AccountByEmail(ctx context.Context, email string) (config.Account, error) {
+	query := "SELECT " + accountColumns + " FROM users WHERE email=$1;"
+
+	acc, err := scanAccount(db.QueryRowContext(ctx, query, email))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return config.Account{}, config.ErrNotFound
+		}
+
+		return config.Account{}, err
+	}
+
+	return acc, nil
+}
+
+// SearchAccounts returns at most limit accounts whose email contains the specified string, ignoring case.
+func (db *DB) SearchAccounts(ctx context.Context, email string, limit int) ([]config.Account, error) {
+	// escape the LIKE wildcards so that they're matched literally
+	pattern := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(email)
+
+	query := "SELECT " + accountColumns + " FROM users WHERE email ILIKE '%' || $1 || '%' ORDER BY id LIMIT $2;"
+
+	rows, err := db.QueryContext(ctx, query, pattern, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var accs []config.Account
+
+	for rows.Next() {
+		acc, err := scanAccount(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		accs = append(accs, acc)
+	}
+
+	return accs, rows.Err()
+}
+
+// SetAccountStatus changes the status of an account.
+func (db *DB) SetAccountStatus(ctx context.Context, uid uint64, status string) error {
+	return db.updateAccount(ctx, "UPDATE users SET status=$2 WHERE id=$1;", uid, status)
+}
+
+// RecordFailedLogin increases the amount of failed logins and locks the account for the duration of lockout
+// once maxAttempts is reached.
+func (db *DB) RecordFailedLogin(ctx context.Context, uid uint64, maxAttempts int, lockout time.Duration) error {
+	stmt := `UPDATE users
+					 SET failed_logins=failed_logins+1,
+							 locked_until=CASE WHEN failed_logins+1 >= $2 THEN now() + make_interval(secs => $3) ELSE locked_until END
+					 WHERE id=$1;`
+
+	return db.updateAccount(ctx, stmt, uid, maxAttempts, lockout.Seconds())
+}
+
+// ClearLockout resets the amount of failed logins and unlocks the account.
+func (db *DB) ClearLockout(ctx context.Context, uid uint64) error {
+	return db.updateAccount(ctx, "UPDATE users SET failed_logins=0, locked_until=NULL WHERE id=$1;", uid)
+}
+
+// ForcePasswordReset requires the user to choose a new password on the next login.
+func (db *DB) ForcePasswordReset(ctx context.Context, uid uint64) error {
+	return db.updateAccount(ctx, "UPDATE users SET password_reset_required=true WHERE id=$1;", uid)
+}
+
+// SetPassword saves the new password and clears a forced password reset.
+func (db *DB) SetPassword(ctx context.Context, uid uint64, pass string) error {
+	if pass == "" {
+		return errors.New("The password can't be an empty string")
+	}
+
+	passHash, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	return db.updateAccount(ctx, "UPDATE users SET pass=$2, password_reset_required=false WHERE id=$1;", uid, string(passHash))
+}
+
+// TradingPIN returns the bcrypt hash of the user's trading PIN. If the user didn't set one it returns a config.ErrNotFound.
+func (db *DB) TradingPIN(ctx context.Context, uid uint64) (string, error) {
+	var pin sql.NullString
+
+	err := db.QueryRowContext(ctx, "SELECT trading_pin FROM users WHERE id=$1;", uid).Scan(&pin)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", config.ErrNotFound
+		}
+
+		return "", err
+	}
+
+	if !pin.Valid {
+		return "", config.ErrNotFound
+	}
+
+	return pin.String, nil
+}
+
+// SetTradingPIN saves the bcrypt hash of the user's new trading PIN.
+func (db *DB) SetTradingPIN(ctx context.Context, uid uint64, pin string) error {
+	if pin == "" {
+		return errors.New("The PIN can't be an empty string")
+	}
+
+	pinHash, err := bcrypt.GenerateFromPassword([]byte(pin), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	return db.updateAccount(ctx, "UPDATE users SET trading_pin=$2 WHERE id=$1;", uid, string(pinHash))
+}
+
+// RevokeSessions invalidates all authentication tokens issued to the user so far and deletes the
+// user's remembered sessions.
+func (db *DB) RevokeSessions(ctx context.Context, uid uint64) error {
+	err := db.updateAccount(ctx, "UPDATE users SET sessions_revoked_at=now() WHERE id=$1;", uid)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, "DELETE FROM sessions WHERE uid=$1;", uid)
+
+	return err
+}
+
+// RecordAudit adds an entry to the audit log.
+func (db *DB) RecordAudit(ctx context.Context, entry config.AuditEntry) error {
+	var targetUID sql.NullInt64
+	if entry.TargetUID > 0 {
+		targetUID = sql.NullInt64{Int64: int64(entry.TargetUID), Valid: true}
+	}
+
+	stmt := "INSERT INTO audit_log (actor_uid,action,target_uid,details,created_at) VALUES ($1,$2,$3,$4,$5);"
+
+	_, err := db.ExecContext(ctx, stmt, entry.ActorUID, entry.Action, targetUID, entry.Details, entry.At)
+
+	return err
+}
@@ -0,0 +1,93 @@
+package models
+
+import (
+	"auth-proxy/config"
+	"context"
+	"database/sql"
+)
+
+// grantColumns are the columns scanned by scanGrant.
+const grantColumns = "id,grantor_uid,grantee_uid,scope,created_at,expires_at"
+
+func scanGrant(row scanner) (config.Grant, error) {
+	var g config.Grant
+
+	err := row.Scan(&g.ID, &g.GrantorUID, &g.GranteeUID, &g.Scope, &g.CreatedAt, &g.ExpiresAt)
+
+	return g, err
+}
+
+// CreateGrant saves a grant.
+func (db *DB) CreateGrant(ctx context.Context, g config.Grant) error {
+	stmt := "INSERT INTO grants (" + grantColumns + ") VALUES ($1,$2,$3,$4,$5,$6);"
+
+	_, err := db.ExecContext(ctx, stmt, g.ID, g.GrantorUID, g.GranteeUID, g.Scope, g.CreatedAt, g.ExpiresAt)
+
+	return err
+}
+
+// Grants returns the unexpired grants the user gave and received, ordered by their creation time.
+func (db *DB) Grants(ctx context.Context, uid uint64) ([]config.Grant, []config.Grant, error) {
+	query := "SELECT " + grantColumns + " FROM grants WHERE (grantor_uid=$1 OR grantee_uid=$1) AND expires_at > now() ORDER BY created_at;"
+
+	rows, err := db.QueryContext(ctx, query, uid)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer rows.Close()
+
+	given := []config.Grant{}
+	received := []config.Grant{}
+
+	for rows.Next() {
+		g, err := scanGrant(rows)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if g.GrantorUID == uid {
+			given = append(given, g)
+		} else {
+			received = append(received, g)
+		}
+	}
+
+	return given, received, rows.Err()
+}
+
+// ActiveGrant returns the unexpired grant of the grantor to the grantee which expires last. If there's none it
+// returns a config.ErrNotFound.
+func (db *DB) ActiveGrant(ctx context.Context, grantorUID, granteeUID uint64) (config.Grant, error) {
+	query := "SELECT " + grantColumns + " FROM grants WHERE grantor_uid=$1 AND grantee_uid=$2 AND expires_at > now() ORDER BY expires_at DESC LIMIT 1;"
+
+	g, err := scanGrant(db.QueryRowContext(ctx, query, grantorUID, granteeUID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return config.Grant{}, config.ErrNotFound
+		}
+
+		return config.Grant{}, err
+	}
+
+	return g, nil
+}
+
+// DeleteGrant deletes the grant if the user is either its grantor or its grantee.
+func (db *DB) DeleteGrant(ctx context.Context, uid uint64, id string) error {
+	res, err := db.ExecContext(ctx, "DELETE FROM grants WHERE id=$1 AND (grantor_uid=$2 OR grantee_uid=$2);", id, uid)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return config.ErrNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,97 @@
+package models
+
+import (
+	"auth-proxy/config"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/lib/pq"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// guestEmailDomain is the domain of the placeholder emails of guest accounts. It's reserved, so no mail is ever
+// delivered to it.
+const guestEmailDomain = "guest.invalid"
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// CreateGuest adds a guest account with the same starting cash as regular accounts. Its email is a placeholder
+// and its password random, so nobody can log in to it.
+func (db *DB) CreateGuest(ctx context.Context, expiresAt time.Time) (uint64, error) {
+	id, err := randomHex(16)
+	if err != nil {
+		return 0, err
+	}
+
+	pass, err := randomHex(32)
+	if err != nil {
+		return 0, err
+	}
+
+	passHash, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.DefaultCost)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	defer tx.Rollback()
+
+	var uid uint64
+
+	email := "guest-" + id + "@" + guestEmailDomain
+
+	err = tx.QueryRowContext(ctx, registerStmt+" RETURNING id;", email, string(passHash), "Guest", "", defaultLang, startingCash, "{}").Scan(&uid)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE users SET guest_expires_at=$2 WHERE id=$1;", uid, expiresAt)
+	if err != nil {
+		return 0, err
+	}
+
+	return uid, tx.Commit()
+}
+
+// ConvertGuest replaces the guest account's placeholder credentials and makes it permanent.
+func (db *DB) ConvertGuest(ctx context.Context, uid uint64, body config.RegistrationReqBody) error {
+	passHash, err := bcrypt.GenerateFromPassword([]byte(body.Pass), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	stmt := "UPDATE users SET email=$2,pass=$3,last_name=$4,first_name=$5,guest_expires_at=NULL WHERE id=$1 AND guest_expires_at > now();"
+
+	err = db.updateAccount(ctx, stmt, uid, body.Email, string(passHash), body.LastName, body.FirstName)
+	if err, ok := err.(*pq.Error); ok && err.Code.Name() == "unique_violation" {
+		return config.ErrConflict
+	}
+
+	return err
+}
+
+// DeleteExpiredGuests deletes the guest accounts which weren't converted in time. Their login history, sessions
+// and magic links are deleted by the db as well.
+func (db *DB) DeleteExpiredGuests(ctx context.Context) (int64, error) {
+	res, err := db.ExecContext(ctx, "DELETE FROM users WHERE guest_expires_at <= now();")
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
@@ -0,0 +1,114 @@
+package models
+
+import (
+	"auth-proxy/config"
+	"context"
+	"database/sql"
+	"encoding/json"
+)
+
+// KnownLogin reports if the user already logged in from the specified device or network.
+func (db *DB) KnownLogin(ctx context.Context, uid uint64, deviceID, network string) (bool, bool, error) {
+	var knownDevice, knownNetwork bool
+
+	query := `SELECT
+							EXISTS(SELECT 1 FROM logins WHERE uid=$1 AND device_id=$2),
+							EXISTS(SELECT 1 FROM logins WHERE uid=$1 AND network=$3);`
+
+	err := db.QueryRowContext(ctx, query, uid, deviceID, network).Scan(&knownDevice, &knownNetwork)
+	if err != nil {
+		return false, false, err
+	}
+
+	return knownDevice, knownNetwork, nil
+}
+
+// LastLogin returns the user's most recent login. If the user never logged in it returns a config.ErrNotFound.
+func (db *DB) LastLogin(ctx context.Context, uid uint64) (config.LoginRecord, error) {
+	var (
+		login    = config.LoginRecord{UID: uid}
+		region   sql.NullString
+		lat, lon sql.NullFloat64
+	)
+
+	query := `SELECT device_id,network,ip,user_agent,region,lat,lon,created_at
+						FROM logins
+						WHERE uid=$1
+						ORDER BY created_at DESC
+						LIMIT 1;`
+
+	err := db.QueryRowContext(ctx, query, uid).Scan(&login.DeviceID, &login.Network, &login.IP, &login.UserAgent, &region, &lat, &lon, &login.At)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return config.LoginRecord{}, config.ErrNotFound
+		}
+
+		return config.LoginRecord{}, err
+	}
+
+	if region.Valid && lat.Valid && lon.Valid {
+		login.Location = &config.Location{Region: region.String, Lat: lat.Float64, Lon: lon.Float64}
+	}
+
+	return login, nil
+}
+
+// RecordLogin adds a login to the user's login history.
+func (db *DB) RecordLogin(ctx context.Context, login config.LoginRecord) error {
+	var (
+		region   sql.NullString
+		lat, lon sql.NullFloat64
+	)
+
+	if login.Location != nil {
+		region = sql.NullString{String: login.Location.Region, Valid: true}
+		lat = sql.NullFloat64{Float64: login.Location.Lat, Valid: true}
+		lon = sql.NullFloat64{Float64: login.Location.Lon, Valid: true}
+	}
+
+	stmt := "INSERT INTO logins VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9);"
+
+	_, err := db.ExecContext(ctx, stmt, login.UID, login.DeviceID, login.Network, login.IP, login.UserAgent, region, lat, lon, login.At)
+
+	return err
+}
+
+// SaveLoginChallenge saves a login which still has to be verified.
+func (db *DB) SaveLoginChallenge(ctx context.Context, ch config.LoginChallenge) error {
+	login, err := json.Marshal(ch.Login)
+	if err != nil {
+		return err
+	}
+
+	stmt := "INSERT INTO login_challenges (id,code_hash,lang,login,expires_at,remember,authenticated) VALUES ($1,$2,$3,$4,$5,$6,$7);"
+
+	_, err = db.ExecContext(ctx, stmt, ch.ID, ch.CodeHash, ch.Lang, login, ch.ExpiresAt, ch.RememberMe, ch.Authenticated)
+
+	return err
+}
+
+// ConsumeLoginChallenge deletes a login challenge and returns it. If no challenge with the specified id exists
+// it returns a config.ErrNotFound.
+func (db *DB) ConsumeLoginChallenge(ctx context.Context, id string) (config.LoginChallenge, error) {
+	var (
+		ch    = config.LoginChallenge{ID: id}
+		login []byte
+	)
+
+	stmt := "DELETE FROM login_challenges WHERE id=$1 RETURNING code_hash,lang,login,expires_at,remember,authenticated;"
+
+	err := db.QueryRowContext(ctx, stmt, id).Scan(&ch.CodeHash, &ch.Lang, &login, &ch.ExpiresAt, &ch.RememberMe, &ch.Authenticated)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return config.LoginChallenge{}, config.ErrNotFound
+		}
+
+		return config.LoginChallenge{}, err
+	}
+
+	if err = json.Unmarshal(login, &ch.Login); err != nil {
+		return config.LoginChallenge{}, err
+	}
+
+	return ch, nil
+}
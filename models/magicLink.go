@@ -0,0 +1,39 @@
+package models
+
+import (
+	"auth-proxy/config"
+	"context"
+	"database/sql"
+)
+
+// SaveMagicLink saves a magic login link.
+func (db *DB) SaveMagicLink(ctx context.Context, link config.MagicLink) error {
+	stmt := "INSERT INTO magic_links VALUES ($1,$2,$3,$4);"
+
+	_, err := db.ExecContext(ctx, stmt, link.TokenHash, link.NonceHash, link.UID, link.ExpiresAt)
+
+	return err
+}
+
+// ConsumeMagicLink deletes the magic link with the specified token hash and returns it. Expired links are
+// deleted as well. If no link with the token hash exists it returns a config.ErrNotFound.
+func (db *DB) ConsumeMagicLink(ctx context.Context, tokenHash string) (config.MagicLink, error) {
+	link := config.MagicLink{TokenHash: tokenHash}
+
+	stmt := "DELETE FROM magic_links WHERE token_hash=$1 RETURNING nonce_hash,uid,expires_at;"
+
+	err := db.QueryRowContext(ctx, stmt, tokenHash).Scan(&link.NonceHash, &link.UID, &link.ExpiresAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return config.MagicLink{}, config.ErrNotFound
+		}
+
+		return config.MagicLink{}, err
+	}
+
+	if _, err = db.ExecContext(ctx, "DELETE FROM magic_links WHERE expires_at < now();"); err != nil {
+		return config.MagicLink{}, err
+	}
+
+	return link, nil
+}
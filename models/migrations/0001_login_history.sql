@@ -0,0 +1,23 @@
+-- Login history used to detect logins from unknown devices, networks and locations.
+CREATE TABLE IF NOT EXISTS logins (
+  uid        BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  device_id  TEXT NOT NULL,
+  network    TEXT NOT NULL,
+  ip         TEXT NOT NULL,
+  user_agent TEXT NOT NULL,
+  region     TEXT,
+  lat        DOUBLE PRECISION,
+  lon        DOUBLE PRECISION,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS logins_uid_created_at_idx ON logins (uid, created_at DESC);
+
+-- Logins which have to be confirmed with a code before a token gets issued.
+CREATE TABLE IF NOT EXISTS login_challenges (
+  id         TEXT PRIMARY KEY,
+  code_hash  TEXT NOT NULL,
+  lang       TEXT NOT NULL,
+  login      JSONB NOT NULL,
+  expires_at TIMESTAMPTZ NOT NULL
+);
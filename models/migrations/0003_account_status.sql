@@ -0,0 +1,2 @@
+-- Only accounts with the status 'active' can log in and use their tokens.
+ALTER TABLE users ADD CONSTRAINT users_status_check CHECK (status IN ('active', 'disabled', 'suspended', 'pending'));
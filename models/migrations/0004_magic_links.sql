@@ -0,0 +1,7 @@
+-- Single-use login links. Only hashes of the token and the nonce binding it to a browser are saved.
+CREATE TABLE IF NOT EXISTS magic_links (
+  token_hash TEXT PRIMARY KEY,
+  nonce_hash TEXT NOT NULL,
+  uid        BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  expires_at TIMESTAMPTZ NOT NULL
+);
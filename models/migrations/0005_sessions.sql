@@ -0,0 +1,11 @@
+-- Remembered logins. The id is the hash of the token saved in the session cookie.
+CREATE TABLE IF NOT EXISTS sessions (
+  id         TEXT PRIMARY KEY,
+  uid        BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS sessions_uid_idx ON sessions (uid);
+
+ALTER TABLE login_challenges ADD COLUMN IF NOT EXISTS remember BOOLEAN NOT NULL DEFAULT false;
@@ -0,0 +1,5 @@
+-- bcrypt hash of the PIN which can be used instead of the password to confirm trades.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS trading_pin TEXT;
+
+-- Logins verified with an emailed code only count as authenticated if they used a password.
+ALTER TABLE login_challenges ADD COLUMN IF NOT EXISTS authenticated BOOLEAN NOT NULL DEFAULT true;
@@ -0,0 +1,5 @@
+-- Guest accounts are sandbox accounts which get deleted after guest_expires_at unless they're
+-- converted into regular accounts. It's NULL for regular accounts.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS guest_expires_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS users_guest_expires_at_idx ON users (guest_expires_at) WHERE guest_expires_at IS NOT NULL;
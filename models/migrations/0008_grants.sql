@@ -0,0 +1,13 @@
+-- Grants let the grantee act on the grantor's account. The scope is either 'read' or 'trade'.
+CREATE TABLE IF NOT EXISTS grants (
+  id          TEXT PRIMARY KEY,
+  grantor_uid BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  grantee_uid BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  scope       TEXT NOT NULL CHECK (scope IN ('read', 'trade')),
+  created_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+  expires_at  TIMESTAMPTZ NOT NULL,
+  CHECK (grantor_uid <> grantee_uid)
+);
+
+CREATE INDEX IF NOT EXISTS grants_grantor_uid_idx ON grants (grantor_uid);
+CREATE INDEX IF NOT EXISTS grants_grantee_uid_idx ON grants (grantee_uid);
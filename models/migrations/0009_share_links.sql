@@ -0,0 +1,10 @@
+-- Share links give read access to some paths of a user's account to everybody knowing their token.
+CREATE TABLE IF NOT EXISTS share_links (
+  id         TEXT PRIMARY KEY,
+  uid        BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  paths      TEXT[] NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS share_links_uid_idx ON share_links (uid);
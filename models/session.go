@@ -0,0 +1,41 @@
+package models
+
+import (
+	"auth-proxy/config"
+	"context"
+	"database/sql"
+)
+
+// CreateSession saves a remembered session.
+func (db *DB) CreateSession(ctx context.Context, s config.Session) error {
+	stmt := "INSERT INTO sessions VALUES ($1,$2,$3,$4);"
+
+	_, err := db.ExecContext(ctx, stmt, s.ID, s.UID, s.CreatedAt, s.ExpiresAt)
+
+	return err
+}
+
+// Session returns the session with the specified id. If it doesn't exist it returns a config.ErrNotFound.
+func (db *DB) Session(ctx context.Context, id string) (config.Session, error) {
+	s := config.Session{ID: id}
+
+	query := "SELECT uid,created_at,expires_at FROM sessions WHERE id=$1;"
+
+	err := db.QueryRowContext(ctx, query, id).Scan(&s.UID, &s.CreatedAt, &s.ExpiresAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return config.Session{}, config.ErrNotFound
+		}
+
+		return config.Session{}, err
+	}
+
+	return s, nil
+}
+
+// DeleteSession deletes the session with the specified id.
+func (db *DB) DeleteSession(ctx context.Context, id string) error {
+	_, err := db.ExecContext(ctx, "DELETE FROM sessions WHERE id=$1;", id)
+
+	return err
+}
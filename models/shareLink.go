@@ -0,0 +1,89 @@
+package models
+
+import (
+	"auth-proxy/config"
+	"context"
+	"database/sql"
+
+	"github.com/lib/pq"
+)
+
+// shareLinkColumns are the columns scanned by scanShareLink.
+const shareLinkColumns = "id,uid,paths,created_at,expires_at"
+
+func scanShareLink(row scanner) (config.ShareLink, error) {
+	var l config.ShareLink
+
+	err := row.Scan(&l.ID, &l.UID, pq.Array(&l.Paths), &l.CreatedAt, &l.ExpiresAt)
+
+	return l, err
+}
+
+// CreateShareLink saves a share link.
+func (db *DB) CreateShareLink(ctx context.Context, l config.ShareLink) error {
+	stmt := "INSERT INTO share_links (" + shareLinkColumns + ") VALUES ($1,$2,$3,$4,$5);"
+
+	_, err := db.ExecContext(ctx, stmt, l.ID, l.UID, pq.Array(l.Paths), l.CreatedAt, l.ExpiresAt)
+
+	return err
+}
+
+// ShareLinks returns the user's unexpired share links ordered by their creation time.
+func (db *DB) ShareLinks(ctx context.Context, uid uint64) ([]config.ShareLink, error) {
+	query := "SELECT " + shareLinkColumns + " FROM share_links WHERE uid=$1 AND expires_at > now() ORDER BY created_at;"
+
+	rows, err := db.QueryContext(ctx, query, uid)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	links := []config.ShareLink{}
+
+	for rows.Next() {
+		l, err := scanShareLink(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		links = append(links, l)
+	}
+
+	return links, rows.Err()
+}
+
+// ShareLink returns the share link with the id. If it doesn't exist it returns a config.ErrNotFound.
+func (db *DB) ShareLink(ctx context.Context, id string) (config.ShareLink, error) {
+	query := "SELECT " + shareLinkColumns + " FROM share_links WHERE id=$1;"
+
+	l, err := scanShareLink(db.QueryRowContext(ctx, query, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return config.ShareLink{}, config.ErrNotFound
+		}
+
+		return config.ShareLink{}, err
+	}
+
+	return l, nil
+}
+
+// DeleteShareLink deletes the user's share link with the id.
+func (db *DB) DeleteShareLink(ctx context.Context, uid uint64, id string) error {
+	res, err := db.ExecContext(ctx, "DELETE FROM share_links WHERE id=$1 AND uid=$2;", id, uid)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return config.ErrNotFound
+	}
+
+	return nil
+}
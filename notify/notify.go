@@ -0,0 +1,149 @@
+// Package notify provides implementations of the config.Notifier interface.
+package notify
+
+import (
+	"auth-proxy/config"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Email informs users by sending them an email.
+type Email struct {
+	config.Notifier
+	mailer config.Mailer
+}
+
+// NewEmail returns a new Email notifier which sends its mails through the specified mailer.
+func NewEmail(mailer config.Mailer) (*Email, error) {
+	if mailer == nil {
+		return nil, errors.New("The mailer can't be nil")
+	}
+
+	return &Email{mailer: mailer}, nil
+}
+
+// NotifyLogin sends an email describing the login to the user.
+func (n *Email) NotifyLogin(ctx context.Context, ev config.LoginEvent) error {
+	var reasons []string
+	if ev.NewDevice {
+		reasons = append(reasons, "from a device you haven't used before")
+	}
+
+	if ev.NewNetwork {
+		reasons = append(reasons, "from a network you haven't used before")
+	}
+
+	if ev.ImpossibleTravel {
+		reasons = append(reasons, "from a location which is unusually far away from your last login")
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "We noticed a new login to your account %s.\n\n", strings.Join(reasons, " and "))
+	fmt.Fprintf(&b, "Time: %s\n", ev.Login.At.UTC().Format(time.RFC1123))
+	fmt.Fprintf(&b, "IP address: %s\n", ev.Login.IP)
+	if ev.Login.Location != nil {
+		fmt.Fprintf(&b, "Region: %s\n", ev.Login.Location.Region)
+	}
+	fmt.Fprintf(&b, "Browser: %s\n\n", ev.Login.UserAgent)
+	b.WriteString("If this was you, you can ignore this email. Otherwise please change your password immediately.\n")
+
+	m := config.Mail{
+		To:      ev.Email,
+		Subject: "New login to your account",
+		Body:    b.String(),
+	}
+
+	return n.mailer.Send(ctx, m)
+}
+
+// Webhook informs an external service by posting the login event as JSON to an URL.
+type Webhook struct {
+	config.Notifier
+	url    string
+	client *http.Client
+}
+
+// NewWebhook returns a new Webhook notifier posting to the specified url.
+func NewWebhook(url string) (*Webhook, error) {
+	if url == "" {
+		return nil, errors.New("The webhook url can't be an empty string")
+	}
+
+	n := &Webhook{
+		url:    url,
+		client: &http.Client{Timeout: time.Second * 10},
+	}
+
+	return n, nil
+}
+
+// NotifyLogin posts the event to the webhook. Every response status other than 2xx is treated as an error.
+func (n *Webhook) NotifyLogin(ctx context.Context, ev config.LoginEvent) error {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", n.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("The webhook responded with status code %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// Multi forwards every notification to all of its notifiers.
+type Multi []config.Notifier
+
+// NotifyLogin notifies all notifiers and returns the first error which occured.
+func (m Multi) NotifyLogin(ctx context.Context, ev config.LoginEvent) error {
+	var firstErr error
+
+	for _, n := range m {
+		if err := n.NotifyLogin(ctx, ev); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// Stub saves all notifications in a channel. It's meant to be used in tests.
+type Stub struct {
+	config.Notifier
+	Events chan config.LoginEvent
+}
+
+// NewStub returns a new Stub which can buffer up to n events.
+func NewStub(n int) *Stub {
+	return &Stub{Events: make(chan config.LoginEvent, n)}
+}
+
+// NotifyLogin sends the event to the Events channel.
+func (n *Stub) NotifyLogin(ctx context.Context, ev config.LoginEvent) error {
+	select {
+	case n.Events <- ev:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,84 @@
+package notify_test
+
+import (
+	"auth-proxy/config"
+	"auth-proxy/mail"
+	"auth-proxy/notify"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var mockEvent = config.LoginEvent{
+	Email:     "john.doe@gmail.com",
+	Login:     config.LoginRecord{UID: 1, IP: "81.2.69.160", UserAgent: "Mozilla/5.0", At: time.Now()},
+	NewDevice: true,
+}
+
+func TestEmail(t *testing.T) {
+	mailer := new(mail.Memory)
+
+	n, err := notify.NewEmail(mailer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = n.NotifyLogin(context.Background(), mockEvent); err != nil {
+		t.Fatal(err)
+	}
+
+	sent := mailer.Sent()
+	if len(sent) != 1 {
+		t.Fatalf("Expected 1 mail to be sent but got %d", len(sent))
+	}
+
+	if sent[0].To != mockEvent.Email {
+		t.Errorf("Expected the mail to be sent to %s but got %s", mockEvent.Email, sent[0].To)
+	}
+
+	if !strings.Contains(sent[0].Body, mockEvent.Login.IP) {
+		t.Error("The mail doesn't contain the login's ip address")
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	events := make(chan config.LoginEvent, 1)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev config.LoginEvent
+
+		if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if ev.Login.UID == 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		events <- ev
+	}))
+	defer srv.Close()
+
+	n, err := notify.NewWebhook(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = n.NotifyLogin(context.Background(), mockEvent); err != nil {
+		t.Fatal(err)
+	}
+
+	if ev := <-events; ev.Email != mockEvent.Email || !ev.NewDevice {
+		t.Errorf("The webhook received an unexpected event: %+v", ev)
+	}
+
+	if err = n.NotifyLogin(context.Background(), config.LoginEvent{}); err == nil {
+		t.Error("Expected an error when the webhook responds with a status code other than 2xx")
+	}
+}
@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync/atomic"
+)
+
+// Possible values of a route's balancer field.
+const (
+	// RoundRobin forwards requests to the upstreams in turns. It's the default.
+	RoundRobin = "round-robin"
+	// LeastConnections forwards requests to the upstream with the fewest requests in progress.
+	LeastConnections = "least-connections"
+	// ConsistentHash forwards all requests of a user to the same upstream, as long as the pool doesn't change.
+	// Changing the pool only moves the users of the added or removed upstream.
+	ConsistentHash = "consistent-hash"
+)
+
+// hashReplicas defines how often every upstream is placed on the hash ring. More replicas distribute the
+// users more evenly.
+const hashReplicas = 100
+
+// Upstream is an instance of a service requests can be forwarded to.
+type Upstream struct {
+	URL *url.URL
+
+	active int64
+	health
+	// breaker is nil if the route has no circuit breaker
+	breaker *breaker
+	// pool are the upstreams of the route, including this one
+	pool []*Upstream
+}
+
+// Active returns the number of requests in progress.
+func (u *Upstream) Active() int64 {
+	return atomic.LoadInt64(&u.active)
+}
+
+// Balancer picks the upstream a request is forwarded to. Only available upstreams are picked. If none is available,
+// it returns nil.
+type Balancer interface {
+	Pick(r *http.Request) *Upstream
+}
+
+// NewBalancer returns the balancer with the strategy for the upstreams. An empty strategy defaults to RoundRobin.
+func NewBalancer(strategy string, upstreams []*Upstream) Balancer {
+	switch strategy {
+	case LeastConnections:
+		return leastConnections(upstreams)
+	case ConsistentHash:
+		return newHashRing(upstreams)
+	default:
+		return &roundRobin{upstreams: upstreams}
+	}
+}
+
+type excludedKey struct{}
+
+// pickable reports if the upstream is available for the request. Retries exclude the upstream whose attempt
+// failed.
+func pickable(r *http.Request, u *Upstream) bool {
+	excluded, _ := r.Context().Value(excludedKey{}).(*Upstream)
+	return u != excluded && u.Available()
+}
+
+type roundRobin struct {
+	upstreams []*Upstream
+	next      uint32
+}
+
+func (b *roundRobin) Pick(r *http.Request) *Upstream {
+	n := atomic.AddUint32(&b.next, 1)
+
+	for i := 0; i < len(b.upstreams); i++ {
+		if u := b.upstreams[(int(n-1)+i)%len(b.upstreams)]; pickable(r, u) {
+			return u
+		}
+	}
+
+	return nil
+}
+
+type leastConnections []*Upstream
+
+func (b leastConnections) Pick(r *http.Request) *Upstream {
+	var best *Upstream
+
+	for _, u := range b {
+		if pickable(r, u) && (best == nil || u.Active() < best.Active()) {
+			best = u
+		}
+	}
+
+	return best
+}
+
+type hashRing struct {
+	hashes    []uint32
+	upstreams map[uint32]*Upstream
+	fallback  *roundRobin
+}
+
+func hash(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+
+	return h.Sum32()
+}
+
+func newHashRing(upstreams []*Upstream) *hashRing {
+	ring := &hashRing{
+		upstreams: make(map[uint32]*Upstream),
+		fallback:  &roundRobin{upstreams: upstreams},
+	}
+
+	for _, u := range upstreams {
+		for i := 0; i < hashReplicas; i++ {
+			h := hash(u.URL.String() + "#" + strconv.Itoa(i))
+			if _, ok := ring.upstreams[h]; ok {
+				continue
+			}
+
+			ring.upstreams[h] = u
+			ring.hashes = append(ring.hashes, h)
+		}
+	}
+
+	sort.Slice(ring.hashes, func(i, j int) bool { return ring.hashes[i] < ring.hashes[j] })
+
+	return ring
+}
+
+// Pick hashes the uid set by the authMiddleware. If the user's upstream isn't available, the next one on the ring
+// is picked. Requests without a uid are distributed in turns.
+func (ring *hashRing) Pick(r *http.Request) *Upstream {
+	uid := r.Header.Get("UID")
+	if uid == "" {
+		return ring.fallback.Pick(r)
+	}
+
+	h := hash(uid)
+
+	start := sort.Search(len(ring.hashes), func(i int) bool { return ring.hashes[i] >= h })
+
+	for i := 0; i < len(ring.hashes); i++ {
+		if u := ring.upstreams[ring.hashes[(start+i)%len(ring.hashes)]]; pickable(r, u) {
+			return u
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,120 @@
+package proxy_test
+
+import (
+	"auth-proxy/proxy"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func upstreams(t *testing.T, n int) []*proxy.Upstream {
+	t.Helper()
+
+	var us []*proxy.Upstream
+
+	for i := 0; i < n; i++ {
+		u, err := url.Parse(fmt.Sprintf("http://stock_service_%d:8082", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		us = append(us, &proxy.Upstream{URL: u})
+	}
+
+	return us
+}
+
+func requestOf(uid int) *http.Request {
+	r := httptest.NewRequest("GET", "/api/stocks", nil)
+	r.Header.Set("UID", strconv.Itoa(uid))
+
+	return r
+}
+
+func TestRoundRobin(t *testing.T) {
+	us := upstreams(t, 3)
+	b := proxy.NewBalancer(proxy.RoundRobin, us)
+
+	for i := 0; i < 6; i++ {
+		if u := b.Pick(requestOf(1)); u != us[i%3] {
+			t.Errorf("Expected request %d to be forwarded to %s but got %s", i, us[i%3].URL, u.URL)
+		}
+	}
+}
+
+func TestConsistentHash(t *testing.T) {
+	us := upstreams(t, 3)
+	b := proxy.NewBalancer(proxy.ConsistentHash, us)
+	shrunk := proxy.NewBalancer(proxy.ConsistentHash, us[:2])
+
+	counts := make(map[*proxy.Upstream]int)
+
+	for uid := 1; uid <= 3000; uid++ {
+		u := b.Pick(requestOf(uid))
+		counts[u]++
+
+		if again := b.Pick(requestOf(uid)); again != u {
+			t.Fatalf("Expected user %d to always be forwarded to %s but got %s", uid, u.URL, again.URL)
+		}
+
+		// only the users of the removed upstream move
+		if u != us[2] && shrunk.Pick(requestOf(uid)) != u {
+			t.Errorf("Expected user %d to stay on %s after another upstream was removed", uid, u.URL)
+		}
+	}
+
+	for _, u := range us {
+		if counts[u] < 500 {
+			t.Errorf("Expected the users to be distributed evenly but got %d users on %s", counts[u], u.URL)
+		}
+	}
+
+	// requests without a uid are distributed in turns
+	anonymous := httptest.NewRequest("GET", "/api/stocks", nil)
+	if b.Pick(anonymous) == b.Pick(anonymous) {
+		t.Error("Expected requests without a uid to be distributed in turns")
+	}
+}
+
+func TestLeastConnections(t *testing.T) {
+	release := make(chan struct{})
+	counts := make([]int, 2)
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		counts[0]++
+		<-release
+	}))
+	defer slow.Close()
+
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		counts[1]++
+	}))
+	defer fast.Close()
+
+	h := newHandler(t, proxy.Route{Balancer: proxy.LeastConnections}, slow, fast)
+
+	done := make(chan struct{})
+	go func() {
+		get(h, "GET", "/api/stocks")
+		close(done)
+	}()
+
+	for h.Upstreams()[0].Active() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	for i := 0; i < 5; i++ {
+		get(h, "GET", "/api/stocks")
+	}
+
+	close(release)
+	<-done
+
+	if counts[0] != 1 || counts[1] != 5 {
+		t.Errorf("Expected the requests to avoid the busy upstream but got %v", counts)
+	}
+}
@@ -0,0 +1,493 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Possible values of a fallback's type.
+const (
+	// FallbackProblem responds with a http 503 and a problem document. It's the default.
+	FallbackProblem = "problem"
+	// FallbackStatic responds with a static JSON body.
+	FallbackStatic = "static"
+	// FallbackCached responds with the last successful response to the same GET request of the same user. If
+	// there's none, it falls back to FallbackProblem.
+	FallbackCached = "cached"
+)
+
+// Defaults of the circuit breaker.
+const (
+	DefaultFailureRate      = 0.5
+	DefaultMinRequests      = 20
+	DefaultBreakerWindow    = 10 * time.Second
+	DefaultOpenFor          = 30 * time.Second
+	DefaultHalfOpenRequests = 1
+	DefaultFallbackMaxAge   = 5 * time.Minute
+)
+
+// Limits of the responses kept for FallbackCached.
+const (
+	maxCachedResponses = 1000
+	maxCachedBodySize  = 1 << 20
+)
+
+// States of a circuit breaker.
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half-open"
+)
+
+// errCircuitOpen is returned by the breakerTransport instead of forwarding a request to an upstream whose
+// circuit is open.
+var errCircuitOpen = errors.New("the upstream's circuit is open")
+
+// breaker is the circuit breaker of an upstream. While it's closed, the outcomes of requests are counted in
+// windows and once too many failed, it opens and rejects all requests. After a while it becomes half-open and lets
+// a few trial requests through. If they succeed it closes again, otherwise it opens again.
+type breaker struct {
+	cfg CircuitBreaker
+
+	mu          sync.Mutex
+	state       string
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+	trials      int
+	successes   int
+	// generation changes with every state change, so outcomes of requests allowed before are ignored
+	generation uint64
+}
+
+func newBreaker(cfg CircuitBreaker) *breaker {
+	return &breaker{cfg: cfg, state: circuitClosed, windowStart: time.Now()}
+}
+
+// allow reports if a request may be forwarded and returns the generation its outcome has to be reported with.
+func (b *breaker) allow() (uint64, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+
+	switch b.state {
+	case circuitOpen:
+		if now.Sub(b.openedAt) < b.cfg.openFor() {
+			return 0, false
+		}
+
+		b.setState(circuitHalfOpen, now)
+		fallthrough
+	case circuitHalfOpen:
+		if b.trials >= b.cfg.halfOpenRequests() {
+			return 0, false
+		}
+
+		b.trials++
+	default:
+		if now.Sub(b.windowStart) >= b.cfg.window() {
+			b.windowStart = now
+			b.requests = 0
+			b.failures = 0
+		}
+	}
+
+	return b.generation, true
+}
+
+// report records the outcome of a request allowed in the generation.
+func (b *breaker) report(generation uint64, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if generation != b.generation {
+		return
+	}
+
+	now := time.Now()
+
+	switch b.state {
+	case circuitHalfOpen:
+		if failed {
+			b.setState(circuitOpen, now)
+			return
+		}
+
+		b.successes++
+		if b.successes >= b.cfg.halfOpenRequests() {
+			b.setState(circuitClosed, now)
+		}
+	case circuitClosed:
+		b.requests++
+		if failed {
+			b.failures++
+		}
+
+		if b.requests >= b.cfg.minRequests() && float64(b.failures)/float64(b.requests) >= b.cfg.failureRate() {
+			b.setState(circuitOpen, now)
+		}
+	}
+}
+
+// release gives back the trial of a request allowed in the generation whose outcome is unknown, e.g. because
+// the client went away.
+func (b *breaker) release(generation uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if generation == b.generation && b.state == circuitHalfOpen {
+		b.trials--
+	}
+}
+
+func (b *breaker) setState(state string, now time.Time) {
+	b.state = state
+	b.generation++
+	b.trials = 0
+	b.successes = 0
+	b.requests = 0
+	b.failures = 0
+	b.windowStart = now
+
+	if state == circuitOpen {
+		b.openedAt = now
+	}
+}
+
+// State returns the breaker's current state.
+func (b *breaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == circuitOpen && time.Since(b.openedAt) >= b.cfg.openFor() {
+		return circuitHalfOpen
+	}
+
+	return b.state
+}
+
+// available reports if the breaker would let a request through, without using up one of the trials of a
+// half-open circuit.
+func (b *breaker) available() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case circuitOpen:
+		if time.Since(b.openedAt) < b.cfg.openFor() {
+			return false
+		}
+
+		// the next request becomes the first trial
+		return true
+	case circuitHalfOpen:
+		return b.trials < b.cfg.halfOpenRequests()
+	}
+
+	return true
+}
+
+// retryAfter returns the time until the breaker lets requests through again.
+func (b *breaker) retryAfter() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state != circuitOpen {
+		return 0
+	}
+
+	if d := b.cfg.openFor() - time.Since(b.openedAt); d > 0 {
+		return d
+	}
+
+	return 0
+}
+
+func (cb CircuitBreaker) failureRate() float64 {
+	if cb.FailureRate > 0 {
+		return cb.FailureRate
+	}
+
+	return DefaultFailureRate
+}
+
+func (cb CircuitBreaker) minRequests() int {
+	if cb.MinRequests > 0 {
+		return cb.MinRequests
+	}
+
+	return DefaultMinRequests
+}
+
+func (cb CircuitBreaker) window() time.Duration {
+	if cb.Window > 0 {
+		return time.Duration(cb.Window)
+	}
+
+	return DefaultBreakerWindow
+}
+
+func (cb CircuitBreaker) openFor() time.Duration {
+	if cb.OpenFor > 0 {
+		return time.Duration(cb.OpenFor)
+	}
+
+	return DefaultOpenFor
+}
+
+func (cb CircuitBreaker) halfOpenRequests() int {
+	if cb.HalfOpenRequests > 0 {
+		return cb.HalfOpenRequests
+	}
+
+	return DefaultHalfOpenRequests
+}
+
+// breakerTransport only forwards requests to upstreams whose circuit lets them through and reports their
+// outcome. Connection errors, timeouts and responses with a http 502, 503 or 504 count as failures, while other
+// errors are the application's, e.g. a http 500 caused by a bad request.
+type breakerTransport struct {
+	next http.RoundTripper
+}
+
+func (t *breakerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	b := upstreamOf(r).breaker
+
+	generation, ok := b.allow()
+	if !ok {
+		return nil, errCircuitOpen
+	}
+
+	resp, err := t.next.RoundTrip(r)
+
+	switch {
+	case err != nil && r.Context().Err() == context.Canceled:
+		b.release(generation)
+	case err != nil:
+		b.report(generation, true)
+	default:
+		b.report(generation, gatewayFailure(resp.StatusCode))
+	}
+
+	return resp, err
+}
+
+type fallbackKey struct{}
+
+// fallbackCacheKey returns the key of the request's response in the fallback cache. Responses are only shared
+// between the requests of the same user.
+func fallbackCacheKey(r *http.Request) string {
+	return r.Header.Get("UID") + " " + r.URL.RequestURI()
+}
+
+type cachedResponse struct {
+	header   http.Header
+	body     []byte
+	storedAt time.Time
+}
+
+// responseCache keeps the last successful response of GET requests for FallbackCached.
+type responseCache struct {
+	maxAge time.Duration
+
+	mu      sync.Mutex
+	entries map[string]cachedResponse
+}
+
+func newResponseCache(maxAge time.Duration) *responseCache {
+	return &responseCache{maxAge: maxAge, entries: make(map[string]cachedResponse)}
+}
+
+func (c *responseCache) store(key string, header http.Header, body []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= maxCachedResponses {
+		c.evictExpired()
+
+		// make room by evicting an arbitrary entry
+		for k := range c.entries {
+			if len(c.entries) < maxCachedResponses {
+				break
+			}
+
+			delete(c.entries, k)
+		}
+	}
+
+	c.entries[key] = cachedResponse{header: header, body: body, storedAt: time.Now()}
+}
+
+func (c *responseCache) evictExpired() {
+	for k, e := range c.entries {
+		if time.Since(e.storedAt) > c.maxAge {
+			delete(c.entries, k)
+		}
+	}
+}
+
+func (c *responseCache) load(key string) (cachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok || time.Since(e.storedAt) > c.maxAge {
+		return cachedResponse{}, false
+	}
+
+	return e, true
+}
+
+// recordingBody passes the body of a response to store once it has been read completely, unless it's larger
+// than limit.
+type recordingBody struct {
+	io.ReadCloser
+
+	limit    int
+	store    func(body []byte)
+	buf      bytes.Buffer
+	tooLarge bool
+	stored   bool
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+
+	if !b.tooLarge {
+		b.buf.Write(p[:n])
+
+		if b.buf.Len() > b.limit {
+			b.tooLarge = true
+			b.buf = bytes.Buffer{}
+		}
+	}
+
+	if err == io.EOF && !b.tooLarge && !b.stored {
+		b.stored = true
+		b.store(append([]byte{}, b.buf.Bytes()...))
+	}
+
+	return n, err
+}
+
+// recordForFallback makes successful responses to GET requests available to FallbackCached.
+func (h *Handler) recordForFallback(resp *http.Response) {
+	key, _ := resp.Request.Context().Value(fallbackKey{}).(string)
+	if h.fallbackCache == nil || key == "" || resp.StatusCode != http.StatusOK {
+		return
+	}
+
+	header := resp.Header.Clone()
+	header.Del("Set-Cookie")
+
+	resp.Body = &recordingBody{ReadCloser: resp.Body, limit: maxCachedBodySize, store: func(body []byte) {
+		h.fallbackCache.store(key, header, body)
+	}}
+}
+
+// retryAfter returns the time until the circuit of the request's upstream lets requests through again. Requests
+// which couldn't be forwarded to any upstream wait for the first circuit of the pool.
+func (h *Handler) retryAfter(r *http.Request) time.Duration {
+	if u, ok := r.Context().Value(upstreamKey{}).(*Upstream); ok {
+		return u.breaker.retryAfter()
+	}
+
+	var min time.Duration
+
+	for _, u := range h.upstreams {
+		if d := u.breaker.retryAfter(); d > 0 && (min == 0 || d < min) {
+			min = d
+		}
+	}
+
+	return min
+}
+
+// circuitsOpen reports if open circuits keep upstreams out of the pool which are healthy otherwise, so that
+// requests which couldn't be forwarded to any upstream get the circuit breaker's fallback.
+func (h *Handler) circuitsOpen() bool {
+	if h.route.CircuitBreaker == nil {
+		return false
+	}
+
+	for _, u := range h.upstreams {
+		if u.healthy() && !u.breaker.available() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// problem is a problem document as described in RFC 7807 with the machine-readable code used by all error
+// responses of the proxy.
+type problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail"`
+	Code   string `json:"code"`
+}
+
+// fallback responds to a request which wasn't forwarded because the upstream's circuit is open.
+func (h *Handler) fallback(w http.ResponseWriter, r *http.Request) {
+	fb := h.route.CircuitBreaker.Fallback
+
+	switch fb.Type {
+	case FallbackStatic:
+		status := fb.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Fallback", FallbackStatic)
+		w.WriteHeader(status)
+		w.Write([]byte(fb.Body))
+
+		return
+	case FallbackCached:
+		key, _ := r.Context().Value(fallbackKey{}).(string)
+
+		if e, ok := h.fallbackCache.load(key); key != "" && ok {
+			for k, v := range e.header {
+				w.Header()[k] = v
+			}
+
+			w.Header().Set("Age", strconv.Itoa(int(time.Since(e.storedAt).Seconds())))
+			w.Header().Set("X-Fallback", FallbackCached)
+			w.Write(e.body)
+
+			return
+		}
+	}
+
+	if d := h.retryAfter(r); d > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(http.StatusServiceUnavailable)
+
+	err := json.NewEncoder(w).Encode(problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(http.StatusServiceUnavailable),
+		Status: http.StatusServiceUnavailable,
+		Detail: "The service is temporarily unavailable. Please try again later.",
+		Code:   "circuit_open",
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
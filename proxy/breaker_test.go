@@ -0,0 +1,182 @@
+package proxy_test
+
+import (
+	"auth-proxy/proxy"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyUpstream returns an upstream responding with a http 502 while failing is set.
+func flakyUpstream(failing *int32) *testUpstream {
+	return newUpstream(func(w http.ResponseWriter, r *http.Request, n int32) {
+		if atomic.LoadInt32(failing) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		w.Write([]byte(`{"symbol": "AAPL", "user": "` + r.Header.Get("UID") + `"}`))
+	})
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	failing := int32(1)
+
+	upstream := flakyUpstream(&failing)
+	defer upstream.Close()
+
+	h := newHandler(t, proxy.Route{CircuitBreaker: &proxy.CircuitBreaker{}}, upstream.Server)
+
+	for i := 0; i < 4; i++ {
+		if rr := get(h, "GET", "/api/stocks"); rr.Code != http.StatusBadGateway {
+			t.Fatalf("Expected status code %d but got %d while the circuit is closed", http.StatusBadGateway, rr.Code)
+		}
+	}
+
+	rr := get(h, "GET", "/api/stocks")
+	if rr.Code != http.StatusServiceUnavailable || upstream.Received() != 4 {
+		t.Fatalf("Expected the request to be rejected without reaching the upstream but got %d after %d requests", rr.Code, upstream.Received())
+	}
+
+	if ct := rr.Header().Get("Content-Type"); ct != "application/problem+json" || rr.Header().Get("Retry-After") != "1" {
+		t.Errorf("Expected a problem document with a Retry-After header but got %v", rr.Header())
+	}
+
+	var doc map[string]interface{}
+	if err := json.NewDecoder(rr.Body).Decode(&doc); err != nil {
+		t.Fatal(err)
+	}
+
+	if doc["code"] != "circuit_open" || doc["status"] != float64(http.StatusServiceUnavailable) {
+		t.Errorf("Unexpected problem document %v", doc)
+	}
+
+	if st := h.Upstreams()[0].Status(); st.Circuit != "open" {
+		t.Errorf("Expected the circuit to be reported as open but got %q", st.Circuit)
+	}
+
+	// a failed trial request opens the circuit again
+	time.Sleep(time.Millisecond * 60)
+
+	if rr := get(h, "GET", "/api/stocks"); rr.Code != http.StatusBadGateway || upstream.Received() != 5 {
+		t.Fatalf("Expected a trial request to reach the upstream but got %d after %d requests", rr.Code, upstream.Received())
+	}
+
+	if rr := get(h, "GET", "/api/stocks"); rr.Code != http.StatusServiceUnavailable || upstream.Received() != 5 {
+		t.Fatalf("Expected the circuit to open again after a failed trial but got %d after %d requests", rr.Code, upstream.Received())
+	}
+
+	// a successful trial request closes it
+	atomic.StoreInt32(&failing, 0)
+	time.Sleep(time.Millisecond * 60)
+
+	for i := 0; i < 3; i++ {
+		if rr := get(h, "GET", "/api/stocks"); rr.Code != http.StatusOK {
+			t.Fatalf("Expected status code %d but got %d after the upstream recovered", http.StatusOK, rr.Code)
+		}
+	}
+
+	if st := h.Upstreams()[0].Status(); st.Circuit != "closed" {
+		t.Errorf("Expected the circuit to be reported as closed but got %q", st.Circuit)
+	}
+}
+
+func TestStaticFallback(t *testing.T) {
+	failing := int32(1)
+
+	upstream := flakyUpstream(&failing)
+	defer upstream.Close()
+
+	h := newHandler(t, proxy.Route{CircuitBreaker: &proxy.CircuitBreaker{Fallback: proxy.Fallback{Type: proxy.FallbackStatic, Body: `{"quotes": []}`}}}, upstream.Server)
+
+	for i := 0; i < 4; i++ {
+		get(h, "GET", "/api/stocks")
+	}
+
+	rr := get(h, "GET", "/api/stocks")
+	if rr.Code != http.StatusOK || rr.Body.String() != `{"quotes": []}` || rr.Header().Get("X-Fallback") != proxy.FallbackStatic {
+		t.Errorf("Expected the static fallback but got %d %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestCachedFallback(t *testing.T) {
+	failing := int32(0)
+
+	upstream := flakyUpstream(&failing)
+	defer upstream.Close()
+
+	h := newHandler(t, proxy.Route{CircuitBreaker: &proxy.CircuitBreaker{Fallback: proxy.Fallback{Type: proxy.FallbackCached}}}, upstream.Server)
+
+	fresh := getAs(h, "1", "/api/stocks/AAPL").Body.String()
+
+	atomic.StoreInt32(&failing, 1)
+
+	for i := 0; i < 4; i++ {
+		getAs(h, "1", "/api/stocks/AAPL")
+	}
+
+	rr := getAs(h, "1", "/api/stocks/AAPL")
+	if rr.Code != http.StatusOK || rr.Body.String() != fresh || rr.Header().Get("X-Fallback") != proxy.FallbackCached {
+		t.Errorf("Expected the cached response %s but got %d %s", fresh, rr.Code, rr.Body.String())
+	}
+
+	// responses aren't shared between users
+	if rr := getAs(h, "2", "/api/stocks/AAPL"); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status code %d but got %d for another user", http.StatusServiceUnavailable, rr.Code)
+	}
+
+	if rr := getAs(h, "1", "/api/stocks/MSFT"); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status code %d but got %d for an uncached path", http.StatusServiceUnavailable, rr.Code)
+	}
+}
+
+func TestCircuitBreakerSkipsOpenCircuits(t *testing.T) {
+	failing, healthy := int32(1), int32(0)
+
+	broken := flakyUpstream(&failing)
+	defer broken.Close()
+
+	upstream := flakyUpstream(&healthy)
+	defer upstream.Close()
+
+	h := newHandler(t, proxy.Route{CircuitBreaker: &proxy.CircuitBreaker{}}, broken.Server, upstream.Server)
+
+	for i := 0; i < 8; i++ {
+		get(h, "GET", "/api/stocks")
+	}
+
+	if st := h.Upstreams()[0].Status(); st.Circuit != "open" {
+		t.Fatalf("Expected the circuit of the failing upstream to be open but got %q", st.Circuit)
+	}
+
+	for i := 0; i < 4; i++ {
+		if rr := get(h, "GET", "/api/stocks"); rr.Code != http.StatusOK || rr.Header().Get("X-Fallback") != "" {
+			t.Fatalf("Expected the request to be forwarded to the healthy upstream but got %d", rr.Code)
+		}
+	}
+
+	if broken.Received() != 4 || upstream.Received() != 8 {
+		t.Errorf("Expected the open circuit to be skipped but the upstreams got %d and %d requests", broken.Received(), upstream.Received())
+	}
+}
+
+func TestCircuitBreakerIgnoresApplicationErrors(t *testing.T) {
+	upstream := newUpstream(func(w http.ResponseWriter, r *http.Request, n int32) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	defer upstream.Close()
+
+	h := newHandler(t, proxy.Route{CircuitBreaker: &proxy.CircuitBreaker{}}, upstream.Server)
+
+	for i := 0; i < 8; i++ {
+		if rr := get(h, "GET", "/api/stocks"); rr.Code != http.StatusInternalServerError {
+			t.Fatalf("Expected the application's error to be passed on but got %d", rr.Code)
+		}
+	}
+
+	if st := h.Upstreams()[0].Status(); st.Circuit != "closed" || upstream.Received() != 8 {
+		t.Errorf("Expected the circuit to stay closed but got %q after %d requests", st.Circuit, upstream.Received())
+	}
+}
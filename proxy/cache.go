@@ -0,0 +1,349 @@
+package proxy
+
+import (
+	"container/list"
+	"context"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultCacheSize is the default memory bound of a route's response cache in bytes.
+const DefaultCacheSize = 16 << 20
+
+// CacheHeader tells the client if a response was served from the cache. Its value is either HIT, STALE or MISS.
+const CacheHeader = "X-Cache"
+
+type cacheKey struct{}
+
+// cacheEntry is a cached response.
+type cacheEntry struct {
+	key      string
+	header   http.Header
+	body     []byte
+	storedAt time.Time
+	// ttl defines how long the response is fresh and swr how long it may be served afterwards while it's refreshed
+	ttl          time.Duration
+	swr          time.Duration
+	size         int
+	revalidating bool
+}
+
+// routeCache is a route's response cache. Once its size exceeds maxSize, the least recently used responses are
+// evicted.
+type routeCache struct {
+	cfg     Cache
+	maxSize int
+
+	mu    sync.Mutex
+	size  int
+	lru   *list.List
+	items map[string]*list.Element
+}
+
+func newRouteCache(cfg Cache) *routeCache {
+	maxSize := cfg.MaxSize
+	if maxSize <= 0 {
+		maxSize = DefaultCacheSize
+	}
+
+	return &routeCache{cfg: cfg, maxSize: maxSize, lru: list.New(), items: make(map[string]*list.Element)}
+}
+
+// requestKey returns the key of a GET request, which includes the values of the headers in vary. The encoding
+// is always part of the key, so that compressed responses are only passed to clients which accept them.
+func requestKey(r *http.Request, vary []string) string {
+	var b strings.Builder
+
+	b.WriteString(r.URL.RequestURI())
+
+	for _, h := range append([]string{"Accept-Encoding"}, vary...) {
+		b.WriteString("\n" + textproto.CanonicalMIMEHeaderKey(h) + ": " + r.Header.Get(h))
+	}
+
+	return b.String()
+}
+
+// cacheable reports if a request may be answered from the cache. Streams are never cached and clients can bypass
+// it with a Cache-Control header containing no-cache or no-store.
+func cacheable(r *http.Request) bool {
+	if r.Method != "GET" || mayStream(r) {
+		return false
+	}
+
+	cc := parseCacheControl(r.Header.Get("Cache-Control"))
+	_, noCache := cc["no-cache"]
+	_, noStore := cc["no-store"]
+
+	return !noCache && !noStore
+}
+
+// lookup returns the entry of the key and moves it to the front of the LRU list.
+func (c *routeCache) lookup(key string) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	e := el.Value.(*cacheEntry)
+
+	if time.Since(e.storedAt) > e.ttl+e.swr {
+		c.remove(el)
+		return nil, false
+	}
+
+	c.lru.MoveToFront(el)
+
+	return e, true
+}
+
+func (c *routeCache) store(e *cacheEntry) {
+	e.size = len(e.key) + len(e.body)
+	for k, vs := range e.header {
+		for _, v := range vs {
+			e.size += len(k) + len(v)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[e.key]; ok {
+		c.remove(el)
+	}
+
+	if e.size > c.maxSize {
+		return
+	}
+
+	c.items[e.key] = c.lru.PushFront(e)
+	c.size += e.size
+
+	for c.size > c.maxSize {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *routeCache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*cacheEntry)
+	delete(c.items, e.key)
+	c.size -= e.size
+}
+
+// startRevalidation reports if the stale entry should be refreshed. Only one refresh per entry runs at a time.
+func (c *routeCache) startRevalidation(e *cacheEntry) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e.revalidating {
+		return false
+	}
+
+	e.revalidating = true
+
+	return true
+}
+
+func (c *routeCache) endRevalidation(e *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e.revalidating = false
+}
+
+// parseCacheControl returns the directives of a Cache-Control header by their lowercase name.
+func parseCacheControl(header string) map[string]string {
+	directives := make(map[string]string)
+
+	for _, d := range strings.Split(header, ",") {
+		d = strings.TrimSpace(d)
+		if d == "" {
+			continue
+		}
+
+		name, value := d, ""
+		if i := strings.Index(d, "="); i >= 0 {
+			name, value = d[:i], strings.Trim(d[i+1:], `"`)
+		}
+
+		directives[strings.ToLower(name)] = value
+	}
+
+	return directives
+}
+
+func seconds(directives map[string]string, name string) (time.Duration, bool) {
+	v, ok := directives[name]
+	if !ok {
+		return 0, false
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, true
+	}
+
+	return time.Duration(n) * time.Second, true
+}
+
+// entryOf returns the cache entry of a response or false if it mustn't be cached. Only 200 responses without
+// cookies are cached. Their Cache-Control header is respected: the s-maxage or max-age take precedence over the
+// route's TTL and private responses are only cached if they vary by the UID. Responses varying by headers the
+// route doesn't vary by aren't cached.
+func (c *routeCache) entryOf(key string, resp *http.Response) (*cacheEntry, bool) {
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Set-Cookie") != "" {
+		return nil, false
+	}
+
+	cc := parseCacheControl(resp.Header.Get("Cache-Control"))
+
+	for _, d := range []string{"no-store", "no-cache"} {
+		if _, ok := cc[d]; ok {
+			return nil, false
+		}
+	}
+
+	if _, ok := cc["private"]; ok && !c.variesBy("UID") {
+		return nil, false
+	}
+
+	for _, vary := range resp.Header.Values("Vary") {
+		for _, h := range strings.Split(vary, ",") {
+			h = strings.TrimSpace(h)
+			if h == "*" || (h != "" && !c.variesBy(h)) {
+				return nil, false
+			}
+		}
+	}
+
+	ttl := time.Duration(c.cfg.TTL)
+	if d, ok := seconds(cc, "max-age"); ok {
+		ttl = d
+	}
+
+	if d, ok := seconds(cc, "s-maxage"); ok {
+		ttl = d
+	}
+
+	if ttl <= 0 {
+		return nil, false
+	}
+
+	swr := time.Duration(c.cfg.StaleWhileRevalidate)
+	if d, ok := seconds(cc, "stale-while-revalidate"); ok {
+		swr = d
+	}
+
+	header := resp.Header.Clone()
+	header.Del(CacheHeader)
+
+	return &cacheEntry{key: key, header: header, storedAt: time.Now(), ttl: ttl, swr: swr}, true
+}
+
+func (c *routeCache) variesBy(header string) bool {
+	header = textproto.CanonicalMIMEHeaderKey(header)
+	if header == "Accept-Encoding" {
+		return true
+	}
+
+	for _, h := range c.cfg.Vary {
+		if textproto.CanonicalMIMEHeaderKey(h) == header {
+			return true
+		}
+	}
+
+	return false
+}
+
+// recordForCache stores cacheable responses once their body has been read.
+func (h *Handler) recordForCache(resp *http.Response) {
+	key, _ := resp.Request.Context().Value(cacheKey{}).(string)
+	if h.cache == nil || key == "" {
+		return
+	}
+
+	resp.Header.Set(CacheHeader, "MISS")
+
+	e, ok := h.cache.entryOf(key, resp)
+	if !ok {
+		return
+	}
+
+	resp.Body = &recordingBody{ReadCloser: resp.Body, limit: h.cache.maxSize, store: func(body []byte) {
+		e.body = body
+		h.cache.store(e)
+	}}
+}
+
+// serveCached answers the request from the cache. Stale responses are served while they're refreshed in the
+// background. On a miss, the request is forwarded and its response stored.
+func (h *Handler) serveCached(w http.ResponseWriter, r *http.Request) {
+	key := requestKey(r, h.cache.cfg.Vary)
+
+	e, ok := h.cache.lookup(key)
+	if !ok {
+		h.fetch(w, r.WithContext(context.WithValue(r.Context(), cacheKey{}, key)))
+		return
+	}
+
+	age := time.Since(e.storedAt)
+	status := "HIT"
+
+	if age > e.ttl {
+		status = "STALE"
+
+		if h.cache.startRevalidation(e) {
+			// the request belongs to the server once the handler returned, so the background request is a copy
+			// which isn't tied to the client
+			ctx, cancel := context.WithTimeout(context.Background(), h.revalidationTimeout())
+			go h.revalidate(r.Clone(context.WithValue(ctx, cacheKey{}, key)), cancel, e)
+		}
+	}
+
+	for k, v := range e.header {
+		w.Header()[k] = v
+	}
+
+	w.Header().Set("Age", strconv.Itoa(int(age.Seconds())))
+	w.Header().Set(CacheHeader, status)
+	w.Write(e.body)
+}
+
+// revalidate refreshes a stale entry with the request, which may be coalesced with identical ones in flight.
+// Cancel is called once it's done.
+func (h *Handler) revalidate(r *http.Request, cancel context.CancelFunc, stale *cacheEntry) {
+	defer h.cache.endRevalidation(stale)
+	defer cancel()
+
+	h.fetch(&discardWriter{header: make(http.Header)}, r)
+}
+
+// revalidationTimeout returns how long the refresh of a stale entry may take.
+func (h *Handler) revalidationTimeout() time.Duration {
+	if h.route.Timeout > 0 {
+		return time.Duration(h.route.Timeout)
+	}
+
+	return 30 * time.Second
+}
+
+// discardWriter is the response writer of background requests.
+type discardWriter struct {
+	header http.Header
+}
+
+func (w *discardWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (w *discardWriter) WriteHeader(status int) {}
@@ -0,0 +1,158 @@
+package proxy_test
+
+import (
+	"auth-proxy/proxy"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// countingUpstream responds with the number of the request and the Cache-Control header cc.
+func countingUpstream(cc string) *testUpstream {
+	return newUpstream(func(w http.ResponseWriter, r *http.Request, n int32) {
+		if cc != "" {
+			w.Header().Set("Cache-Control", cc)
+		}
+
+		w.Write([]byte(strconv.Itoa(int(n))))
+	})
+}
+
+func TestCache(t *testing.T) {
+	upstream := countingUpstream("")
+	defer upstream.Close()
+
+	h := newHandler(t, proxy.Route{Cache: &proxy.Cache{Vary: []string{"Lang"}}}, upstream.Server)
+
+	cases := []struct {
+		path         string
+		header       map[string]string
+		expectedBody string
+		expectedHit  string
+	}{
+		{"/api/news", map[string]string{"Lang": "en"}, "1", "MISS"},
+		{"/api/news", map[string]string{"Lang": "en", "UID": "2"}, "1", "HIT"},
+		{"/api/news", map[string]string{"Lang": "de"}, "2", "MISS"},
+		{"/api/news?page=2", map[string]string{"Lang": "en"}, "3", "MISS"},
+		{"/api/news", map[string]string{"Lang": "en", "Cache-Control": "no-cache"}, "4", ""},
+		{"/api/news", map[string]string{"Lang": "de"}, "2", "HIT"},
+	}
+
+	for _, i := range cases {
+		rr := request(h, "GET", i.path, nil, i.header)
+		if rr.Body.String() != i.expectedBody || rr.Header().Get(proxy.CacheHeader) != i.expectedHit {
+			t.Errorf("Expected %s (%s) but got %s (%s) when path=%s and header=%v", i.expectedBody, i.expectedHit, rr.Body.String(), rr.Header().Get(proxy.CacheHeader), i.path, i.header)
+		}
+	}
+
+	if rr := get(h, "POST", "/api/news"); rr.Header().Get(proxy.CacheHeader) != "" || rr.Body.String() != "5" {
+		t.Errorf("Expected POST requests not to be cached but got %s", rr.Body.String())
+	}
+}
+
+func TestCacheControl(t *testing.T) {
+	cases := []struct {
+		cc       string
+		vary     []string
+		expected bool
+	}{
+		{"max-age=60", nil, true},
+		{"no-store", nil, false},
+		{"no-cache", nil, false},
+		{"max-age=0", nil, false},
+		{"private, max-age=60", nil, false},
+		{"private, max-age=60", []string{"UID"}, true},
+	}
+
+	for _, i := range cases {
+		upstream := countingUpstream(i.cc)
+		h := newHandler(t, proxy.Route{Cache: &proxy.Cache{Vary: i.vary}}, upstream.Server)
+
+		getAs(h, "1", "/api/stocks/AAPL")
+		rr := getAs(h, "1", "/api/stocks/AAPL")
+		upstream.Close()
+
+		if cached := rr.Header().Get(proxy.CacheHeader) == "HIT"; cached != i.expected {
+			t.Errorf("Expected cached=%v but got %v when Cache-Control=%s and vary=%v", i.expected, cached, i.cc, i.vary)
+		}
+	}
+}
+
+func TestCacheVaryHeader(t *testing.T) {
+	upstream := newUpstream(func(w http.ResponseWriter, r *http.Request, n int32) {
+		w.Header().Set("Vary", "Accept-Language")
+	})
+	defer upstream.Close()
+
+	h := newHandler(t, proxy.Route{Cache: &proxy.Cache{}}, upstream.Server)
+
+	get(h, "GET", "/api/news")
+	get(h, "GET", "/api/news")
+
+	if upstream.Received() != 2 {
+		t.Errorf("Expected responses varying by other headers not to be cached but the upstream got %d requests", upstream.Received())
+	}
+}
+
+func TestCacheStaleWhileRevalidate(t *testing.T) {
+	upstream := countingUpstream("")
+	defer upstream.Close()
+
+	route := proxy.Route{Cache: &proxy.Cache{
+		TTL:                  proxy.Duration(time.Millisecond * 50),
+		StaleWhileRevalidate: proxy.Duration(time.Hour),
+	}}
+
+	h := newHandler(t, route, upstream.Server)
+
+	get(h, "GET", "/api/news")
+	time.Sleep(time.Millisecond * 60)
+
+	rr := get(h, "GET", "/api/news")
+	if rr.Body.String() != "1" || rr.Header().Get(proxy.CacheHeader) != "STALE" {
+		t.Fatalf("Expected the stale response but got %s (%s)", rr.Body.String(), rr.Header().Get(proxy.CacheHeader))
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for get(h, "GET", "/api/news").Body.String() != "2" && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 5)
+	}
+
+	rr = get(h, "GET", "/api/news")
+	if rr.Body.String() != "2" || rr.Header().Get(proxy.CacheHeader) != "HIT" || upstream.Received() != 2 {
+		t.Errorf("Expected the response to be refreshed once in the background but got %s (%s) after %d requests", rr.Body.String(), rr.Header().Get(proxy.CacheHeader), upstream.Received())
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	upstream := newUpstream(func(w http.ResponseWriter, r *http.Request, n int32) {
+		w.Write([]byte(strings.Repeat("x", 100)))
+	})
+	defer upstream.Close()
+
+	// two responses fit into the cache
+	h := newHandler(t, proxy.Route{Cache: &proxy.Cache{MaxSize: 500}}, upstream.Server)
+
+	get(h, "GET", "/api/news/a")
+	get(h, "GET", "/api/news/b")
+	get(h, "GET", "/api/news/a")
+	get(h, "GET", "/api/news/c")
+
+	// the least recently used response is checked last, since the miss stores it again
+	expected := []struct {
+		path string
+		hit  string
+	}{
+		{"/api/news/a", "HIT"},
+		{"/api/news/c", "HIT"},
+		{"/api/news/b", "MISS"},
+	}
+
+	for _, i := range expected {
+		if got := get(h, "GET", i.path).Header().Get(proxy.CacheHeader); got != i.hit {
+			t.Errorf("Expected %s when path=%s but got %s", i.hit, i.path, got)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"auth-proxy/config"
+	"auth-proxy/internal"
+	"net/http"
+	"strconv"
+)
+
+// PoolHeader names the pool which forwarded the request to a route with a canary. Users allowed to override the
+// pool choose it by sending the header.
+const PoolHeader = "X-Upstream-Pool"
+
+// StablePool is the name of the pool of a route's own upstreams.
+const StablePool = "stable"
+
+// weightBuckets is the number of buckets the users are hashed into, so that weights with two decimals are
+// exact.
+const weightBuckets = 10000
+
+// canary assigns the requests of a route to its pools.
+type canary struct {
+	route         string
+	pools         []*pool
+	overrideRoles []string
+}
+
+// pool is a pool of a canary, whose requests are forwarded by its own handler.
+type pool struct {
+	Pool
+	handler *Handler
+	uids    map[uint64]bool
+}
+
+// newCanary returns the canary of the route, whose pools forward the requests like the route's handler does,
+// but to their own upstreams.
+func newCanary(route Route) (*canary, error) {
+	c := &canary{route: route.Name, overrideRoles: route.Canary.OverrideRoles}
+	if len(c.overrideRoles) == 0 {
+		c.overrideRoles = []string{config.RoleAdmin}
+	}
+
+	for _, p := range route.Canary.Pools {
+		sub := route
+		sub.Upstreams = p.Upstreams
+		sub.Versions = nil
+		sub.Canary = nil
+
+		h, err := New(sub)
+		if err != nil {
+			c.close()
+			return nil, err
+		}
+
+		uids := make(map[uint64]bool, len(p.UIDs))
+		for _, uid := range p.UIDs {
+			uids[uid] = true
+		}
+
+		c.pools = append(c.pools, &pool{Pool: p, handler: h, uids: uids})
+	}
+
+	return c, nil
+}
+
+func (c *canary) close() {
+	for _, p := range c.pools {
+		p.handler.Close()
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// pick returns the pool of the request or nil for the route's own upstreams. The PoolHeader of users allowed to
+// override the pool takes precedence over the uids and roles of the pools, which take precedence over the
+// weights. Requests without a uid are assigned by the client's ip. The role is the one of the authenticated user,
+// so requests on behalf of another user are only assigned by the uid of that user. The PoolHeader is removed, as
+// it's meant for the proxy.
+func (c *canary) pick(r *http.Request) *pool {
+	role, _ := internal.RoleFromContext(r.Context())
+	if r.Header.Get("Actor-UID") != "" {
+		role = ""
+	}
+
+	name := r.Header.Get(PoolHeader)
+	r.Header.Del(PoolHeader)
+
+	if name != "" && role != "" && contains(c.overrideRoles, role) {
+		if name == StablePool {
+			return nil
+		}
+
+		for _, p := range c.pools {
+			if p.Name == name {
+				return p
+			}
+		}
+	}
+
+	uid := r.Header.Get("UID")
+	n, err := strconv.ParseUint(uid, 10, 64)
+
+	for _, p := range c.pools {
+		if (err == nil && p.uids[n]) || (role != "" && contains(p.Roles, role)) {
+			return p
+		}
+	}
+
+	key := uid
+	if key == "" {
+		key = internal.ClientIP(r).String()
+	}
+
+	bucket := float64(hash(c.route+"#"+key) % weightBuckets)
+
+	var until float64
+
+	for _, p := range c.pools {
+		until += p.Weight * weightBuckets / 100
+		if bucket < until {
+			return p
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,170 @@
+package proxy_test
+
+import (
+	"auth-proxy/internal"
+	"auth-proxy/proxy"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func canaryRoute(stable, canary *httptest.Server, weight float64) proxy.Route {
+	return proxy.Route{
+		Name:      "news",
+		Upstreams: []string{stable.URL},
+		Canary: &proxy.Canary{
+			Pools: []proxy.Pool{{Name: "canary", Weight: weight, Upstreams: []string{canary.URL}, UIDs: []uint64{7}, Roles: []string{"tester"}}},
+		},
+	}
+}
+
+// poolOf returns the pool the request of the user with the role is forwarded to.
+func poolOf(h *proxy.Handler, uid, role, override string) string {
+	r := httptest.NewRequest("GET", "/api/news", nil)
+	r.Header.Set("UID", uid)
+
+	if role != "" {
+		r = r.WithContext(internal.WithRole(r.Context(), role))
+	}
+
+	if override != "" {
+		r.Header.Set(proxy.PoolHeader, override)
+	}
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, r)
+
+	return rr.Header().Get(proxy.PoolHeader)
+}
+
+func TestCanaryWeights(t *testing.T) {
+	stable, canary := namedUpstream("stable"), namedUpstream("canary")
+	defer stable.Close()
+	defer canary.Close()
+
+	h := newHandler(t, canaryRoute(stable, canary, 5))
+	defer h.Close()
+
+	users := 2000
+	inCanary := make(map[string]bool)
+
+	for i := 100; i < 100+users; i++ {
+		uid := strconv.Itoa(i)
+
+		rr := getAs(h, uid, "/api/news")
+		if pool := rr.Header().Get(proxy.PoolHeader); pool == "canary" {
+			inCanary[uid] = true
+
+			if rr.Body.String() != "canary /api/news " {
+				t.Fatalf("Expected the canary's upstream to respond but got %q", rr.Body.String())
+			}
+		}
+
+		if pool, again := rr.Header().Get(proxy.PoolHeader), getAs(h, uid, "/api/news").Header().Get(proxy.PoolHeader); pool != again {
+			t.Fatalf("Expected user %s to stay in the pool %s but got %s", uid, pool, again)
+		}
+	}
+
+	if share := float64(len(inCanary)) / float64(users); share < 0.03 || share > 0.07 {
+		t.Errorf("Expected about 5%% of the users in the canary but got %.1f%%", share*100)
+	}
+
+	// raising the weight only adds users to the canary
+	h = newHandler(t, canaryRoute(stable, canary, 20))
+	defer h.Close()
+
+	for uid := range inCanary {
+		if pool := getAs(h, uid, "/api/news").Header().Get(proxy.PoolHeader); pool != "canary" {
+			t.Errorf("Expected user %s to stay in the canary after raising its weight but got %s", uid, pool)
+		}
+	}
+}
+
+func TestCanaryCohorts(t *testing.T) {
+	stable, canary := namedUpstream("stable"), namedUpstream("canary")
+	defer stable.Close()
+	defer canary.Close()
+
+	h := newHandler(t, canaryRoute(stable, canary, 0))
+	defer h.Close()
+
+	cases := []struct {
+		uid      string
+		role     string
+		override string
+		expected string
+	}{
+		{"1", "user", "", proxy.StablePool},
+		{"7", "user", "", "canary"},
+		{"1", "tester", "", "canary"},
+		{"1", "admin", "canary", "canary"},
+		{"7", "admin", proxy.StablePool, proxy.StablePool},
+		{"1", "user", "canary", proxy.StablePool},
+		{"1", "", "canary", proxy.StablePool},
+	}
+
+	for _, i := range cases {
+		if pool := poolOf(h, i.uid, i.role, i.override); pool != i.expected {
+			t.Errorf("Expected the pool %s but got %s when uid=%s, role=%s, override=%s", i.expected, pool, i.uid, i.role, i.override)
+		}
+	}
+}
+
+func TestCanaryDelegation(t *testing.T) {
+	stable, canary := namedUpstream("stable"), namedUpstream("canary")
+	defer stable.Close()
+	defer canary.Close()
+
+	h := newHandler(t, canaryRoute(stable, canary, 0))
+	defer h.Close()
+
+	// the role belongs to the acting user, not to the user whose uid is forwarded
+	for _, override := range []string{"", "canary"} {
+		r := httptest.NewRequest("GET", "/api/news", nil)
+		r.Header.Set("UID", "1")
+		r.Header.Set("Actor-UID", "2")
+		r = r.WithContext(internal.WithRole(r.Context(), "admin"))
+
+		if override != "" {
+			r.Header.Set(proxy.PoolHeader, override)
+		}
+
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, r)
+
+		if pool := rr.Header().Get(proxy.PoolHeader); pool != proxy.StablePool {
+			t.Errorf("Expected a delegated request to use the principal's pool but got %s when override=%s", pool, override)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/api/news", nil)
+	r.Header.Set("UID", "7")
+	r.Header.Set("Actor-UID", "2")
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, r)
+
+	if pool := rr.Header().Get(proxy.PoolHeader); pool != "canary" {
+		t.Errorf("Expected a delegated request to use the principal's pool but got %s", pool)
+	}
+}
+
+func TestCanaryOverrideNotForwarded(t *testing.T) {
+	received := make(chan string, 2)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Get(proxy.PoolHeader)
+	}))
+	defer upstream.Close()
+
+	h := newHandler(t, canaryRoute(upstream, upstream, 0))
+	defer h.Close()
+
+	for _, role := range []string{"admin", "user"} {
+		poolOf(h, "1", role, "canary")
+
+		if header := <-received; header != "" {
+			t.Errorf("Expected the %s header not to be forwarded but got %q when role=%s", proxy.PoolHeader, header, role)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+)
+
+// CoalescedHeader marks responses which were shared with an identical request in flight.
+const CoalescedHeader = "X-Coalesced"
+
+// maxCoalescedBody is the largest response which is shared between coalesced requests.
+const maxCoalescedBody = 1 << 20
+
+// call is a request in flight which identical requests wait for.
+type call struct {
+	done chan struct{}
+
+	// the response, which is only valid if shared is set once done is closed
+	status int
+	header http.Header
+	body   bytes.Buffer
+	shared bool
+}
+
+// coalescer tracks the GET requests in flight by their key.
+type coalescer struct {
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+func newCoalescer() *coalescer {
+	return &coalescer{calls: make(map[string]*call)}
+}
+
+// join returns the call of the key and reports if the caller leads it, i.e. has to make the request.
+func (c *coalescer) join(key string) (*call, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cl, ok := c.calls[key]; ok {
+		return cl, false
+	}
+
+	cl := &call{done: make(chan struct{})}
+	c.calls[key] = cl
+
+	return cl, true
+}
+
+// leave ends the call of the key, so that its response is passed to the waiting requests and new requests start
+// a new call.
+func (c *coalescer) leave(key string, cl *call) {
+	c.mu.Lock()
+	delete(c.calls, key)
+	c.mu.Unlock()
+
+	close(cl.done)
+}
+
+// fetch forwards the request. If the route coalesces requests, identical GET requests in flight share one
+// upstream response: the first one is forwarded and the others wait for its response. If the response can't be
+// shared, because it's too large, sets cookies or the first client went away, the others are forwarded on their
+// own.
+func (h *Handler) fetch(w http.ResponseWriter, r *http.Request) {
+	if h.coalescer == nil || r.Method != "GET" || mayStream(r) {
+		h.forward(w, r)
+		return
+	}
+
+	key := requestKey(r, h.route.Coalesce.Vary)
+
+	cl, leader := h.coalescer.join(key)
+	if leader {
+		tw := &teeWriter{w: w, header: make(http.Header), call: cl}
+		h.forward(tw, r)
+
+		cl.shared = tw.wroteHeader && !tw.tooLarge && r.Context().Err() == nil && cl.header.Get("Set-Cookie") == ""
+		h.coalescer.leave(key, cl)
+
+		return
+	}
+
+	select {
+	case <-cl.done:
+	case <-r.Context().Done():
+		return
+	}
+
+	if !cl.shared {
+		h.forward(w, r)
+		return
+	}
+
+	for k, v := range cl.header {
+		w.Header()[k] = v
+	}
+
+	w.Header().Set(CoalescedHeader, "true")
+	w.WriteHeader(cl.status)
+	w.Write(cl.body.Bytes())
+}
+
+// teeWriter writes the response of the request leading a call to its client and keeps a copy for the waiting
+// requests. The response's headers are kept apart from the ones the client's response already has, e.g. its
+// csrf cookie.
+type teeWriter struct {
+	w      http.ResponseWriter
+	header http.Header
+	call   *call
+
+	wroteHeader bool
+	tooLarge    bool
+}
+
+func (t *teeWriter) Header() http.Header {
+	return t.header
+}
+
+func (t *teeWriter) WriteHeader(status int) {
+	if t.wroteHeader {
+		return
+	}
+
+	t.wroteHeader = true
+	t.call.status = status
+	t.call.header = t.header.Clone()
+
+	for k, v := range t.header {
+		t.w.Header()[k] = v
+	}
+
+	t.w.WriteHeader(status)
+}
+
+func (t *teeWriter) Write(b []byte) (int, error) {
+	if !t.wroteHeader {
+		t.WriteHeader(http.StatusOK)
+	}
+
+	if !t.tooLarge {
+		t.call.body.Write(b)
+
+		if t.call.body.Len() > maxCoalescedBody {
+			t.tooLarge = true
+			t.call.body = bytes.Buffer{}
+		}
+	}
+
+	return t.w.Write(b)
+}
+
+func (t *teeWriter) Flush() {
+	if f, ok := t.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
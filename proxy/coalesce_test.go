@@ -0,0 +1,118 @@
+package proxy_test
+
+import (
+	"auth-proxy/proxy"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockingUpstream responds with the number of the request once release is closed. If cookie is set, its
+// responses set a cookie.
+func blockingUpstream(release chan struct{}, cookie bool) *testUpstream {
+	return newUpstream(func(w http.ResponseWriter, r *http.Request, n int32) {
+		<-release
+
+		if cookie {
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: strconv.Itoa(int(n))})
+		}
+
+		w.Write([]byte(strconv.Itoa(int(n))))
+	})
+}
+
+// concurrently sends a GET request as each of the users at the same time and returns the responses once
+// release was closed.
+func concurrently(h http.Handler, release chan struct{}, uids ...string) []*httptest.ResponseRecorder {
+	responses := make([]*httptest.ResponseRecorder, len(uids))
+
+	var wg sync.WaitGroup
+
+	for i, uid := range uids {
+		wg.Add(1)
+
+		go func(i int, uid string) {
+			defer wg.Done()
+			responses[i] = getAs(h, uid, "/api/stocks/AAPL")
+		}(i, uid)
+	}
+
+	// give all requests time to reach the proxy
+	time.Sleep(time.Millisecond * 50)
+	close(release)
+	wg.Wait()
+
+	return responses
+}
+
+func TestCoalescing(t *testing.T) {
+	cases := []struct {
+		coalesce         *proxy.Coalesce
+		cookie           bool
+		uids             []string
+		expectedRequests int32
+	}{
+		{&proxy.Coalesce{}, false, []string{"1", "2", "3", "4", "5", "6"}, 1},
+		{&proxy.Coalesce{Vary: []string{"UID"}}, false, []string{"1", "2", "1", "2", "1", "2"}, 2},
+		{nil, false, []string{"1", "2", "3"}, 3},
+		{&proxy.Coalesce{}, true, []string{"1", "2", "3"}, 3},
+	}
+
+	for _, i := range cases {
+		release := make(chan struct{})
+
+		upstream := blockingUpstream(release, i.cookie)
+		h := newHandler(t, proxy.Route{Coalesce: i.coalesce}, upstream.Server)
+
+		responses := concurrently(h, release, i.uids...)
+		upstream.Close()
+
+		if upstream.Received() != i.expectedRequests {
+			t.Errorf("Expected %d upstream requests but got %d when coalesce=%+v and cookie=%v", i.expectedRequests, upstream.Received(), i.coalesce, i.cookie)
+		}
+
+		coalesced := 0
+		for _, rr := range responses {
+			if rr.Code != http.StatusOK {
+				t.Errorf("Expected status code %d but got %d", http.StatusOK, rr.Code)
+			}
+
+			if rr.Header().Get(proxy.CoalescedHeader) != "" {
+				coalesced++
+			}
+		}
+
+		if expected := len(i.uids) - int(i.expectedRequests); coalesced != expected {
+			t.Errorf("Expected %d coalesced responses but got %d when coalesce=%+v and cookie=%v", expected, coalesced, i.coalesce, i.cookie)
+		}
+	}
+}
+
+func TestCoalescingPerUser(t *testing.T) {
+	release := make(chan struct{})
+
+	upstream := blockingUpstream(release, false)
+	defer upstream.Close()
+
+	h := newHandler(t, proxy.Route{Coalesce: &proxy.Coalesce{Vary: []string{"UID"}}}, upstream.Server)
+
+	responses := concurrently(h, release, "1", "2", "1", "2")
+
+	bodies := map[string]string{}
+	for i, uid := range []string{"1", "2", "1", "2"} {
+		body := responses[i].Body.String()
+
+		if b, ok := bodies[uid]; ok && b != body {
+			t.Errorf("Expected the requests of user %s to share a response but got %s and %s", uid, b, body)
+		}
+
+		bodies[uid] = body
+	}
+
+	if bodies["1"] == bodies["2"] {
+		t.Error("Expected the users not to share a response")
+	}
+}
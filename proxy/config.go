@@ -0,0 +1,759 @@
+// Package proxy forwards requests to the upstream services based on a declarative route configuration.
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Possible values of a route's auth field.
+const (
+	// AuthRequired only forwards requests of authenticated users. It's the default.
+	AuthRequired = "required"
+	// AuthNone forwards all requests without identifying the user.
+	AuthNone = "none"
+)
+
+// identityHeaders are set by the proxy to identify the user, so routes can't change them.
+var identityHeaders = []string{"UID", "Lang", "Impersonator-UID", "Actor-UID", "Guest", "Share-Link-ID"}
+
+// DeadlineHeader tells the upstreams how many milliseconds are left until the proxy gives up on a request, so they
+// can give up early as well. It's set by the proxy, so routes can't change it.
+const DeadlineHeader = "X-Request-Timeout"
+
+type (
+	// Config represents a route configuration file.
+	Config struct {
+		Routes []Route `yaml:"routes" json:"routes"`
+		// Policies overrides the default policies if it's set.
+		Policies *Policies `yaml:"policies" json:"policies"`
+	}
+
+	// Policies defines which requests need additional checks.
+	Policies struct {
+		// StepUp defines requests which require a recent password or PIN authentication.
+		StepUp []StepUpPolicy `yaml:"stepUp" json:"stepUp"`
+		// Confirm defines requests which have to be confirmed before they're forwarded.
+		Confirm []RulePolicy `yaml:"confirm" json:"confirm"`
+		// Guests defines the path prefixes guests can access.
+		Guests []string `yaml:"guests" json:"guests"`
+	}
+
+	// RulePolicy matches requests by their method and path prefix. If Methods is empty, all methods match.
+	RulePolicy struct {
+		Methods []string `yaml:"methods" json:"methods"`
+		Prefix  string   `yaml:"prefix" json:"prefix"`
+	}
+
+	// StepUpPolicy requires matching requests to be made within MaxAge of the last authentication.
+	StepUpPolicy struct {
+		Methods  []string `yaml:"methods" json:"methods"`
+		Prefix   string   `yaml:"prefix" json:"prefix"`
+		MaxAge   Duration `yaml:"maxAge" json:"maxAge"`
+		AllowPIN bool     `yaml:"allowPIN" json:"allowPIN"`
+	}
+
+	// Route defines which requests are forwarded to which upstream services and how.
+	Route struct {
+		// Name identifies the route in logs and error messages.
+		Name string `yaml:"name" json:"name"`
+		// Prefix the request's path has to start with. It only matches whole path segments.
+		Prefix string `yaml:"prefix" json:"prefix"`
+		// Upstreams are the urls of the services the requests are forwarded to.
+		Upstreams []string `yaml:"upstreams" json:"upstreams"`
+		// Protocol the requests are forwarded with. It's either HTTP1, H2C or H2 and defaults to HTTP1.
+		Protocol string `yaml:"protocol" json:"protocol"`
+		// Balancer is the strategy distributing the requests to the upstreams. It's either RoundRobin,
+		// LeastConnections or ConsistentHash and defaults to RoundRobin.
+		Balancer string `yaml:"balancer" json:"balancer"`
+		// Auth is either AuthRequired or AuthNone. It defaults to AuthRequired.
+		Auth string `yaml:"auth" json:"auth"`
+		// Methods the route accepts. If it's empty, all methods are accepted.
+		Methods []string `yaml:"methods" json:"methods"`
+		// Timeout limits how long forwarding a request may take. There's no limit if it's 0.
+		Timeout Duration `yaml:"timeout" json:"timeout"`
+		// Headers modifies the headers of the forwarded requests and their responses.
+		Headers HeaderRules `yaml:"headers" json:"headers"`
+		// HealthCheck actively probes the upstreams if it's set.
+		HealthCheck *HealthCheck `yaml:"healthCheck" json:"healthCheck"`
+		// OutlierDetection ejects upstreams whose requests fail repeatedly.
+		OutlierDetection OutlierDetection `yaml:"outlierDetection" json:"outlierDetection"`
+		// CircuitBreaker stops forwarding requests to failing upstreams for a while if it's set.
+		CircuitBreaker *CircuitBreaker `yaml:"circuitBreaker" json:"circuitBreaker"`
+		// Retries retries failed idempotent requests if it's set.
+		Retries *Retries `yaml:"retries" json:"retries"`
+		// Cache caches the responses to GET requests if it's set.
+		Cache *Cache `yaml:"cache" json:"cache"`
+		// Coalesce lets identical GET requests in flight share one upstream response if it's set.
+		Coalesce *Coalesce `yaml:"coalesce" json:"coalesce"`
+		// Streaming allows WebSockets and server-sent events if it's set.
+		Streaming *Streaming `yaml:"streaming" json:"streaming"`
+		// Rewrite changes the paths of the forwarded requests if it's set.
+		Rewrite *Rewrite `yaml:"rewrite" json:"rewrite"`
+		// Versions are forwarded to their own upstreams. Requests without a version are forwarded to Upstreams.
+		Versions []Version `yaml:"versions" json:"versions"`
+		// Canary splits the users between the route's upstreams and other pools if it's set. The versions
+		// aren't split.
+		Canary *Canary `yaml:"canary" json:"canary"`
+	}
+
+	// Canary forwards the requests of some users to the pools of new releases instead of the route's upstreams.
+	// Users with one of the OverrideRoles choose the pool with the PoolHeader. OverrideRoles defaults to the
+	// admins.
+	Canary struct {
+		Pools         []Pool   `yaml:"pools" json:"pools"`
+		OverrideRoles []string `yaml:"overrideRoles" json:"overrideRoles"`
+	}
+
+	// Pool receives the users in UIDs, the users with one of the Roles and Weight percent of the others. The
+	// users are assigned by the hash of their uid, so that they keep their pool as long as the weights of the
+	// pools before it don't change.
+	Pool struct {
+		Name      string   `yaml:"name" json:"name"`
+		Weight    float64  `yaml:"weight" json:"weight"`
+		Upstreams []string `yaml:"upstreams" json:"upstreams"`
+		UIDs      []uint64 `yaml:"uids" json:"uids"`
+		Roles     []string `yaml:"roles" json:"roles"`
+	}
+
+	// Version is an API version of a route, which requests choose with the VersionHeader or by using Prefix
+	// instead of the route's prefix, e.g. /api/v1/users instead of /api/users. Responses of Deprecated versions
+	// announce the date in the Deprecation header, the Sunset if it's set and the Link to a migration guide if
+	// it's set.
+	Version struct {
+		Name       string   `yaml:"name" json:"name"`
+		Prefix     string   `yaml:"prefix" json:"prefix"`
+		Upstreams  []string `yaml:"upstreams" json:"upstreams"`
+		Deprecated Date     `yaml:"deprecated" json:"deprecated"`
+		Sunset     Date     `yaml:"sunset" json:"sunset"`
+		Link       string   `yaml:"link" json:"link"`
+	}
+
+	// Rewrite removes StripPrefix from the paths of the forwarded requests, applies the first of the Rules
+	// matching the rest and prepends AddPrefix. The paths of the responses' Location header and cookies are
+	// changed back, as far as the prefixes are concerned.
+	Rewrite struct {
+		StripPrefix string        `yaml:"stripPrefix" json:"stripPrefix"`
+		AddPrefix   string        `yaml:"addPrefix" json:"addPrefix"`
+		Rules       []RewriteRule `yaml:"rules" json:"rules"`
+	}
+
+	// RewriteRule replaces paths matching the regular expression Match with Replace, which may refer to the
+	// submatches like $1.
+	RewriteRule struct {
+		Match   string `yaml:"match" json:"match"`
+		Replace string `yaml:"replace" json:"replace"`
+	}
+
+	// Streaming allows long-lived connections, which aren't bound by the route's and the server's timeouts. Users
+	// may have MaxPerUser streams of the route open at the same time and the authentication of every stream is
+	// checked every RecheckInterval. Zero values default to DefaultMaxStreamsPerUser and DefaultRecheckInterval.
+	// WebSockets are allowed on the whole route, while server-sent events are only streamed for GET requests to
+	// the EventPaths, which match whole path segments like the route's prefix.
+	Streaming struct {
+		MaxPerUser      int      `yaml:"maxPerUser" json:"maxPerUser"`
+		RecheckInterval Duration `yaml:"recheckInterval" json:"recheckInterval"`
+		EventPaths      []string `yaml:"eventPaths" json:"eventPaths"`
+	}
+
+	// Coalesce defines which GET requests are identical. Requests are identical if their path, query and the values
+	// of the forwarded request headers in Vary match. Routes whose responses differ between users have to vary by
+	// the UID.
+	Coalesce struct {
+		Vary []string `yaml:"vary" json:"vary"`
+	}
+
+	// Cache keeps responses for TTL, unless the upstream specifies a max-age. Responses are cached separately for
+	// every value of the forwarded request headers in Vary, e.g. Lang or UID. After they expired, they're served
+	// for StaleWhileRevalidate while they're refreshed in the background, unless the upstream specifies
+	// stale-while-revalidate. Once the cached responses exceed MaxSize bytes, the least recently used ones are
+	// evicted. MaxSize defaults to DefaultCacheSize.
+	Cache struct {
+		TTL                  Duration `yaml:"ttl" json:"ttl"`
+		Vary                 []string `yaml:"vary" json:"vary"`
+		StaleWhileRevalidate Duration `yaml:"staleWhileRevalidate" json:"staleWhileRevalidate"`
+		MaxSize              int      `yaml:"maxSize" json:"maxSize"`
+	}
+
+	// Retries retries GET and HEAD requests and requests with an Idempotency-Key up to Attempts times on
+	// connection errors and the status codes in On. Before every retry, a random delay of up to BaseBackoff,
+	// doubling with every retry up to MaxBackoff, is waited. Budget limits the retries to this share of the
+	// route's requests. Zero values default to the Default* values.
+	Retries struct {
+		Attempts    int      `yaml:"attempts" json:"attempts"`
+		On          []int    `yaml:"on" json:"on"`
+		BaseBackoff Duration `yaml:"baseBackoff" json:"baseBackoff"`
+		MaxBackoff  Duration `yaml:"maxBackoff" json:"maxBackoff"`
+		Budget      float64  `yaml:"budget" json:"budget"`
+	}
+
+	// HealthCheck probes every upstream with a GET request to the path. Upstreams responding with an error or
+	// a status code of 400 or above don't receive requests until they pass a probe again.
+	HealthCheck struct {
+		Path string `yaml:"path" json:"path"`
+		// Interval defaults to 10 seconds.
+		Interval Duration `yaml:"interval" json:"interval"`
+		// Timeout defaults to 2 seconds.
+		Timeout Duration `yaml:"timeout" json:"timeout"`
+	}
+
+	// OutlierDetection ejects an upstream after ConsecutiveErrors failed requests in a row. The first ejection lasts
+	// BaseEjectionTime and every further one in a row twice as long, up to MaxEjectionTime. At most
+	// MaxEjectionPercent of the upstreams are ejected at the same time, so a single upstream is never ejected unless
+	// it's 100. Zero values default to the Default* constants.
+	OutlierDetection struct {
+		ConsecutiveErrors  int      `yaml:"consecutiveErrors" json:"consecutiveErrors"`
+		BaseEjectionTime   Duration `yaml:"baseEjectionTime" json:"baseEjectionTime"`
+		MaxEjectionTime    Duration `yaml:"maxEjectionTime" json:"maxEjectionTime"`
+		MaxEjectionPercent int      `yaml:"maxEjectionPercent" json:"maxEjectionPercent"`
+	}
+
+	// CircuitBreaker opens the circuit of an upstream once FailureRate of at least MinRequests requests within
+	// Window failed. While it's open, requests get the fallback response. After OpenFor, HalfOpenRequests trial
+	// requests are let through, which close the circuit again if they succeed. Zero values default to the
+	// Default* constants.
+	CircuitBreaker struct {
+		FailureRate      float64  `yaml:"failureRate" json:"failureRate"`
+		MinRequests      int      `yaml:"minRequests" json:"minRequests"`
+		Window           Duration `yaml:"window" json:"window"`
+		OpenFor          Duration `yaml:"openFor" json:"openFor"`
+		HalfOpenRequests int      `yaml:"halfOpenRequests" json:"halfOpenRequests"`
+		Fallback         Fallback `yaml:"fallback" json:"fallback"`
+	}
+
+	// Fallback defines the response to requests which aren't forwarded because the circuit is open.
+	Fallback struct {
+		// Type is either FallbackProblem, FallbackStatic or FallbackCached.
+		Type string `yaml:"type" json:"type"`
+		// Status and Body are the response of FallbackStatic. Body has to be JSON and Status defaults to 200.
+		Status int    `yaml:"status" json:"status"`
+		Body   string `yaml:"body" json:"body"`
+		// MaxAge defines how long responses are kept for FallbackCached. It defaults to DefaultFallbackMaxAge.
+		MaxAge Duration `yaml:"maxAge" json:"maxAge"`
+	}
+
+	// HeaderRules modifies the headers of requests and responses.
+	HeaderRules struct {
+		Request  HeaderRule `yaml:"request" json:"request"`
+		Response HeaderRule `yaml:"response" json:"response"`
+	}
+
+	// HeaderRule sets and removes headers. Headers are removed before others are set.
+	HeaderRule struct {
+		Set    map[string]string `yaml:"set" json:"set"`
+		Remove []string          `yaml:"remove" json:"remove"`
+	}
+
+	// Duration is a time.Duration written like "1.5s" in the configuration file.
+	Duration time.Duration
+
+	// Date is a time.Time written like "2021-06-30" or "2021-06-30T12:00:00Z" in the configuration file.
+	Date time.Time
+)
+
+// UnmarshalYAML parses a duration like "1.5s".
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+
+	return d.parse(s)
+}
+
+// UnmarshalJSON parses a duration like "1.5s".
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	return d.parse(s)
+}
+
+func (d *Duration) parse(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(v)
+
+	return nil
+}
+
+// UnmarshalYAML parses a date like "2021-06-30".
+func (d *Date) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+
+	return d.parse(s)
+}
+
+// UnmarshalJSON parses a date like "2021-06-30".
+func (d *Date) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	return d.parse(s)
+}
+
+func (d *Date) parse(s string) error {
+	v, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		v, err = time.Parse("2006-01-02", s)
+	}
+
+	if err != nil {
+		return fmt.Errorf("invalid date %q, expected a date like 2021-06-30", s)
+	}
+
+	*d = Date(v)
+
+	return nil
+}
+
+// Apply removes and sets the headers.
+func (rule HeaderRule) Apply(h http.Header) {
+	for _, k := range rule.Remove {
+		h.Del(k)
+	}
+
+	for k, v := range rule.Set {
+		h.Set(k, v)
+	}
+}
+
+// RequiresAuth reports if the route only forwards requests of authenticated users.
+func (route Route) RequiresAuth() bool {
+	return route.Auth != AuthNone
+}
+
+// ValidationError lists all problems found in a route configuration.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid route configuration:\n  " + strings.Join(e.Problems, "\n  ")
+}
+
+// Load reads and validates the route configuration file. Files ending with .json are parsed as JSON, all others
+// as YAML. Unknown fields are rejected.
+func Load(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return Parse(b, strings.EqualFold(filepath.Ext(path), ".json"))
+}
+
+// Parse parses and validates a route configuration.
+func Parse(b []byte, isJSON bool) (*Config, error) {
+	var cfg Config
+
+	if isJSON {
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+
+		if err := dec.Decode(&cfg); err != nil {
+			return nil, fmt.Errorf("invalid route configuration: %v", err)
+		}
+	} else if err := yaml.UnmarshalStrict(b, &cfg); err != nil {
+		return nil, fmt.Errorf("invalid route configuration: %v", err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &cfg, nil
+}
+
+// Validate checks the configuration and returns a *ValidationError describing every problem.
+func (cfg *Config) Validate() error {
+	var problems []string
+
+	if len(cfg.Routes) == 0 {
+		problems = append(problems, "no routes are defined")
+	}
+
+	names := make(map[string]bool)
+	prefixes := make(map[string]string)
+
+	for i, route := range cfg.Routes {
+		at := fmt.Sprintf("routes[%d]", i)
+		if route.Name != "" {
+			at += fmt.Sprintf(" (%s)", route.Name)
+		}
+
+		problem := func(format string, args ...interface{}) {
+			problems = append(problems, at+": "+fmt.Sprintf(format, args...))
+		}
+
+		switch {
+		case route.Name == "":
+			problem("the name is missing")
+		case names[route.Name]:
+			problem("the name is already used by another route")
+		}
+
+		names[route.Name] = true
+
+		checkPrefix := func(p string) {
+			prefix := strings.TrimSuffix(p, "/")
+
+			switch {
+			case !strings.HasPrefix(p, "/"):
+				problem("the prefix %q has to start with a /", p)
+			case prefixes[prefix] != "":
+				problem("the prefix %q is already used by %s", p, prefixes[prefix])
+			}
+
+			prefixes[prefix] = at
+		}
+
+		checkPrefix(route.Prefix)
+
+		if len(route.Upstreams) == 0 {
+			problem("at least one upstream is required")
+		}
+
+		upstreams := append([]string{}, route.Upstreams...)
+		versions := make(map[string]bool)
+
+		for _, v := range route.Versions {
+			switch {
+			case v.Name == "" || strings.ContainsAny(v.Name, " ,;"):
+				problem("the version name %q has to be a non-empty token", v.Name)
+			case versions[v.Name]:
+				problem("the version %q is defined twice", v.Name)
+			}
+
+			versions[v.Name] = true
+
+			if v.Prefix != "" {
+				checkPrefix(v.Prefix)
+			}
+
+			if len(v.Upstreams) == 0 {
+				problem("the version %q needs at least one upstream", v.Name)
+			}
+
+			upstreams = append(upstreams, v.Upstreams...)
+
+			deprecated, sunset := time.Time(v.Deprecated), time.Time(v.Sunset)
+
+			switch {
+			case !sunset.IsZero() && deprecated.IsZero():
+				problem("the version %q has a sunset but isn't deprecated", v.Name)
+			case !sunset.IsZero() && sunset.Before(deprecated):
+				problem("the version %q's sunset is before its deprecation", v.Name)
+			}
+
+			if parsed, err := url.Parse(v.Link); v.Link != "" && (err != nil || !parsed.IsAbs()) {
+				problem("the version %q's link has to be an absolute url", v.Name)
+			}
+		}
+
+		if c := route.Canary; c != nil {
+			var weights float64
+
+			pools := make(map[string]bool)
+
+			for _, p := range c.Pools {
+				switch {
+				case p.Name == "" || p.Name == StablePool || strings.ContainsAny(p.Name, " ,;"):
+					problem("the pool name %q has to be a non-empty token other than %q", p.Name, StablePool)
+				case pools[p.Name]:
+					problem("the pool %q is defined twice", p.Name)
+				case versions[p.Name]:
+					problem("the pool %q has the name of a version", p.Name)
+				}
+
+				pools[p.Name] = true
+
+				if p.Weight < 0 || p.Weight > 100 {
+					problem("the pool %q's weight has to be between 0 and 100", p.Name)
+				}
+
+				weights += p.Weight
+
+				if len(p.Upstreams) == 0 {
+					problem("the pool %q needs at least one upstream", p.Name)
+				}
+
+				upstreams = append(upstreams, p.Upstreams...)
+			}
+
+			if weights > 100 {
+				problem("the pools' weights add up to more than 100")
+			}
+		}
+
+		for _, u := range upstreams {
+			parsed, err := url.Parse(u)
+			if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+				problem("the upstream %q has to be an absolute http or https url", u)
+			}
+		}
+
+		switch route.Protocol {
+		case "", HTTP1:
+		case H2C, H2:
+			scheme := "http"
+			if route.Protocol == H2 {
+				scheme = "https"
+			}
+
+			for _, u := range upstreams {
+				parsed, err := url.Parse(u)
+				if err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Scheme != scheme {
+					problem("the upstream %q has to be a %s url to be forwarded with %s", u, scheme, route.Protocol)
+				}
+			}
+		default:
+			problem("the protocol %q has to be either %q, %q or %q", route.Protocol, HTTP1, H2C, H2)
+		}
+
+		switch route.Balancer {
+		case "", RoundRobin, LeastConnections, ConsistentHash:
+		default:
+			problem("the balancer %q has to be either %q, %q or %q", route.Balancer, RoundRobin, LeastConnections, ConsistentHash)
+		}
+
+		if route.Auth != "" && route.Auth != AuthRequired && route.Auth != AuthNone {
+			problem("the auth %q has to be either %q or %q", route.Auth, AuthRequired, AuthNone)
+		}
+
+		for _, m := range route.Methods {
+			if !validMethod(m) {
+				problem("the method %q has to be an uppercase http method", m)
+			}
+		}
+
+		if route.Timeout < 0 {
+			problem("the timeout can't be negative")
+		}
+
+		if hc := route.HealthCheck; hc != nil {
+			if !strings.HasPrefix(hc.Path, "/") {
+				problem("the health check's path %q has to start with a /", hc.Path)
+			}
+
+			if hc.Interval < 0 || hc.Timeout < 0 {
+				problem("the health check's interval and timeout can't be negative")
+			}
+		}
+
+		if od := route.OutlierDetection; od.ConsecutiveErrors < 0 || od.BaseEjectionTime < 0 || od.MaxEjectionTime < 0 {
+			problem("the outlier detection's values can't be negative")
+		}
+
+		if p := route.OutlierDetection.MaxEjectionPercent; p < 0 || p > 100 {
+			problem("the outlier detection's maxEjectionPercent has to be between 0 and 100")
+		}
+
+		if cb := route.CircuitBreaker; cb != nil {
+			for _, p := range cb.validate() {
+				problem("%s", p)
+			}
+		}
+
+		if rt := route.Retries; rt != nil {
+			if rt.Attempts < 0 || rt.Attempts > 10 {
+				problem("the retry attempts have to be between 0 and 10")
+			}
+
+			for _, status := range rt.On {
+				if (status < 500 && status != http.StatusTooManyRequests) || status > 599 {
+					problem("the retried status %d has to be 429 or a http 5xx", status)
+				}
+			}
+
+			if rt.BaseBackoff < 0 || rt.MaxBackoff < 0 {
+				problem("the retry backoff can't be negative")
+			}
+
+			if rt.Budget < 0 || rt.Budget > 1 {
+				problem("the retry budget has to be between 0 and 1")
+			}
+		}
+
+		if c := route.Cache; c != nil {
+			if c.TTL < 0 || c.StaleWhileRevalidate < 0 || c.MaxSize < 0 {
+				problem("the cache's values can't be negative")
+			}
+
+			for _, h := range c.Vary {
+				if !validHeaderName(h) {
+					problem("the cache can't vary by the invalid header %q", h)
+				}
+			}
+		}
+
+		if c := route.Coalesce; c != nil {
+			for _, h := range c.Vary {
+				if !validHeaderName(h) {
+					problem("the coalescing can't vary by the invalid header %q", h)
+				}
+			}
+		}
+
+		if st := route.Streaming; st != nil {
+			if st.MaxPerUser < 0 || st.RecheckInterval < 0 {
+				problem("the streaming's values can't be negative")
+			}
+
+			for _, p := range st.EventPaths {
+				if !strings.HasPrefix(p, "/") {
+					problem("the streaming's event path %q has to start with /", p)
+				}
+			}
+		}
+
+		if rw := route.Rewrite; rw != nil {
+			for _, p := range rw.validate() {
+				problem("%s", p)
+			}
+		}
+
+		keys := append([]string{}, route.Headers.Request.Remove...)
+		for k := range route.Headers.Request.Set {
+			keys = append(keys, k)
+		}
+
+		for _, k := range keys {
+			for _, id := range append(identityHeaders, DeadlineHeader) {
+				if textproto.CanonicalMIMEHeaderKey(k) == textproto.CanonicalMIMEHeaderKey(id) {
+					problem("the request header %q is set by the proxy and can't be changed", k)
+				}
+			}
+		}
+	}
+
+	if cfg.Policies != nil {
+		problems = append(problems, cfg.Policies.validate()...)
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+
+	return nil
+}
+
+func (cb *CircuitBreaker) validate() []string {
+	var problems []string
+
+	if cb.FailureRate < 0 || cb.FailureRate > 1 {
+		problems = append(problems, "the circuit breaker's failure rate has to be between 0 and 1")
+	}
+
+	if cb.MinRequests < 0 || cb.Window < 0 || cb.OpenFor < 0 || cb.HalfOpenRequests < 0 {
+		problems = append(problems, "the circuit breaker's values can't be negative")
+	}
+
+	fb := cb.Fallback
+
+	switch fb.Type {
+	case "", FallbackProblem, FallbackCached:
+	case FallbackStatic:
+		if !json.Valid([]byte(fb.Body)) {
+			problems = append(problems, "the static fallback's body has to be valid JSON")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("the fallback %q has to be either %q, %q or %q", fb.Type, FallbackProblem, FallbackStatic, FallbackCached))
+	}
+
+	if fb.Status != 0 && (fb.Status < 200 || fb.Status > 599) {
+		problems = append(problems, fmt.Sprintf("the fallback's status %d isn't a valid http status code", fb.Status))
+	}
+
+	if fb.MaxAge < 0 {
+		problems = append(problems, "the fallback's max age can't be negative")
+	}
+
+	return problems
+}
+
+func (rw *Rewrite) validate() []string {
+	var problems []string
+
+	for _, p := range []string{rw.StripPrefix, rw.AddPrefix} {
+		if p != "" && !strings.HasPrefix(p, "/") {
+			problems = append(problems, fmt.Sprintf("the rewrite's prefix %q has to start with a /", p))
+		}
+	}
+
+	for _, rule := range rw.Rules {
+		if _, err := regexp.Compile(rule.Match); err != nil {
+			problems = append(problems, fmt.Sprintf("the rewrite rule %q isn't a valid regular expression", rule.Match))
+		}
+
+		if !strings.HasPrefix(rule.Replace, "/") {
+			problems = append(problems, fmt.Sprintf("the rewrite rule's replacement %q has to start with a /", rule.Replace))
+		}
+	}
+
+	return problems
+}
+
+func validHeaderName(h string) bool {
+	return h != "" && !strings.ContainsAny(h, " :,")
+}
+
+func validMethod(m string) bool {
+	return m != "" && strings.ToUpper(m) == m && !strings.ContainsAny(m, " /")
+}
+
+func (p *Policies) validate() []string {
+	var problems []string
+
+	rule := func(at string, methods []string, prefix string) {
+		if !strings.HasPrefix(prefix, "/") {
+			problems = append(problems, fmt.Sprintf("%s: the prefix %q has to start with a /", at, prefix))
+		}
+
+		for _, m := range methods {
+			if !validMethod(m) {
+				problems = append(problems, fmt.Sprintf("%s: the method %q has to be an uppercase http method", at, m))
+			}
+		}
+	}
+
+	for i, s := range p.StepUp {
+		at := fmt.Sprintf("policies.stepUp[%d]", i)
+		rule(at, s.Methods, s.Prefix)
+
+		if s.MaxAge <= 0 {
+			problems = append(problems, at+": the maxAge has to be positive")
+		}
+	}
+
+	for i, c := range p.Confirm {
+		rule(fmt.Sprintf("policies.confirm[%d]", i), c.Methods, c.Prefix)
+	}
+
+	for i, g := range p.Guests {
+		rule(fmt.Sprintf("policies.guests[%d]", i), nil, g)
+	}
+
+	return problems
+}
@@ -0,0 +1,127 @@
+package proxy_test
+
+import (
+	"auth-proxy/proxy"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoad(t *testing.T) {
+	cfg, err := proxy.Load("../routes.yaml")
+	if err != nil {
+		t.Fatalf("Expected the shipped route configuration to be valid but got %v", err)
+	}
+
+	if len(cfg.Routes) != 3 {
+		t.Errorf("Expected 3 routes but got %d", len(cfg.Routes))
+	}
+}
+
+func TestParse(t *testing.T) {
+	yamlCfg := `
+routes:
+  - name: stocks
+    prefix: /api/stocks
+    upstreams: [http://stock_service:8082, http://stock_service_2:8082]
+    methods: [GET, POST]
+    timeout: 1.5s
+    headers:
+      request:
+        set: {X-Service: stocks}
+        remove: [Authorization]
+      response:
+        remove: [Server]
+  - name: status
+    prefix: /status
+    upstreams: [https://status.example.com/v1]
+    auth: none
+`
+
+	jsonCfg := `{"routes": [{"name": "stocks", "prefix": "/api/stocks", "upstreams": ["http://stock_service:8082"], "timeout": "2s"}]}`
+
+	cfg, err := proxy.Parse([]byte(yamlCfg), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stocks := cfg.Routes[0]
+	if len(stocks.Upstreams) != 2 || time.Duration(stocks.Timeout) != time.Millisecond*1500 || stocks.Headers.Request.Set["X-Service"] != "stocks" {
+		t.Errorf("Unexpected route %+v", stocks)
+	}
+
+	if !stocks.RequiresAuth() || cfg.Routes[1].RequiresAuth() {
+		t.Error("Expected only the stocks route to require authentication")
+	}
+
+	cfg, err = proxy.Parse([]byte(jsonCfg), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if time.Duration(cfg.Routes[0].Timeout) != time.Second*2 {
+		t.Errorf("Expected a timeout of 2s but got %v", time.Duration(cfg.Routes[0].Timeout))
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		cfg     string
+		problem string
+	}{
+		{`routes: []`, "no routes are defined"},
+		{`routes: [{prefix: /api, upstreams: [http://a]}]`, "the name is missing"},
+		{`routes: [{name: a, prefix: /a, upstreams: [http://a]}, {name: a, prefix: /b, upstreams: [http://b]}]`, "(a): the name is already used"},
+		{`routes: [{name: a, prefix: api, upstreams: [http://a]}]`, `the prefix "api" has to start with a /`},
+		{`routes: [{name: a, prefix: /a, upstreams: [http://a]}, {name: b, prefix: /a/, upstreams: [http://b]}]`, `the prefix "/a/" is already used by routes[0] (a)`},
+		{`routes: [{name: a, prefix: /a}]`, "at least one upstream is required"},
+		{`routes: [{name: a, prefix: /a, upstreams: [stock_service:8082]}]`, `the upstream "stock_service:8082" has to be an absolute http or https url`},
+		{`routes: [{name: a, prefix: /a, upstreams: [http://a], auth: optional}]`, `the auth "optional"`},
+		{`routes: [{name: a, prefix: /a, upstreams: [http://a], balancer: random}]`, `the balancer "random"`},
+		{`routes: [{name: a, prefix: /a, upstreams: [http://a], protocol: spdy}]`, `the protocol "spdy"`},
+		{`routes: [{name: a, prefix: /a, upstreams: [http://a], protocol: h2}]`, `the upstream "http://a" has to be a https url to be forwarded with h2`},
+		{`routes: [{name: a, prefix: /a, upstreams: [http://a], methods: [get]}]`, `the method "get" has to be an uppercase http method`},
+		{`routes: [{name: a, prefix: /a, upstreams: [http://a], timeout: -1s}]`, "the timeout can't be negative"},
+		{`routes: [{name: a, prefix: /a, upstreams: [http://a], headers: {request: {set: {uid: "1"}}}}]`, `the request header "uid" is set by the proxy`},
+		{`routes: [{name: a, prefix: /a, upstreams: [http://a], healthCheck: {path: healthz}}]`, `the health check's path "healthz" has to start with a /`},
+		{`routes: [{name: a, prefix: /a, upstreams: [http://a], healthCheck: {path: /healthz, interval: -1s}}]`, "the health check's interval and timeout can't be negative"},
+		{`routes: [{name: a, prefix: /a, upstreams: [http://a], outlierDetection: {consecutiveErrors: -1}}]`, "the outlier detection's values can't be negative"},
+		{`routes: [{name: a, prefix: /a, upstreams: [http://a], outlierDetection: {maxEjectionPercent: 101}}]`, "the outlier detection's maxEjectionPercent has to be between 0 and 100"},
+		{`routes: [{name: a, prefix: /a, upstreams: [http://a], circuitBreaker: {failureRate: 1.5}}]`, "the circuit breaker's failure rate has to be between 0 and 1"},
+		{`routes: [{name: a, prefix: /a, upstreams: [http://a], circuitBreaker: {fallback: {type: retry}}}]`, `the fallback "retry"`},
+		{`routes: [{name: a, prefix: /a, upstreams: [http://a], circuitBreaker: {fallback: {type: static, body: "{"}}}]`, "the static fallback's body has to be valid JSON"},
+		{`routes: [{name: a, prefix: /a, upstreams: [http://a], headers: {request: {remove: [x-request-timeout]}}}]`, `the request header "x-request-timeout" is set by the proxy`},
+		{`routes: [{name: a, prefix: /a, upstreams: [http://a], cache: {ttl: -1s}}]`, "the cache's values can't be negative"},
+		{`routes: [{name: a, prefix: /a, upstreams: [http://a], cache: {vary: ["Lang, UID"]}}]`, `the cache can't vary by the invalid header "Lang, UID"`},
+		{`routes: [{name: a, prefix: /a, upstreams: [http://a], coalesce: {vary: [""]}}]`, `the coalescing can't vary by the invalid header ""`},
+		{`routes: [{name: a, prefix: /a, upstreams: [http://a], streaming: {maxPerUser: -1}}]`, "the streaming's values can't be negative"},
+		{`routes: [{name: a, prefix: /a, upstreams: [http://a], streaming: {eventPaths: [a/events]}}]`, "the streaming's event path \"a/events\" has to start with /"},
+		{`routes: [{name: a, prefix: /a, upstreams: [http://a], rewrite: {stripPrefix: a}}]`, `the rewrite's prefix "a" has to start with a /`},
+		{`routes: [{name: a, prefix: /a, upstreams: [http://a], rewrite: {rules: [{match: "(", replace: /b}]}}]`, `the rewrite rule "(" isn't a valid regular expression`},
+		{`routes: [{name: a, prefix: /a, upstreams: [http://a], rewrite: {rules: [{match: ^/a$, replace: b}]}}]`, `the rewrite rule's replacement "b" has to start with a /`},
+		{`routes: [{name: a, prefix: /a, upstreams: [http://a], versions: [{name: v1, upstreams: [http://b]}, {name: v1, upstreams: [http://c]}]}]`, `the version "v1" is defined twice`},
+		{`routes: [{name: a, prefix: /a, upstreams: [http://a], versions: [{name: v1, prefix: /a, upstreams: [http://b]}]}]`, `the prefix "/a" is already used by routes[0] (a)`},
+		{`routes: [{name: a, prefix: /a, upstreams: [http://a], versions: [{name: v1}]}]`, `the version "v1" needs at least one upstream`},
+		{`routes: [{name: a, prefix: /a, upstreams: [http://a], versions: [{name: v1, upstreams: [b]}]}]`, `the upstream "b" has to be an absolute http or https url`},
+		{`routes: [{name: a, prefix: /a, upstreams: [http://a], versions: [{name: v1, upstreams: [http://b], sunset: 2021-07-01}]}]`, `the version "v1" has a sunset but isn't deprecated`},
+		{`routes: [{name: a, prefix: /a, upstreams: [http://a], versions: [{name: v1, upstreams: [http://b], deprecated: 2021-07-01, sunset: 2021-01-01}]}]`, `the version "v1"'s sunset is before its deprecation`},
+		{`routes: [{name: a, prefix: /a, upstreams: [http://a], versions: [{name: v1, upstreams: [http://b], deprecated: soon}]}]`, `invalid date "soon"`},
+		{`routes: [{name: a, prefix: /a, upstreams: [http://a], canary: {pools: [{name: stable, upstreams: [http://b]}]}}]`, `the pool name "stable" has to be a non-empty token other than "stable"`},
+		{`routes: [{name: a, prefix: /a, upstreams: [http://a], canary: {pools: [{name: b, weight: 60, upstreams: [http://b]}, {name: c, weight: 50, upstreams: [http://c]}]}}]`, "the pools' weights add up to more than 100"},
+		{`routes: [{name: a, prefix: /a, upstreams: [http://a], canary: {pools: [{name: b, weight: -5, upstreams: [http://b]}]}}]`, `the pool "b"'s weight has to be between 0 and 100`},
+		{`routes: [{name: a, prefix: /a, upstreams: [http://a], canary: {pools: [{name: b}]}}]`, `the pool "b" needs at least one upstream`},
+		{`routes: [{name: a, prefix: /a, upstreams: [http://a], versions: [{name: v1, upstreams: [http://b]}], canary: {pools: [{name: v1, upstreams: [http://c]}]}}]`, `the pool "v1" has the name of a version`},
+		{`routes: [{name: a, prefix: /a, upstreams: [http://a], timeout: soon}]`, "invalid route configuration"},
+		{`routes: [{name: a, prefix: /a, upstreams: [http://a], retries: {attempts: 11}}]`, "the retry attempts have to be between 0 and 10"},
+		{`routes: [{name: a, prefix: /a, upstreams: [http://a], retries: {on: [404]}}]`, "the retried status 404 has to be 429 or a http 5xx"},
+		{`routes: [{name: a, prefix: /a, upstreams: [http://a], retries: {budget: 2}}]`, "the retry budget has to be between 0 and 1"},
+		{`routes: [{name: a, prefix: /a, upstreams: [http://a], mirror: true}]`, "field mirror not found"},
+	}
+
+	for _, i := range cases {
+		_, err := proxy.Parse([]byte(i.cfg), false)
+		if err == nil || !strings.Contains(err.Error(), i.problem) {
+			t.Errorf("Expected an error containing %q but got %v when cfg=%s", i.problem, err, i.cfg)
+		}
+	}
+}
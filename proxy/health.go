@@ -0,0 +1,299 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults of the outlier detection.
+const (
+	DefaultConsecutiveErrors  = 5
+	DefaultBaseEjectionTime   = 30 * time.Second
+	DefaultMaxEjectionTime    = 5 * time.Minute
+	DefaultMaxEjectionPercent = 50
+)
+
+// health tracks whether an upstream can receive requests. Upstreams are taken out of the pool if their health
+// probe fails or, with an exponentially growing ejection time, if too many requests in a row failed. Requests
+// fail if the upstream can't be reached or answers with a http 502, 503 or 504, while other errors are the
+// application's.
+type health struct {
+	mu           sync.Mutex
+	probeFailed  bool
+	failures     int
+	ejections    int
+	ejectedUntil time.Time
+	lastError    string
+}
+
+// UpstreamStatus describes the health of an upstream.
+type UpstreamStatus struct {
+	URL               string     `json:"url"`
+	Healthy           bool       `json:"healthy"`
+	ProbeFailed       bool       `json:"probeFailed"`
+	EjectedUntil      *time.Time `json:"ejectedUntil,omitempty"`
+	ConsecutiveErrors int        `json:"consecutiveErrors"`
+	ActiveRequests    int64      `json:"activeRequests"`
+	LastError         string     `json:"lastError,omitempty"`
+	// Circuit is the state of the upstream's circuit breaker, if the route has one.
+	Circuit string `json:"circuit,omitempty"`
+}
+
+// Available reports if the upstream can receive requests. Upstreams whose circuit is open, or half-open without
+// trials left, can't.
+func (u *Upstream) Available() bool {
+	return u.healthy() && (u.breaker == nil || u.breaker.available())
+}
+
+// healthy reports if neither the health probe nor the outlier detection took the upstream out of the pool.
+func (u *Upstream) healthy() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return !u.probeFailed && !time.Now().Before(u.ejectedUntil)
+}
+
+// Status returns the upstream's health.
+func (u *Upstream) Status() UpstreamStatus {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	s := UpstreamStatus{
+		URL:               u.URL.String(),
+		Healthy:           !u.probeFailed && !time.Now().Before(u.ejectedUntil),
+		ProbeFailed:       u.probeFailed,
+		ConsecutiveErrors: u.failures,
+		ActiveRequests:    u.Active(),
+		LastError:         u.lastError,
+	}
+
+	if time.Now().Before(u.ejectedUntil) {
+		t := u.ejectedUntil
+		s.EjectedUntil = &t
+	}
+
+	if u.breaker != nil {
+		s.Circuit = u.breaker.State()
+	}
+
+	return s
+}
+
+// reportSuccess resets the consecutive errors and the ejection backoff.
+func (u *Upstream) reportSuccess() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.failures = 0
+	u.ejections = 0
+}
+
+// gatewayFailure reports if the status code means that the upstream couldn't handle the request, unlike the
+// errors of the application, e.g. a http 500.
+func gatewayFailure(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+// ejected reports if the outlier detection took the upstream out of the pool.
+func (u *Upstream) ejected() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return time.Now().Before(u.ejectedUntil)
+}
+
+// mayEject reports if ejecting the upstream keeps the ejected upstreams of its pool within the outlier
+// detection's maximum share, so that a failing pool isn't emptied.
+func (u *Upstream) mayEject(od OutlierDetection) bool {
+	ejected := 1
+
+	for _, p := range u.pool {
+		if p != u && p.ejected() {
+			ejected++
+		}
+	}
+
+	return ejected*100 <= od.maxEjectionPercent()*len(u.pool)
+}
+
+// reportFailure counts a failed request and ejects the upstream once the outlier detection's limit is reached,
+// unless too many upstreams of the pool are ejected already. Every ejection in a row doubles the ejection time up
+// to its maximum.
+func (u *Upstream) reportFailure(od OutlierDetection, reason string) {
+	// checked before locking, since the other upstreams are locked to check them
+	mayEject := u.mayEject(od)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.failures++
+	u.lastError = reason
+
+	if u.failures < od.consecutiveErrors() || !mayEject {
+		return
+	}
+
+	d := od.baseEjectionTime() << uint(u.ejections)
+	if d > od.maxEjectionTime() || d <= 0 {
+		d = od.maxEjectionTime()
+	}
+
+	u.ejectedUntil = time.Now().Add(d)
+	u.ejections++
+	u.failures = 0
+}
+
+// reportProbe records the result of a health probe.
+func (u *Upstream) reportProbe(err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.probeFailed = err != nil
+	if err != nil {
+		u.lastError = "health check: " + err.Error()
+	}
+}
+
+func (od OutlierDetection) consecutiveErrors() int {
+	if od.ConsecutiveErrors > 0 {
+		return od.ConsecutiveErrors
+	}
+
+	return DefaultConsecutiveErrors
+}
+
+func (od OutlierDetection) baseEjectionTime() time.Duration {
+	if od.BaseEjectionTime > 0 {
+		return time.Duration(od.BaseEjectionTime)
+	}
+
+	return DefaultBaseEjectionTime
+}
+
+func (od OutlierDetection) maxEjectionTime() time.Duration {
+	if od.MaxEjectionTime > 0 {
+		return time.Duration(od.MaxEjectionTime)
+	}
+
+	return DefaultMaxEjectionTime
+}
+
+func (od OutlierDetection) maxEjectionPercent() int {
+	if od.MaxEjectionPercent > 0 {
+		return od.MaxEjectionPercent
+	}
+
+	return DefaultMaxEjectionPercent
+}
+
+// probe sends a GET request to the health check's path of the upstream. Every status code below 400 counts
+// as healthy.
+func probe(ctx context.Context, client *http.Client, u *Upstream, path string) error {
+	req, err := http.NewRequest("GET", strings.TrimSuffix(u.URL.String(), "/")+path, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return nil
+}
+
+// probeLoop probes all upstreams every interval with the route's transport until ctx is done.
+func probeLoop(ctx context.Context, hc HealthCheck, transport http.RoundTripper, upstreams []*Upstream) {
+	client := &http.Client{Transport: transport, Timeout: hc.timeout()}
+
+	t := time.NewTicker(hc.interval())
+	defer t.Stop()
+
+	for {
+		var wg sync.WaitGroup
+
+		for _, u := range upstreams {
+			wg.Add(1)
+
+			go func(u *Upstream) {
+				defer wg.Done()
+				u.reportProbe(probe(ctx, client, u, hc.Path))
+			}(u)
+		}
+
+		wg.Wait()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (hc HealthCheck) interval() time.Duration {
+	if hc.Interval > 0 {
+		return time.Duration(hc.Interval)
+	}
+
+	return 10 * time.Second
+}
+
+func (hc HealthCheck) timeout() time.Duration {
+	if hc.Timeout > 0 {
+		return time.Duration(hc.Timeout)
+	}
+
+	return 2 * time.Second
+}
+
+// HandleStatus returns a handler listing the health of every route's upstreams by the route's name. The upstreams
+// of a route's versions and pools are listed by the route's name and the version's or pool's, like users@v1.
+func HandleStatus(handlers []*Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := make(map[string][]UpstreamStatus, len(handlers))
+
+		for _, h := range handlers {
+			for _, u := range h.upstreams {
+				status[h.route.Name] = append(status[h.route.Name], u.Status())
+			}
+
+			for _, v := range h.versions {
+				name := h.route.Name + "@" + v.Name
+
+				for _, u := range v.handler.upstreams {
+					status[name] = append(status[name], u.Status())
+				}
+			}
+
+			if h.canary != nil {
+				for _, p := range h.canary.pools {
+					name := h.route.Name + "@" + p.Name
+
+					for _, u := range p.handler.upstreams {
+						status[name] = append(status[name], u.Status())
+					}
+				}
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		err := json.NewEncoder(w).Encode(status)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
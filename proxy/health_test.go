@@ -0,0 +1,237 @@
+package proxy_test
+
+import (
+	"auth-proxy/proxy"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestOutlierDetection(t *testing.T) {
+	var failing, healthy int32
+
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&failing, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer bad.Close()
+
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&healthy, 1)
+	}))
+	defer good.Close()
+
+	route := proxy.Route{
+		OutlierDetection: proxy.OutlierDetection{
+			ConsecutiveErrors: 2,
+			BaseEjectionTime:  proxy.Duration(time.Hour),
+		},
+	}
+
+	h := newHandler(t, route, bad, good)
+	defer h.Close()
+
+	for i := 0; i < 10; i++ {
+		get(h, "GET", "/api/stocks")
+	}
+
+	if failing != 2 || healthy != 8 {
+		t.Errorf("Expected the failing upstream to be ejected after 2 errors but it got %d and the healthy one %d requests", failing, healthy)
+	}
+
+	st := h.Upstreams()[0].Status()
+	if st.Healthy || st.EjectedUntil == nil || st.LastError == "" {
+		t.Errorf("Expected the failing upstream to be reported as ejected but got %+v", st)
+	}
+
+	if st := h.Upstreams()[1].Status(); !st.Healthy || st.EjectedUntil != nil {
+		t.Errorf("Expected the healthy upstream to be reported as healthy but got %+v", st)
+	}
+}
+
+func TestApplicationErrorsAreNotOutliers(t *testing.T) {
+	var received int32
+
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&received, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer bad.Close()
+
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer good.Close()
+
+	h := newHandler(t, proxy.Route{OutlierDetection: proxy.OutlierDetection{ConsecutiveErrors: 1}}, bad, good)
+	defer h.Close()
+
+	for i := 0; i < 10; i++ {
+		get(h, "GET", "/api/stocks")
+	}
+
+	if received != 5 {
+		t.Errorf("Expected the upstream answering with http 500 to keep receiving requests but it got %d", received)
+	}
+}
+
+func TestMaxEjectionPercent(t *testing.T) {
+	bad := func() *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadGateway)
+		}))
+	}
+
+	cases := []struct {
+		upstreams       int
+		percent         int
+		expectedEjected int
+	}{
+		{1, 0, 0},
+		{3, 0, 1},
+		{3, 70, 2},
+		{1, 100, 1},
+	}
+
+	for _, i := range cases {
+		var servers []*httptest.Server
+		for n := 0; n < i.upstreams; n++ {
+			u := bad()
+			defer u.Close()
+
+			servers = append(servers, u)
+		}
+
+		route := proxy.Route{OutlierDetection: proxy.OutlierDetection{ConsecutiveErrors: 1, MaxEjectionPercent: i.percent}}
+
+		h := newHandler(t, route, servers...)
+		defer h.Close()
+
+		for n := 0; n < 10; n++ {
+			get(h, "GET", "/api/stocks")
+		}
+
+		ejected := 0
+		for _, u := range h.Upstreams() {
+			if u.Status().EjectedUntil != nil {
+				ejected++
+			}
+		}
+
+		if ejected != i.expectedEjected {
+			t.Errorf("Expected %d of %d failing upstreams to be ejected but got %d when maxEjectionPercent=%d", i.expectedEjected, i.upstreams, ejected, i.percent)
+		}
+	}
+}
+
+func TestEjectionBackoff(t *testing.T) {
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer bad.Close()
+
+	route := proxy.Route{
+		OutlierDetection: proxy.OutlierDetection{
+			ConsecutiveErrors:  1,
+			BaseEjectionTime:   proxy.Duration(time.Millisecond * 50),
+			MaxEjectionTime:    proxy.Duration(time.Millisecond * 120),
+			MaxEjectionPercent: 100,
+		},
+	}
+
+	h := newHandler(t, route, bad)
+	defer h.Close()
+
+	expected := []time.Duration{time.Millisecond * 50, time.Millisecond * 100, time.Millisecond * 120}
+
+	for _, d := range expected {
+		start := time.Now()
+		get(h, "GET", "/api/stocks")
+
+		st := h.Upstreams()[0].Status()
+		if st.EjectedUntil == nil {
+			t.Fatal("Expected the upstream to be ejected")
+		}
+
+		if got := st.EjectedUntil.Sub(start); got < d || got > d+time.Millisecond*40 {
+			t.Errorf("Expected the upstream to be ejected for %v but it's ejected for %v", d, got)
+		}
+
+		if rr := get(h, "GET", "/api/stocks"); rr.Code != http.StatusServiceUnavailable {
+			t.Errorf("Expected status code %d but got %d while the only upstream is ejected", http.StatusServiceUnavailable, rr.Code)
+		}
+
+		time.Sleep(time.Until(*st.EjectedUntil) + time.Millisecond*5)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	var unhealthy int32
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" && atomic.LoadInt32(&unhealthy) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer upstream.Close()
+
+	route := proxy.Route{
+		HealthCheck: &proxy.HealthCheck{
+			Path:     "/healthz",
+			Interval: proxy.Duration(time.Millisecond * 10),
+		},
+	}
+
+	h := newHandler(t, route, upstream)
+	defer h.Close()
+
+	waitFor := func(code int) {
+		t.Helper()
+
+		deadline := time.Now().Add(time.Second)
+		for time.Now().Before(deadline) {
+			if get(h, "GET", "/api/stocks").Code == code {
+				return
+			}
+
+			time.Sleep(time.Millisecond * 5)
+		}
+
+		t.Fatalf("Expected status code %d within a second", code)
+	}
+
+	waitFor(http.StatusOK)
+
+	atomic.StoreInt32(&unhealthy, 1)
+	waitFor(http.StatusServiceUnavailable)
+
+	if st := h.Upstreams()[0].Status(); !st.ProbeFailed || st.LastError == "" {
+		t.Errorf("Expected the failed probe to be reported but got %+v", st)
+	}
+
+	atomic.StoreInt32(&unhealthy, 0)
+	waitFor(http.StatusOK)
+}
+
+func TestHandleStatus(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	h := newHandler(t, proxy.Route{Name: "stocks"}, upstream)
+	defer h.Close()
+
+	rr := get(proxy.HandleStatus([]*proxy.Handler{h}), "GET", "/api/admin/upstreams")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d but got %d", http.StatusOK, rr.Code)
+	}
+
+	var status map[string][]proxy.UpstreamStatus
+	if err := json.NewDecoder(rr.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(status["stocks"]) != 1 || status["stocks"][0].URL != upstream.URL || !status["stocks"][0].Healthy {
+		t.Errorf("Unexpected status %+v", status)
+	}
+}
@@ -0,0 +1,385 @@
+package proxy
+
+import (
+	"auth-proxy/internal"
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/csrf"
+)
+
+// Handler forwards the requests of a route to its upstreams.
+type Handler struct {
+	route     Route
+	upstreams []*Upstream
+	balancer  Balancer
+	proxy     *httputil.ReverseProxy
+	// fallbackCache is nil unless the route falls back to cached responses
+	fallbackCache *responseCache
+	// cache is nil unless the route caches responses
+	cache *routeCache
+	// coalescer is nil unless the route coalesces requests
+	coalescer *coalescer
+	// rewriter is nil unless the route rewrites paths
+	rewriter *rewriter
+	// versions are the route's API versions and usage counts the requests without a version
+	versions []*version
+	usage    *usage
+	// canary is nil unless the route splits its users between pools
+	canary *canary
+
+	// stopProbes stops the active health checks
+	stopProbes context.CancelFunc
+}
+
+type upstreamKey struct{}
+
+// New returns a Handler for the route, which has to be valid. If the route has a health check, its upstreams are
+// probed until the handler is closed.
+func New(route Route) (*Handler, error) {
+	h := &Handler{route: route}
+
+	for _, u := range route.Upstreams {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			return nil, err
+		}
+
+		u := &Upstream{URL: parsed}
+		if route.CircuitBreaker != nil {
+			u.breaker = newBreaker(*route.CircuitBreaker)
+		}
+
+		h.upstreams = append(h.upstreams, u)
+	}
+
+	for _, u := range h.upstreams {
+		u.pool = h.upstreams
+	}
+
+	h.balancer = NewBalancer(route.Balancer, h.upstreams)
+
+	h.proxy = &httputil.ReverseProxy{
+		Director:       h.direct,
+		ModifyResponse: h.modifyResponse,
+		ErrorHandler:   h.handleError,
+	}
+
+	// HTTP/2 routes may stream, e.g. gRPC calls, so every write is flushed to the client immediately
+	if route.usesHTTP2() {
+		h.proxy.FlushInterval = -1
+	}
+
+	base := newTransport(route.Protocol)
+	transport := base
+
+	if cb := route.CircuitBreaker; cb != nil {
+		transport = &breakerTransport{next: transport}
+
+		if cb.Fallback.Type == FallbackCached {
+			maxAge := time.Duration(cb.Fallback.MaxAge)
+			if maxAge <= 0 {
+				maxAge = DefaultFallbackMaxAge
+			}
+
+			h.fallbackCache = newResponseCache(maxAge)
+		}
+	}
+
+	if route.Cache != nil {
+		h.cache = newRouteCache(*route.Cache)
+	}
+
+	if route.Coalesce != nil {
+		h.coalescer = newCoalescer()
+	}
+
+	if route.Rewrite != nil {
+		rw, err := newRewriter(*route.Rewrite)
+		if err != nil {
+			return nil, err
+		}
+
+		h.rewriter = rw
+	}
+
+	// every attempt of a retried request passes the circuit breaker
+	if route.Retries != nil {
+		transport = &retryTransport{
+			next:     transport,
+			cfg:      *route.Retries,
+			od:       route.OutlierDetection,
+			budget:   newRetryBudget(route.Retries.Budget),
+			balancer: h.balancer,
+		}
+	}
+
+	h.proxy.Transport = transport
+
+	if len(route.Versions) > 0 {
+		versions, err := newVersions(route)
+		if err != nil {
+			return nil, err
+		}
+
+		h.versions = versions
+		h.usage = usages.get(route.Name, "")
+	}
+
+	if route.Canary != nil {
+		c, err := newCanary(route)
+		if err != nil {
+			for _, v := range h.versions {
+				v.handler.Close()
+			}
+
+			return nil, err
+		}
+
+		h.canary = c
+	}
+
+	if route.HealthCheck != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		h.stopProbes = cancel
+
+		go probeLoop(ctx, *route.HealthCheck, base, h.upstreams)
+	}
+
+	return h, nil
+}
+
+// Close stops the active health checks of the route's upstreams, including the ones of its versions and pools.
+func (h *Handler) Close() error {
+	if h.stopProbes != nil {
+		h.stopProbes()
+	}
+
+	for _, v := range h.versions {
+		v.handler.Close()
+	}
+
+	if h.canary != nil {
+		h.canary.close()
+	}
+
+	return nil
+}
+
+// Route returns the route the handler forwards requests for.
+func (h *Handler) Route() Route {
+	return h.route
+}
+
+// Upstreams returns the route's upstreams.
+func (h *Handler) Upstreams() []*Upstream {
+	return h.upstreams
+}
+
+func (h *Handler) direct(r *http.Request) {
+	u := upstreamOf(r).URL
+
+	r.Header.Set("X-Forwarded-Host", r.Host)
+	r.URL.Scheme = u.Scheme
+	r.URL.Host = u.Host
+
+	if h.rewriter != nil {
+		r.URL.Path = h.rewriter.path(r.URL.Path)
+		r.URL.RawPath = ""
+	}
+
+	if p := strings.TrimSuffix(u.Path, "/"); p != "" {
+		r.URL.Path = p + r.URL.Path
+		r.URL.RawPath = ""
+	}
+
+	h.route.Headers.Request.Apply(r.Header)
+	setDeadline(r)
+}
+
+// setDeadline sets the DeadlineHeader of a request forwarded to an upstream. Values sent by the client are
+// removed. The grpc-timeout of gRPC calls is shortened to the same deadline.
+func setDeadline(r *http.Request) {
+	r.Header.Del(DeadlineHeader)
+
+	if deadline, ok := r.Context().Deadline(); ok {
+		ms := time.Until(deadline).Milliseconds()
+		if ms < 1 {
+			ms = 1
+		}
+
+		r.Header.Set(DeadlineHeader, strconv.FormatInt(ms, 10))
+	}
+
+	setGRPCTimeout(r)
+}
+
+func upstreamOf(r *http.Request) *Upstream {
+	return r.Context().Value(upstreamKey{}).(*Upstream)
+}
+
+func (h *Handler) modifyResponse(resp *http.Response) error {
+	u := upstreamOf(resp.Request)
+	if gatewayFailure(resp.StatusCode) {
+		u.reportFailure(h.route.OutlierDetection, resp.Status)
+	} else {
+		u.reportSuccess()
+	}
+
+	// the csrf middleware skips gRPC calls, so they have no token
+	if resp.Request.Method == "POST" && !IsGRPC(resp.Request) {
+		resp.Header.Set("X-CSRF-Token", csrf.Token(resp.Request))
+	}
+
+	if h.rewriter != nil {
+		h.rewriter.response(resp, u.URL)
+	}
+
+	h.route.Headers.Response.Apply(resp.Header)
+	h.recordForFallback(resp)
+	h.recordForCache(resp)
+
+	return nil
+}
+
+// handleError counts requests the upstream couldn't answer as failed, unless the client went away. Requests
+// rejected by the circuit breaker get its fallback response and requests which timed out a http 504.
+func (h *Handler) handleError(w http.ResponseWriter, r *http.Request, err error) {
+	if err == errCircuitOpen {
+		h.fallback(w, r)
+		return
+	}
+
+	if r.Context().Err() != context.Canceled {
+		upstreamOf(r).reportFailure(h.route.OutlierDetection, err.Error())
+	}
+
+	log.Printf("proxy: %s: %v", h.route.Name, err)
+
+	if timedOut(r, err) {
+		internal.WriteError(w, http.StatusGatewayTimeout, "upstream_timeout", "The service didn't respond in time. Please try again later.")
+		return
+	}
+
+	internal.WriteError(w, http.StatusBadGateway, "upstream_error", "The service couldn't be reached. Please try again later.")
+}
+
+func timedOut(r *http.Request, err error) bool {
+	if r.Context().Err() == context.DeadlineExceeded || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var netErr net.Error
+
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func (h *Handler) allowsMethod(method string) bool {
+	if len(h.route.Methods) == 0 {
+		return true
+	}
+
+	for _, m := range h.route.Methods {
+		if m == method {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// only the authMiddleware identifies users, so clients of routes without it can't claim to be one
+	if !h.route.RequiresAuth() {
+		for _, name := range identityHeaders {
+			r.Header.Del(name)
+		}
+	}
+
+	// requests which didn't pass WithVersion yet resolve their version first
+	if len(h.versions) > 0 {
+		v, resolved := r.Context().Value(versionKey{}).(*version)
+		if !resolved {
+			h.WithVersion(h).ServeHTTP(w, r)
+			return
+		}
+
+		if v != nil {
+			v.handler.ServeHTTP(w, r)
+			return
+		}
+	}
+
+	if h.canary != nil {
+		if p := h.canary.pick(r); p != nil {
+			w.Header().Set(PoolHeader, p.Name)
+			p.handler.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set(PoolHeader, StablePool)
+	}
+
+	if !h.allowsMethod(r.Method) {
+		w.Header().Set("Allow", strings.Join(h.route.Methods, ", "))
+		http.Error(w, "The method isn't allowed for this route", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if h.route.Streaming == nil && IsUpgrade(r) {
+		internal.WriteError(w, http.StatusBadRequest, "streaming_not_allowed", "This route doesn't allow WebSockets")
+		return
+	}
+
+	if h.cache != nil && cacheable(r) {
+		h.serveCached(w, r)
+		return
+	}
+
+	h.fetch(w, r)
+}
+
+// forward forwards the request to one of the available upstreams. If open circuits leave none, the request gets
+// the circuit breaker's fallback. Streams of routes which allow them aren't bound by any timeout.
+func (h *Handler) forward(w http.ResponseWriter, r *http.Request) {
+	stream := h.route.IsStream(r)
+	if stream {
+		liftDeadlines(r)
+	}
+
+	if h.route.Timeout > 0 && !stream {
+		ctx, cancel := context.WithTimeout(r.Context(), time.Duration(h.route.Timeout))
+		defer cancel()
+
+		r = r.WithContext(ctx)
+	}
+
+	if h.fallbackCache != nil && r.Method == "GET" {
+		r = r.WithContext(context.WithValue(r.Context(), fallbackKey{}, fallbackCacheKey(r)))
+	}
+
+	u := h.balancer.Pick(r)
+	if u == nil {
+		if h.circuitsOpen() {
+			h.fallback(w, r)
+			return
+		}
+
+		internal.WriteError(w, http.StatusServiceUnavailable, "upstream_unavailable", "The service is currently unavailable. Please try again later.")
+		return
+	}
+
+	atomic.AddInt64(&u.active, 1)
+	defer atomic.AddInt64(&u.active, -1)
+
+	h.proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), upstreamKey{}, u)))
+}
@@ -0,0 +1,298 @@
+package proxy_test
+
+import (
+	"auth-proxy/proxy"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newHandler returns a handler for the route with the upstreams. The route's policies get short durations, so that
+// tests don't wait for the defaults: cached responses live for a minute, retries back off for a millisecond and
+// circuits open for 50ms once half of 4 requests failed. Unless the route configures the outlier detection,
+// upstreams of routes with retries or a circuit breaker are only ejected after 100 errors in a row, so that just
+// the tested policy rejects requests.
+func newHandler(t *testing.T, route proxy.Route, upstreams ...*httptest.Server) *proxy.Handler {
+	t.Helper()
+
+	for _, u := range upstreams {
+		route.Upstreams = append(route.Upstreams, u.URL)
+	}
+
+	if route.Name == "" {
+		route.Name = "test"
+	}
+
+	if route.Prefix == "" {
+		route.Prefix = "/api"
+	}
+
+	if c := route.Cache; c != nil && c.TTL == 0 {
+		c.TTL = proxy.Duration(time.Minute)
+	}
+
+	if rt := route.Retries; rt != nil && rt.BaseBackoff == 0 {
+		rt.BaseBackoff = proxy.Duration(time.Millisecond)
+	}
+
+	if cb := route.CircuitBreaker; cb != nil {
+		if cb.MinRequests == 0 {
+			cb.MinRequests = 4
+		}
+
+		if cb.OpenFor == 0 {
+			cb.OpenFor = proxy.Duration(time.Millisecond * 50)
+		}
+	}
+
+	if (route.Retries != nil || route.CircuitBreaker != nil) && route.OutlierDetection.ConsecutiveErrors == 0 {
+		route.OutlierDetection.ConsecutiveErrors = 100
+	}
+
+	cfg := proxy.Config{Routes: []proxy.Route{route}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := proxy.New(route)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return h
+}
+
+// testUpstream is an upstream which counts the requests it received.
+type testUpstream struct {
+	*httptest.Server
+	received int32
+}
+
+// newUpstream returns an upstream answering every request with respond, which gets the number of the request.
+func newUpstream(respond func(w http.ResponseWriter, r *http.Request, n int32)) *testUpstream {
+	u := &testUpstream{}
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		respond(w, r, atomic.AddInt32(&u.received, 1))
+	}))
+
+	return u
+}
+
+// Received returns the number of requests the upstream received.
+func (u *testUpstream) Received() int32 {
+	return atomic.LoadInt32(&u.received)
+}
+
+// request sends a request with the body and headers to the handler.
+func request(h http.Handler, method, path string, body io.Reader, header map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, body)
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, r)
+
+	return rr
+}
+
+func get(h http.Handler, method, path string) *httptest.ResponseRecorder {
+	return request(h, method, path, nil, nil)
+}
+
+// getAs sends a GET request as the user with the uid.
+func getAs(h http.Handler, uid, path string) *httptest.ResponseRecorder {
+	return request(h, "GET", path, nil, map[string]string{"UID": uid})
+}
+
+func TestHandler(t *testing.T) {
+	var lastPath, lastService, lastAuth string
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lastPath = r.URL.Path
+		lastService = r.Header.Get("X-Service")
+		lastAuth = r.Header.Get("Authorization")
+
+		w.Header().Set("Server", "stock-service")
+	}))
+	defer upstream.Close()
+
+	route := proxy.Route{
+		Methods: []string{"GET"},
+		Headers: proxy.HeaderRules{
+			Request:  proxy.HeaderRule{Set: map[string]string{"X-Service": "stocks"}, Remove: []string{"Authorization"}},
+			Response: proxy.HeaderRule{Remove: []string{"Server"}},
+		},
+	}
+
+	h := newHandler(t, route, upstream)
+
+	req := httptest.NewRequest("GET", "/api/stocks", nil)
+	req.Header.Set("Authorization", "secret")
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d but got %d", http.StatusOK, rr.Code)
+	}
+
+	if lastPath != "/api/stocks" || lastService != "stocks" || lastAuth != "" {
+		t.Errorf("Unexpected forwarded request path=%s, X-Service=%s, Authorization=%s", lastPath, lastService, lastAuth)
+	}
+
+	if rr.Header().Get("Server") != "" {
+		t.Error("Expected the Server header to be removed from the response")
+	}
+
+	rr = get(h, "POST", "/api/stocks")
+	if rr.Code != http.StatusMethodNotAllowed || rr.Header().Get("Allow") != "GET" {
+		t.Errorf("Expected status code %d with the allowed methods but got %d", http.StatusMethodNotAllowed, rr.Code)
+	}
+}
+
+func TestHandlerAnonymousIdentity(t *testing.T) {
+	var lastUID, lastGuest string
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lastUID = r.Header.Get("UID")
+		lastGuest = r.Header.Get("Guest")
+	}))
+	defer upstream.Close()
+
+	cases := []struct {
+		auth          string
+		expectedUID   string
+		expectedGuest string
+	}{
+		{proxy.AuthNone, "", ""},
+		{proxy.AuthRequired, "1", "true"},
+	}
+
+	for _, i := range cases {
+		h := newHandler(t, proxy.Route{Auth: i.auth, Balancer: proxy.ConsistentHash}, upstream)
+		defer h.Close()
+
+		req := httptest.NewRequest("GET", "/api/news", nil)
+		req.Header.Set("UID", "1")
+		req.Header.Set("Guest", "true")
+
+		h.ServeHTTP(httptest.NewRecorder(), req)
+
+		if lastUID != i.expectedUID || lastGuest != i.expectedGuest {
+			t.Errorf("Expected the upstream to receive UID=%q, Guest=%q but got UID=%q, Guest=%q when auth=%s", i.expectedUID, i.expectedGuest, lastUID, lastGuest, i.auth)
+		}
+	}
+}
+
+func TestHandlerUpstreamPath(t *testing.T) {
+	var lastPath string
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lastPath = r.URL.Path
+	}))
+	defer upstream.Close()
+
+	route := proxy.Route{Name: "v1", Prefix: "/api", Upstreams: []string{upstream.URL + "/v1/"}}
+
+	h, err := proxy.New(route)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get(h, "GET", "/api/news")
+
+	if lastPath != "/v1/api/news" {
+		t.Errorf("Expected the upstream's path to be prepended but got %s", lastPath)
+	}
+}
+
+func TestHandlerUpstreams(t *testing.T) {
+	counts := make([]int, 2)
+	var upstreams []*httptest.Server
+
+	for i := range counts {
+		i := i
+
+		u := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			counts[i]++
+		}))
+		defer u.Close()
+
+		upstreams = append(upstreams, u)
+	}
+
+	h := newHandler(t, proxy.Route{}, upstreams...)
+
+	for i := 0; i < 10; i++ {
+		get(h, "GET", "/api/news")
+	}
+
+	if counts[0] != 5 || counts[1] != 5 {
+		t.Errorf("Expected the requests to be distributed evenly but got %v", counts)
+	}
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer upstream.Close()
+
+	h := newHandler(t, proxy.Route{Timeout: proxy.Duration(time.Millisecond * 50)}, upstream)
+
+	start := time.Now()
+	rr := get(h, "GET", "/api/news")
+
+	if rr.Code != http.StatusGatewayTimeout || time.Since(start) > time.Millisecond*500 {
+		t.Errorf("Expected the request to be aborted after the timeout but got %d after %v", rr.Code, time.Since(start))
+	}
+}
+
+func TestHandlerDeadlineHeader(t *testing.T) {
+	var lastDeadline string
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lastDeadline = r.Header.Get(proxy.DeadlineHeader)
+	}))
+	defer upstream.Close()
+
+	cases := []struct {
+		timeout time.Duration
+	}{
+		{time.Second},
+		{0},
+	}
+
+	for _, i := range cases {
+		h := newHandler(t, proxy.Route{Timeout: proxy.Duration(i.timeout)}, upstream)
+
+		req := httptest.NewRequest("GET", "/api/news", nil)
+		req.Header.Set(proxy.DeadlineHeader, "999999")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+
+		ms, err := strconv.Atoi(lastDeadline)
+		if (i.timeout == 0 && lastDeadline != "") || (i.timeout > 0 && (err != nil || ms <= 900 || ms > 1000)) {
+			t.Errorf("Unexpected deadline header %q when timeout=%v", lastDeadline, i.timeout)
+		}
+	}
+}
+
+func TestHandlerUnreachable(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	h := newHandler(t, proxy.Route{}, upstream)
+	upstream.Close()
+
+	rr := get(h, "GET", "/api/news")
+	if rr.Code != http.StatusBadGateway || !strings.Contains(rr.Body.String(), "upstream_error") {
+		t.Errorf("Expected status code %d with the code upstream_error but got %d %s", http.StatusBadGateway, rr.Code, rr.Body.String())
+	}
+}
@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BuildFunc builds the handler serving all requests from a valid route configuration. If the handler implements
+// io.Closer, it's closed once it has been replaced.
+type BuildFunc func(cfg *Config) (http.Handler, error)
+
+// Reloader serves requests with the handler built from the latest valid route configuration. A new handler is
+// built and validated off to the side and swapped in atomically, so requests which already started finish on
+// the old one. If the configuration is invalid, the last valid one is kept.
+type Reloader struct {
+	path  string
+	build BuildFunc
+
+	current atomic.Value
+
+	// mu serializes reloads and guards the file's last known state
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+}
+
+// NewReloader returns a Reloader serving requests with the handler built from the configuration file. It fails
+// if the initial configuration is invalid.
+func NewReloader(path string, build BuildFunc) (*Reloader, error) {
+	rl := &Reloader{path: path, build: build}
+
+	if err := rl.Reload(); err != nil {
+		return nil, err
+	}
+
+	return rl, nil
+}
+
+// Reload reads the configuration file again and swaps in the handler built from it. If the configuration is
+// invalid, the current handler is kept and the error returned.
+func (rl *Reloader) Reload() error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	// remember the state before reading, so that changes made while reading trigger another reload
+	if fi, err := os.Stat(rl.path); err == nil {
+		rl.modTime = fi.ModTime()
+		rl.size = fi.Size()
+	}
+
+	cfg, err := Load(rl.path)
+	if err != nil {
+		return err
+	}
+
+	h, err := rl.build(cfg)
+	if err != nil {
+		return err
+	}
+
+	old, _ := rl.current.Load().(*http.Handler)
+	rl.current.Store(&h)
+
+	// stop background work like health checks of the replaced handler
+	if old != nil {
+		if c, ok := (*old).(io.Closer); ok {
+			c.Close()
+		}
+	}
+
+	return nil
+}
+
+// changed reports if the configuration file changed since it was last read.
+func (rl *Reloader) changed() bool {
+	fi, err := os.Stat(rl.path)
+	if err != nil {
+		return false
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	return !fi.ModTime().Equal(rl.modTime) || fi.Size() != rl.size
+}
+
+// Watch reloads the configuration whenever the file changes until stop is closed. The file is checked every
+// interval. Failed reloads are logged.
+func (rl *Reloader) Watch(interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			if rl.changed() {
+				rl.reloadAndLog("file change")
+			}
+		}
+	}
+}
+
+// ReloadOn reloads the configuration whenever a value is received from the channel, e.g. on a SIGHUP.
+func (rl *Reloader) ReloadOn(c <-chan os.Signal) {
+	for sig := range c {
+		rl.reloadAndLog(sig.String())
+	}
+}
+
+func (rl *Reloader) reloadAndLog(reason string) {
+	if err := rl.Reload(); err != nil {
+		log.Printf("routes: keeping the last valid configuration after a %s: %v", reason, err)
+		return
+	}
+
+	log.Printf("routes: reloaded %s after a %s", rl.path, reason)
+}
+
+func (rl *Reloader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h := rl.current.Load().(*http.Handler)
+
+	(*h).ServeHTTP(w, r)
+}
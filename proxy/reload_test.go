@@ -0,0 +1,170 @@
+package proxy_test
+
+import (
+	"auth-proxy/proxy"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// routeConfig returns a configuration with a single route named name.
+func routeConfig(name string) string {
+	return "routes: [{name: " + name + ", prefix: /api, upstreams: [http://upstream]}]"
+}
+
+// buildNamed builds handlers responding with the name of the first route. Requests to /block wait until
+// release is closed.
+func buildNamed(release chan struct{}) proxy.BuildFunc {
+	return func(cfg *proxy.Config) (http.Handler, error) {
+		name := cfg.Routes[0].Name
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/block" {
+				<-release
+			}
+
+			w.Write([]byte(name))
+		}), nil
+	}
+}
+
+func served(h http.Handler, path string) string {
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+
+	return rr.Body.String()
+}
+
+func TestReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "routes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "routes.yaml")
+	write := func(cfg string) {
+		t.Helper()
+
+		if err := ioutil.WriteFile(path, []byte(cfg), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("routes: []")
+
+	release := make(chan struct{})
+
+	if _, err := proxy.NewReloader(path, buildNamed(release)); err == nil {
+		t.Fatal("Expected an invalid initial configuration to be rejected")
+	}
+
+	write(routeConfig("first"))
+
+	rl, err := proxy.NewReloader(path, buildNamed(release))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := served(rl, "/"); got != "first" {
+		t.Fatalf("Expected the first configuration to be served but got %s", got)
+	}
+
+	// a request which started before the reload finishes on the old handler
+	inFlight := make(chan string)
+	go func() {
+		inFlight <- served(rl, "/block")
+	}()
+
+	time.Sleep(time.Millisecond * 10)
+
+	write(routeConfig("second"))
+
+	if err := rl.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := served(rl, "/"); got != "second" {
+		t.Errorf("Expected the second configuration to be served but got %s", got)
+	}
+
+	close(release)
+
+	if got := <-inFlight; got != "first" {
+		t.Errorf("Expected the in-flight request to finish on the first configuration but got %s", got)
+	}
+
+	write("routes: [{name: broken}]")
+
+	if err := rl.Reload(); err == nil {
+		t.Error("Expected the invalid configuration to be rejected")
+	}
+
+	if got := served(rl, "/"); got != "second" {
+		t.Errorf("Expected the last valid configuration to be kept but got %s", got)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	go rl.Watch(time.Millisecond*10, stop)
+
+	// make sure the modification time changes on file systems with a coarse resolution
+	time.Sleep(time.Millisecond * 20)
+	write(routeConfig("third"))
+	os.Chtimes(path, time.Now().Add(time.Second), time.Now().Add(time.Second))
+
+	deadline := time.Now().Add(time.Second)
+	for served(rl, "/") != "third" && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	if got := served(rl, "/"); got != "third" {
+		t.Errorf("Expected the changed file to be reloaded but got %s", got)
+	}
+}
+
+type closingHandler struct {
+	http.Handler
+	closed *bool
+}
+
+func (h closingHandler) Close() error {
+	*h.closed = true
+	return nil
+}
+
+func TestReloaderClosesReplacedHandler(t *testing.T) {
+	f, err := ioutil.TempFile("", "routes*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	f.WriteString(routeConfig("first"))
+	f.Close()
+
+	var closed []*bool
+
+	rl, err := proxy.NewReloader(f.Name(), func(cfg *proxy.Config) (http.Handler, error) {
+		c := new(bool)
+		closed = append(closed, c)
+
+		return closingHandler{http.NotFoundHandler(), c}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rl.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !*closed[0] || *closed[1] {
+		t.Errorf("Expected only the replaced handler to be closed")
+	}
+}
@@ -0,0 +1,298 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults of the retries.
+const (
+	DefaultRetryAttempts = 2
+	DefaultBaseBackoff   = 25 * time.Millisecond
+	DefaultMaxBackoff    = 250 * time.Millisecond
+	DefaultRetryBudget   = 0.2
+)
+
+// DefaultRetryOn are the status codes retried by default.
+var DefaultRetryOn = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+
+// The retry budget is tracked in windows of retryBudgetWindow, in which at least minRetriesPerWindow retries
+// are allowed regardless of the budget.
+const (
+	retryBudgetWindow   = 10 * time.Second
+	minRetriesPerWindow = 10
+)
+
+// maxReplayableBody is the largest body of an idempotent request which is buffered, so that the request can be
+// retried.
+const maxReplayableBody = 1 << 20
+
+func (rt Retries) attempts() int {
+	if rt.Attempts > 0 {
+		return rt.Attempts
+	}
+
+	return DefaultRetryAttempts
+}
+
+func (rt Retries) retriesOn(status int) bool {
+	on := rt.On
+	if len(on) == 0 {
+		on = DefaultRetryOn
+	}
+
+	for _, s := range on {
+		if s == status {
+			return true
+		}
+	}
+
+	return false
+}
+
+// backoff returns a random delay before the retry, whose upper bound doubles with every attempt.
+func (rt Retries) backoff(retry int) time.Duration {
+	base, max := DefaultBaseBackoff, DefaultMaxBackoff
+	if rt.BaseBackoff > 0 {
+		base = time.Duration(rt.BaseBackoff)
+	}
+
+	if rt.MaxBackoff > 0 {
+		max = time.Duration(rt.MaxBackoff)
+	}
+
+	d := base << uint(retry)
+	if d > max || d <= 0 {
+		d = max
+	}
+
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// retryBudget limits the retries of a route to a share of its requests, so that retries don't multiply the
+// load of an upstream which is already struggling.
+type retryBudget struct {
+	ratio float64
+
+	mu          sync.Mutex
+	windowStart time.Time
+	requests    int
+	retries     int
+}
+
+func newRetryBudget(ratio float64) *retryBudget {
+	if ratio <= 0 {
+		ratio = DefaultRetryBudget
+	}
+
+	return &retryBudget{ratio: ratio, windowStart: time.Now()}
+}
+
+func (b *retryBudget) roll() {
+	if time.Since(b.windowStart) >= retryBudgetWindow {
+		b.windowStart = time.Now()
+		b.requests = 0
+		b.retries = 0
+	}
+}
+
+func (b *retryBudget) request() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.roll()
+	b.requests++
+}
+
+// withdraw reports if another retry is within the budget and counts it if it is.
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.roll()
+
+	allowed := b.ratio * float64(b.requests)
+	if allowed < minRetriesPerWindow {
+		allowed = minRetriesPerWindow
+	}
+
+	if float64(b.retries) >= allowed {
+		return false
+	}
+
+	b.retries++
+
+	return true
+}
+
+// retryTransport retries idempotent requests, i.e. GET and HEAD requests and requests with an Idempotency-Key,
+// on connection errors and the configured status codes. Retries wait a jittered backoff, are limited by the
+// route's budget and aren't attempted if the request's deadline would pass while waiting. Every retry is
+// forwarded to another upstream picked by the balancer, unless the failed one is the only one available.
+type retryTransport struct {
+	next     http.RoundTripper
+	cfg      Retries
+	od       OutlierDetection
+	budget   *retryBudget
+	balancer Balancer
+}
+
+func idempotent(r *http.Request) bool {
+	return r.Method == "GET" || r.Method == "HEAD" || r.Header.Get("Idempotency-Key") != ""
+}
+
+// onceBody tracks if the body of a request has been read. The body is closed by the server once the request is
+// done, so closing it after an attempt is a no-op.
+type onceBody struct {
+	io.ReadCloser
+	read int32
+}
+
+func (b *onceBody) Read(p []byte) (int, error) {
+	atomic.StoreInt32(&b.read, 1)
+	return b.ReadCloser.Read(p)
+}
+
+func (b *onceBody) Close() error {
+	return nil
+}
+
+// replayable prepares the body of an idempotent request for retries and returns a function reporting if the
+// request can still be retried. Small bodies of a known length are buffered and sent again. Other bodies can only
+// be retried as long as nothing has been read from them.
+func replayable(r *http.Request) (func() bool, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return func() bool { return true }, nil
+	}
+
+	if r.ContentLength > 0 && r.ContentLength <= maxReplayableBody {
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		r.Body.Close()
+
+		r.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(b)), nil
+		}
+		r.Body, _ = r.GetBody()
+
+		return func() bool { return true }, nil
+	}
+
+	body := &onceBody{ReadCloser: r.Body}
+	r.Body = body
+
+	return func() bool { return atomic.LoadInt32(&body.read) == 0 }, nil
+}
+
+func (t *retryTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	t.budget.request()
+
+	if !idempotent(r) {
+		return t.next.RoundTrip(r)
+	}
+
+	canRetry, err := replayable(r)
+	if err != nil {
+		return nil, err
+	}
+
+	req := r
+
+	for retry := 0; ; retry++ {
+		resp, err := t.next.RoundTrip(req)
+
+		if retry >= t.cfg.attempts() || !t.shouldRetry(r, resp, err) || !canRetry() {
+			return resp, err
+		}
+
+		d := t.cfg.backoff(retry)
+
+		if deadline, ok := r.Context().Deadline(); ok && time.Until(deadline) <= d {
+			return resp, err
+		}
+
+		if !t.budget.withdraw() {
+			return resp, err
+		}
+
+		failed := upstreamOf(req)
+
+		if err != nil {
+			failed.reportFailure(t.od, err.Error())
+		} else {
+			if gatewayFailure(resp.StatusCode) {
+				failed.reportFailure(t.od, resp.Status)
+			}
+
+			io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+		}
+
+		timer := time.NewTimer(d)
+
+		select {
+		case <-r.Context().Done():
+			timer.Stop()
+			return nil, r.Context().Err()
+		case <-timer.C:
+		}
+
+		u := t.balancer.Pick(r.WithContext(context.WithValue(r.Context(), excludedKey{}, failed)))
+		if u == nil {
+			u = failed
+		}
+
+		if u != upstreamOf(r) {
+			atomic.AddInt64(&u.active, 1)
+			defer atomic.AddInt64(&u.active, -1)
+		}
+
+		req = r.Clone(context.WithValue(r.Context(), upstreamKey{}, u))
+		retarget(req, upstreamOf(r), u)
+		setDeadline(req)
+		if r.GetBody != nil {
+			if req.Body, err = r.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// retarget changes the url of a request directed to the upstream from to the upstream to.
+func retarget(r *http.Request, from, to *Upstream) {
+	if from == to {
+		return
+	}
+
+	r.URL.Scheme = to.URL.Scheme
+	r.URL.Host = to.URL.Host
+
+	if p := strings.TrimSuffix(from.URL.Path, "/"); p != "" {
+		r.URL.Path = strings.TrimPrefix(r.URL.Path, p)
+	}
+
+	if p := strings.TrimSuffix(to.URL.Path, "/"); p != "" {
+		r.URL.Path = p + r.URL.Path
+	}
+
+	r.URL.RawPath = ""
+}
+
+func (t *retryTransport) shouldRetry(r *http.Request, resp *http.Response, err error) bool {
+	if err != nil {
+		return err != errCircuitOpen && r.Context().Err() == nil
+	}
+
+	return t.cfg.retriesOn(resp.StatusCode)
+}
@@ -0,0 +1,168 @@
+package proxy_test
+
+import (
+	"auth-proxy/proxy"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failingUpstream responds with a http 503 to the first failures requests and echoes the body of the others.
+// It records the bodies it received.
+func failingUpstream(failures int32, bodies chan<- string) *testUpstream {
+	return newUpstream(func(w http.ResponseWriter, r *http.Request, n int32) {
+		b, _ := ioutil.ReadAll(r.Body)
+		if bodies != nil {
+			bodies <- string(b)
+		}
+
+		if n <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Write(b)
+	})
+}
+
+func TestRetries(t *testing.T) {
+	cases := []struct {
+		method           string
+		idempotencyKey   string
+		failures         int32
+		expectedCode     int
+		expectedAttempts int32
+	}{
+		{"GET", "", 2, http.StatusOK, 3},
+		{"GET", "", 3, http.StatusServiceUnavailable, 3},
+		{"POST", "", 1, http.StatusServiceUnavailable, 1},
+		{"POST", "order-1", 1, http.StatusOK, 2},
+	}
+
+	for _, i := range cases {
+		bodies := make(chan string, 10)
+
+		upstream := failingUpstream(i.failures, bodies)
+		h := newHandler(t, proxy.Route{Retries: &proxy.Retries{Attempts: 2}}, upstream.Server)
+
+		header := map[string]string{}
+		if i.idempotencyKey != "" {
+			header["Idempotency-Key"] = i.idempotencyKey
+		}
+
+		rr := request(h, i.method, "/api/stocks", strings.NewReader(`{"symbol": "AAPL"}`), header)
+		upstream.Close()
+		close(bodies)
+
+		if rr.Code != i.expectedCode || upstream.Received() != i.expectedAttempts {
+			t.Errorf("Expected status code %d after %d attempts but got %d after %d when method=%s and key=%q", i.expectedCode, i.expectedAttempts, rr.Code, upstream.Received(), i.method, i.idempotencyKey)
+		}
+
+		for b := range bodies {
+			if i.method == "POST" && b != `{"symbol": "AAPL"}` {
+				t.Errorf("Expected every attempt to carry the whole body but got %q", b)
+			}
+		}
+	}
+}
+
+func TestRetryConnectionError(t *testing.T) {
+	upstream := newUpstream(func(w http.ResponseWriter, r *http.Request, n int32) {
+		if n == 1 {
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err == nil {
+				conn.Close()
+			}
+		}
+	})
+	defer upstream.Close()
+
+	h := newHandler(t, proxy.Route{Retries: &proxy.Retries{}}, upstream.Server)
+
+	if rr := get(h, "GET", "/api/stocks"); rr.Code != http.StatusOK || upstream.Received() != 2 {
+		t.Errorf("Expected the reset connection to be retried but got %d after %d attempts", rr.Code, upstream.Received())
+	}
+}
+
+func TestRetryOtherUpstream(t *testing.T) {
+	reset := newUpstream(func(w http.ResponseWriter, r *http.Request, n int32) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	})
+	defer reset.Close()
+
+	upstream := newUpstream(func(w http.ResponseWriter, r *http.Request, n int32) {
+		w.Write([]byte(r.URL.Path))
+	})
+	defer upstream.Close()
+
+	h := newHandler(t, proxy.Route{Retries: &proxy.Retries{}}, reset.Server, upstream.Server)
+
+	rr := get(h, "GET", "/api/stocks")
+	if rr.Code != http.StatusOK || rr.Body.String() != "/api/stocks" {
+		t.Errorf("Expected the retry to be answered by the other upstream but got %d %s", rr.Code, rr.Body.String())
+	}
+
+	if reset.Received() != 1 || upstream.Received() != 1 {
+		t.Errorf("Expected one attempt per upstream but got %d and %d", reset.Received(), upstream.Received())
+	}
+}
+
+func TestNoRetryAfterStreamedBody(t *testing.T) {
+	upstream := failingUpstream(1, nil)
+	defer upstream.Close()
+
+	h := newHandler(t, proxy.Route{Retries: &proxy.Retries{}}, upstream.Server)
+
+	// the length of a body read from a pipe is unknown, so it's streamed instead of buffered
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write([]byte(`{"symbol": "AAPL"}`))
+		pw.Close()
+	}()
+
+	rr := request(h, "POST", "/api/stocks", pr, map[string]string{"Idempotency-Key": "order-1"})
+	if rr.Code != http.StatusServiceUnavailable || upstream.Received() != 1 {
+		t.Errorf("Expected the streamed request not to be retried but got %d after %d attempts", rr.Code, upstream.Received())
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	upstream := failingUpstream(1000, nil)
+	defer upstream.Close()
+
+	h := newHandler(t, proxy.Route{Retries: &proxy.Retries{Attempts: 1, Budget: 0.1}}, upstream.Server)
+
+	for i := 0; i < 20; i++ {
+		get(h, "GET", "/api/stocks")
+	}
+
+	// at least 10 retries are allowed per window regardless of the budget
+	if upstream.Received() != 30 {
+		t.Errorf("Expected 20 requests and 10 retries to reach the upstream but got %d", upstream.Received())
+	}
+}
+
+func TestRetryDeadline(t *testing.T) {
+	upstream := failingUpstream(1000, nil)
+	defer upstream.Close()
+
+	route := proxy.Route{
+		Retries: &proxy.Retries{BaseBackoff: proxy.Duration(time.Hour), MaxBackoff: proxy.Duration(time.Hour)},
+		Timeout: proxy.Duration(time.Millisecond * 100),
+	}
+
+	h := newHandler(t, route, upstream.Server)
+
+	start := time.Now()
+	get(h, "GET", "/api/stocks")
+
+	if time.Since(start) > time.Millisecond*100 || upstream.Received() != 1 {
+		t.Errorf("Expected no retry to be attempted past the deadline but got %d attempts after %v", upstream.Received(), time.Since(start))
+	}
+}
@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// rewriter changes the paths of the requests forwarded to the upstreams and the paths in their responses back.
+type rewriter struct {
+	strip string
+	add   string
+	rules []rewriteRule
+}
+
+type rewriteRule struct {
+	match   *regexp.Regexp
+	replace string
+}
+
+func newRewriter(rw Rewrite) (*rewriter, error) {
+	r := &rewriter{
+		strip: strings.TrimSuffix(rw.StripPrefix, "/"),
+		add:   strings.TrimSuffix(rw.AddPrefix, "/"),
+	}
+
+	for _, rule := range rw.Rules {
+		re, err := regexp.Compile(rule.Match)
+		if err != nil {
+			return nil, err
+		}
+
+		r.rules = append(r.rules, rewriteRule{match: re, replace: rule.Replace})
+	}
+
+	return r, nil
+}
+
+// trimPathPrefix removes the prefix from the path if it matches whole path segments. The rest always starts with
+// a /.
+func trimPathPrefix(path, prefix string) (string, bool) {
+	switch {
+	case prefix == "":
+		return path, true
+	case path == prefix:
+		return "/", true
+	case strings.HasPrefix(path, prefix+"/"):
+		return path[len(prefix):], true
+	}
+
+	return path, false
+}
+
+// path returns the path the request with the path is forwarded to.
+func (rw *rewriter) path(p string) string {
+	p, _ = trimPathPrefix(p, rw.strip)
+
+	for _, rule := range rw.rules {
+		if rule.match.MatchString(p) {
+			p = rule.match.ReplaceAllString(p, rule.replace)
+			break
+		}
+	}
+
+	return rw.add + p
+}
+
+// reverse returns the path of the client's request for a path of the upstream. It fails if the path doesn't
+// start with the added prefix.
+func (rw *rewriter) reverse(p string) (string, bool) {
+	p, ok := trimPathPrefix(p, rw.add)
+	if !ok {
+		return p, false
+	}
+
+	// the stripped prefix covers its own path as well as the ones below it
+	if p == "/" && rw.strip != "" {
+		return rw.strip, true
+	}
+
+	return rw.strip + p, true
+}
+
+// reverseUpstream returns the path of the client's request for a path of the upstream u, whose own path is
+// removed first.
+func (rw *rewriter) reverseUpstream(p string, u *url.URL) (string, bool) {
+	p, ok := trimPathPrefix(p, strings.TrimSuffix(u.Path, "/"))
+	if !ok {
+		return p, false
+	}
+
+	return rw.reverse(p)
+}
+
+// response changes the paths of the response's Location header and the cookies it sets back to the ones the
+// client knows. Redirects to other hosts are left alone.
+func (rw *rewriter) response(resp *http.Response, u *url.URL) {
+	if loc := resp.Header.Get("Location"); loc != "" {
+		resp.Header.Set("Location", rw.location(loc, u))
+	}
+
+	cookies := resp.Header["Set-Cookie"]
+	for i, c := range cookies {
+		cookies[i] = rw.cookie(c, u)
+	}
+}
+
+// location rewrites the path of a redirect to the upstream u. Absolute urls of the upstream become relative to
+// the client's host.
+func (rw *rewriter) location(loc string, u *url.URL) string {
+	parsed, err := url.Parse(loc)
+	if err != nil {
+		return loc
+	}
+
+	if parsed.Host != "" {
+		if parsed.Host != u.Host {
+			return loc
+		}
+
+		parsed.Scheme, parsed.User, parsed.Host = "", nil, ""
+	}
+
+	// relative paths resolve against the client's url anyway
+	if !strings.HasPrefix(parsed.Path, "/") {
+		return loc
+	}
+
+	p, ok := rw.reverseUpstream(parsed.Path, u)
+	if !ok {
+		return loc
+	}
+
+	parsed.Path, parsed.RawPath = p, ""
+
+	return parsed.String()
+}
+
+// cookie rewrites the Path attribute of a Set-Cookie header.
+func (rw *rewriter) cookie(c string, u *url.URL) string {
+	attrs := strings.Split(c, ";")
+
+	for i := 1; i < len(attrs); i++ {
+		kv := strings.SplitN(attrs[i], "=", 2)
+		if len(kv) != 2 || !strings.EqualFold(strings.TrimSpace(kv[0]), "path") {
+			continue
+		}
+
+		if p, ok := rw.reverseUpstream(strings.TrimSpace(kv[1]), u); ok {
+			attrs[i] = " Path=" + p
+		}
+	}
+
+	return strings.Join(attrs, ";")
+}
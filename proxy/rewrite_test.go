@@ -0,0 +1,114 @@
+package proxy_test
+
+import (
+	"auth-proxy/proxy"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRewrite(t *testing.T) {
+	var lastPath, lastQuery string
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lastPath, lastQuery = r.URL.Path, r.URL.RawQuery
+	}))
+	defer upstream.Close()
+
+	cases := []struct {
+		rewrite  proxy.Rewrite
+		path     string
+		expected string
+	}{
+		{proxy.Rewrite{StripPrefix: "/api/users"}, "/api/users/42", "/42"},
+		{proxy.Rewrite{StripPrefix: "/api/users"}, "/api/users", "/"},
+		{proxy.Rewrite{StripPrefix: "/api/users"}, "/api/usersettings", "/api/usersettings"},
+		{proxy.Rewrite{AddPrefix: "/v2/"}, "/api/users/42", "/v2/api/users/42"},
+		{proxy.Rewrite{StripPrefix: "/api/users", AddPrefix: "/v2"}, "/api/users/42", "/v2/42"},
+		{
+			proxy.Rewrite{
+				StripPrefix: "/api",
+				AddPrefix:   "/internal",
+				Rules: []proxy.RewriteRule{
+					{Match: `^/users/(\d+)/orders$`, Replace: "/orders/by-user/$1"},
+					{Match: `^/users/(\d+)$`, Replace: "/accounts/$1"},
+				},
+			},
+			"/api/users/42/orders?page=2",
+			"/internal/orders/by-user/42",
+		},
+	}
+
+	for _, i := range cases {
+		rw := i.rewrite
+		h := newHandler(t, proxy.Route{Rewrite: &rw}, upstream)
+
+		rr := get(h, "GET", i.path)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status code %d but got %d", http.StatusOK, rr.Code)
+		}
+
+		if lastPath != i.expected {
+			t.Errorf("Expected %s to be forwarded to %s but got %s", i.path, i.expected, lastPath)
+		}
+	}
+
+	if lastQuery != "page=2" {
+		t.Errorf("Expected the query to be kept but got %q", lastQuery)
+	}
+}
+
+func TestRewriteResponse(t *testing.T) {
+	var upstream *httptest.Server
+
+	upstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/svc/v2/login":
+			http.SetCookie(w, &http.Cookie{Name: "a", Value: "1", Path: "/svc/v2", HttpOnly: true})
+			http.SetCookie(w, &http.Cookie{Name: "b", Value: "2", Path: "/svc/v2/profile"})
+			http.SetCookie(w, &http.Cookie{Name: "c", Value: "3", Path: "/elsewhere"})
+			http.Redirect(w, r, "/svc/v2/profile?tab=1", http.StatusFound)
+		case "/svc/v2/absolute":
+			http.Redirect(w, r, upstream.URL+"/svc/v2/profile", http.StatusFound)
+		case "/svc/v2/external":
+			http.Redirect(w, r, "https://example.com/svc/v2/profile", http.StatusFound)
+		}
+	}))
+	defer upstream.Close()
+
+	route := proxy.Route{
+		Name:      "users",
+		Prefix:    "/api/users",
+		Upstreams: []string{upstream.URL + "/svc"},
+		Rewrite:   &proxy.Rewrite{StripPrefix: "/api/users", AddPrefix: "/v2"},
+	}
+
+	h := newHandler(t, route)
+
+	rr := get(h, "GET", "/api/users/login")
+
+	if loc := rr.Header().Get("Location"); loc != "/api/users/profile?tab=1" {
+		t.Errorf("Expected the redirect to /api/users/profile?tab=1 but got %s", loc)
+	}
+
+	cookies := rr.Header()["Set-Cookie"]
+	expected := []string{"a=1; Path=/api/users; HttpOnly", "b=2; Path=/api/users/profile", "c=3; Path=/elsewhere"}
+
+	if len(cookies) != len(expected) {
+		t.Fatalf("Expected the cookies %v but got %v", expected, cookies)
+	}
+
+	for i := range expected {
+		if cookies[i] != expected[i] {
+			t.Errorf("Expected the cookie %q but got %q", expected[i], cookies[i])
+		}
+	}
+
+	if loc := get(h, "GET", "/api/users/absolute").Header().Get("Location"); loc != "/api/users/profile" {
+		t.Errorf("Expected the upstream's url to become /api/users/profile but got %s", loc)
+	}
+
+	if loc := get(h, "GET", "/api/users/external").Header().Get("Location"); loc != "https://example.com/svc/v2/profile" {
+		t.Errorf("Expected redirects to other hosts to be kept but got %s", loc)
+	}
+}
@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"auth-proxy/internal"
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Defaults of the streaming.
+const (
+	DefaultMaxStreamsPerUser = 5
+	DefaultRecheckInterval   = 30 * time.Second
+)
+
+// MaxStreamsPerUser returns the number of streams a user may have open at the same time.
+func (s Streaming) MaxStreamsPerUser() int {
+	if s.MaxPerUser > 0 {
+		return s.MaxPerUser
+	}
+
+	return DefaultMaxStreamsPerUser
+}
+
+// Recheck returns how often the authentication of an open stream is checked again.
+func (s Streaming) Recheck() time.Duration {
+	if s.RecheckInterval > 0 {
+		return time.Duration(s.RecheckInterval)
+	}
+
+	return DefaultRecheckInterval
+}
+
+// IsUpgrade reports if the request asks to switch the protocol, e.g. to a WebSocket.
+func IsUpgrade(r *http.Request) bool {
+	for _, v := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return r.Header.Get("Upgrade") != ""
+			}
+		}
+	}
+
+	return false
+}
+
+// IsStream reports if the request opens a long-lived connection on the route, i.e. a WebSocket or a stream of
+// server-sent events from one of the streaming's event paths. Requests accepting text/event-stream elsewhere are
+// ordinary requests, so that the header doesn't lift their timeouts.
+func (route Route) IsStream(r *http.Request) bool {
+	st := route.Streaming
+	if st == nil {
+		return false
+	}
+
+	if IsUpgrade(r) {
+		return true
+	}
+
+	for _, p := range st.EventPaths {
+		if (internal.RouteRule{Methods: []string{"GET"}, Prefix: p}).Matches(r) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// mayStream reports if the response to the request may be a stream, which can't be cached or shared.
+func mayStream(r *http.Request) bool {
+	return IsUpgrade(r) || strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+type connKey struct{}
+
+// ConnContext keeps the client's connection in the context, so that the server's read and write timeouts can be
+// lifted for streams. It has to be used as the server's ConnContext.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, c)
+}
+
+// liftDeadlines removes the deadlines the server set on the connection of a HTTP/1 stream, so that it can stay
+// open longer than the server's timeouts.
+func liftDeadlines(r *http.Request) {
+	if r.ProtoMajor != 1 {
+		return
+	}
+
+	if c, ok := r.Context().Value(connKey{}).(net.Conn); ok {
+		c.SetReadDeadline(time.Time{})
+		c.SetWriteDeadline(time.Time{})
+	}
+}
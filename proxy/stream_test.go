@@ -0,0 +1,175 @@
+package proxy_test
+
+import (
+	"auth-proxy/proxy"
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// echoUpstream switches to an echo protocol on upgrade requests.
+func echoUpstream() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		brw.Flush()
+
+		io.Copy(conn, brw)
+	}))
+}
+
+// serve starts a server for the handler with the write timeout, whose connection deadlines can be lifted.
+func serve(h http.Handler, writeTimeout time.Duration) *httptest.Server {
+	s := httptest.NewUnstartedServer(h)
+	s.Config.WriteTimeout = writeTimeout
+	s.Config.ConnContext = proxy.ConnContext
+	s.Start()
+
+	return s
+}
+
+func upgrade(t *testing.T, addr string) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fmt.Fprint(conn, "GET /api/quotes HTTP/1.1\r\nHost: proxy\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+
+	rd := bufio.NewReader(conn)
+
+	resp, err := http.ReadResponse(rd, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return conn, rd, resp
+}
+
+func TestWebSocket(t *testing.T) {
+	upstream := echoUpstream()
+	defer upstream.Close()
+
+	route := proxy.Route{
+		Timeout:   proxy.Duration(time.Millisecond * 50),
+		Streaming: &proxy.Streaming{},
+	}
+
+	s := serve(newHandler(t, route, upstream), time.Millisecond*50)
+	defer s.Close()
+
+	conn, rd, resp := upgrade(t, s.Listener.Addr().String())
+	defer conn.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected status code %d but got %d", http.StatusSwitchingProtocols, resp.StatusCode)
+	}
+
+	// the connection outlives the route's and the server's timeouts
+	time.Sleep(time.Millisecond * 100)
+
+	conn.SetDeadline(time.Now().Add(time.Second))
+	fmt.Fprint(conn, "ping\n")
+
+	if line, err := rd.ReadString('\n'); err != nil || line != "ping\n" {
+		t.Errorf("Expected the message to be echoed but got %q, %v", line, err)
+	}
+}
+
+func TestWebSocketNotAllowed(t *testing.T) {
+	upstream := echoUpstream()
+	defer upstream.Close()
+
+	s := serve(newHandler(t, proxy.Route{}, upstream), 0)
+	defer s.Close()
+
+	conn, _, resp := upgrade(t, s.Listener.Addr().String())
+	defer conn.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status code %d but got %d on a route without streaming", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestServerSentEvents(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+
+		for i := 0; i < 5; i++ {
+			fmt.Fprintf(w, "data: %d\n\n", i)
+			w.(http.Flusher).Flush()
+			time.Sleep(time.Millisecond * 30)
+		}
+	}))
+	defer upstream.Close()
+
+	route := proxy.Route{
+		Timeout:   proxy.Duration(time.Millisecond * 50),
+		Streaming: &proxy.Streaming{EventPaths: []string{"/api/quotes"}},
+	}
+
+	s := serve(newHandler(t, route, upstream), time.Millisecond*50)
+	defer s.Close()
+
+	resp := acceptEvents(t, s.URL+"/api/quotes")
+	defer resp.Body.Close()
+
+	rd := bufio.NewReader(resp.Body)
+
+	// the first event arrives before the stream ended
+	start := time.Now()
+	if line, err := rd.ReadString('\n'); err != nil || line != "data: 0\n" || time.Since(start) > time.Millisecond*100 {
+		t.Fatalf("Expected the first event to be flushed immediately but got %q, %v", line, err)
+	}
+
+	body, err := ioutil.ReadAll(rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := strings.Count(string(body), "data: "); n != 4 {
+		t.Errorf("Expected the stream to outlive the timeouts and deliver all events but got %q", body)
+	}
+
+	// requests outside the event paths keep their timeouts, even if they accept events
+	resp = acceptEvents(t, s.URL+"/api/news")
+	defer resp.Body.Close()
+
+	body, _ = ioutil.ReadAll(resp.Body)
+	if n := strings.Count(string(body), "data: "); n == 5 {
+		t.Errorf("Expected the timeouts to end the response but got %q", body)
+	}
+}
+
+// acceptEvents sends a GET request accepting server-sent events.
+func acceptEvents(t *testing.T, url string) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp
+}
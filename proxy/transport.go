@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// Possible values of a route's protocol field.
+const (
+	// HTTP1 forwards requests with HTTP/1.1, or HTTP/2 if a https upstream offers it. It's the default.
+	HTTP1 = "http1"
+	// H2C forwards requests with HTTP/2 without TLS, which gRPC services speak by default. The upstreams have
+	// to be http urls.
+	H2C = "h2c"
+	// H2 forwards requests with HTTP/2 over TLS. The upstreams have to be https urls.
+	H2 = "h2"
+)
+
+// dialTimeout limits how long connecting to a HTTP/2 upstream may take.
+const dialTimeout = 30 * time.Second
+
+// newTransport returns the transport forwarding the requests with the protocol.
+func newTransport(protocol string) http.RoundTripper {
+	switch protocol {
+	case H2C:
+		return &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return net.DialTimeout(network, addr, dialTimeout)
+			},
+		}
+	case H2:
+		return &http2.Transport{}
+	default:
+		return http.DefaultTransport
+	}
+}
+
+// usesHTTP2 reports if the route's requests are always forwarded with HTTP/2.
+func (route Route) usesHTTP2() bool {
+	return route.Protocol == H2C || route.Protocol == H2
+}
+
+// IsGRPC reports if the request is a gRPC call.
+func IsGRPC(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// setGRPCTimeout shortens the grpc-timeout of a gRPC call forwarded to an upstream to the time left until the
+// proxy gives up on it, so that the gRPC service gives up as well.
+func setGRPCTimeout(r *http.Request) {
+	deadline, ok := r.Context().Deadline()
+	if !ok || !IsGRPC(r) {
+		return
+	}
+
+	left := time.Until(deadline)
+	if left < time.Millisecond {
+		left = time.Millisecond
+	}
+
+	if d, ok := parseGRPCTimeout(r.Header.Get("Grpc-Timeout")); ok && d <= left {
+		return
+	}
+
+	r.Header.Set("Grpc-Timeout", strconv.FormatInt(left.Milliseconds(), 10)+"m")
+}
+
+// grpcTimeoutUnits maps the units of the grpc-timeout header to their durations.
+var grpcTimeoutUnits = map[byte]time.Duration{
+	'H': time.Hour,
+	'M': time.Minute,
+	'S': time.Second,
+	'm': time.Millisecond,
+	'u': time.Microsecond,
+	'n': time.Nanosecond,
+}
+
+// parseGRPCTimeout parses a grpc-timeout like "100m", which consists of at most 8 digits and a unit.
+func parseGRPCTimeout(s string) (time.Duration, bool) {
+	if len(s) < 2 || len(s) > 9 {
+		return 0, false
+	}
+
+	unit, ok := grpcTimeoutUnits[s[len(s)-1]]
+	if !ok {
+		return 0, false
+	}
+
+	n, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+
+	if n > math.MaxInt64/int64(unit) {
+		return math.MaxInt64, true
+	}
+
+	return time.Duration(n) * unit, true
+}
@@ -0,0 +1,139 @@
+package proxy_test
+
+import (
+	"auth-proxy/proxy"
+	"context"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// healthService answers for the uid in the call's metadata. Users other than 42 are denied.
+type healthService struct {
+	grpc_health_v1.UnimplementedHealthServer
+}
+
+func (healthService) Check(ctx context.Context, req *grpc_health_v1.HealthCheckRequest) (*grpc_health_v1.HealthCheckResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if uid := md.Get("uid"); len(uid) != 1 || uid[0] != "42" {
+		return nil, status.Errorf(codes.PermissionDenied, "denied uid %v", uid)
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		return nil, status.Error(codes.InvalidArgument, "no deadline")
+	}
+
+	grpc.SetTrailer(ctx, metadata.Pairs("checked-uid", "42"))
+
+	return &grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_SERVING}, nil
+}
+
+func (healthService) Watch(req *grpc_health_v1.HealthCheckRequest, stream grpc_health_v1.Health_WatchServer) error {
+	for _, s := range []grpc_health_v1.HealthCheckResponse_ServingStatus{grpc_health_v1.HealthCheckResponse_NOT_SERVING, grpc_health_v1.HealthCheckResponse_SERVING} {
+		if err := stream.Send(&grpc_health_v1.HealthCheckResponse{Status: s}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// grpcProxy starts a gRPC upstream and a proxy forwarding to it with h2c and returns a client connected to the
+// proxy.
+func grpcProxy(t *testing.T) (grpc_health_v1.HealthClient, func()) {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upstream := grpc.NewServer()
+	grpc_health_v1.RegisterHealthServer(upstream, healthService{})
+
+	go upstream.Serve(lis)
+
+	route := proxy.Route{
+		Protocol:  proxy.H2C,
+		Upstreams: []string{"http://" + lis.Addr().String()},
+		Prefix:    "/grpc.health.v1.Health",
+		Timeout:   proxy.Duration(time.Second * 5),
+	}
+
+	s := httptest.NewServer(h2c.NewHandler(newHandler(t, route), &http2.Server{}))
+
+	conn, err := grpc.Dial(s.Listener.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return grpc_health_v1.NewHealthClient(conn), func() {
+		conn.Close()
+		s.Close()
+		upstream.Stop()
+	}
+}
+
+func TestGRPC(t *testing.T) {
+	client, done := grpcProxy(t)
+	defer done()
+
+	var trailer metadata.MD
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "uid", "42")
+
+	resp, err := client.Check(ctx, &grpc_health_v1.HealthCheckRequest{}, grpc.Trailer(&trailer))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.Status != grpc_health_v1.HealthCheckResponse_SERVING {
+		t.Errorf("Expected the status SERVING but got %v", resp.Status)
+	}
+
+	if v := trailer.Get("checked-uid"); len(v) != 1 || v[0] != "42" {
+		t.Errorf("Expected the trailer checked-uid: 42 but got %v", v)
+	}
+}
+
+func TestGRPCStatus(t *testing.T) {
+	client, done := grpcProxy(t)
+	defer done()
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "uid", "7")
+
+	_, err := client.Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	if s := status.Convert(err); s.Code() != codes.PermissionDenied || s.Message() != "denied uid [7]" {
+		t.Errorf("Expected the status PermissionDenied with the upstream's message but got %v", err)
+	}
+}
+
+func TestGRPCStream(t *testing.T) {
+	client, done := grpcProxy(t)
+	defer done()
+
+	stream, err := client.Watch(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []grpc_health_v1.HealthCheckResponse_ServingStatus{grpc_health_v1.HealthCheckResponse_NOT_SERVING, grpc_health_v1.HealthCheckResponse_SERVING} {
+		resp, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Status != expected {
+			t.Errorf("Expected the status %v but got %v", expected, resp.Status)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package proxy
+
+import (
+	"auth-proxy/internal"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// VersionHeader chooses the API version of a request to a route with versions. Requests using the prefix of a
+// version are forwarded with the version's name in it.
+const VersionHeader = "Accept-Version"
+
+type versionKey struct{}
+
+// version is an API version of a route, whose requests are forwarded by its own handler.
+type version struct {
+	Version
+	handler *Handler
+	usage   *usage
+}
+
+// usage counts the requests of an API version.
+type usage struct {
+	requests int64
+	// last is the time of the last request in unix nanoseconds
+	last int64
+}
+
+type usageKey struct {
+	route, version string
+}
+
+// usageRegistry keeps the usage of the API versions by their route's and their name.
+type usageRegistry struct {
+	mu     sync.Mutex
+	usages map[usageKey]*usage
+}
+
+// usages is shared by all handlers, so that reloading the routes doesn't reset the usage of their versions.
+var usages = &usageRegistry{usages: make(map[usageKey]*usage)}
+
+// get returns the usage of the route's version. The requests without a version have the empty name.
+func (r *usageRegistry) get(route, version string) *usage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	k := usageKey{route, version}
+	if _, ok := r.usages[k]; !ok {
+		r.usages[k] = &usage{}
+	}
+
+	return r.usages[k]
+}
+
+// LogVersionUsage logs how many requests every API version got since the proxy started and when the last one was
+// made, so that operators can sum up the usage from the logs. The counts themselves are lost on a restart.
+// Requests without a version are logged as "unversioned".
+func LogVersionUsage() {
+	usages.mu.Lock()
+	defer usages.mu.Unlock()
+
+	keys := make([]usageKey, 0, len(usages.usages))
+	for k := range usages.usages {
+		keys = append(keys, k)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].route != keys[j].route {
+			return keys[i].route < keys[j].route
+		}
+
+		return keys[i].version < keys[j].version
+	})
+
+	for _, k := range keys {
+		s := usages.usages[k].status()
+		if s.LastRequest == nil {
+			continue
+		}
+
+		name := k.version
+		if name == "" {
+			name = "unversioned"
+		}
+
+		log.Printf("versions: %s %s: %d requests, the last one at %s", k.route, name, s.Requests, s.LastRequest.UTC().Format(time.RFC3339))
+	}
+}
+
+func (u *usage) record() {
+	atomic.AddInt64(&u.requests, 1)
+	atomic.StoreInt64(&u.last, time.Now().UnixNano())
+}
+
+// VersionUsage describes how much an API version is used.
+type VersionUsage struct {
+	Requests    int64      `json:"requests"`
+	LastRequest *time.Time `json:"lastRequest,omitempty"`
+	Deprecated  *time.Time `json:"deprecated,omitempty"`
+	Sunset      *time.Time `json:"sunset,omitempty"`
+}
+
+// RouteUsage describes how much the API versions of a route and the requests without a version are used.
+type RouteUsage struct {
+	Unversioned VersionUsage            `json:"unversioned"`
+	Versions    map[string]VersionUsage `json:"versions"`
+}
+
+func (u *usage) status() VersionUsage {
+	s := VersionUsage{Requests: atomic.LoadInt64(&u.requests)}
+
+	if last := atomic.LoadInt64(&u.last); last != 0 {
+		t := time.Unix(0, last)
+		s.LastRequest = &t
+	}
+
+	return s
+}
+
+func (v *version) status() VersionUsage {
+	s := v.usage.status()
+
+	if d := time.Time(v.Deprecated); !d.IsZero() {
+		s.Deprecated = &d
+	}
+
+	if d := time.Time(v.Sunset); !d.IsZero() {
+		s.Sunset = &d
+	}
+
+	return s
+}
+
+// Prefixes returns the route's prefix and the prefixes of its versions.
+func (route Route) Prefixes() []string {
+	prefixes := []string{route.Prefix}
+
+	for _, v := range route.Versions {
+		if v.Prefix != "" {
+			prefixes = append(prefixes, v.Prefix)
+		}
+	}
+
+	return prefixes
+}
+
+// newVersions returns the versions of the route, whose handlers forward the requests like the route's handler
+// does, but to the upstreams of the version.
+func newVersions(route Route) ([]*version, error) {
+	var versions []*version
+
+	for _, v := range route.Versions {
+		sub := route
+		sub.Upstreams = v.Upstreams
+		sub.Versions = nil
+		sub.Canary = nil
+
+		h, err := New(sub)
+		if err != nil {
+			for _, v := range versions {
+				v.handler.Close()
+			}
+
+			return nil, err
+		}
+
+		versions = append(versions, &version{Version: v, handler: h, usage: usages.get(route.Name, v.Name)})
+	}
+
+	return versions, nil
+}
+
+// announce sets the headers announcing the deprecation of the version.
+func (v *version) announce(h http.Header) {
+	deprecated := time.Time(v.Deprecated)
+	if deprecated.IsZero() {
+		return
+	}
+
+	h.Set("Deprecation", "@"+strconv.FormatInt(deprecated.Unix(), 10))
+
+	if sunset := time.Time(v.Sunset); !sunset.IsZero() {
+		h.Set("Sunset", sunset.UTC().Format(http.TimeFormat))
+	}
+
+	if v.Link != "" {
+		h.Add("Link", "<"+v.Link+`>; rel="deprecation"`)
+	}
+}
+
+// resolveVersion returns the version of the request and the request with the path of the route's prefix. The
+// version is nil if the request doesn't choose one and ok is false if it chooses an unknown one.
+func (h *Handler) resolveVersion(r *http.Request) (v *version, resolved *http.Request, ok bool) {
+	for _, v := range h.versions {
+		if v.Prefix == "" {
+			continue
+		}
+
+		prefix := strings.TrimSuffix(v.Prefix, "/")
+
+		if _, matches := trimPathPrefix(r.URL.Path, prefix); !matches {
+			continue
+		}
+
+		u := *r.URL
+		u.Path = strings.TrimSuffix(h.route.Prefix, "/") + r.URL.Path[len(prefix):]
+		u.RawPath = ""
+
+		if u.Path == "" {
+			u.Path = "/"
+		}
+
+		resolved = r.WithContext(r.Context())
+		resolved.URL = &u
+		resolved.RequestURI = u.RequestURI()
+		resolved.Header.Set(VersionHeader, v.Name)
+
+		return v, resolved, true
+	}
+
+	name := r.Header.Get(VersionHeader)
+	if name == "" {
+		return nil, r, true
+	}
+
+	for _, v := range h.versions {
+		if v.Name == name {
+			return v, r, true
+		}
+	}
+
+	return nil, r, false
+}
+
+// WithVersion resolves the API version of the requests before passing them to next. Requests using the prefix
+// of a version continue with the path of the route's prefix, so that next, e.g. the authentication and its
+// policies, only has to know the route's paths. Requests choosing an unknown version are rejected with a http
+// 400 and the responses of deprecated versions announce it.
+func (h *Handler) WithVersion(next http.Handler) http.Handler {
+	if len(h.versions) == 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v, r, ok := h.resolveVersion(r)
+		if !ok {
+			internal.WriteError(w, http.StatusBadRequest, "unknown_version", "The requested API version doesn't exist")
+			return
+		}
+
+		if v == nil {
+			h.usage.record()
+		} else {
+			v.usage.record()
+			v.announce(w.Header())
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), versionKey{}, v)))
+	})
+}
+
+// HandleVersions returns a handler listing how much the API versions of every route with versions are used by
+// the route's name.
+func HandleVersions(handlers []*Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		usages := make(map[string]RouteUsage)
+
+		for _, h := range handlers {
+			if len(h.versions) == 0 {
+				continue
+			}
+
+			ru := RouteUsage{Unversioned: h.usage.status(), Versions: make(map[string]VersionUsage)}
+			for _, v := range h.versions {
+				ru.Versions[v.Name] = v.status()
+			}
+
+			usages[h.route.Name] = ru
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		err := json.NewEncoder(w).Encode(usages)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package proxy_test
+
+import (
+	"auth-proxy/proxy"
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// namedUpstream responds with its name, the path and the version of the request.
+func namedUpstream(name string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(name + " " + r.URL.Path + " " + r.Header.Get(proxy.VersionHeader)))
+	}))
+}
+
+func versionedRoute(unversioned, v1, v2 *httptest.Server) proxy.Route {
+	return proxy.Route{
+		Name:      "users",
+		Prefix:    "/api/users",
+		Upstreams: []string{unversioned.URL},
+		Versions: []proxy.Version{
+			{
+				Name:       "v1",
+				Prefix:     "/api/v1/users",
+				Upstreams:  []string{v1.URL},
+				Deprecated: proxy.Date(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)),
+				Sunset:     proxy.Date(time.Date(2021, 7, 1, 0, 0, 0, 0, time.UTC)),
+				Link:       "https://example.com/migrate-to-v2",
+			},
+			{Name: "v2", Prefix: "/api/v2/users", Upstreams: []string{v2.URL}},
+		},
+	}
+}
+
+func TestVersions(t *testing.T) {
+	unversioned, v1, v2 := namedUpstream("unversioned"), namedUpstream("v1"), namedUpstream("v2")
+	defer unversioned.Close()
+	defer v1.Close()
+	defer v2.Close()
+
+	h := newHandler(t, versionedRoute(unversioned, v1, v2))
+	defer h.Close()
+
+	cases := []struct {
+		path       string
+		version    string
+		expected   string
+		deprecated bool
+	}{
+		{"/api/users/42", "", "unversioned /api/users/42 ", false},
+		{"/api/v1/users/42", "", "v1 /api/users/42 v1", true},
+		{"/api/v1/users", "", "v1 /api/users v1", true},
+		{"/api/v2/users/42", "v1", "v2 /api/users/42 v2", false},
+		{"/api/users/42", "v1", "v1 /api/users/42 v1", true},
+		{"/api/users/42", "v2", "v2 /api/users/42 v2", false},
+	}
+
+	for _, i := range cases {
+		req := httptest.NewRequest("GET", i.path, nil)
+		if i.version != "" {
+			req.Header.Set(proxy.VersionHeader, i.version)
+		}
+
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+
+		if rr.Body.String() != i.expected {
+			t.Errorf("Expected %q but got %q when path=%s, version=%s", i.expected, rr.Body.String(), i.path, i.version)
+		}
+
+		if deprecated := rr.Header().Get("Deprecation") != ""; deprecated != i.deprecated {
+			t.Errorf("Expected the deprecation to be announced to be %v when path=%s, version=%s", i.deprecated, i.path, i.version)
+		}
+	}
+
+	rr := get(h, "GET", "/api/v1/users")
+	expected := map[string]string{
+		"Deprecation": "@1609459200",
+		"Sunset":      "Thu, 01 Jul 2021 00:00:00 GMT",
+		"Link":        `<https://example.com/migrate-to-v2>; rel="deprecation"`,
+	}
+
+	for k, v := range expected {
+		if rr.Header().Get(k) != v {
+			t.Errorf("Expected the header %s: %s but got %q", k, v, rr.Header().Get(k))
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/api/users", nil)
+	req.Header.Set(proxy.VersionHeader, "v3")
+
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d for an unknown version but got %d", http.StatusBadRequest, rr.Code)
+	}
+}
+
+// routeUsage returns the usage of the handler's route listed by HandleVersions.
+func routeUsage(t *testing.T, h *proxy.Handler) proxy.RouteUsage {
+	t.Helper()
+
+	rr := get(proxy.HandleVersions([]*proxy.Handler{h}), "GET", "/api/admin/versions")
+
+	var usages map[string]proxy.RouteUsage
+	if err := json.NewDecoder(rr.Body).Decode(&usages); err != nil {
+		t.Fatal(err)
+	}
+
+	return usages[h.Route().Name]
+}
+
+func TestHandleVersions(t *testing.T) {
+	unversioned, v1, v2 := namedUpstream("unversioned"), namedUpstream("v1"), namedUpstream("v2")
+	defer unversioned.Close()
+	defer v1.Close()
+	defer v2.Close()
+
+	// the usage of a route is shared by all its handlers, even the ones of other tests, so only the requests
+	// made since the start are counted
+	route := versionedRoute(unversioned, v1, v2)
+	route.Name = "usage"
+
+	h := newHandler(t, route)
+	start := routeUsage(t, h)
+
+	get(h, "GET", "/api/users")
+	get(h, "GET", "/api/v1/users")
+	h.Close()
+
+	// a reload builds a new handler for the route
+	h = newHandler(t, route)
+	defer h.Close()
+
+	get(h, "GET", "/api/v1/users/42")
+
+	u := routeUsage(t, h)
+
+	unversionedRequests := u.Unversioned.Requests - start.Unversioned.Requests
+	v1Requests := u.Versions["v1"].Requests - start.Versions["v1"].Requests
+
+	if unversionedRequests != 1 || v1Requests != 2 || u.Versions["v2"].Requests != 0 {
+		t.Errorf("Expected 1 unversioned, 2 v1 and no v2 requests but got %+v", u)
+	}
+
+	if u.Versions["v1"].LastRequest == nil || u.Versions["v2"].LastRequest != nil {
+		t.Errorf("Expected only v1 to have a last request but got %+v", u.Versions)
+	}
+
+	if u.Versions["v1"].Sunset == nil || u.Versions["v2"].Deprecated != nil {
+		t.Errorf("Expected only v1 to be deprecated but got %+v", u.Versions)
+	}
+}
+
+func TestLogVersionUsage(t *testing.T) {
+	unversioned, v1, v2 := namedUpstream("unversioned"), namedUpstream("v1"), namedUpstream("v2")
+	defer unversioned.Close()
+	defer v1.Close()
+	defer v2.Close()
+
+	route := versionedRoute(unversioned, v1, v2)
+	route.Name = "logged"
+
+	h := newHandler(t, route)
+	defer h.Close()
+
+	get(h, "GET", "/api/v2/users")
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	proxy.LogVersionUsage()
+
+	logged := regexp.MustCompile(`versions: logged v2: \d+ requests, the last one at `)
+	if !logged.MatchString(buf.String()) || strings.Contains(buf.String(), "logged v1") {
+		t.Errorf("Expected only the usage of v2 to be logged but got %q", buf.String())
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"auth-proxy/handler"
+	"auth-proxy/internal"
+	"auth-proxy/proxy"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/csrf"
+	"github.com/gorilla/mux"
+)
+
+// defaultStepUpRules defines requests which require a recent password or PIN authentication, unless the route
+// configuration defines policies.
+var defaultStepUpRules = []internal.StepUpRule{
+	{
+		RouteRule: internal.RouteRule{Methods: []string{"POST", "PUT", "PATCH", "DELETE"}, Prefix: "/api/stocks"},
+		MaxAge:    5 * time.Minute,
+		AllowPIN:  true,
+	},
+}
+
+// defaultGuestRules defines the requests guests can make, unless the route configuration defines policies.
+var defaultGuestRules = []internal.RouteRule{
+	{Prefix: "/api/check-credentials"},
+	{Prefix: "/api/news"},
+	{Prefix: "/api/stocks"},
+}
+
+// defaultConfirmationRules defines the orders which have to be confirmed before they're forwarded to the stock
+// service, unless the route configuration defines policies.
+var defaultConfirmationRules = []internal.RouteRule{
+	{Methods: []string{"POST"}, Prefix: "/api/stocks/buy"},
+	{Methods: []string{"POST"}, Prefix: "/api/stocks/sell"},
+}
+
+// policy holds the rules enforced by the authMiddleware and the proxied routes. Every router gets its own
+// policy, so that reloading the configuration doesn't affect requests which already started.
+type policy struct {
+	stepUp        []internal.StepUpRule
+	guests        []internal.RouteRule
+	confirmations []internal.RouteRule
+}
+
+// newPolicy returns the policy defined by the route configuration. The GUEST_ROUTES environment variable takes
+// precedence over the configured guest routes.
+func newPolicy(cfg *proxy.Config) *policy {
+	p := &policy{
+		stepUp:        defaultStepUpRules,
+		guests:        defaultGuestRules,
+		confirmations: defaultConfirmationRules,
+	}
+
+	if ps := cfg.Policies; ps != nil {
+		p.stepUp = nil
+		for _, s := range ps.StepUp {
+			p.stepUp = append(p.stepUp, internal.StepUpRule{
+				RouteRule: internal.RouteRule{Methods: s.Methods, Prefix: s.Prefix},
+				MaxAge:    time.Duration(s.MaxAge),
+				AllowPIN:  s.AllowPIN,
+			})
+		}
+
+		p.confirmations = nil
+		for _, c := range ps.Confirm {
+			p.confirmations = append(p.confirmations, internal.RouteRule{Methods: c.Methods, Prefix: c.Prefix})
+		}
+
+		p.guests = nil
+		for _, g := range ps.Guests {
+			p.guests = append(p.guests, internal.RouteRule{Prefix: g})
+		}
+	}
+
+	if guestRoutes != "" {
+		p.guests = nil
+		for _, g := range strings.Split(guestRoutes, ",") {
+			p.guests = append(p.guests, internal.RouteRule{Prefix: strings.TrimSpace(g)})
+		}
+	}
+
+	return p
+}
+
+// router serves the proxy's own endpoints and the proxied routes. Closing it stops the health checks of the
+// proxied routes.
+type router struct {
+	http.Handler
+	proxies []*proxy.Handler
+}
+
+func (rt *router) Close() error {
+	closeProxies(rt.proxies)
+	return nil
+}
+
+func closeProxies(proxies []*proxy.Handler) {
+	for _, ph := range proxies {
+		ph.Close()
+	}
+}
+
+// buildRouter builds the router serving the proxy's own endpoints and the proxied routes of the configuration.
+func buildRouter(cfg *proxy.Config) (http.Handler, error) {
+	p := newPolicy(cfg)
+
+	proxies, err := newProxies(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	csrfMiddleware := csrf.Protect(
+		[]byte(csrfKey),
+	)
+
+	r := mux.NewRouter()
+	r.Use(grpcMiddleware, csrfMiddleware)
+
+	api := r.PathPrefix("/api").Subrouter()
+	api.Use(timeoutMiddleware(apiTimeout))
+
+	api.HandleFunc("/get-csrf-token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-CSRF-Token", csrf.Token(r))
+	}).Methods("GET")
+
+	api.Handle("/check-credentials", p.authMiddleware(func() http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {}
+	}())).Methods("GET")
+
+	api.Handle("/login", handler.HandleLogin(env)).Methods("POST")
+	api.Handle("/login/verify", handler.HandleLoginVerification(env)).Methods("POST")
+	api.Handle("/logout", handler.HandleLogout(env)).Methods("POST")
+
+	if env.MagicLinkURL != "" {
+		api.Handle("/login/magic-link", handler.HandleMagicLinkRequest(env)).Methods("POST")
+		api.Handle("/login/magic-link/redeem", handler.HandleMagicLinkRedeem(env)).Methods("POST")
+	}
+
+	api.Handle("/register", handler.HandleRegistration(env)).Methods("POST")
+
+	if env.GuestLifetime > 0 {
+		api.Handle("/guest", handler.HandleGuest(env)).Methods("POST")
+	}
+
+	api.Handle("/step-up", p.authMiddleware(handler.HandleStepUp(env))).Methods("POST")
+	api.Handle("/trading-pin", p.authMiddleware(handler.HandleSetTradingPIN(env))).Methods("POST")
+
+	grants := api.PathPrefix("/grants").Subrouter()
+	grants.Use(p.authMiddleware)
+	grants.Handle("", handler.HandleCreateGrant(env)).Methods("POST")
+	grants.Handle("", handler.HandleListGrants(env)).Methods("GET")
+	grants.Handle("/{id}", handler.HandleRevokeGrant(env)).Methods("DELETE")
+
+	shareLinks := api.PathPrefix("/share-links").Subrouter()
+	shareLinks.Use(p.authMiddleware)
+	shareLinks.Handle("", handler.HandleCreateShareLink(env)).Methods("POST")
+	shareLinks.Handle("", handler.HandleListShareLinks(env)).Methods("GET")
+	shareLinks.Handle("/{id}", handler.HandleRevokeShareLink(env)).Methods("DELETE")
+
+	admin := api.PathPrefix("/admin").Subrouter()
+	admin.Use(p.authMiddleware, adminMiddleware)
+	admin.Handle("/users", handler.HandleAdminSearchUsers(env)).Methods("GET")
+	admin.Handle("/users/{uid:[0-9]+}", handler.HandleAdminGetUser(env)).Methods("GET")
+	admin.Handle("/users/{uid:[0-9]+}/status", handler.HandleAdminSetAccountStatus(env)).Methods("POST")
+	admin.Handle("/users/{uid:[0-9]+}/unlock", handler.HandleAdminClearLockout(env)).Methods("POST")
+	admin.Handle("/users/{uid:[0-9]+}/password-reset", handler.HandleAdminForcePasswordReset(env)).Methods("POST")
+	admin.Handle("/users/{uid:[0-9]+}/logout", handler.HandleAdminRevokeSessions(env)).Methods("POST")
+	admin.Handle("/users/{uid:[0-9]+}/impersonate", handler.HandleAdminImpersonate(env)).Methods("POST")
+	admin.Handle("/upstreams", proxy.HandleStatus(proxies)).Methods("GET")
+	admin.Handle("/versions", proxy.HandleVersions(proxies)).Methods("GET")
+
+	p.registerRoutes(r, proxies)
+
+	return &router{Handler: r, proxies: proxies}, nil
+}
+
+// newProxies returns the handlers of the configuration's routes. Routes with longer prefixes, including the ones
+// of their versions, come first, so that they take precedence over the routes they're nested in.
+func newProxies(cfg *proxy.Config) ([]*proxy.Handler, error) {
+	routes := append([]proxy.Route{}, cfg.Routes...)
+	sort.SliceStable(routes, func(i, j int) bool {
+		return longestPrefix(routes[i]) > longestPrefix(routes[j])
+	})
+
+	var proxies []*proxy.Handler
+
+	for _, route := range routes {
+		ph, err := proxy.New(route)
+		if err != nil {
+			closeProxies(proxies)
+			return nil, err
+		}
+
+		proxies = append(proxies, ph)
+	}
+
+	return proxies, nil
+}
+
+func longestPrefix(route proxy.Route) int {
+	n := 0
+
+	for _, p := range route.Prefixes() {
+		if len(p) > n {
+			n = len(p)
+		}
+	}
+
+	return n
+}
+
+// registerRoutes registers the proxied routes in order. Requests to routes requiring authentication have to pass
+// the authMiddleware and orders have to be confirmed.
+func (p *policy) registerRoutes(r *mux.Router, proxies []*proxy.Handler) {
+	for _, ph := range proxies {
+		route := ph.Route()
+
+		var h http.Handler = ph
+		if route.Streaming != nil {
+			h = streamMiddleware(route)(h)
+		}
+
+		if route.RequiresAuth() {
+			h = p.authMiddleware(internal.RequireConfirmation(confirmer, p.confirmations, h))
+		}
+
+		// the route's timeout includes the account lookups of the authMiddleware, but streams outlive it
+		timed := timeoutMiddleware(time.Duration(route.Timeout))(h)
+		if route.Streaming == nil {
+			h = timed
+		} else {
+			h = streamOr(route, h, timed)
+		}
+
+		// the version is resolved first, so that the policies only have to know the route's prefix
+		h = ph.WithVersion(h)
+
+		var rules []internal.RouteRule
+		for _, p := range route.Prefixes() {
+			rules = append(rules, internal.RouteRule{Prefix: p})
+		}
+
+		r.MatcherFunc(func(req *http.Request, _ *mux.RouteMatch) bool {
+			return internal.MatchAny(rules, req)
+		}).Handler(h)
+	}
+}
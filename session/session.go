@@ -0,0 +1,202 @@
+// Package session manages the lifetime of logins beyond a single authentication token.
+//
+// Every login gets an absolute lifetime after which its token can't be refreshed anymore. Logins
+// which should be remembered additionally get a server-side session and a persistent session cookie,
+// which is used to issue a new token once the short-lived authentication token expired.
+package session
+
+import (
+	"auth-proxy/config"
+	"auth-proxy/internal"
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+var (
+	// ErrExpired is returned when the session reached its end of life.
+	ErrExpired = errors.New("The session expired")
+
+	// ErrRevoked is returned when the session has been deleted.
+	ErrRevoked = errors.New("The session has been revoked")
+)
+
+// policy returns the env's session policy with missing values set to their defaults.
+func policy(env *config.Env) config.SessionPolicy {
+	p := env.Sessions
+	def := config.DefaultSessionPolicy()
+
+	if p.RememberFor <= 0 {
+		p.RememberFor = def.RememberFor
+	}
+
+	if p.MaxLifetime <= 0 {
+		p.MaxLifetime = def.MaxLifetime
+	}
+
+	if p.RememberFor > p.MaxLifetime {
+		p.RememberFor = p.MaxLifetime
+	}
+
+	return p
+}
+
+// tokenExpiry returns the expiration time of a new authentication token, which never outlives the session.
+func tokenExpiry(sessionExpiresAt time.Time) time.Time {
+	exp := config.DefaultExpTime()
+	if sessionExpiresAt.Before(exp) {
+		return sessionExpiresAt
+	}
+
+	return exp
+}
+
+// Cookie returns the cookie containing the token of a remembered session. A zero expiration time deletes the cookie.
+func Cookie(token string, expires time.Time) *http.Cookie {
+	c := &http.Cookie{
+		Name:     "session",
+		Path:     "/api",
+		Value:    token,
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	}
+
+	if expires.IsZero() {
+		c.MaxAge = -1
+	}
+
+	return c
+}
+
+// New starts a session for the user and returns the claims of its first authentication token. If remember is
+// set, a server-side session is created and its cookie returned as well. Otherwise the cookie's nil.
+// Authenticated tells if the user logged in with a password or second factor. Other logins, e.g. with a magic
+// link, have no AuthTime, so they have to step up before sensitive operations. Since resumed sessions count as
+// authenticated when they were created, such logins mustn't be remembered.
+func New(ctx context.Context, env *config.Env, uid uint64, remember, authenticated bool) (config.Claims, *http.Cookie, error) {
+	p := policy(env)
+	now := time.Now()
+
+	cl := config.Claims{
+		UID:              uid,
+		SessionExpiresAt: now.Add(p.MaxLifetime),
+	}
+
+	if authenticated {
+		cl.AuthTime = now
+	}
+
+	if !remember {
+		cl.ExpiresAt = tokenExpiry(cl.SessionExpiresAt)
+		return cl, nil, nil
+	}
+
+	return startSession(ctx, env, cl, now.Add(p.RememberFor))
+}
+
+// startSession creates a server-side session, which ends at expiresAt, for the claims. It returns the claims of the
+// session's first authentication token and its cookie.
+func startSession(ctx context.Context, env *config.Env, cl config.Claims, expiresAt time.Time) (config.Claims, *http.Cookie, error) {
+	token, err := internal.RandomToken(32)
+	if err != nil {
+		return config.Claims{}, nil, err
+	}
+
+	s := config.Session{
+		ID:        internal.HashToken(token),
+		UID:       cl.UID,
+		CreatedAt: time.Now(),
+		ExpiresAt: expiresAt,
+	}
+
+	err = env.DB.CreateSession(ctx, s)
+	if err != nil {
+		return config.Claims{}, nil, err
+	}
+
+	cl.SessionID = s.ID
+	cl.SessionExpiresAt = s.ExpiresAt
+	cl.ExpiresAt = tokenExpiry(s.ExpiresAt)
+
+	return cl, Cookie(token, s.ExpiresAt), nil
+}
+
+// NewGuest starts the session of a guest account, which ends when the account expires. Like remembered
+// logins, it's kept in a server-side session, so the guest isn't lost once the authentication token expired.
+func NewGuest(ctx context.Context, env *config.Env, uid uint64, expiresAt time.Time) (config.Claims, *http.Cookie, error) {
+	cl := config.Claims{
+		UID:      uid,
+		Guest:    true,
+		AuthTime: time.Now(),
+	}
+
+	return startSession(ctx, env, cl, expiresAt)
+}
+
+// Resume returns the claims of a new authentication token for the remembered session with the specified token.
+func Resume(ctx context.Context, env *config.Env, token string) (config.Claims, error) {
+	s, err := env.DB.Session(ctx, internal.HashToken(token))
+	if err != nil {
+		if err == config.ErrNotFound {
+			return config.Claims{}, ErrRevoked
+		}
+
+		return config.Claims{}, err
+	}
+
+	if !time.Now().Before(s.ExpiresAt) {
+		if err = env.DB.DeleteSession(ctx, s.ID); err != nil {
+			return config.Claims{}, err
+		}
+
+		return config.Claims{}, ErrExpired
+	}
+
+	cl := config.Claims{
+		UID:              s.UID,
+		SessionID:        s.ID,
+		SessionExpiresAt: s.ExpiresAt,
+		// resuming a session isn't an authentication, so the last one happened when the session was created
+		AuthTime:  s.CreatedAt,
+		IssuedAt:  time.Now(),
+		ExpiresAt: tokenExpiry(s.ExpiresAt),
+	}
+
+	return cl, nil
+}
+
+// Refresh returns the claims for the token replacing an authentication token which is about to expire. It returns
+// ErrExpired if the session reached its absolute lifetime and ErrRevoked if its server-side session was deleted.
+func Refresh(ctx context.Context, env *config.Env, cl config.Claims) (config.Claims, error) {
+	// tokens issued before sessions had a lifetime get one now
+	if cl.SessionExpiresAt.IsZero() {
+		cl.SessionExpiresAt = time.Now().Add(policy(env).MaxLifetime)
+	}
+
+	if !time.Now().Before(cl.SessionExpiresAt) {
+		return config.Claims{}, ErrExpired
+	}
+
+	if cl.SessionID != "" {
+		_, err := env.DB.Session(ctx, cl.SessionID)
+		if err != nil {
+			if err == config.ErrNotFound {
+				return config.Claims{}, ErrRevoked
+			}
+
+			return config.Claims{}, err
+		}
+	}
+
+	cl.ExpiresAt = tokenExpiry(cl.SessionExpiresAt)
+
+	return cl, nil
+}
+
+// End deletes the remembered session with the specified token.
+func End(ctx context.Context, env *config.Env, token string) error {
+	return env.DB.DeleteSession(ctx, internal.HashToken(token))
+}
@@ -0,0 +1,109 @@
+package session_test
+
+import (
+	"auth-proxy/config"
+	"auth-proxy/session"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	ctx := context.Background()
+	env := config.NewMockEnv()
+	env.Sessions = config.SessionPolicy{RememberFor: time.Hour, MaxLifetime: time.Hour * 2}
+
+	cl, c, err := session.New(ctx, env, 1, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c != nil || cl.SessionID != "" {
+		t.Error("Expected no server-side session when the login shouldn't be remembered")
+	}
+
+	if d := time.Until(cl.SessionExpiresAt); d < time.Hour || d > time.Hour*2 {
+		t.Errorf("Expected the session to expire after its max lifetime but it expires in %v", d)
+	}
+
+	if time.Until(cl.ExpiresAt) > time.Minute*2 {
+		t.Errorf("Expected a short-lived token but it expires at %v", cl.ExpiresAt)
+	}
+
+	cl, c, err = session.New(ctx, env, 1, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c == nil || cl.SessionID == "" {
+		t.Fatal("Expected a server-side session when the login should be remembered")
+	}
+
+	if !c.Expires.Equal(cl.SessionExpiresAt) {
+		t.Errorf("Expected the session cookie to expire with the session at %v but it expires at %v", cl.SessionExpiresAt, c.Expires)
+	}
+
+	if d := time.Until(cl.SessionExpiresAt); d > time.Hour {
+		t.Errorf("Expected the remembered session to last 1h but it expires in %v", d)
+	}
+
+	resumed, err := session.Resume(ctx, env, c.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resumed.UID != 1 || resumed.SessionID != cl.SessionID {
+		t.Errorf("The resumed claims (%+v) don't belong to the session (%+v)", resumed, cl)
+	}
+
+	if _, err = session.Resume(ctx, env, "unknown"); err != session.ErrRevoked {
+		t.Errorf("Expected session.ErrRevoked for an unknown session but got %v", err)
+	}
+
+	if err = session.End(ctx, env, c.Value); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = session.Resume(ctx, env, c.Value); err != session.ErrRevoked {
+		t.Errorf("Expected session.ErrRevoked after the session ended but got %v", err)
+	}
+
+	if _, err = session.Refresh(ctx, env, cl); err != session.ErrRevoked {
+		t.Errorf("Expected session.ErrRevoked when refreshing an ended session but got %v", err)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	ctx := context.Background()
+	env := config.NewMockEnv()
+
+	cases := []struct {
+		cl  config.Claims
+		err error
+	}{
+		{config.Claims{UID: 1, SessionExpiresAt: time.Now().Add(time.Hour)}, nil},
+		{config.Claims{UID: 1, SessionExpiresAt: time.Now().Add(time.Second * 30)}, nil},
+		{config.Claims{UID: 1, SessionExpiresAt: time.Now().Add(-time.Second)}, session.ErrExpired},
+		{config.Claims{UID: 1}, nil},
+	}
+
+	for _, i := range cases {
+		cl, err := session.Refresh(ctx, env, i.cl)
+		if err != i.err {
+			t.Errorf("Expected the error %v but got %v when claims=%+v", i.err, err, i.cl)
+			continue
+		}
+
+		if err != nil {
+			continue
+		}
+
+		if cl.ExpiresAt.After(cl.SessionExpiresAt) {
+			t.Errorf("The token expires at %v which is after the session expires at %v", cl.ExpiresAt, cl.SessionExpiresAt)
+		}
+
+		if time.Until(cl.ExpiresAt) > time.Minute*2 {
+			t.Errorf("Expected a short-lived token but it expires at %v", cl.ExpiresAt)
+		}
+	}
+}
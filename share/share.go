@@ -0,0 +1,145 @@
+// Package share manages share links, which give read access to parts of a user's account to everybody
+// knowing their token.
+//
+// A token consists of the link's id and a signature of the link, so tokens can't be guessed or extended.
+// Links are saved in the datastore, so they can be revoked.
+package share
+
+import (
+	"auth-proxy/config"
+	"auth-proxy/internal"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// MaxLifetime defines how long a share link can be valid at most.
+const MaxLifetime = time.Hour * 24 * 30
+
+var (
+	// ErrInvalid is returned when a token or path isn't valid.
+	ErrInvalid = errors.New("The share link is invalid")
+
+	// ErrExpired is returned when the share link expired.
+	ErrExpired = errors.New("The share link expired")
+
+	// ErrRevoked is returned when the share link has been deleted.
+	ErrRevoked = errors.New("The share link has been revoked")
+)
+
+// Roots defines the requests share links can give access to.
+var Roots = []internal.RouteRule{
+	{Methods: []string{"GET"}, Prefix: "/api/users"},
+	{Methods: []string{"GET"}, Prefix: "/api/stocks"},
+}
+
+func sign(key []byte, l config.ShareLink) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\n%d\n%d\n%s", l.ID, l.UID, l.ExpiresAt.Unix(), strings.Join(l.Paths, "\n"))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// matches reports if a GET request of the path matches one of the rules.
+func matches(rules []internal.RouteRule, p string) bool {
+	return internal.MatchAny(rules, &http.Request{Method: "GET", URL: &url.URL{Path: p}})
+}
+
+// ValidPath reports if share links can give access to the path.
+func ValidPath(p string) bool {
+	return p != "" && path.Clean(p) == p && matches(Roots, p)
+}
+
+// New creates a share link of the user to the paths and returns it together with its token.
+func New(ctx context.Context, env *config.Env, uid uint64, paths []string, expiresAt time.Time) (config.ShareLink, string, error) {
+	if len(paths) == 0 || !expiresAt.After(time.Now()) || time.Until(expiresAt) > MaxLifetime {
+		return config.ShareLink{}, "", ErrInvalid
+	}
+
+	for _, p := range paths {
+		if !ValidPath(p) {
+			return config.ShareLink{}, "", ErrInvalid
+		}
+	}
+
+	id, err := internal.RandomToken(16)
+	if err != nil {
+		return config.ShareLink{}, "", err
+	}
+
+	l := config.ShareLink{
+		ID:        id,
+		UID:       uid,
+		Paths:     paths,
+		CreatedAt: time.Now(),
+		// tokens only sign the expiration time in seconds
+		ExpiresAt: expiresAt.Truncate(time.Second),
+	}
+
+	if err = env.DB.CreateShareLink(ctx, l); err != nil {
+		return config.ShareLink{}, "", err
+	}
+
+	return l, l.ID + "." + sign(env.ShareLinkKey, l), nil
+}
+
+// Resolve returns the share link of the token.
+func Resolve(ctx context.Context, env *config.Env, token string) (config.ShareLink, error) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return config.ShareLink{}, ErrInvalid
+	}
+
+	l, err := env.DB.ShareLink(ctx, parts[0])
+	if err != nil {
+		if err == config.ErrNotFound {
+			return config.ShareLink{}, ErrRevoked
+		}
+
+		return config.ShareLink{}, err
+	}
+
+	if !hmac.Equal([]byte(parts[1]), []byte(sign(env.ShareLinkKey, l))) {
+		return config.ShareLink{}, ErrInvalid
+	}
+
+	if !time.Now().Before(l.ExpiresAt) {
+		return config.ShareLink{}, ErrExpired
+	}
+
+	return l, nil
+}
+
+// Allows reports if the share link gives access to the request.
+func Allows(l config.ShareLink, r *http.Request) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+
+	rules := make([]internal.RouteRule, len(l.Paths))
+	for i, p := range l.Paths {
+		rules[i] = internal.RouteRule{Prefix: p}
+	}
+
+	p := r.URL.Path
+
+	return path.Clean(p) == p && matches(Roots, p) && matches(rules, p)
+}
+
+// Token returns the share token of the request. It's either sent in the X-Share-Token header or, so that links
+// can be opened in a browser, in the share query parameter.
+func Token(r *http.Request) string {
+	if t := r.Header.Get("X-Share-Token"); t != "" {
+		return t
+	}
+
+	return r.URL.Query().Get("share")
+}
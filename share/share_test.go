@@ -0,0 +1,112 @@
+package share_test
+
+import (
+	"auth-proxy/config"
+	"auth-proxy/share"
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	ctx := context.Background()
+	env := config.NewMockEnv()
+	tomorrow := time.Now().Add(time.Hour * 24)
+
+	cases := []struct {
+		paths     []string
+		expiresAt time.Time
+		err       error
+	}{
+		{[]string{"/api/users/portfolio"}, tomorrow, nil},
+		{[]string{"/api/stocks"}, tomorrow, nil},
+		{nil, tomorrow, share.ErrInvalid},
+		{[]string{"/api/news"}, tomorrow, share.ErrInvalid},
+		{[]string{"/api/users/../admin"}, tomorrow, share.ErrInvalid},
+		{[]string{"/api/users/portfolio"}, time.Now().Add(-time.Hour), share.ErrInvalid},
+		{[]string{"/api/users/portfolio"}, time.Now().Add(share.MaxLifetime + time.Hour), share.ErrInvalid},
+	}
+
+	for _, i := range cases {
+		if _, _, err := share.New(ctx, env, 1, i.paths, i.expiresAt); err != i.err {
+			t.Errorf("Expected the error %v but got %v when paths=%v and expiresAt=%v", i.err, err, i.paths, i.expiresAt)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	ctx := context.Background()
+	env := config.NewMockEnv()
+
+	l, token, err := share.New(ctx, env, 1, []string{"/api/users/portfolio"}, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := share.Resolve(ctx, env, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.ID != l.ID || got.UID != 1 {
+		t.Errorf("Expected the link %+v but got %+v", l, got)
+	}
+
+	if _, err := share.Resolve(ctx, env, l.ID+".forged"); err != share.ErrInvalid {
+		t.Errorf("Expected a forged token to be invalid but got %v", err)
+	}
+
+	other := config.NewMockEnv()
+	other.ShareLinkKey = []byte("other-key")
+	other.DB.CreateShareLink(ctx, l)
+
+	if _, err := share.Resolve(ctx, other, token); err != share.ErrInvalid {
+		t.Errorf("Expected a token signed with another key to be invalid but got %v", err)
+	}
+
+	if err := env.DB.DeleteShareLink(ctx, 1, l.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := share.Resolve(ctx, env, token); err != share.ErrRevoked {
+		t.Errorf("Expected a deleted link to be revoked but got %v", err)
+	}
+
+	_, token, err = share.New(ctx, env, 1, []string{"/api/users/portfolio"}, time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Second)
+
+	if _, err := share.Resolve(ctx, env, token); err != share.ErrExpired {
+		t.Errorf("Expected the link to be expired but got %v", err)
+	}
+}
+
+func TestAllows(t *testing.T) {
+	l := config.ShareLink{Paths: []string{"/api/users/portfolio", "/api/stocks/history"}}
+
+	cases := []struct {
+		method string
+		path   string
+		allows bool
+	}{
+		{"GET", "/api/users/portfolio", true},
+		{"HEAD", "/api/users/portfolio/2020", true},
+		{"GET", "/api/stocks/history?symbol=ACME", true},
+		{"POST", "/api/users/portfolio", false},
+		{"GET", "/api/users/settings", false},
+		{"GET", "/api/users/portfolio/../settings", false},
+		{"GET", "/api/stocks", false},
+	}
+
+	for _, i := range cases {
+		r := httptest.NewRequest(i.method, i.path, nil)
+
+		if share.Allows(l, r) != i.allows {
+			t.Errorf("Expected allows to be %v when method=%s and path=%s", i.allows, i.method, i.path)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"auth-proxy/config"
+	"auth-proxy/internal"
+	"auth-proxy/proxy"
+	"auth-proxy/share"
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// streamCheck reports if the user who opened a stream may still receive it. Errors are temporary and keep the
+// stream open.
+type streamCheck func(ctx context.Context) (bool, error)
+
+type streamCheckKey struct{}
+
+func withStreamCheck(ctx context.Context, check streamCheck) context.Context {
+	return context.WithValue(ctx, streamCheckKey{}, check)
+}
+
+// sessionCheck returns the check of a stream opened with the claims on behalf of the user with the uid. The
+// stream ends once the session expired or was revoked, the account can't log in anymore or, if the stream was
+// opened on behalf of another user, the grant was revoked.
+func sessionCheck(cl config.Claims, issuedAt time.Time, uid uint64) streamCheck {
+	return func(ctx context.Context) (bool, error) {
+		if !cl.SessionExpiresAt.IsZero() && !time.Now().Before(cl.SessionExpiresAt) {
+			return false, nil
+		}
+
+		if cl.SessionID != "" {
+			s, err := env.DB.Session(ctx, cl.SessionID)
+			if err == config.ErrNotFound {
+				return false, nil
+			}
+
+			if err != nil {
+				return true, err
+			}
+
+			if !time.Now().Before(s.ExpiresAt) {
+				return false, nil
+			}
+		}
+
+		acc, err := account(ctx, cl.UID)
+		if err == config.ErrNotFound {
+			return false, nil
+		}
+
+		if err != nil {
+			return true, err
+		}
+
+		if code, _ := internal.AccountStatusError(acc.Status); code != "" || sessionRevoked(acc, issuedAt) {
+			return false, nil
+		}
+
+		if uid != cl.UID {
+			_, err = env.DB.ActiveGrant(ctx, uid, cl.UID)
+			if err == config.ErrNotFound {
+				return false, nil
+			}
+
+			if err != nil {
+				return true, err
+			}
+		}
+
+		return true, nil
+	}
+}
+
+// shareCheck returns the check of a stream opened with the share link's token. The stream ends once the link
+// expired or was revoked or its owner can't log in anymore.
+func shareCheck(token string) streamCheck {
+	return func(ctx context.Context) (bool, error) {
+		l, err := share.Resolve(ctx, env, token)
+		switch err {
+		case nil:
+		case share.ErrInvalid, share.ErrExpired, share.ErrRevoked:
+			return false, nil
+		default:
+			return true, err
+		}
+
+		acc, err := account(ctx, l.UID)
+		if err != nil {
+			return true, err
+		}
+
+		code, _ := internal.AccountStatusError(acc.Status)
+
+		return code == "", nil
+	}
+}
+
+// streamLimiter counts the open streams by their key.
+type streamLimiter struct {
+	mu   sync.Mutex
+	open map[string]int
+}
+
+// streams is shared by all routers, so that streams opened before a reload still count.
+var streams = &streamLimiter{open: make(map[string]int)}
+
+// acquire counts a new stream of the key and reports if it stays within max.
+func (l *streamLimiter) acquire(key string, max int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.open[key] >= max {
+		return false
+	}
+
+	l.open[key]++
+
+	return true
+}
+
+func (l *streamLimiter) release(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.open[key]--
+	if l.open[key] <= 0 {
+		delete(l.open, key)
+	}
+}
+
+// streamMiddleware limits the open streams of the route per user, or per ip if the route doesn't require
+// authentication, and ends streams whose authentication isn't valid anymore. It has to be used after the
+// authMiddleware.
+func streamMiddleware(route proxy.Route) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !route.IsStream(r) {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			key := route.Name + " ip " + internal.ClientIP(r).String()
+			if uid, ok := internal.UIDFromContext(r.Context()); ok {
+				key = route.Name + " uid " + strconv.FormatUint(uid, 10)
+			}
+
+			if !streams.acquire(key, route.Streaming.MaxStreamsPerUser()) {
+				internal.WriteError(w, http.StatusTooManyRequests, "too_many_streams", "Too many connections are open. Please close one first.")
+				return
+			}
+
+			defer streams.release(key)
+
+			ctx, cancel := context.WithCancel(r.Context())
+			defer cancel()
+
+			if check, ok := r.Context().Value(streamCheckKey{}).(streamCheck); ok {
+				go watchStream(ctx, cancel, check, route.Streaming.Recheck())
+			}
+
+			h.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// streamOr serves the route's streams with stream and all other requests with h.
+func streamOr(route proxy.Route, stream, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route.IsStream(r) {
+			stream.ServeHTTP(w, r)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// watchStream runs the check every interval and ends the stream once it fails.
+func watchStream(ctx context.Context, end context.CancelFunc, check streamCheck, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		ok, err := check(ctx)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		if !ok {
+			end()
+			return
+		}
+	}
+}